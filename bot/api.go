@@ -0,0 +1,182 @@
+package bot
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	apiSessionsPath = "/sessions"
+)
+
+// apiStatus is the response of "GET /sessions" of the admin API, see Bot.apiSessionsHandler
+type apiStatus struct {
+	Uptime   string        `json:"uptime"`
+	Config   *apiConfig    `json:"config"`
+	Sessions []*apiSession `json:"sessions"`
+}
+
+// apiConfig is the part of the bot's config that is exposed via the admin API. Tokens and other secrets are left out.
+type apiConfig struct {
+	Platforms          []string `json:"platforms"`
+	TerminalBackend    string   `json:"terminal_backend"`
+	Scripts            []string `json:"scripts"`
+	MaxTotalSessions   int      `json:"max_total_sessions"`
+	MaxUserSessions    int      `json:"max_user_sessions"`
+	IdleTimeout        string   `json:"idle_timeout"`
+	MaxSessionDuration string   `json:"max_session_duration"`
+	ReadOnlyMode       bool     `json:"read_only_mode"`
+}
+
+// apiSession is a single session, as returned by the admin API
+type apiSession struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name,omitempty"`
+	Script      string    `json:"script"`
+	User        string    `json:"user"`
+	Platform    string    `json:"platform"`
+	ControlMode string    `json:"control_mode"`
+	WindowMode  string    `json:"window_mode"`
+	AuthMode    string    `json:"auth_mode"`
+	Size        string    `json:"size"`
+	Web         bool      `json:"web"`
+	Record      bool      `json:"record"`
+	Tags        []string  `json:"tags,omitempty"`
+	Started     time.Time `json:"started"`
+	Uptime      string    `json:"uptime"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiHandler returns the handler of the admin API, which lets operators list and close sessions via HTTP (e.g. for
+// a dashboard), like the "sessions" admin command does in the chat. All requests must carry the configured token
+// as "Authorization: Bearer <token>", see config.Config.AdminToken.
+func (b *Bot) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiSessionsPath, b.apiSessionsHandler)
+	mux.HandleFunc(apiSessionsPath+"/", b.apiSessionHandler)
+	return b.apiAuth(mux)
+}
+
+func (b *Bot) apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(b.config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiSessionsHandler handles "GET /sessions", which returns the bot's uptime and config, and all sessions,
+// oldest session first
+func (b *Bot) apiSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	b.mu.RLock()
+	sessions := make([]*session, 0, len(b.sessions))
+	for _, sess := range b.sessions {
+		sessions = append(sessions, sess)
+	}
+	b.mu.RUnlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].started.Before(sessions[j].started)
+	})
+	status := &apiStatus{
+		Uptime:   time.Since(b.started).Round(time.Second).String(),
+		Config:   b.apiConfig(),
+		Sessions: make([]*apiSession, 0, len(sessions)),
+	}
+	for _, sess := range sessions {
+		status.Sessions = append(status.Sessions, sess.apiSession())
+	}
+	writeAPIResponse(w, http.StatusOK, status)
+}
+
+// apiSessionHandler handles "GET /sessions/{id}", which returns the session, and "DELETE /sessions/{id}", which
+// force-closes it. Users are told that the session is ending, like when it times out.
+func (b *Bot) apiSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, apiSessionsPath+"/")
+	b.mu.RLock()
+	sess, ok := b.sessions[id]
+	b.mu.RUnlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeAPIResponse(w, http.StatusOK, sess.apiSession())
+	case http.MethodDelete:
+		sess.logf("session_force_close", "Force-closing session via admin API")
+		if err := sess.ForceClose(); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, sess.apiSession())
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (b *Bot) apiConfig() *apiConfig {
+	platforms := make([]string, 0, len(b.workspaces))
+	for _, ws := range b.workspaces {
+		platforms = append(platforms, string(ws.config.Platform()))
+	}
+	scripts := b.config.Scripts()
+	sort.Strings(scripts)
+	return &apiConfig{
+		Platforms:          platforms,
+		TerminalBackend:    string(b.config.TerminalBackend),
+		Scripts:            scripts,
+		MaxTotalSessions:   b.config.MaxTotalSessions,
+		MaxUserSessions:    b.config.MaxUserSessions,
+		IdleTimeout:        b.config.IdleTimeout.String(),
+		MaxSessionDuration: b.config.MaxSessionDuration.String(),
+		ReadOnlyMode:       b.config.ReadOnlyMode,
+	}
+}
+
+// apiSession returns the session details shown by the admin API
+func (s *session) apiSession() *apiSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &apiSession{
+		ID:          s.conf.id,
+		Name:        s.conf.name,
+		Script:      filepath.Base(s.conf.script),
+		User:        s.conf.user,
+		Platform:    string(s.conf.global.Platform()),
+		ControlMode: string(s.conf.controlMode),
+		WindowMode:  string(s.conf.windowMode),
+		AuthMode:    string(s.conf.authMode),
+		Size:        s.conf.size.Name,
+		Web:         s.webCmd != nil,
+		Record:      s.conf.record,
+		Tags:        s.conf.tags,
+		Started:     s.started,
+		Uptime:      time.Since(s.started).Round(time.Second).String(),
+	}
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIResponse(w, status, &apiError{Error: message})
+}
@@ -3,21 +3,29 @@ package bot
 
 import (
 	"context"
+	"crypto/subtle"
 	_ "embed" // go:embed requires this
 	"errors"
 	"fmt"
 	"github.com/gliderlabs/ssh"
+	"github.com/gorilla/websocket"
 	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/sync/errgroup"
 	"heckel.io/replbot/config"
 	"heckel.io/replbot/util"
-	"log"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -25,23 +33,149 @@ const (
 	mentionMessage = "I'm a robot for running interactive REPLs and shells from right here. To start a new session, simply tag me " +
 		"and name one of the available REPLs, like so: %s %s\n\nAvailable REPLs: %s.\n\nTo run the session in a `thread`, " +
 		"the main `channel`, or in `split` mode, use the respective keywords (default: `%s`). To define the terminal size, use the words " +
-		"`tiny`, `small`, `medium` or `large` (default: `%s`). Use `full` or `trim` to set the window mode (default: `%s`), and `everyone` " +
+		"`tiny`, `small`, `medium` or `large`, or a custom size like `size:120x40` (default: `%s`). Use `full` or `trim` to set the window mode (default: `%s`), and `everyone` " +
 		"or `only-me` to define who can send commands (default: `%s`). Send `record` or `norecord` to define if your session should be " +
-		"recorded (default: `%s`)."
+		"recorded (default: `%s`). Use `color` or `no-color` to keep or strip terminal colors (default: `%s`)."
 	shareMessage = "Using the word `share` will allow you to share your own terminal here in the chat. Terminal sharing " +
 		"sessions are always started in `only-me` mode, unless overridden."
-	webMessage                      = "Use the word `web` or `noweb` to enable a web-based terminal for this session (default: `%s`)."
+	webMessage                 = "Use the word `web` or `noweb` to enable a web-based terminal for this session (default: `%s`)."
+	workDirMessage             = "To start the session in a different working directory, use `cwd:<path>`, with a path inside %s."
+	workDirNotAllowedMessage   = "🙁 I'm sorry, but I can't start the session in _%s_: %s."
+	maxDurationMessage         = "To close the session automatically after some time, use `max:<duration>`, e.g. `max:30m`."
+	maxDurationLimitMessage    = " Sessions are closed after %s at the latest."
+	maxDurationInvalidMessage  = "🙁 I don't understand the duration _%s_. Please use something like `max:30m` or `max:2h`."
+	maxDurationExceededMessage = "🙁 I'm sorry, but sessions can run for at most %s."
+	maxOutputMessage           = "To interrupt commands with runaway output, use `max-output:<bytes>` or `max-messages:<count>`, e.g. `max-messages:100`."
+	maxOutputLimitMessage      = " Commands are interrupted after %s at the latest."
+	maxOutputInvalidMessage    = "🙁 I don't understand the limit _%s_. Please use a positive number, like `max-output:100000` or `max-messages:100`."
+	maxOutputExceededMessage   = "🙁 I'm sorry, but commands can send at most %s."
+	sizeInvalidMessage         = "🙁 I don't understand the size _%s_. Please use something like `size:120x40`, between %dx%d and %dx%d."
+	collapseMessage            = "Use `collapse` to hide long output behind a spoiler, or to upload it as a snippet, where supported."
+	ephemeralHelpMessage       = "Use `ephemeral` for a throwaway session, whose messages are deleted when it ends, where supported."
+	separateStderrHelpMessage  = "Use `separate-stderr` to show the REPL's error output in its own thread instead of the terminal."
+	quietHelpMessage           = "Use `quiet` or `noquiet` to leave out or send the start and exit messages (default: `%s`)."
+	nameHelpMessage            = "To reconnect to a session later, e.g. from another channel, give it a name like `name:myshell`, and use `!detach` and `attach myshell`."
+	nameInvalidMessage         = "🙁 I'm sorry, but _%s_ is not a valid session name. Please use up to 32 letters, digits, dots, dashes or underscores."
+	renderMessage              = "To show the terminal differently, use `render:<name>`, e.g. `render:text` for plain text (default: `%s`, available: %s)."
+	renderInvalidMessage       = "🙁 I don't know how to render the terminal as _%s_. Please use one of: %s."
+	tagMessage                 = "To tag a session, e.g. to find it later, use `tag:<name>`, like so: `tag:incident-123`."
+	listHelpMessage            = "To see what each REPL does, use `list`."
+	helpOptionsHintMessage     = "To see more options, e.g. to name, tag or limit your session, use `help options`."
+	helpOptionsMessage         = "Here are more options for new sessions:\n\n%s\n\nTo use them, simply add them when you tag me, like so: %s %s tag:incident-123"
+	listMessage                = "Here are all available REPLs:\n\n%s\n\nTo start one, simply tag me and name it, like so: %s %s"
+	listItem                   = "• `%s`%s"
+	listItemDescription        = "• `%s`%s: %s"
+	listItemAliases            = " (or %s)"
+	helpCategoryMessage        = "To only list the REPLs of one category, use `help <category>`, e.g. `help %s`."
+	categoryScriptsMessage     = "Here are the REPLs in the _%s_ category: %s.\n\nTo start one, simply tag me and name it, like so: %s %s"
+	categoryUnknownMessage     = "🙁 I don't know the category _%s_. Available categories: %s."
+	prefsMessage               = "⚙️ Here are your preferences for new sessions:\n\n  Size: %s\n  Window mode: %s\n  Control mode: %s\n\n" +
+		"Use `prefs size=large window=full control=thread` to change them, or `prefs reset` to clear them. Keywords in your " +
+		"session request always take precedence."
+	prefsHelpMessage                = "To set your own defaults for new sessions, use `prefs`, e.g. `prefs size=large window=full`."
+	prefsSavedMessage               = "👍 Okay, I saved your preferences. "
+	prefsResetMessage               = "👍 Okay, I cleared your preferences. New sessions will use the defaults again."
+	prefsInvalidMessage             = "🙁 I don't understand _%s_. Use `size=tiny|small|medium|large|<width>x<height>`, `window=full|trim` or `control=channel|thread|split`."
+	prefsNotSetValue                = "_not set_"
+	adminOnlyMessage                = "🙁 I'm sorry, but only admins can list, search and message all sessions, make me join and leave channels, reload the scripts, or view my logs."
+	sessionsMessage                 = "Here are all active sessions:\n\n%s"
+	noSessionsMessage               = "There are no active sessions right now."
+	findMessage                     = "Here are the active sessions tagged _%s_:\n\n%s"
+	findNoMatchMessage              = "I couldn't find any active sessions tagged _%s_."
+	findUsageMessage                = "Please tell me which tag to look for, e.g. `find tag:incident-123`."
+	broadcastMessage                = "📢 *Message from the admins:* %s"
+	broadcastSentMessage            = "📢 Okay, I sent your message to %d active session(s)."
+	broadcastUsageMessage           = "Please tell me what to broadcast, e.g. `broadcast maintenance in 5 minutes, please wrap up`."
+	joinUsageMessage                = "Please tell me which channel to %s, e.g. `%s #general`."
+	joinedMessage                   = "👋 Okay, I joined %s."
+	leftMessage                     = "👋 Okay, I left %s."
+	joinFailedMessage               = "🙁 I couldn't %s %s: %s"
+	joinNotSupportedMessage         = "🙁 I'm sorry, but I cannot join or leave channels on my own on this platform. Please invite or remove me manually."
+	reloadedMessage                 = "🔄 Okay, I reloaded the scripts: %d added, %d removed, %d changed. Active sessions are not affected.%s"
+	reloadedScriptsMessage          = "\n%s: %s"
+	reloadFetchFailedMessage        = "\n\n⚠️ I couldn't fetch some remote scripts, so I kept their previous version:\n%s"
+	reloadBrokenScriptsMessage      = "\n\n⚠️ Some scripts are broken and will fail when they are started:\n%s"
+	logsMessage                     = "Here are my last %d log line(s), with secrets redacted:\n%s"
+	logsEmptyMessage                = "There is nothing in my logs yet."
+	logsUsageMessage                = "Please tell me how many log lines to show, e.g. `logs 50` (at most %d)."
+	sessionListItem                 = "• `%s`: _%s_ by %s, up %s"
+	sessionListItemTags             = ", tags: %s"
+	shareNoPortMessage              = "😬 All ports for terminal sharing are in use right now. Please try again later."
+	shareReadOnlyModeMessage        = "🙁 I'm sorry, but terminal sharing is disabled, because I'm in read-only mode."
+	separateStderrImageMessage      = "🙁 I'm sorry, but `separate-stderr` is not supported for REPLs that run in a container."
+	namedSessionsMessage            = "Here are your named sessions:\n\n%s\n\nTo reconnect to one, tag me like so: %s attach %s"
+	namedSessionsItem               = "• `%s`: _%s_, up %s%s"
+	namedSessionsItemDetached       = " (detached)"
+	noNamedSessionsMessage          = "You don't have any named sessions. To start one, give it a name when you start it, e.g. `name:myshell`."
+	namedSessionNotFoundMessage     = "🙁 I couldn't find a session named _%s_. Tag me like so to see your named sessions: %s attach"
+	namedSessionExistsMessage       = "🙁 You already have a session named _%s_. To reconnect to it, tag me like so: %s attach %s"
 	unknownCommandMessage           = "I am not quite sure what you mean by _%s_ ⁉"
+	unknownScriptSuggestionMessage  = "I am not quite sure what you mean by _%s_ ⁉ Did you mean `%s`?"
 	misconfiguredMessage            = "😭 Oh no. It looks like REPLbot is misconfigured. I couldn't find any scripts to run."
 	maxTotalSessionsExceededMessage = "😭 There are too many active sessions. Please wait until another session is closed."
 	maxUserSessionsExceededMessage  = "😭 You have too many active sessions. Please close a session to start a new one."
+	shutdownMessage                 = "🔌 REPLbot is shutting down, so your session is ending. Sorry about that!"
 	helpRequestedCommand            = "help"
+	helpOptionsCommand              = "options"
+	otherCategory                   = "other" // Scripts without a category, see formatScriptList
 	recordCommand                   = "record"
 	noRecordCommand                 = "norecord"
 	webCommand                      = "web"
 	noWebCommand                    = "noweb"
 	shareCommand                    = "share"
-	shareServerScriptFile           = "/tmp/replbot_share_server.sh"
+	collapseCommand                 = "collapse"
+	ephemeralCommand                = "ephemeral"
+	separateStderrCommand           = "separate-stderr"
+	quietCommand                    = "quiet"
+	noQuietCommand                  = "noquiet"
+	prefsCommand                    = "prefs"
+	prefsResetCommand               = "reset"
+	listCommand                     = "list"
+	sessionsCommand                 = "sessions"
+	findCommand                     = "find"
+	broadcastCommand                = "broadcast"
+	joinCommand                     = "join"
+	leaveCommand                    = "leave"
+	reloadCommand                   = "reload"
+	logsCommand                     = "logs"
+	attachCommand                   = "attach"
+	namePrefix                      = "name:"
+	namedSessionPrefix              = "named_" // Prefix of named session IDs, see workspace.namedSessionID
+	workDirPrefix                   = "cwd:"
+	tagPrefix                       = "tag:"
+	maxDurationPrefix               = "max:"
+	maxOutputBytesPrefix            = "max-output:"
+	maxOutputMessagesPrefix         = "max-messages:"
+	sizePrefix                      = "size:"
+	renderPrefix                    = "render:"
+	shareServerScriptFileName       = "replbot_share_server.sh"
+	shareWebSocketClientPath        = "client.js"
+	shareWebSocketPath              = "ws"
+
+	// shareWebSocketConnectTimeout is the max time to wait for the share server script to connect to the relay port
+	shareWebSocketConnectTimeout = 10 * time.Second
+
+	// shutdownNotifyTimeout is the max time Stop waits for the shutdown message to be sent to all sessions
+	shutdownNotifyTimeout = 5 * time.Second
+
+	// reconnectMaxBackoff is the max time to wait between two reconnect attempts, see runWorkspace
+	reconnectMaxBackoff = time.Minute
+
+	// helpTemplateMaxPlaceholders is the max number of %s placeholders in the help template, see handleHelp
+	helpTemplateMaxPlaceholders = 9
+
+	// logsBufferLines is the number of log lines kept in memory for the "logs" command, and logsDefaultLines the
+	// number of lines it shows if the admin doesn't say
+	logsBufferLines  = 1000
+	logsDefaultLines = 20
+
+	// logsMinSecretLength is the min length of configured secrets that are redacted in the logs, see redactLogs
+	logsMinSecretLength = 8
+
+	// inputForwardedReaction and inputDroppedReaction acknowledge messages sent to a session, if enabled via
+	// config.Config.AckReactions, see maybeAcknowledge
+	inputForwardedReaction = "✅"
+	inputDroppedReaction   = "🚫"
 )
 
 // Key exchange algorithms, ciphers,and MACs (see `ssh-audit` output)
@@ -58,45 +192,159 @@ var (
 	//go:embed share_server.sh
 	shareServerScriptSource string
 	errNoScript             = errors.New("no script defined")
+	errTooManyPlaceholders  = errors.New("too many placeholders in help template")
+	errDisconnected         = errors.New("disconnected from platform")
 	errHelpRequested        = errors.New("help requested")
+	sessionNameRegex        = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,31}$`)
+	logsURLCredentialsRegex = regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`)
+	logsSecretRegex         = regexp.MustCompile(`(?i)((?:token|secret|password|passwd)\s*[=:]\s*)[^\s,;&]+`)
+	shareWebSocketUpgrader  = &websocket.Upgrader{} // Rejects cross-origin browser requests; the Node.js client sends no Origin
+
+	// buttonSessionCommands are the session commands that may be used for buttons, in addition to key commands
+	buttonSessionCommands = []string{"!help", "!h", "!exit", "!q", "!screen", "!s", "!clear", "!pause", "!resume", "!kill", "!restart", "!info", "!alive"}
 )
 
 // Bot is the main struct that provides REPLbot
 type Bot struct {
-	config    *config.Config
-	conn      conn
-	sessions  map[string]*session
-	shareUser map[string]*session
-	webPrefix map[string]*session
-	cancelFn  context.CancelFunc
-	mu        sync.RWMutex
+	config       *config.Config
+	workspaces   []*workspace
+	sessions     map[string]*session
+	shareUser    map[string]*session
+	webPrefix    map[string]*session
+	movedControl map[string]*session            // session ID of a channel/thread -> session that is controlled from there, see controlMoved
+	tags         map[string]map[string]*session // lowercase tag -> session ID -> session
+	shareConns   *shareConnLimiter
+	prefs        *prefsStore
+	welcome      string
+	help         string
+	helpArgs     int // number of %s placeholders in help
+	cancelFn     context.CancelFunc
+	reloadMu     sync.Mutex      // held while scripts are reloaded, see handleReloadCommand
+	logs         *util.LogBuffer // recent log lines for the "logs" command, nil if no admin users are configured
+	started      time.Time
+	stopping     bool // set by Stop, so that no new sessions are started while the active ones are closed
+	mu           sync.RWMutex
+}
+
+// workspace is a single chat connection of the bot, see config.Config.Workspaces. All workspaces share the scripts
+// and the session limits, but sessions are namespaced per workspace, so that channel IDs of different workspaces
+// cannot collide in the sessions map.
+type workspace struct {
+	name   string // prefix of all session IDs, empty for the first workspace
+	config *config.Config
+	conn   conn
+}
+
+// sessionID returns the ID of the session in the given channel and thread (which may be empty)
+func (w *workspace) sessionID(channel, thread string) string {
+	id := util.SanitizeNonAlphanumeric(fmt.Sprintf("%s_%s", channel, thread))
+	if w.name == "" {
+		return id
+	}
+	return w.name + "_" + id
+}
+
+// namedSessionID returns the ID of the user's session with the given name. Unlike other sessions, named sessions are
+// not keyed by their channel/thread, so that they can be attached to from anywhere, see Bot.handleAttachCommand.
+func (w *workspace) namedSessionID(user, name string) string {
+	return w.sessionID(namedSessionPrefix+user, name)
+}
+
+// owns returns true if the session was started in this workspace
+func (w *workspace) owns(sess *session) bool {
+	return sess.conf.global == w.config
 }
 
 // New creates a new REPLbot instance using the given configuration
 func New(conf *config.Config) (*Bot, error) {
+	conf.PruneScriptCache() // No sessions are running yet
+	for _, err := range conf.FetchScripts() {
+		util.Log(util.LogFields{"event": "script_fetch_error"}, "Warning: %s; using previously fetched scripts, if any", err.Error())
+	}
+	for alias, script := range conf.ScriptAliases {
+		if conf.Script(script) == "" {
+			util.Log(util.LogFields{"event": "script_alias_unknown"}, "Warning: alias %s refers to unknown script %s", alias, script)
+		}
+	}
 	if len(conf.Scripts()) == 0 {
 		return nil, errors.New("no REPL scripts found in script dir")
-	} else if err := util.Run("tmux", "-V"); err != nil {
-		return nil, fmt.Errorf("tmux check failed: %s", err.Error())
+	} else if errs := conf.CheckScripts(); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid REPL scripts: %s", formatErrors(errs))
+	} else if err := checkTerminalBackend(conf.TerminalBackend); err != nil {
+		return nil, err
+	} else if err := checkShell(conf.Shell); err != nil {
+		return nil, err
+	}
+	welcome, help, helpArgs, err := loadTemplates(conf)
+	if err != nil {
+		return nil, err
+	} else if err := checkReactions(conf.Reactions); err != nil {
+		return nil, err
+	} else if err := checkButtons(conf.Buttons); err != nil {
+		return nil, err
+	}
+	prefs, err := newPrefsStore(conf.PrefsFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load preferences file: %s", err.Error())
 	}
-	var conn conn
+	var logs *util.LogBuffer
+	if len(conf.AdminUsers) > 0 {
+		logs = util.NewLogBuffer(logsBufferLines)
+		util.CaptureLogs(logs)
+	}
+	workspaces := make([]*workspace, 0)
+	for i, workspaceConf := range conf.Workspaces() {
+		conn, err := newConn(workspaceConf)
+		if err != nil {
+			return nil, err
+		}
+		var name string
+		if i > 0 {
+			name = fmt.Sprintf("ws%d", i) // The first workspace is not namespaced, so that session IDs stay the same
+		}
+		workspaces = append(workspaces, &workspace{name: name, config: workspaceConf, conn: conn})
+	}
+	return &Bot{
+		config:       conf,
+		workspaces:   workspaces,
+		sessions:     make(map[string]*session),
+		shareUser:    make(map[string]*session),
+		webPrefix:    make(map[string]*session),
+		movedControl: make(map[string]*session),
+		tags:         make(map[string]map[string]*session),
+		shareConns:   newShareConnLimiter(conf.ShareMaxConns, conf.ShareMaxSessionConns),
+		prefs:        prefs,
+		welcome:      welcome,
+		help:         help,
+		helpArgs:     helpArgs,
+		logs:         logs,
+		started:      time.Now(),
+	}, nil
+}
+
+func newConn(conf *config.Config) (conn, error) {
 	switch conf.Platform() {
 	case config.Slack:
-		conn = newSlackConn(conf)
+		return newSlackConn(conf), nil
 	case config.Discord:
-		conn = newDiscordConn(conf)
+		return newDiscordConn(conf), nil
+	case config.Zulip:
+		return newZulipConn(conf), nil
+	case config.Teams:
+		return newTeamsConn(conf), nil
+	case config.RocketChat:
+		return newRocketChatConn(conf), nil
+	case config.Matrix:
+		return newMatrixConn(conf), nil
+	case config.WhatsApp:
+		return newWhatsAppConn(conf), nil
+	case config.Webhook:
+		return newWebhookConn(conf), nil
 	case config.Mem:
-		conn = newMemConn(conf)
+		return newMemConn(conf), nil
 	default:
 		return nil, fmt.Errorf("invalid type: %s", conf.Platform())
 	}
-	return &Bot{
-		config:    conf,
-		conn:      conn,
-		sessions:  make(map[string]*session),
-		shareUser: make(map[string]*session),
-		webPrefix: make(map[string]*session),
-	}, nil
 }
 
 // Run runs the bot in the foreground indefinitely or until Stop is called.
@@ -105,13 +353,12 @@ func (b *Bot) Run() error {
 	var ctx context.Context
 	ctx, b.cancelFn = context.WithCancel(context.Background())
 	g, ctx := errgroup.WithContext(ctx)
-	eventChan, err := b.conn.Connect(ctx)
-	if err != nil {
-		return err
+	for _, ws := range b.workspaces {
+		ws := ws
+		g.Go(func() error {
+			return b.runWorkspace(ctx, ws)
+		})
 	}
-	g.Go(func() error {
-		return b.handleEvents(ctx, eventChan)
-	})
 	if b.config.ShareHost != "" {
 		g.Go(func() error {
 			return b.runShareServer(ctx)
@@ -122,18 +369,33 @@ func (b *Bot) Run() error {
 			return b.runWebServer(ctx)
 		})
 	}
+	for addr, handler := range b.httpHandlers() {
+		addr, handler := addr, handler
+		g.Go(func() error {
+			return b.runHTTPServer(ctx, addr, handler)
+		})
+	}
 	return g.Wait()
 }
 
-// Stop gracefully shuts down the bot, closing all active sessions gracefully
+// sessionLogFields returns the structured log fields for the given session and user, see util.Log
+func sessionLogFields(conf *sessionConfig, user, event string) util.LogFields {
+	return util.LogFields{
+		"session":  conf.id,
+		"platform": string(conf.global.Platform()),
+		"user":     user,
+		"event":    event,
+	}
+}
+
+// Stop gracefully shuts down the bot, closing all active sessions gracefully. Users are told that their session is
+// ending before it is closed. If that message cannot be sent, the session is force-closed instead, see ForceClose.
 func (b *Bot) Stop() {
 	b.mu.Lock()
-	defer b.mu.Unlock()
+	b.stopping = true
+	sessions := make(map[string]*session, len(b.sessions))
 	for sessionID, sess := range b.sessions {
-		log.Printf("[%s] Force-closing session", sessionID)
-		if err := sess.ForceClose(); err != nil {
-			log.Printf("[%s] Force-closing failed: %s", sessionID, err.Error())
-		}
+		sessions[sessionID] = sess
 		delete(b.sessions, sessionID)
 		if sess.conf.share != nil {
 			delete(b.shareUser, sess.conf.share.user)
@@ -141,27 +403,130 @@ func (b *Bot) Stop() {
 		if sess.webPrefix != "" {
 			delete(b.webPrefix, sess.webPrefix)
 		}
+		b.untagSession(sess)
+		b.removeMovedControl(sess)
+	}
+	b.mu.Unlock()
+	failed := notifyShutdown(sessions) // Not holding the lock, since this talks to the chat API
+	for sessionID, sess := range sessions {
+		if failed[sessionID] {
+			sess.logf("session_force_close", "Force-closing session")
+			if err := sess.ForceClose(); err != nil {
+				sess.logf("error", "Force-closing failed: %s", err.Error())
+			}
+		} else {
+			sess.logf("session_close", "Closing session")
+			if err := sess.Close(); err != nil {
+				sess.logf("error", "Closing failed: %s", err.Error())
+			}
+		}
+	}
+	if b.logs != nil {
+		util.CaptureLogs(nil)
 	}
 	b.cancelFn() // This must be at the end, see app.go
 }
 
-func (b *Bot) handleEvents(ctx context.Context, eventChan <-chan event) error {
+// notifyShutdown sends the shutdown message to all active sessions in parallel, and returns the IDs of the sessions
+// for which sending failed. To not block the shutdown on a slow chat API, it only waits up to shutdownNotifyTimeout.
+// Messages that are still in flight by then are not considered failed.
+func notifyShutdown(sessions map[string]*session) map[string]bool {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := make(map[string]bool)
+	for sessionID, sess := range sessions {
+		if !sess.Active() {
+			continue
+		}
+		wg.Add(1)
+		go func(sessionID string, sess *session) {
+			defer wg.Done()
+			if err := sess.conn.Send(sess.control(), shutdownMessage); err != nil {
+				sess.logf("warning", "Warning: unable to send shutdown message: %s", err.Error())
+				mu.Lock()
+				failed[sessionID] = true
+				mu.Unlock()
+			}
+		}(sessionID, sess)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownNotifyTimeout):
+		util.Log(util.LogFields{"event": "shutdown"}, "Timed out sending shutdown message to sessions")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	result := make(map[string]bool, len(failed))
+	for sessionID := range failed {
+		result[sessionID] = true
+	}
+	return result
+}
+
+// runWorkspace connects to the workspace's platform and handles its events until the bot is stopped. If the connection
+// fails or drops, it reconnects with exponential backoff, giving up after ReconnectRetries failed attempts in a row.
+// Active sessions are not affected by a reconnect: their terminals keep running, and they use the same conn.
+func (b *Bot) runWorkspace(ctx context.Context, ws *workspace) error {
+	retries, backoff := 0, b.config.ReconnectBackoff
 	for {
+		connCtx, cancel := context.WithCancel(ctx)
+		connected := time.Now()
+		eventChan, err := ws.conn.Connect(connCtx)
+		if err == nil {
+			err = b.handleEvents(connCtx, ws, eventChan)
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return nil // Stopped
+		} else if time.Since(connected) > reconnectMaxBackoff {
+			retries, backoff = 0, b.config.ReconnectBackoff // Connections that drop right away count as failed attempts
+		}
+		if retries >= b.config.ReconnectRetries {
+			return err
+		}
+		retries++
+		util.Log(util.LogFields{"event": "reconnect", "platform": string(ws.config.Platform())}, "Connection failed: %s; reconnecting in %s (attempt %d of %d)", err.Error(), backoff, retries, b.config.ReconnectRetries)
+		_ = ws.conn.Close()
 		select {
 		case <-ctx.Done():
 			return nil
-		case ev := <-eventChan:
-			if err := b.handleEvent(ev); err != nil {
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+func (b *Bot) handleEvents(ctx context.Context, ws *workspace, eventChan <-chan event) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-eventChan:
+			if !ok {
+				return errDisconnected
+			} else if err := b.handleEvent(ws, ev); err != nil {
 				return err
 			}
 		}
 	}
 }
 
-func (b *Bot) handleEvent(e event) error {
+func (b *Bot) handleEvent(ws *workspace, e event) error {
 	switch ev := e.(type) {
 	case *messageEvent:
-		return b.handleMessageEvent(ev)
+		return b.handleMessageEvent(ws, ev)
+	case *reactionEvent:
+		return b.handleReactionEvent(ws, ev)
+	case *buttonEvent:
+		return b.handleButtonEvent(ws, ev)
 	case *errorEvent:
 		return ev.Error
 	default:
@@ -169,72 +534,156 @@ func (b *Bot) handleEvent(e event) error {
 	}
 }
 
-func (b *Bot) handleMessageEvent(ev *messageEvent) error {
-	if b.maybeForwardMessage(ev) {
+func (b *Bot) handleMessageEvent(ws *workspace, ev *messageEvent) error {
+	if b.maybeForwardMessage(ws, ev) {
 		return nil // We forwarded the message
 	} else if ev.ChannelType == channelTypeUnknown {
 		return nil
-	} else if ev.ChannelType == channelTypeChannel && !strings.Contains(ev.Message, b.conn.MentionBot()) {
+	} else if ev.ChannelType == channelTypeChannel && !strings.Contains(ev.Message, ws.conn.MentionBot()) {
 		return nil
+	} else if handled, err := b.maybeHandlePrefsCommand(ws, ev); handled {
+		return err
+	} else if handled, err := b.maybeHandleAdminCommand(ws, ev); handled {
+		return err
+	} else if handled, err := b.maybeHandleHelpOptions(ws, ev); handled {
+		return err
+	} else if handled, err := b.maybeHandleHelpCategory(ws, ev); handled {
+		return err
+	} else if handled, err := b.maybeHandleListCommand(ws, ev); handled {
+		return err
+	} else if handled, err := b.maybeHandleAttachCommand(ws, ev); handled {
+		return err
 	}
-	conf, err := b.parseSessionConfig(ev)
+	conf, err := b.parseSessionConfig(ws, ev)
 	if err != nil {
-		return b.handleHelp(ev.Channel, ev.Thread, err)
+		return b.handleHelp(ws, ev.Channel, ev.Thread, err)
 	}
-	if allowed, err := b.checkSessionAllowed(ev.Channel, ev.Thread, conf); err != nil || !allowed {
+	if allowed, err := b.checkSessionAllowed(ws, ev.Channel, ev.Thread, conf); err != nil || !allowed {
 		return err
 	}
 	switch conf.controlMode {
 	case config.Channel:
-		return b.startSessionChannel(ev, conf)
+		return b.startSessionChannel(ws, ev, conf)
 	case config.Thread:
-		return b.startSessionThread(ev, conf)
+		return b.startSessionThread(ws, ev, conf)
 	case config.Split:
-		return b.startSessionSplit(ev, conf)
+		return b.startSessionSplit(ws, ev, conf)
 	default:
 		return fmt.Errorf("unexpected mode: %s", conf.controlMode)
 	}
 }
 
-func (b *Bot) maybeForwardMessage(ev *messageEvent) bool {
+func (b *Bot) maybeForwardMessage(ws *workspace, ev *messageEvent) bool {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-	sessionID := util.SanitizeNonAlphanumeric(fmt.Sprintf("%s_%s", ev.Channel, ev.Thread)) // Thread may be empty, that's ok
-	if sess, ok := b.sessions[sessionID]; ok && sess.Active() {
-		sess.UserInput(ev.User, ev.Message)
-		return true
+	sessionID := ws.sessionID(ev.Channel, ev.Thread) // Thread may be empty, that's ok
+	sess, ok := b.sessions[sessionID]
+	if !ok || !sess.Active() {
+		sess, ok = b.movedControl[sessionID]
 	}
-	return false
+	if !ok || !sess.Active() {
+		b.mu.Unlock()
+		return false
+	}
+	forwarded := !b.config.ReadOnlyMode && sess.UserInput(ev.User, ev.Message) // In read-only mode, messages in a session's channel/thread are dropped
+	b.mu.Unlock()
+	b.maybeAcknowledge(ws, sess, ev, forwarded)
+	return true
+}
+
+// maybeAcknowledge reacts to a message sent to a session, so that users in busy channels know if their input was
+// forwarded to the REPL, or dropped (e.g. if the user is not allowed to send commands). This is only done if enabled,
+// and only on platforms that support reactions, see config.Config.AckReactions.
+func (b *Bot) maybeAcknowledge(ws *workspace, sess *session, ev *messageEvent, forwarded bool) {
+	if !b.config.AckReactions || ev.ID == "" {
+		return
+	}
+	reaction := inputDroppedReaction
+	if forwarded {
+		reaction = inputForwardedReaction
+	}
+	if err := ws.conn.React(&channelID{ev.Channel, ev.Thread}, ev.ID, reaction); err != nil && !errors.Is(err, errReactNotSupported) {
+		sess.logUserf(ev.User, "warning", "Warning: unable to react to message: %s", err.Error())
+	}
+}
+
+// handleReactionEvent translates emoji reactions to the terminal message of a session to key commands (see
+// config.Reactions), and forwards them to the session. Authorization is left to the session, see UserInput.
+func (b *Bot) handleReactionEvent(ws *workspace, ev *reactionEvent) error {
+	command, ok := b.config.Reactions[ev.Reaction]
+	if !ok || b.config.ReadOnlyMode {
+		return nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sess := range b.sessions {
+		if ws.owns(sess) && sess.Active() && sess.TerminalID() == ev.MessageID {
+			sess.UserInput(ev.User, b.config.CommandPrefix+strings.TrimPrefix(command, commandPrefix))
+			return nil
+		}
+	}
+	return nil
+}
+
+// handleButtonEvent forwards the command of a clicked control button (see config.Buttons) to the session the button
+// belongs to. Like reactions, clicks are subject to the session's auth mode, see UserInput.
+func (b *Bot) handleButtonEvent(ws *workspace, ev *buttonEvent) error {
+	if b.config.ReadOnlyMode || !isButtonCommand(b.config.Buttons, ev.Command) {
+		return nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sess := range b.sessions {
+		if ws.owns(sess) && sess.Active() && sess.ButtonsID() == ev.MessageID {
+			sess.UserInput(ev.User, b.config.CommandPrefix+strings.TrimPrefix(ev.Command, commandPrefix))
+			return nil
+		}
+	}
+	return nil
 }
 
-func (b *Bot) parseSessionConfig(ev *messageEvent) (*sessionConfig, error) {
+func (b *Bot) parseSessionConfig(ws *workspace, ev *messageEvent) (*sessionConfig, error) {
 	conf := &sessionConfig{
-		global:    b.config,
-		user:      ev.User,
-		record:    b.config.DefaultRecord,
-		web:       b.config.DefaultWeb,
-		notifyWeb: b.webUpdated,
+		global:      ws.config,
+		user:        ev.User,
+		record:      b.config.DefaultRecord,
+		web:         b.config.DefaultWeb,
+		quiet:       b.config.DefaultQuiet,
+		notifyWeb:   b.webUpdated,
+		moveControl: b.controlMoved,
+		detach:      b.controlDetached,
 	}
-	fields := strings.Fields(ev.Message)
+	scriptConf := &config.ScriptConfig{}
+	fields := strings.Fields(strings.ReplaceAll(ev.Message, ws.conn.MentionBot(), "")) // Bot mention may contain spaces (Zulip)
 	for _, field := range fields {
 		switch field {
-		case b.conn.MentionBot():
-			// Ignore
 		case helpRequestedCommand:
 			return nil, errHelpRequested
 		case string(config.Thread), string(config.Channel), string(config.Split):
 			conf.controlMode = config.ControlMode(field)
 		case string(config.Full), string(config.Trim):
 			conf.windowMode = config.WindowMode(field)
+		case string(config.Color), string(config.NoColor):
+			conf.colorMode = config.ColorMode(field)
 		case string(config.OnlyMe), string(config.Everyone):
 			conf.authMode = config.AuthMode(field)
 		case config.Tiny.Name, config.Small.Name, config.Medium.Name, config.Large.Name:
 			conf.size = config.Sizes[field]
 		case recordCommand, noRecordCommand:
 			conf.record = field == recordCommand
+		case collapseCommand:
+			conf.collapse = true
+		case ephemeralCommand:
+			conf.ephemeral = true
+		case separateStderrCommand:
+			conf.separateStderr = true
+		case quietCommand, noQuietCommand:
+			conf.quiet = field == quietCommand
 		default:
 			if b.config.ShareEnabled() && field == shareCommand {
-				relayPort, err := util.RandomPort()
+				if b.config.ReadOnlyMode {
+					return nil, errors.New(shareReadOnlyModeMessage) //lint:ignore ST1005 we'll pass this to the client
+				}
+				relayPort, err := b.shareRelayPort()
 				if err != nil {
 					return nil, err
 				}
@@ -246,17 +695,72 @@ func (b *Bot) parseSessionConfig(ev *messageEvent) (*sessionConfig, error) {
 				if err != nil {
 					return nil, err
 				}
-				conf.script = shareServerScriptFile
+				conf.script = b.shareServerScriptFile()
 				conf.share = &shareConfig{
 					user:          util.RandomString(10),
+					token:         util.RandomString(32),
 					relayPort:     relayPort,
 					hostKeyPair:   hostKeyPair,
 					clientKeyPair: clientKeyPair,
 				}
+			} else if strings.HasPrefix(field, tagPrefix) && len(field) > len(tagPrefix) {
+				if tag := strings.TrimPrefix(field, tagPrefix); !util.InStringList(conf.tags, tag) {
+					conf.tags = append(conf.tags, tag)
+				}
+			} else if strings.HasPrefix(field, namePrefix) {
+				if conf.name = strings.TrimPrefix(field, namePrefix); !sessionNameRegex.MatchString(conf.name) {
+					return nil, fmt.Errorf(nameInvalidMessage, conf.name) //lint:ignore ST1005 we'll pass this to the client
+				}
+			} else if strings.HasPrefix(field, maxDurationPrefix) {
+				maxDuration, err := time.ParseDuration(strings.TrimPrefix(field, maxDurationPrefix))
+				if err != nil || maxDuration <= 0 {
+					return nil, fmt.Errorf(maxDurationInvalidMessage, field) //lint:ignore ST1005 we'll pass this to the client
+				} else if b.config.MaxSessionDuration > 0 && maxDuration > b.config.MaxSessionDuration {
+					return nil, fmt.Errorf(maxDurationExceededMessage, b.config.MaxSessionDuration) //lint:ignore ST1005 we'll pass this to the client
+				}
+				conf.maxDuration = maxDuration
+			} else if strings.HasPrefix(field, maxOutputBytesPrefix) {
+				maxBytes, err := strconv.Atoi(strings.TrimPrefix(field, maxOutputBytesPrefix))
+				if err != nil || maxBytes <= 0 {
+					return nil, fmt.Errorf(maxOutputInvalidMessage, field) //lint:ignore ST1005 we'll pass this to the client
+				} else if b.config.MaxOutputBytes > 0 && maxBytes > b.config.MaxOutputBytes {
+					return nil, fmt.Errorf(maxOutputExceededMessage, formatOutputLimit(b.config.MaxOutputBytes, 0)) //lint:ignore ST1005 we'll pass this to the client
+				}
+				conf.maxOutputBytes = maxBytes
+			} else if strings.HasPrefix(field, maxOutputMessagesPrefix) {
+				maxMessages, err := strconv.Atoi(strings.TrimPrefix(field, maxOutputMessagesPrefix))
+				if err != nil || maxMessages <= 0 {
+					return nil, fmt.Errorf(maxOutputInvalidMessage, field) //lint:ignore ST1005 we'll pass this to the client
+				} else if b.config.MaxOutputMessages > 0 && maxMessages > b.config.MaxOutputMessages {
+					return nil, fmt.Errorf(maxOutputExceededMessage, formatOutputLimit(0, b.config.MaxOutputMessages)) //lint:ignore ST1005 we'll pass this to the client
+				}
+				conf.maxOutputMessages = maxMessages
+			} else if strings.HasPrefix(field, renderPrefix) {
+				renderer := strings.TrimPrefix(field, renderPrefix)
+				if _, ok := outputRenderers[renderer]; !ok {
+					return nil, fmt.Errorf(renderInvalidMessage, renderer, formatScripts(rendererNames())) //lint:ignore ST1005 we'll pass this to the client
+				}
+				conf.renderer = renderer
+			} else if strings.HasPrefix(field, sizePrefix) {
+				size, err := config.ParseSize(strings.TrimPrefix(field, sizePrefix))
+				if err != nil {
+					return nil, fmt.Errorf(sizeInvalidMessage, field, config.MinSize.Width, config.MinSize.Height, config.MaxSize.Width, config.MaxSize.Height) //lint:ignore ST1005 we'll pass this to the client
+				}
+				conf.size = size
 			} else if b.config.WebHost != "" && (field == webCommand || field == noWebCommand) {
 				conf.web = field == webCommand
-			} else if s := b.config.Script(field); conf.script == "" && s != "" {
-				conf.script = s
+			} else if len(b.config.AllowedWorkDirs) > 0 && strings.HasPrefix(field, workDirPrefix) {
+				dir := strings.TrimPrefix(field, workDirPrefix)
+				workDir, err := b.config.AllowedWorkDir(dir)
+				if err != nil {
+					return nil, fmt.Errorf(workDirNotAllowedMessage, dir, err.Error()) //lint:ignore ST1005 we'll pass this to the client
+				}
+				conf.workDir = workDir
+			} else if sc := b.config.ScriptConfig(b.config.ResolveScript(field)); conf.script == "" && sc != nil {
+				conf.script = sc.Path
+				scriptConf = sc
+			} else if suggestion := b.suggestScript(field); conf.script == "" && suggestion != "" {
+				return nil, fmt.Errorf(unknownScriptSuggestionMessage, field, suggestion) //lint:ignore ST1005 we'll pass this to the client
 			} else {
 				return nil, fmt.Errorf(unknownCommandMessage, field) //lint:ignore ST1005 we'll pass this to the client
 			}
@@ -264,11 +768,27 @@ func (b *Bot) parseSessionConfig(ev *messageEvent) (*sessionConfig, error) {
 	}
 	if conf.script == "" {
 		return nil, errNoScript
+	} else if conf.ephemeral {
+		conf.record = false // The recording is uploaded when the session ends, and uploads cannot be deleted
 	}
-	return b.applySessionConfigDefaults(ev, conf)
+	return b.applySessionConfigDefaults(ws, ev, conf, scriptConf)
 }
 
-func (b *Bot) applySessionConfigDefaults(ev *messageEvent, conf *sessionConfig) (*sessionConfig, error) {
+// suggestScript returns the script name or alias (see config.ScriptAliases) that the given field is most likely
+// a typo of, or an empty string if there is none, see closestMatch
+func (b *Bot) suggestScript(field string) string {
+	candidates := b.config.Scripts()
+	for alias := range b.config.ScriptAliases {
+		candidates = append(candidates, alias)
+	}
+	return closestMatch(field, candidates)
+}
+
+// applySessionConfigDefaults fills in the session config values that were not explicitly set by the user, using
+// the script's defaults first (see config.ScriptConfig), then the user's own preferences (see userPrefs), and
+// then the global defaults.
+func (b *Bot) applySessionConfigDefaults(ws *workspace, ev *messageEvent, conf *sessionConfig, scriptConf *config.ScriptConfig) (*sessionConfig, error) {
+	prefs := b.prefs.Get(ev.User)
 	if conf.share != nil { // sane defaults for terminal sharing
 		if conf.authMode == "" {
 			conf.authMode = config.OnlyMe
@@ -277,25 +797,68 @@ func (b *Bot) applySessionConfigDefaults(ev *messageEvent, conf *sessionConfig)
 	if conf.controlMode == "" {
 		if ev.Thread != "" {
 			conf.controlMode = config.Thread // special handling, because it'd be weird otherwise
+		} else if scriptConf.ControlMode != "" {
+			conf.controlMode = scriptConf.ControlMode
+		} else if prefs.ControlMode != "" {
+			conf.controlMode = prefs.ControlMode
 		} else {
 			conf.controlMode = b.config.DefaultControlMode
 		}
 	}
-	if b.config.Platform() == config.Discord && ev.ChannelType == channelTypeDM && conf.controlMode != config.Channel {
+	if ws.config.Platform() == config.Discord && ev.ChannelType == channelTypeDM && conf.controlMode != config.Channel {
 		conf.controlMode = config.Channel // special case: Discord does not support threads in direct messages
+	} else if ws.config.Platform() == config.WhatsApp && conf.controlMode != config.Channel {
+		conf.controlMode = config.Channel // special case: WhatsApp does not support threads at all
 	}
 	if conf.windowMode == "" {
-		if conf.controlMode == config.Thread {
+		if scriptConf.WindowMode != "" {
+			conf.windowMode = scriptConf.WindowMode
+		} else if prefs.WindowMode != "" {
+			conf.windowMode = prefs.WindowMode
+		} else if conf.controlMode == config.Thread {
 			conf.windowMode = config.Trim
 		} else {
 			conf.windowMode = b.config.DefaultWindowMode
 		}
 	}
+	if conf.colorMode == "" {
+		if scriptConf.ColorMode != "" {
+			conf.colorMode = scriptConf.ColorMode
+		} else {
+			conf.colorMode = b.config.DefaultColorMode
+		}
+	}
 	if conf.authMode == "" {
-		conf.authMode = b.config.DefaultAuthMode
+		if scriptConf.AuthMode != "" {
+			conf.authMode = scriptConf.AuthMode
+		} else {
+			conf.authMode = b.config.DefaultAuthMode
+		}
+	}
+	if conf.workDir == "" {
+		conf.workDir = b.config.WorkDir
+	}
+	if conf.maxDuration == 0 {
+		conf.maxDuration = b.config.MaxSessionDuration
+	}
+	if conf.maxOutputBytes == 0 {
+		conf.maxOutputBytes = b.config.MaxOutputBytes
 	}
+	if conf.maxOutputMessages == 0 {
+		conf.maxOutputMessages = b.config.MaxOutputMessages
+	}
+	conf.image = scriptConf.Image
+	if conf.separateStderr && conf.image != "" {
+		return nil, errors.New(separateStderrImageMessage) //lint:ignore ST1005 we'll pass this to the client
+	}
+	conf.prompt = scriptConf.Prompt
+	conf.ready = scriptConf.Ready
 	if conf.size == nil {
-		if conf.controlMode == config.Thread {
+		if scriptConf.Size != nil {
+			conf.size = scriptConf.Size
+		} else if size, err := config.ParseSize(prefs.Size); err == nil {
+			conf.size = size
+		} else if conf.controlMode == config.Thread {
 			conf.size = config.Tiny // special case: make it tiny in a thread
 		} else {
 			conf.size = b.config.DefaultSize
@@ -304,53 +867,65 @@ func (b *Bot) applySessionConfigDefaults(ev *messageEvent, conf *sessionConfig)
 	return conf, nil
 }
 
-func (b *Bot) startSessionChannel(ev *messageEvent, conf *sessionConfig) error {
-	conf.id = util.SanitizeNonAlphanumeric(fmt.Sprintf("%s_%s", ev.Channel, ""))
+func (b *Bot) startSessionChannel(ws *workspace, ev *messageEvent, conf *sessionConfig) error {
+	conf.id = ws.sessionID(ev.Channel, "")
 	conf.control = &channelID{Channel: ev.Channel, Thread: ""}
 	conf.terminal = conf.control
-	return b.startSession(conf)
+	return b.startSession(ws, conf)
 }
 
-func (b *Bot) startSessionThread(ev *messageEvent, conf *sessionConfig) error {
+func (b *Bot) startSessionThread(ws *workspace, ev *messageEvent, conf *sessionConfig) error {
 	if ev.Thread == "" {
-		conf.id = util.SanitizeNonAlphanumeric(fmt.Sprintf("%s_%s", ev.Channel, ev.ID))
+		conf.id = ws.sessionID(ev.Channel, ev.ID)
 		conf.control = &channelID{Channel: ev.Channel, Thread: ev.ID}
 		conf.terminal = conf.control
-		return b.startSession(conf)
+		return b.startSession(ws, conf)
 	}
-	conf.id = util.SanitizeNonAlphanumeric(fmt.Sprintf("%s_%s", ev.Channel, ev.Thread))
+	conf.id = ws.sessionID(ev.Channel, ev.Thread)
 	conf.control = &channelID{Channel: ev.Channel, Thread: ev.Thread}
 	conf.terminal = conf.control
-	return b.startSession(conf)
+	return b.startSession(ws, conf)
 }
 
-func (b *Bot) startSessionSplit(ev *messageEvent, conf *sessionConfig) error {
+func (b *Bot) startSessionSplit(ws *workspace, ev *messageEvent, conf *sessionConfig) error {
 	if ev.Thread == "" {
-		conf.id = util.SanitizeNonAlphanumeric(fmt.Sprintf("%s_%s", ev.Channel, ev.ID))
+		conf.id = ws.sessionID(ev.Channel, ev.ID)
 		conf.control = &channelID{Channel: ev.Channel, Thread: ev.ID}
 		conf.terminal = &channelID{Channel: ev.Channel, Thread: ""}
-		return b.startSession(conf)
+		return b.startSession(ws, conf)
 	}
-	conf.id = util.SanitizeNonAlphanumeric(fmt.Sprintf("%s_%s", ev.Channel, ev.Thread))
+	conf.id = ws.sessionID(ev.Channel, ev.Thread)
 	conf.control = &channelID{Channel: ev.Channel, Thread: ev.Thread}
 	conf.terminal = &channelID{Channel: ev.Channel, Thread: ""}
-	return b.startSession(conf)
+	return b.startSession(ws, conf)
 }
 
-func (b *Bot) startSession(conf *sessionConfig) error {
+func (b *Bot) startSession(ws *workspace, conf *sessionConfig) error {
 	b.mu.Lock()
+	if b.stopping {
+		b.mu.Unlock()
+		return ws.conn.Send(conf.control, shutdownMessage)
+	}
 	defer b.mu.Unlock()
-	sess := newSession(conf, b.conn)
+	location := conf.id
+	if conf.name != "" {
+		conf.id = ws.namedSessionID(conf.user, conf.name)
+	}
+	sess := newSession(conf, ws.conn)
 	b.sessions[conf.id] = sess
+	if conf.name != "" {
+		b.movedControl[location] = sess // See controlMoved
+	}
 	if conf.share != nil {
 		b.shareUser[conf.share.user] = sess
 	}
-	log.Printf("[%s] Starting session, requested by %s", conf.id, conf.user)
+	b.tagSession(sess)
+	sess.logf("session_start", "Starting session, requested by %s", conf.user)
 	go func() {
 		if err := sess.Run(); err != nil {
-			log.Printf("[%s] Session exited with error: %s", conf.id, err.Error())
+			sess.logf("session_error", "Session exited with error: %s", err.Error())
 		} else {
-			log.Printf("[%s] Session exited successfully", conf.id)
+			sess.logf("session_exit", "Session exited successfully")
 		}
 		b.mu.Lock()
 		delete(b.sessions, conf.id)
@@ -360,41 +935,560 @@ func (b *Bot) startSession(conf *sessionConfig) error {
 		if sess.webPrefix != "" {
 			delete(b.webPrefix, sess.webPrefix)
 		}
+		b.untagSession(sess)
+		b.removeMovedControl(sess)
 		b.mu.Unlock()
 	}()
 	return nil
 }
 
-func (b *Bot) handleHelp(channel, thread string, err error) error {
+// tagSession adds the session to the tag index, see handleFindCommand. The caller must hold the lock.
+func (b *Bot) tagSession(sess *session) {
+	for _, tag := range sess.conf.tags {
+		tag = strings.ToLower(tag)
+		if _, ok := b.tags[tag]; !ok {
+			b.tags[tag] = make(map[string]*session)
+		}
+		b.tags[tag][sess.conf.id] = sess
+	}
+}
+
+// untagSession removes the session from the tag index. The caller must hold the lock.
+func (b *Bot) untagSession(sess *session) {
+	for _, tag := range sess.conf.tags {
+		tag = strings.ToLower(tag)
+		if b.tags[tag][sess.conf.id] == sess {
+			delete(b.tags[tag], sess.conf.id)
+		}
+		if len(b.tags[tag]) == 0 {
+			delete(b.tags, tag)
+		}
+	}
+}
+
+// maybeHandlePrefsCommand handles the "prefs" bot command, which lets users show, change and reset their own
+// defaults for new sessions (see userPrefs). If it returns false, the message should be treated as a session request.
+func (b *Bot) maybeHandlePrefsCommand(ws *workspace, ev *messageEvent) (handled bool, err error) {
+	fields := strings.Fields(strings.ReplaceAll(ev.Message, ws.conn.MentionBot(), ""))
+	if len(fields) == 0 || fields[0] != prefsCommand {
+		return false, nil
+	}
+	target := &channelID{Channel: ev.Channel, Thread: ev.Thread}
+	if len(fields) == 1 {
+		return true, ws.conn.Send(target, b.formatPrefs(b.prefs.Get(ev.User)))
+	} else if len(fields) == 2 && fields[1] == prefsResetCommand {
+		if err := b.prefs.Reset(ev.User); err != nil {
+			return true, err
+		}
+		return true, ws.conn.Send(target, prefsResetMessage)
+	}
+	prefs := b.prefs.Get(ev.User)
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, "=", 2)
+		key, value := parts[0], parts[len(parts)-1]
+		switch {
+		case key == "size" && isValidSize(value):
+			prefs.Size = value
+		case key == "window" && (value == string(config.Full) || value == string(config.Trim)):
+			prefs.WindowMode = config.WindowMode(value)
+		case key == "control" && (value == string(config.Channel) || value == string(config.Thread) || value == string(config.Split)):
+			prefs.ControlMode = config.ControlMode(value)
+		default:
+			return true, ws.conn.Send(target, fmt.Sprintf(prefsInvalidMessage, field))
+		}
+	}
+	if err := b.prefs.Set(ev.User, prefs); err != nil {
+		return true, err
+	}
+	return true, ws.conn.Send(target, prefsSavedMessage+b.formatPrefs(prefs))
+}
+
+func (b *Bot) formatPrefs(prefs *userPrefs) string {
+	values := []string{prefs.Size, string(prefs.WindowMode), string(prefs.ControlMode)}
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		if value == "" {
+			args[i] = prefsNotSetValue
+		} else {
+			args[i] = "`" + value + "`"
+		}
+	}
+	return fmt.Sprintf(prefsMessage, args...)
+}
+
+// maybeHandleAdminCommand handles the admin-only bot commands "sessions", "find", "broadcast", "join", "leave", "reload" and "logs",
+// if the message is one of them and admin users are configured. If it returns false, the message should be treated as a session request.
+func (b *Bot) maybeHandleAdminCommand(ws *workspace, ev *messageEvent) (handled bool, err error) {
+	if len(b.config.AdminUsers) == 0 {
+		return false, nil
+	}
+	message := strings.TrimSpace(strings.ReplaceAll(ev.Message, ws.conn.MentionBot(), ""))
+	fields := strings.Fields(message)
+	if len(fields) == 0 || !util.InStringList([]string{sessionsCommand, findCommand, broadcastCommand, joinCommand, leaveCommand, reloadCommand, logsCommand}, fields[0]) {
+		return false, nil
+	}
+	target := &channelID{Channel: ev.Channel, Thread: ev.Thread}
+	if !util.InStringList(b.config.AdminUsers, ev.User) {
+		return true, ws.conn.Send(target, adminOnlyMessage)
+	}
+	switch fields[0] {
+	case sessionsCommand:
+		return true, b.handleSessionsCommand(ws, target)
+	case findCommand:
+		return true, b.handleFindCommand(ws, target, strings.Join(fields[1:], " "))
+	case joinCommand, leaveCommand:
+		return true, b.handleJoinCommand(ws, target, ev.User, fields[0], fields[1:])
+	case reloadCommand:
+		go b.handleReloadCommand(ws, target, ev.User) // Fetching remote scripts may take a while
+		return true, nil
+	case logsCommand:
+		return true, b.handleLogsCommand(ws, target, fields[1:])
+	default:
+		return true, b.handleBroadcastCommand(ws, target, strings.TrimSpace(strings.TrimPrefix(message, broadcastCommand)))
+	}
+}
+
+func (b *Bot) handleSessionsCommand(ws *workspace, target *channelID) error {
+	b.mu.RLock()
+	sessions := make([]*session, 0, len(b.sessions))
+	for _, sess := range b.sessions {
+		if ws.owns(sess) {
+			sessions = append(sessions, sess)
+		}
+	}
+	b.mu.RUnlock()
+	if len(sessions) == 0 {
+		return ws.conn.Send(target, noSessionsMessage)
+	}
+	return ws.conn.Send(target, fmt.Sprintf(sessionsMessage, b.formatSessionList(sessions)))
+}
+
+// handleFindCommand lists all active sessions with a tag that contains the query, ignoring case
+func (b *Bot) handleFindCommand(ws *workspace, target *channelID, query string) error {
+	query = strings.TrimPrefix(strings.TrimSpace(query), tagPrefix)
+	if query == "" {
+		return ws.conn.Send(target, findUsageMessage)
+	}
+	b.mu.RLock()
+	matches := make(map[string]*session)
+	for tag, sessions := range b.tags {
+		if strings.Contains(tag, strings.ToLower(query)) {
+			for id, sess := range sessions {
+				if ws.owns(sess) {
+					matches[id] = sess
+				}
+			}
+		}
+	}
+	b.mu.RUnlock()
+	if len(matches) == 0 {
+		return ws.conn.Send(target, fmt.Sprintf(findNoMatchMessage, query))
+	}
+	sessions := make([]*session, 0, len(matches))
+	for _, sess := range matches {
+		sessions = append(sessions, sess)
+	}
+	return ws.conn.Send(target, fmt.Sprintf(findMessage, query, b.formatSessionList(sessions)))
+}
+
+// handleBroadcastCommand sends a message to the control channel/thread of all active sessions, e.g. to announce
+// maintenance, and tells the admin how many sessions were notified
+func (b *Bot) handleBroadcastCommand(ws *workspace, target *channelID, message string) error {
+	if message == "" {
+		return ws.conn.Send(target, broadcastUsageMessage)
+	}
+	b.mu.RLock()
+	sessions := make([]*session, 0, len(b.sessions))
+	for _, sess := range b.sessions {
+		if ws.owns(sess) && sess.Active() {
+			sessions = append(sessions, sess)
+		}
+	}
+	b.mu.RUnlock()
+	var notified int
+	for _, sess := range sessions {
+		if err := sess.conn.Send(sess.control(), fmt.Sprintf(broadcastMessage, message)); err != nil {
+			sess.logf("warning", "Warning: unable to send broadcast message: %s", err.Error())
+			continue
+		}
+		notified++
+	}
+	util.Log(util.LogFields{"event": "broadcast"}, "Broadcast message sent to %d of %d session(s)", notified, len(sessions))
+	return ws.conn.Send(target, fmt.Sprintf(broadcastSentMessage, notified))
+}
+
+// handleJoinCommand makes the bot join or leave a channel, so that admins don't have to invite the bot via the
+// platform's UI, e.g. when onboarding a new team
+func (b *Bot) handleJoinCommand(ws *workspace, target *channelID, user, command string, args []string) error {
+	if len(args) != 1 {
+		return ws.conn.Send(target, fmt.Sprintf(joinUsageMessage, command, command))
+	}
+	channel := args[0]
+	var err error
+	if command == joinCommand {
+		err = ws.conn.Join(channel)
+	} else {
+		err = ws.conn.Leave(channel)
+	}
+	fields := util.LogFields{"event": command, "user": user, "channel": channel}
+	if err == errJoinNotSupported {
+		return ws.conn.Send(target, joinNotSupportedMessage)
+	} else if err != nil {
+		util.Log(fields, "Unable to %s channel %s: %s", command, channel, err.Error())
+		return ws.conn.Send(target, fmt.Sprintf(joinFailedMessage, command, channel, err.Error()))
+	}
+	util.Log(fields, "User %s asked me to %s channel %s", user, command, channel)
+	if command == joinCommand {
+		return ws.conn.Send(target, fmt.Sprintf(joinedMessage, channel))
+	}
+	return ws.conn.Send(target, fmt.Sprintf(leftMessage, channel))
+}
+
+// handleLogsCommand sends the last log lines (as many as fit into one message) to the admin, e.g. to find out why a
+// session failed to start without access to the host. Secrets are redacted, see redactLogs.
+func (b *Bot) handleLogsCommand(ws *workspace, target *channelID, args []string) error {
+	n := logsDefaultLines
+	if len(args) > 1 {
+		return ws.conn.Send(target, fmt.Sprintf(logsUsageMessage, logsBufferLines))
+	} else if len(args) == 1 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 1 || n > logsBufferLines {
+			return ws.conn.Send(target, fmt.Sprintf(logsUsageMessage, logsBufferLines))
+		}
+	}
+	if b.logs == nil {
+		return ws.conn.Send(target, logsEmptyMessage)
+	}
+	lines := b.logs.Last(n)
+	if len(lines) == 0 {
+		return ws.conn.Send(target, logsEmptyMessage)
+	}
+	limit := ws.conn.MaxMessageLength() - len(logsMessage) - len(ws.conn.Format("", formatCode)) - 10 // Room for the count
+	logs := trimLeadingLines(b.redactLogs(strings.Join(lines, "\n")), limit)
+	return ws.conn.Send(target, fmt.Sprintf(logsMessage, strings.Count(logs, "\n")+1, ws.conn.Format(logs, formatCode)))
+}
+
+// redactLogs removes secrets from log lines before they are sent to the chat: the tokens and secrets of all
+// workspaces, passwords in URLs, values that look like tokens or passwords, and matches of the session-log-redact
+// option. This is best effort; secrets printed by REPLs in other ways may still show up.
+func (b *Bot) redactLogs(logs string) string {
+	for _, ws := range b.workspaces {
+		for _, secret := range []string{ws.config.Token, ws.config.WhatsAppAppSecret, ws.config.WhatsAppVerifyToken} {
+			if len(secret) >= logsMinSecretLength {
+				logs = strings.ReplaceAll(logs, secret, sessionLogRedacted)
+			}
+		}
+	}
+	logs = logsURLCredentialsRegex.ReplaceAllString(logs, "${1}"+sessionLogRedacted+"@")
+	logs = logsSecretRegex.ReplaceAllString(logs, "${1}"+sessionLogRedacted)
+	if b.config.SessionLogRedact != nil {
+		logs = b.config.SessionLogRedact.ReplaceAllString(logs, sessionLogRedacted)
+	}
+	return logs
+}
+
+// handleReloadCommand fetches the remote scripts (if any) and re-reads all scripts, so that scripts can be added,
+// changed or removed without restarting REPLbot, and tells the admin what changed. Reloads are serialized.
+func (b *Bot) handleReloadCommand(ws *workspace, target *channelID, user string) {
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+	errs := b.config.FetchScripts()
+	changes := b.config.ReloadScripts()
+	fields := util.LogFields{"event": "reload", "user": user}
+	util.Log(fields, "User %s reloaded the scripts: %d added, %d removed, %d changed", user, len(changes.Added), len(changes.Removed), len(changes.Changed))
+	var details string
+	if len(changes.Added) > 0 {
+		details += fmt.Sprintf(reloadedScriptsMessage, "Added", formatScripts(changes.Added))
+	}
+	if len(changes.Removed) > 0 {
+		details += fmt.Sprintf(reloadedScriptsMessage, "Removed", formatScripts(changes.Removed))
+	}
+	if len(changes.Changed) > 0 {
+		details += fmt.Sprintf(reloadedScriptsMessage, "Changed", formatScripts(changes.Changed))
+	}
+	if details != "" {
+		details = "\n" + details
+	}
+	if len(errs) > 0 {
+		lines := make([]string, 0)
+		for _, err := range errs {
+			util.Log(fields, "Warning: %s", err.Error())
+			lines = append(lines, "• "+err.Error())
+		}
+		details += fmt.Sprintf(reloadFetchFailedMessage, strings.Join(lines, "\n"))
+	}
+	if broken := b.config.CheckScripts(); len(broken) > 0 {
+		lines := make([]string, 0)
+		for _, err := range broken {
+			util.Log(fields, "Warning: %s", err.Error())
+			lines = append(lines, "• "+err.Error())
+		}
+		details += fmt.Sprintf(reloadBrokenScriptsMessage, strings.Join(lines, "\n"))
+	}
+	message := fmt.Sprintf(reloadedMessage, len(changes.Added), len(changes.Removed), len(changes.Changed), details)
+	if err := ws.conn.Send(target, message); err != nil {
+		util.Log(fields, "Warning: unable to send reload message: %s", err.Error())
+	}
+}
+
+// formatSessionList returns one line per session, oldest session first
+func (b *Bot) formatSessionList(sessions []*session) string {
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].started.Before(sessions[j].started)
+	})
+	lines := make([]string, 0, len(sessions))
+	for _, sess := range sessions {
+		uptime := time.Since(sess.started).Round(time.Second).String()
+		line := fmt.Sprintf(sessionListItem, sess.conf.id, filepath.Base(sess.conf.script), sess.conn.Mention(sess.conf.user), uptime)
+		if len(sess.conf.tags) > 0 {
+			line += fmt.Sprintf(sessionListItemTags, "`"+strings.Join(sess.conf.tags, "`, `")+"`")
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (b *Bot) handleHelp(ws *workspace, channel, thread string, err error) error {
 	target := &channelID{Channel: channel, Thread: thread}
 	scripts := b.config.Scripts()
 	if len(scripts) == 0 {
-		return b.conn.Send(target, misconfiguredMessage)
+		return ws.conn.Send(target, misconfiguredMessage)
 	}
 	var messageTemplate string
 	if err == nil || err == errNoScript || err == errHelpRequested {
-		messageTemplate = welcomeMessage + mentionMessage
+		messageTemplate = b.help
+		if !b.config.DefaultQuiet {
+			messageTemplate = strings.ReplaceAll(b.welcome, "%", "%%") + messageTemplate
+		}
 	} else {
-		messageTemplate = err.Error() + "\n\n" + mentionMessage
+		messageTemplate = err.Error() + "\n\n" + b.help
 	}
-	if b.config.WebHost != "" {
-		defaultWebCommand := webCommand
-		if !b.config.DefaultWeb {
-			defaultWebCommand = noWebCommand
-		}
-		messageTemplate += " " + fmt.Sprintf(webMessage, defaultWebCommand)
+	messageTemplate += " " + helpOptionsHintMessage + " " + listHelpMessage
+	categories := b.config.ScriptCategories()
+	if names := categoryNames(categories); len(names) > 0 {
+		messageTemplate += " " + strings.ReplaceAll(fmt.Sprintf(helpCategoryMessage, names[0]), "%", "%%")
 	}
 	if b.config.ShareEnabled() {
 		messageTemplate += "\n\n" + shareMessage
-		scripts = append(scripts, shareCommand)
+		categories[""] = append(categories[""], shareCommand)
 	}
-	replList := fmt.Sprintf("`%s`", strings.Join(scripts, "`, `"))
+	replList := formatScriptList(categories)
 	defaultRecordCommand := recordCommand
 	if !b.config.DefaultRecord {
 		defaultRecordCommand = noRecordCommand
 	}
-	message := fmt.Sprintf(messageTemplate, b.conn.MentionBot(), scripts[0], replList, b.config.DefaultControlMode, b.config.DefaultSize.Name, b.config.DefaultWindowMode, b.config.DefaultAuthMode, defaultRecordCommand)
-	return b.conn.Send(target, message)
+	args := []interface{}{ws.conn.MentionBot(), scripts[0], replList, b.config.DefaultControlMode, b.config.DefaultSize.Name, b.config.DefaultWindowMode, b.config.DefaultAuthMode, defaultRecordCommand, b.config.DefaultColorMode}
+	message := fmt.Sprintf(messageTemplate, args[:b.helpArgs]...)
+	return ws.conn.Send(target, message)
+}
+
+// maybeHandleHelpOptions handles "help options" requests, describing the optional keywords of a session request. They
+// are not part of the help message itself, so that it fits into a single message on every platform.
+func (b *Bot) maybeHandleHelpOptions(ws *workspace, ev *messageEvent) (handled bool, err error) {
+	fields := strings.Fields(strings.ReplaceAll(ev.Message, ws.conn.MentionBot(), ""))
+	if len(fields) != 2 || fields[0] != helpRequestedCommand || fields[1] != helpOptionsCommand {
+		return false, nil
+	}
+	target := &channelID{Channel: ev.Channel, Thread: ev.Thread}
+	scripts := b.config.Scripts()
+	if len(scripts) == 0 {
+		return true, ws.conn.Send(target, misconfiguredMessage)
+	}
+	options := make([]string, 0)
+	if b.config.WebHost != "" {
+		defaultWebCommand := webCommand
+		if !b.config.DefaultWeb {
+			defaultWebCommand = noWebCommand
+		}
+		options = append(options, fmt.Sprintf(webMessage, defaultWebCommand))
+	}
+	if len(b.config.AllowedWorkDirs) > 0 {
+		options = append(options, fmt.Sprintf(workDirMessage, "`"+strings.Join(b.config.AllowedWorkDirs, "`, `")+"`"))
+	}
+	maxDuration := maxDurationMessage
+	if b.config.MaxSessionDuration > 0 {
+		maxDuration += fmt.Sprintf(maxDurationLimitMessage, b.config.MaxSessionDuration)
+	}
+	maxOutput := maxOutputMessage
+	if b.config.MaxOutputBytes > 0 || b.config.MaxOutputMessages > 0 {
+		maxOutput += fmt.Sprintf(maxOutputLimitMessage, formatOutputLimit(b.config.MaxOutputBytes, b.config.MaxOutputMessages))
+	}
+	defaultQuietCommand := quietCommand
+	if !b.config.DefaultQuiet {
+		defaultQuietCommand = noQuietCommand
+	}
+	options = append(options, maxDuration, maxOutput, tagMessage, collapseMessage, ephemeralHelpMessage, separateStderrHelpMessage,
+		fmt.Sprintf(quietHelpMessage, defaultQuietCommand), nameHelpMessage, fmt.Sprintf(renderMessage, defaultRenderer, formatScripts(rendererNames())),
+		prefsHelpMessage)
+	message := fmt.Sprintf(helpOptionsMessage, "• "+strings.Join(options, "\n• "), ws.conn.MentionBot(), scripts[0])
+	return true, ws.conn.Send(target, message)
+}
+
+// maybeHandleHelpCategory handles "help <category>" requests, listing only the scripts of the given category
+// (see config.ScriptCategories). If no script has a category, this is handled like any other help request.
+func (b *Bot) maybeHandleHelpCategory(ws *workspace, ev *messageEvent) (handled bool, err error) {
+	fields := strings.Fields(strings.ReplaceAll(ev.Message, ws.conn.MentionBot(), ""))
+	if len(fields) != 2 || fields[0] != helpRequestedCommand {
+		return false, nil
+	}
+	categories := b.config.ScriptCategories()
+	names := categoryNames(categories)
+	if len(names) == 0 {
+		return false, nil
+	}
+	target := &channelID{Channel: ev.Channel, Thread: ev.Thread}
+	for _, name := range names {
+		if strings.EqualFold(name, fields[1]) {
+			scripts := categories[name]
+			if name == otherCategory {
+				scripts = append(categories[name], categories[""]...)
+				sort.Strings(scripts)
+			}
+			message := fmt.Sprintf(categoryScriptsMessage, name, formatScripts(scripts), ws.conn.MentionBot(), scripts[0])
+			return true, ws.conn.Send(target, message)
+		}
+	}
+	return true, ws.conn.Send(target, fmt.Sprintf(categoryUnknownMessage, fields[1], formatScripts(names)))
+}
+
+// maybeHandleListCommand handles the "list" command, listing all scripts with their descriptions (see
+// config.ScriptConfig), so that users can pick the right REPL without trial and error
+func (b *Bot) maybeHandleListCommand(ws *workspace, ev *messageEvent) (handled bool, err error) {
+	fields := strings.Fields(strings.ReplaceAll(ev.Message, ws.conn.MentionBot(), ""))
+	if len(fields) != 1 || fields[0] != listCommand || b.config.Script(listCommand) != "" {
+		return false, nil // A script called "list" wins
+	}
+	scripts := b.config.ScriptConfigs()
+	target := &channelID{Channel: ev.Channel, Thread: ev.Thread}
+	if len(scripts) == 0 {
+		return true, ws.conn.Send(target, misconfiguredMessage)
+	}
+	lines := make([]string, 0, len(scripts))
+	for _, script := range scripts {
+		var aliases string
+		if names := scriptAliases(b.config.ScriptAliases, script.Name); len(names) > 0 {
+			aliases = fmt.Sprintf(listItemAliases, formatScripts(names))
+		}
+		if script.Description != "" {
+			lines = append(lines, fmt.Sprintf(listItemDescription, script.Name, aliases, ws.conn.Format(script.Description, formatText)))
+		} else {
+			lines = append(lines, fmt.Sprintf(listItem, script.Name, aliases))
+		}
+	}
+	return true, ws.conn.Send(target, fmt.Sprintf(listMessage, strings.Join(lines, "\n"), ws.conn.MentionBot(), scripts[0].Name))
+}
+
+// maybeHandleAttachCommand handles "attach <name>", which moves the user's named session (see sessionConfig.name) to
+// where the command was typed, e.g. after "!detach", and "attach", which lists the user's named sessions. In a
+// channel, the session is attached to a thread, like in thread mode.
+func (b *Bot) maybeHandleAttachCommand(ws *workspace, ev *messageEvent) (handled bool, err error) {
+	fields := strings.Fields(strings.ReplaceAll(ev.Message, ws.conn.MentionBot(), ""))
+	if len(fields) == 0 || len(fields) > 2 || fields[0] != attachCommand || b.config.Script(attachCommand) != "" {
+		return false, nil // A script called "attach" wins
+	}
+	target := &channelID{Channel: ev.Channel, Thread: ev.Thread}
+	if len(fields) == 1 {
+		return true, b.handleNamedSessionsList(ws, target, ev.User)
+	}
+	control := target
+	if ev.ChannelType == channelTypeChannel && ev.Thread == "" {
+		control = &channelID{Channel: ev.Channel, Thread: ev.ID}
+	}
+	b.mu.Lock()
+	sess, ok := b.sessions[ws.namedSessionID(ev.User, fields[1])]
+	if ok && sess.Active() {
+		b.removeMovedControl(sess)
+		b.movedControl[ws.sessionID(control.Channel, control.Thread)] = sess // Free, or the message would have been forwarded
+	}
+	b.mu.Unlock()
+	if !ok || !sess.Active() {
+		return true, ws.conn.Send(target, fmt.Sprintf(namedSessionNotFoundMessage, fields[1], ws.conn.MentionBot()))
+	}
+	return true, sess.Attach(control)
+}
+
+// handleNamedSessionsList lists the user's named sessions, so that they know what to attach to
+func (b *Bot) handleNamedSessionsList(ws *workspace, target *channelID, user string) error {
+	b.mu.RLock()
+	sessions := make([]*session, 0)
+	for _, sess := range b.sessions {
+		if ws.owns(sess) && sess.conf.user == user && sess.Name() != "" && sess.Active() {
+			sessions = append(sessions, sess)
+		}
+	}
+	b.mu.RUnlock()
+	if len(sessions) == 0 {
+		return ws.conn.Send(target, noNamedSessionsMessage)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Name() < sessions[j].Name()
+	})
+	lines := make([]string, 0, len(sessions))
+	for _, sess := range sessions {
+		var detached string
+		if sess.Detached() {
+			detached = namedSessionsItemDetached
+		}
+		uptime := time.Since(sess.started).Round(time.Second).String()
+		lines = append(lines, fmt.Sprintf(namedSessionsItem, sess.Name(), filepath.Base(sess.conf.script), uptime, detached))
+	}
+	return ws.conn.Send(target, fmt.Sprintf(namedSessionsMessage, strings.Join(lines, "\n"), ws.conn.MentionBot(), sessions[0].Name()))
+}
+
+// loadTemplates loads the welcome and help templates (see loadTemplate), and counts the placeholders in the help
+// template, making sure that they can all be filled in, see mentionMessage
+func loadTemplates(conf *config.Config) (welcome string, help string, helpArgs int, err error) {
+	welcome, err = loadTemplate(conf.WelcomeTemplate, welcomeMessage)
+	if err != nil {
+		return "", "", 0, err
+	}
+	help, err = loadTemplate(conf.HelpTemplate, mentionMessage)
+	if err != nil {
+		return "", "", 0, err
+	}
+	helpArgs, err = countTemplatePlaceholders(help)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid help template: %s", err.Error())
+	} else if helpArgs > helpTemplateMaxPlaceholders {
+		return "", "", 0, errTooManyPlaceholders
+	}
+	return welcome, help, helpArgs, nil
+}
+
+// checkReactions checks that all reactions map to key commands, see config.Reactions
+func checkReactions(reactions map[string]string) error {
+	for reaction, command := range reactions {
+		if !isSendKeysCommand(command) {
+			return fmt.Errorf("invalid command %s for reaction %s, must be a key command like !c or !r", command, reaction)
+		}
+	}
+	return nil
+}
+
+// checkButtons checks that all buttons send a key command, or one of the session commands that take no arguments,
+// see config.Buttons and buttonSessionCommands
+func checkButtons(buttons []*config.Button) error {
+	for _, button := range buttons {
+		if !isSendKeysCommand(button.Command) && !util.InStringList(buttonSessionCommands, button.Command) {
+			return fmt.Errorf("invalid command %s for button %s, must be a key command like !c or !r, or one of %s", button.Command, button.Label, strings.Join(buttonSessionCommands, ", "))
+		}
+	}
+	return nil
+}
+
+// loadTemplate returns the contents of the given template file, or the template itself if it is not
+// a file. If the template is empty, the fallback is returned.
+func loadTemplate(template, fallback string) (string, error) {
+	if template == "" {
+		return fallback, nil
+	} else if !util.FileExists(template) {
+		return template, nil
+	}
+	b, err := os.ReadFile(template)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\n"), nil
 }
 
 func (b *Bot) runWebServer(ctx context.Context) error {
@@ -405,22 +1499,17 @@ func (b *Bot) runWebServer(ctx context.Context) error {
 	if port == "" {
 		port = "80"
 	}
-	errChan := make(chan error)
-	go func() {
-		http.HandleFunc("/", b.webHandler)
-		errChan <- http.ListenAndServe(":"+port, nil)
-	}()
-	select {
-	case err := <-errChan:
-		return err
-	case <-ctx.Done():
-		return nil
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", b.webHandler)
+	if b.config.ShareEnabled() {
+		mux.HandleFunc("/share/", b.shareWebSocketHandler)
 	}
+	return b.runHTTPServer(ctx, ":"+port, mux)
 }
 
 func (b *Bot) webHandler(w http.ResponseWriter, r *http.Request) {
 	if err := b.webHandlerInternal(w, r); err != nil {
-		log.Printf("[web] error: %s, returning 404", err.Error())
+		util.Log(util.LogFields{"session": "web", "event": "web_error"}, "error: %s, returning 404", err.Error())
 		http.NotFound(w, r)
 	}
 }
@@ -456,8 +1545,95 @@ func (b *Bot) webHandlerInternal(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// httpHandlers returns the HTTP handlers for the health endpoints, the admin API, and for platforms that receive
+// events via HTTP (Teams, WhatsApp, webhook), grouped by listen address, so that they can share an HTTP server
+func (b *Bot) httpHandlers() map[string]*http.ServeMux {
+	handlers := make(map[string]*http.ServeMux)
+	mux := func(addr string) *http.ServeMux {
+		if _, ok := handlers[addr]; !ok {
+			handlers[addr] = http.NewServeMux()
+		}
+		return handlers[addr]
+	}
+	if b.config.HealthAddr != "" {
+		mux(b.config.HealthAddr).HandleFunc("/healthz", b.healthzHandler)
+		mux(b.config.HealthAddr).HandleFunc("/readyz", b.readyzHandler)
+	}
+	if b.config.AdminToken != "" && b.config.AdminAddr != "" {
+		api := b.apiHandler()
+		mux(b.config.AdminAddr).Handle(apiSessionsPath, api)
+		mux(b.config.AdminAddr).Handle(apiSessionsPath+"/", api)
+	}
+	for _, ws := range b.workspaces {
+		if handler, ok := ws.conn.(http.Handler); ok && ws.config.Platform() == config.Teams {
+			mux(ws.config.TeamsAddr).Handle(teamsMessagesPath, handler)
+		} else if ok && ws.config.Platform() == config.WhatsApp {
+			mux(ws.config.WhatsAppAddr).Handle(whatsAppWebhookPath, handler)
+		} else if ok && ws.config.Platform() == config.Webhook {
+			mux(ws.config.WebhookAddr).Handle(webhookMessagesPath, handler)
+		}
+	}
+	return handlers
+}
+
+func (b *Bot) runHTTPServer(ctx context.Context, addr string, handler http.Handler) error {
+	server := &http.Server{Addr: addr, Handler: handler}
+	errChan := make(chan error)
+	go func() {
+		errChan <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return server.Close()
+	}
+}
+
+func (b *Bot) healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+func (b *Bot) readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	for _, ws := range b.workspaces {
+		if !ws.conn.Connected() {
+			http.Error(w, "not connected to chat platform", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if err := checkTerminalBackend(b.config.TerminalBackend); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// checkTerminalBackend checks that the terminal multiplexer used to run the REPLs is installed
+func checkTerminalBackend(backend config.TerminalBackend) error {
+	if backend == config.Screen {
+		if _, err := exec.LookPath("screen"); err != nil {
+			return fmt.Errorf("screen check failed: %s", err.Error())
+		}
+		return nil
+	}
+	if err := util.Run("tmux", "-V"); err != nil {
+		return fmt.Errorf("tmux check failed: %s", err.Error())
+	}
+	return nil
+}
+
+// checkShell checks that the shell used to run the scripts is installed, if one is configured, see config.Config.Shell
+func checkShell(shell string) error {
+	if shell == "" {
+		return nil
+	} else if _, err := exec.LookPath(shell); err != nil {
+		return fmt.Errorf("shell check failed: %s", err.Error())
+	}
+	return nil
+}
+
 func (b *Bot) runShareServer(ctx context.Context) error {
-	if err := os.WriteFile(shareServerScriptFile, []byte(shareServerScriptSource), 0700); err != nil {
+	if err := os.WriteFile(b.shareServerScriptFile(), []byte(shareServerScriptSource), 0700); err != nil {
 		return err
 	}
 	_, port, err := net.SplitHostPort(b.config.ShareHost)
@@ -480,6 +1656,10 @@ func (b *Bot) runShareServer(ctx context.Context) error {
 	}
 }
 
+func (b *Bot) shareServerScriptFile() string {
+	return filepath.Join(b.config.TempDir, shareServerScriptFileName)
+}
+
 func (b *Bot) sshServer(port string) (*ssh.Server, error) {
 	forwardHandler := &ssh.ForwardedTCPHandler{}
 	server := &ssh.Server{
@@ -490,6 +1670,7 @@ func (b *Bot) sshServer(port string) (*ssh.Server, error) {
 		KeyboardInteractiveHandler:    nil,
 		PtyCallback:                   b.sshPtyCallback,
 		ReversePortForwardingCallback: b.sshReversePortForwardingCallback,
+		ConnCallback:                  b.sshConnCallback,
 		Handler:                       b.sshSessionHandler,
 		ServerConfigCallback:          b.sshServerConfigCallback,
 		RequestHandlers: map[string]ssh.RequestHandler{
@@ -510,6 +1691,9 @@ func (b *Bot) sshServer(port string) (*ssh.Server, error) {
 // and opens the reverse tunnel. The session is identified by the SSH user name. If the session is not found, the
 // handler exits immediately.
 func (b *Bot) sshSessionHandler(s ssh.Session) {
+	if !b.sshAttachConn(s.Context(), s.User()) {
+		return
+	}
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	sess, ok := b.shareUser[s.User()]
@@ -521,15 +1705,46 @@ func (b *Bot) sshSessionHandler(s ssh.Session) {
 	}
 	clientUser := s.Command()[0]
 	if err := sess.WriteShareUserFile(clientUser); err != nil {
-		log.Printf("cannot write share user file: %s", err.Error())
+		sess.logf("share_error", "cannot write share user file: %s", err.Error())
 		return
 	}
 	if err := sess.WriteShareClientScript(s); err != nil {
-		log.Printf("cannot write session script: %s", err.Error())
+		sess.logf("share_error", "cannot write session script: %s", err.Error())
 		return
 	}
 }
 
+// sshConnCallback rejects new connections if there are too many open share connections, and closes connections that
+// do not finish the SSH handshake within the share handshake timeout, so that half-open connections don't pile up.
+// The deadline is lifted in sshAttachConn.
+func (b *Bot) sshConnCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	shareConn, err := b.shareConns.Accept(conn)
+	if err != nil {
+		util.Log(util.LogFields{"event": "share_rejected"}, "rejecting connection %s: %s (max. %d)", conn.RemoteAddr(), err.Error(), b.config.ShareMaxConns)
+		return nil
+	}
+	if err := shareConn.SetDeadline(time.Now().Add(b.config.ShareHandshakeTimeout)); err != nil {
+		_ = shareConn.Close()
+		return nil
+	}
+	ctx.SetValue(shareConnContextKey{}, shareConn)
+	return shareConn
+}
+
+// sshAttachConn counts the connection towards the limit of the share session (identified by the SSH user), and
+// lifts the handshake deadline set in sshConnCallback. It returns false if the session has too many connections.
+func (b *Bot) sshAttachConn(ctx context.Context, user string) bool {
+	shareConn, ok := ctx.Value(shareConnContextKey{}).(*shareNetConn)
+	if !ok {
+		return false
+	}
+	if err := b.shareConns.Attach(shareConn, user); err != nil {
+		util.Log(util.LogFields{"event": "share_rejected", "user": user}, "rejecting connection %s: %s (max. %d)", shareConn.RemoteAddr(), err.Error(), b.config.ShareMaxSessionConns)
+		return false
+	}
+	return shareConn.SetDeadline(time.Time{}) == nil
+}
+
 // sshReversePortForwardingCallback checks if the requested reverse tunnel host/port (ssh -R) matches the one
 // that was assigned in the REPL share session and rejects/closes the connection if it doesn't
 func (b *Bot) sshReversePortForwardingCallback(ctx ssh.Context, host string, port uint32) (allow bool) {
@@ -539,12 +1754,14 @@ func (b *Bot) sshReversePortForwardingCallback(ctx ssh.Context, host string, por
 	}
 	defer func() {
 		if !allow {
-			log.Printf("rejecting connection %s", conn.RemoteAddr())
+			util.Log(util.LogFields{"event": "share_rejected"}, "rejecting connection %s", conn.RemoteAddr())
 			conn.Close()
 		}
 	}()
 	if port < 1024 || (host != "localhost" && host != "127.0.0.1") {
 		return
+	} else if !b.sshAttachConn(ctx, ctx.User()) {
+		return
 	}
 	b.mu.RLock()
 	defer b.mu.RUnlock()
@@ -556,6 +1773,114 @@ func (b *Bot) sshReversePortForwardingCallback(ctx ssh.Context, host string, por
 	return true
 }
 
+// shareWebSocketHandler serves the Node.js client for terminal sharing (/share/<token>/client.js), and relays the
+// client's WebSocket (/share/<token>/ws) to the share session. This is an alternative to the SSH reverse tunnel
+// for users without ssh and sshd. The token identifies the session, just like the relay port does for SSH.
+func (b *Bot) shareWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/share/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	sess := b.shareSessionByToken(parts[0])
+	if sess == nil {
+		util.Log(util.LogFields{"event": "share_rejected"}, "rejecting WebSocket share request from %s", r.RemoteAddr)
+		http.NotFound(w, r)
+		return
+	}
+	switch parts[1] {
+	case shareWebSocketClientPath:
+		w.Header().Set("Content-Type", "application/javascript")
+		if err := sess.WriteShareWebSocketClientScript(w); err != nil {
+			sess.logf("share_error", "cannot write session script: %s", err.Error())
+		}
+	case shareWebSocketPath:
+		b.relayShareWebSocket(w, r, sess)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// relayShareWebSocket listens on the session's relay port, and tells the share server script to connect to it. The
+// raw terminal is then relayed between the script and the WebSocket client. Only one client is allowed at a time, so
+// if the relay port is taken (by another WebSocket or SSH client), the connection is rejected.
+func (b *Bot) relayShareWebSocket(w http.ResponseWriter, r *http.Request, sess *session) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", sess.conf.share.relayPort))
+	if err != nil {
+		http.Error(w, "terminal is already shared", http.StatusConflict)
+		return
+	}
+	defer listener.Close()
+	ws, err := shareWebSocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade already replied with an error
+	}
+	defer ws.Close()
+	sess.RegisterShareConn(ws)
+	if err := sess.WriteShareWebSocketFile(); err != nil {
+		sess.logf("share_error", "cannot write share WebSocket file: %s", err.Error())
+		return
+	}
+	defer sess.RemoveShareWebSocketFile()
+	if err := listener.(*net.TCPListener).SetDeadline(time.Now().Add(shareWebSocketConnectTimeout)); err != nil {
+		return
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		sess.logf("share_error", "share script did not connect: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	sess.logf("share_connected", "WebSocket client %s connected", r.RemoteAddr)
+	go func() {
+		buf := make([]byte, 4096) // Reused for every read; WriteMessage is done with it when it returns
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				_ = ws.Close()
+				return
+			}
+			if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+// shareRelayPort picks a free relay port for a terminal sharing session, within the share port range if configured
+func (b *Bot) shareRelayPort() (int, error) {
+	if b.config.SharePortMin == 0 {
+		return util.RandomPort()
+	}
+	port, err := util.RandomPortInRange(b.config.SharePortMin, b.config.SharePortMax)
+	if err != nil {
+		util.Log(util.LogFields{"event": "share_error"}, "Cannot start terminal sharing session: %s", err.Error())
+		return 0, errors.New(shareNoPortMessage) //lint:ignore ST1005 we'll pass this to the client
+	}
+	return port, nil
+}
+
+// shareSessionByToken returns the share session with the given WebSocket token, or nil if there is none
+func (b *Bot) shareSessionByToken(token string) *session {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sess := range b.shareUser {
+		if sess.conf.share != nil && subtle.ConstantTimeCompare([]byte(sess.conf.share.token), []byte(token)) == 1 {
+			return sess
+		}
+	}
+	return nil
+}
+
 // sshPtyCallback always returns false, thereby refusing any SSH client attempt to request a TTY
 func (b *Bot) sshPtyCallback(ctx ssh.Context, pty ssh.Pty) bool {
 	return false
@@ -570,22 +1895,26 @@ func (b *Bot) sshServerConfigCallback(ctx ssh.Context) *gossh.ServerConfig {
 	return conf
 }
 
-func (b *Bot) checkSessionAllowed(channel, thread string, conf *sessionConfig) (allowed bool, err error) {
+func (b *Bot) checkSessionAllowed(ws *workspace, channel, thread string, conf *sessionConfig) (allowed bool, err error) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	if len(b.sessions) >= b.config.MaxTotalSessions {
 		ch := &channelID{Channel: channel, Thread: thread}
-		return false, b.conn.Send(ch, maxTotalSessionsExceededMessage)
+		return false, ws.conn.Send(ch, maxTotalSessionsExceededMessage)
 	}
 	var userSessions int
 	for _, sess := range b.sessions {
-		if sess.conf.user == conf.user {
+		if ws.owns(sess) && sess.conf.user == conf.user {
 			userSessions++
 		}
 	}
 	if userSessions >= b.config.MaxUserSessions {
 		ch := &channelID{Channel: channel, Thread: thread}
-		return false, b.conn.Send(ch, maxUserSessionsExceededMessage)
+		return false, ws.conn.Send(ch, maxUserSessionsExceededMessage)
+	}
+	if _, ok := b.sessions[ws.namedSessionID(conf.user, conf.name)]; conf.name != "" && ok {
+		ch := &channelID{Channel: channel, Thread: thread}
+		return false, ws.conn.Send(ch, fmt.Sprintf(namedSessionExistsMessage, conf.name, ws.conn.MentionBot(), conf.name))
 	}
 	return true, nil
 }
@@ -599,3 +1928,44 @@ func (b *Bot) webUpdated(s *session, enabled bool, prefix string) {
 		delete(b.webPrefix, prefix)
 	}
 }
+
+// controlMoved is called if a session's control channel moved to a direct message (see session.handleDMCommand), or
+// to wherever a named session was started or attached (see handleAttachCommand), so that messages there are forwarded
+// to it. Named sessions are not keyed by their channel/thread, so they can only be reached this way. It returns false
+// if another session is already controlled from there.
+func (b *Bot) controlMoved(s *session, control *channelID) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ws := range b.workspaces {
+		if !ws.owns(s) {
+			continue
+		}
+		id := ws.sessionID(control.Channel, control.Thread)
+		if other, ok := b.sessions[id]; ok && other != s && other.Active() {
+			return false
+		} else if other, ok := b.movedControl[id]; ok && other != s && other.Active() {
+			return false
+		}
+		b.movedControl[id] = s
+		return true
+	}
+	return false
+}
+
+// controlDetached is called if the owner detached from a named session (see session.handleDetachCommand), so that
+// messages where it was controlled from are no longer forwarded to it
+func (b *Bot) controlDetached(s *session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeMovedControl(s)
+}
+
+// removeMovedControl removes the session from the index of moved control channels, see controlMoved. The caller
+// must hold the lock.
+func (b *Bot) removeMovedControl(s *session) {
+	for id, sess := range b.movedControl {
+		if sess == s {
+			delete(b.movedControl, id)
+		}
+	}
+}
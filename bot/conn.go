@@ -2,7 +2,164 @@ package bot
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"heckel.io/replbot/config"
 	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRetryAfter           = 2 * time.Second
+	additionalRateLimitDuration = 500 * time.Millisecond
+	serverErrorMessageMaxLength = 200
+)
+
+// errTitleNotSupported is returned by conn.SetTitle if the platform (or the type of channel) has no title or topic
+var errTitleNotSupported = errors.New("setting a title is not supported")
+
+// errStatusNotSupported is returned by conn.SendStatus and conn.UpdateStatus if the platform cannot show structured
+// status messages (or they are disabled); the status message's Text is sent as a regular message instead
+var errStatusNotSupported = errors.New("status messages are not supported")
+
+// errChannelGone is returned by conn methods if the channel (or thread) was archived or deleted, i.e. messages can
+// never be sent there again. Sessions in such a channel are closed without trying to send an exit message.
+var errChannelGone = errors.New("channel was archived or deleted")
+
+// errButtonsNotSupported is returned by conn.SendButtons if the platform cannot show interactive buttons, or cannot
+// report clicks (e.g. Slack's RTM API); sessions are controlled by typing commands only then
+var errButtonsNotSupported = errors.New("buttons are not supported")
+
+// errDeleteNotSupported is returned by conn.Delete if the platform does not let bots delete their own messages
+var errDeleteNotSupported = errors.New("deleting messages is not supported")
+
+// errJoinNotSupported is returned by conn.Join and conn.Leave if the platform does not let bots join or leave channels
+var errJoinNotSupported = errors.New("joining and leaving channels is not supported")
+
+// errReactNotSupported is returned by conn.React if the platform does not let bots react to messages
+var errReactNotSupported = errors.New("reactions are not supported")
+
+// rateLimitedError is returned by conn methods if the platform rejected a request due to rate limiting.
+// The request may be retried after RetryAfter.
+type rateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.RetryAfter)
+}
+
+// newRateLimitedError creates a rateLimitedError from an HTTP 429 response, using the Retry-After header if present
+func newRateLimitedError(resp *http.Response) *rateLimitedError {
+	if seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil && seconds > 0 {
+		return &rateLimitedError{RetryAfter: time.Duration(seconds * float64(time.Second))}
+	}
+	return &rateLimitedError{RetryAfter: defaultRetryAfter}
+}
+
+// retryRateLimited calls fn until it succeeds or fails with an error other than a rateLimitedError,
+// sleeping as long as the platform asks us to in between
+func retryRateLimited(fn func() error) error {
+	for {
+		err := fn()
+		var e *rateLimitedError
+		if !errors.As(err, &e) {
+			return err
+		}
+		log.Printf("error: %s; sleeping before re-sending", err.Error())
+		time.Sleep(e.RetryAfter + additionalRateLimitDuration)
+	}
+}
+
+// serverError is returned by conn methods if the platform failed with a server error (HTTP 5xx), which is
+// usually temporary. The request may be retried, see retryConn.
+type serverError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *serverError) Error() string {
+	message := strings.TrimSpace(e.Message)
+	if len(message) > serverErrorMessageMaxLength { // Error pages may be long HTML documents
+		message = message[:serverErrorMessageMaxLength] + " ..."
+	}
+	return fmt.Sprintf("server error (HTTP %d): %s", e.StatusCode, message)
+}
+
+// HTTPStatusCode returns the HTTP status code of the response, see isRetryable
+func (e *serverError) HTTPStatusCode() int {
+	return e.StatusCode
+}
+
+// isRetryable returns true if the error is likely temporary (rate limits, timeouts, server errors, dropped
+// connections), and the request should be retried. If the platform asked us to wait, wait is non-zero.
+// All other errors (e.g. authentication failures or unknown channels) are permanent.
+func isRetryable(err error) (retryable bool, wait time.Duration) {
+	var rateLimited *rateLimitedError
+	var statusErr interface{ HTTPStatusCode() int } // serverError, and Slack's internal StatusCodeError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return false, 0
+	case errors.As(err, &rateLimited):
+		return true, rateLimited.RetryAfter + additionalRateLimitDuration
+	case errors.As(err, &statusErr):
+		return statusErr.HTTPStatusCode() >= 500, 0
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true, 0
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return true, 0
+	}
+	return false, 0
+}
+
+// collapseMode defines if and how a platform can collapse long output, see conn.CollapseMode and session.collapse
+type collapseMode int
+
+const (
+	collapseNone    collapseMode = iota // Output cannot be collapsed, and is shown as is
+	collapseSpoiler                     // Output is hidden behind a spoiler, and revealed when clicked (Discord)
+	collapseUpload                      // Output is uploaded as a text snippet, which is shown collapsed (Slack)
+)
+
+// messageFormat defines how text is rendered in a message, see conn.Format
+type messageFormat int
+
+const (
+	formatText     messageFormat = iota // Plain text; formatting characters are escaped, e.g. in user-provided titles
+	formatMarkdown                      // Markdown, sent as is
+	formatCode                          // Code block, e.g. the terminal window
+	formatANSI                          // Code block with colors, only if the platform supports it (see conn.SupportsANSI)
+)
+
+// statusMessage is a session lifecycle message, e.g. "session started". Platforms that support rich messages may show
+// it as a card with a title, fields and a color depending on the state (e.g. a Discord embed), see conn.SendStatus.
+// Text is the full message, which is what all other platforms show.
+type statusMessage struct {
+	Title  string
+	Text   string
+	Fields []*statusField
+	State  statusState
+}
+
+type statusField struct {
+	Name  string
+	Value string
+}
+
+// statusState is the state of the session that a statusMessage is about, e.g. to pick the color of a Discord embed
+type statusState int
+
+const (
+	statusActive statusState = iota // Session is running, e.g. "session started"
+	statusExited                    // Session has ended
+	statusInfo                      // Informational, e.g. the help message
 )
 
 type channelID struct {
@@ -16,12 +173,26 @@ type conn interface {
 	SendWithID(channel *channelID, message string) (string, error)
 	SendEphemeral(channel *channelID, userID, message string) error
 	SendDM(userID string, message string) error
+	OpenDM(userID string) (string, error) // returns the channel ID of the direct message with the user, see "!dm"
 	UploadFile(channel *channelID, message string, filename string, filetype string, file io.Reader) error
 	Update(channel *channelID, id string, message string) error
+	SendStatus(channel *channelID, status *statusMessage) (string, error) // see errStatusNotSupported
+	UpdateStatus(channel *channelID, id string, status *statusMessage) error
+	SendButtons(channel *channelID, message string, buttons []*config.Button) (string, error) // see errButtonsNotSupported
+	Delete(channel *channelID, id string) error                                               // see errDeleteNotSupported
+	React(channel *channelID, id string, emoji string) error                                  // see errReactNotSupported
 	Archive(channel *channelID) error
+	SetTitle(channel *channelID, title string) error
+	Join(channel string) error  // channel as referenced by the user, e.g. a channel mention like "<#C0123|general>"
+	Leave(channel string) error // see Join
 	MentionBot() string
 	Mention(user string) string
 	ParseMention(user string) (string, error)
 	Unescape(s string) string
+	MaxMessageLength() int
+	SupportsANSI() bool // true if "ansi" code blocks render colors, see session.colorEnabled
+	CollapseMode() collapseMode
+	Format(text string, format messageFormat) string
+	Connected() bool
 	Close() error
 }
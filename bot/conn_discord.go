@@ -9,18 +9,48 @@ import (
 	"io"
 	"log"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 )
 
 const (
 	discordMessageLengthLimit = 2000 // Sigh ...
+	discordMaxCommandChoices  = 25   // Max number of choices for a slash command option
+	discordThreadNameLimit    = 100  // Max length of a thread name
+	discordThreadName         = "REPLbot session"
+	discordSlashCommand       = "repl"
+	discordSlashCommandReply  = "🚀 Starting a REPL session ..."
+
+	// discordErrCodeThreadArchived is the JSON error code for sending to an archived thread, which discordgo
+	// doesn't define (yet), see translateDiscordError
+	discordErrCodeThreadArchived = 50083
+
+	// Limits of embeds, see https://discord.com/developers/docs/resources/channel#embed-limits
+	discordEmbedTitleLimit       = 256
+	discordEmbedDescriptionLimit = 4096
+	discordEmbedFieldNameLimit   = 256
+	discordEmbedFieldValueLimit  = 1024
+
+	// Limits of buttons, see https://discord.com/developers/docs/interactions/message-components#buttons
+	discordButtonsPerRow     = 5
+	discordButtonLabelLimit  = 80
+	discordButtonCustomIDMax = 100
 )
 
 var (
 	discordUserLinkRegex    = regexp.MustCompile(`<@!([^>]+)>`)
 	discordChannelLinkRegex = regexp.MustCompile(`<#[^>]+>`)
+	discordChannelIDRegex   = regexp.MustCompile(`^<#(\d+)>$`)
 	discordCodeBlockRegex   = regexp.MustCompile("```([^`]+)```")
 	discordCodeRegex        = regexp.MustCompile("`([^`]+)`")
+
+	// discordEmbedColors are the sidebar colors of status message embeds, see SendStatus
+	discordEmbedColors = map[statusState]int{
+		statusActive: 0x2ecc71, // Green
+		statusExited: 0x95a5a6, // Gray
+		statusInfo:   0x5865f2, // Blurple
+	}
 )
 
 type discordConn struct {
@@ -50,7 +80,18 @@ func (c *discordConn) Connect(ctx context.Context) (<-chan event, error) {
 			eventChan <- ev
 		}
 	})
-	discord.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages
+	discord.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if ev := c.translateInteractionEvent(i); ev != nil {
+			eventChan <- ev
+		}
+	})
+	discord.AddHandler(func(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+		if ev := c.translateReactionEvent(r); ev != nil {
+			eventChan <- ev
+		}
+	})
+	discord.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages |
+		discordgo.IntentsGuildMessageReactions | discordgo.IntentsDirectMessageReactions
 	if err := discord.Open(); err != nil {
 		return nil, err
 	}
@@ -59,6 +100,9 @@ func (c *discordConn) Connect(ctx context.Context) (<-chan event, error) {
 		return nil, errors.New("unexpected internal state")
 	}
 	log.Printf("Discord connected as user %s/%s", discord.State.User.Username, discord.State.User.ID)
+	if _, err := discord.ApplicationCommandBulkOverwrite(discord.State.User.ID, "", c.slashCommands()); err != nil {
+		log.Printf("Warning: cannot register slash commands: %s", err.Error())
+	}
 	return eventChan, nil
 }
 
@@ -74,7 +118,7 @@ func (c *discordConn) SendWithID(channel *channelID, message string) (string, er
 	}
 	msg, err := c.session.ChannelMessageSend(ch, cropWindow(message, discordMessageLengthLimit))
 	if err != nil {
-		return "", err
+		return "", translateDiscordError(err)
 	}
 	return msg.ID, nil
 }
@@ -84,15 +128,22 @@ func (c *discordConn) SendEphemeral(_ *channelID, userID, message string) error
 }
 
 func (c *discordConn) SendDM(userID string, message string) error {
-	ch, err := c.session.UserChannelCreate(userID)
+	channel, err := c.OpenDM(userID)
 	if err != nil {
 		return err
 	}
+	return c.Send(&channelID{channel, ""}, cropWindow(message, discordMessageLengthLimit))
+}
+
+func (c *discordConn) OpenDM(userID string) (string, error) {
+	ch, err := c.session.UserChannelCreate(userID)
+	if err != nil {
+		return "", err
+	}
 	c.mu.Lock()
 	c.channels[ch.ID] = ch
 	c.mu.Unlock()
-	channel := &channelID{ch.ID, ""}
-	return c.Send(channel, cropWindow(message, discordMessageLengthLimit))
+	return ch.ID, nil
 }
 
 func (c *discordConn) Update(channel *channelID, id string, message string) error {
@@ -101,7 +152,7 @@ func (c *discordConn) Update(channel *channelID, id string, message string) erro
 		ch = channel.Thread
 	}
 	_, err := c.session.ChannelMessageEdit(ch, id, cropWindow(message, discordMessageLengthLimit))
-	return err
+	return translateDiscordError(err)
 }
 
 func (c *discordConn) UploadFile(channel *channelID, message string, filename string, filetype string, file io.Reader) error {
@@ -120,18 +171,148 @@ func (c *discordConn) UploadFile(channel *channelID, message string, filename st
 	return err
 }
 
+// SendStatus sends the status message as an embed, if enabled via config.Config.DiscordEmbeds
+func (c *discordConn) SendStatus(channel *channelID, status *statusMessage) (string, error) {
+	if !c.config.DiscordEmbeds {
+		return "", errStatusNotSupported
+	}
+	ch, err := c.maybeCreateThread(channel)
+	if err != nil {
+		return "", err
+	}
+	msg, err := c.session.ChannelMessageSendEmbed(ch, discordEmbed(status))
+	if err != nil {
+		return "", translateDiscordError(err)
+	}
+	return msg.ID, nil
+}
+
+func (c *discordConn) UpdateStatus(channel *channelID, id string, status *statusMessage) error {
+	if !c.config.DiscordEmbeds {
+		return errStatusNotSupported
+	}
+	ch := channel.Channel
+	if channel.Thread != "" {
+		ch = channel.Thread
+	}
+	_, err := c.session.ChannelMessageEditEmbed(ch, id, discordEmbed(status))
+	return translateDiscordError(err)
+}
+
+// SendButtons sends the message with the buttons below it, up to 5 per row. Each button's custom ID is its command,
+// which is reported back as a buttonEvent when it is clicked, see translateButtonEvent.
+func (c *discordConn) SendButtons(channel *channelID, message string, buttons []*config.Button) (string, error) {
+	ch, err := c.maybeCreateThread(channel)
+	if err != nil {
+		return "", err
+	}
+	msg, err := c.session.ChannelMessageSendComplex(ch, &discordgo.MessageSend{
+		Content:    cropWindow(message, discordMessageLengthLimit),
+		Components: discordButtonRows(buttons),
+	})
+	if err != nil {
+		return "", translateDiscordError(err)
+	}
+	return msg.ID, nil
+}
+
+func (c *discordConn) Delete(channel *channelID, id string) error {
+	ch := channel.Channel
+	if channel.Thread != "" {
+		ch = channel.Thread
+	}
+	return translateDiscordError(c.session.ChannelMessageDelete(ch, id))
+}
+
+func (c *discordConn) React(channel *channelID, id string, emoji string) error {
+	ch := channel.Channel
+	if channel.Thread != "" {
+		ch = channel.Thread
+	}
+	return translateDiscordError(c.session.MessageReactionAdd(ch, id, emoji))
+}
+
 func (c *discordConn) Archive(channel *channelID) error {
 	if channel.Thread == "" {
 		return nil
 	}
-	_, err := c.session.ThreadEdit(channel.Thread, "REPLbot session", true, false, discordgo.ArchiveDurationOneHour)
+	name := discordThreadName
+	if thread, err := c.session.Channel(channel.Thread); err == nil {
+		name = thread.Name // Keep the title, see SetTitle
+	}
+	_, err := c.session.ThreadEdit(channel.Thread, name, true, false, discordgo.ArchiveDurationOneHour)
+	return err
+}
+
+func (c *discordConn) SetTitle(channel *channelID, title string) error {
+	if channel.Thread == "" {
+		return errTitleNotSupported
+	}
+	if runes := []rune(title); len(runes) > discordThreadNameLimit {
+		title = string(runes[:discordThreadNameLimit])
+	}
+	_, err := c.session.ThreadEdit(channel.Thread, title, false, false, discordgo.ArchiveDurationOneHour)
 	return err
 }
 
+// Join only checks if the bot can see the channel: On Discord, bots are added to a guild, not to channels, so
+// they can use all channels in the guild they have permissions for.
+func (c *discordConn) Join(channel string) error {
+	matches := discordChannelIDRegex.FindStringSubmatch(channel)
+	if len(matches) == 0 {
+		return errors.New("invalid channel")
+	}
+	_, err := c.session.Channel(matches[1])
+	return err
+}
+
+// Leave is not supported, since bots can only leave the entire guild on Discord, see Join
+func (c *discordConn) Leave(_ string) error {
+	return errJoinNotSupported
+}
+
 func (c *discordConn) Close() error {
 	return c.session.Close()
 }
 
+func (c *discordConn) MaxMessageLength() int {
+	return discordMessageLengthLimit
+}
+
+func (c *discordConn) SupportsANSI() bool {
+	return true
+}
+
+// CollapseMode returns collapseSpoiler, since Discord can hide messages (including code blocks) behind a spoiler
+func (c *discordConn) CollapseMode() collapseMode {
+	return collapseSpoiler
+}
+
+// Format renders text using Discord's Markdown. Discord treats a single word on the first line of a code block
+// as its language (and hides it), so code blocks always start with a new line. In plain text, the spoiler
+// marker "|" is escaped as well.
+func (c *discordConn) Format(text string, format messageFormat) string {
+	switch format {
+	case formatText:
+		return strings.ReplaceAll(renderMarkdown(text, formatText), "|", "\\|")
+	case formatCode:
+		return codeFence + "\n" + escapeCodeFences(text) + codeFence
+	}
+	return renderMarkdown(text, format)
+}
+
+func (c *discordConn) Connected() bool {
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	if session == nil {
+		return false
+	}
+	session.RLock()
+	defer session.RUnlock()
+	return session.DataReady
+}
+
 func (c *discordConn) MentionBot() string {
 	return fmt.Sprintf("<@!%s>", c.session.State.User.ID)
 }
@@ -155,6 +336,26 @@ func (c *discordConn) Unescape(s string) string {
 	return s
 }
 
+func (c *discordConn) translateReactionEvent(r *discordgo.MessageReactionAdd) event {
+	if r.MessageReaction == nil || r.UserID == c.session.State.User.ID {
+		return nil
+	}
+	channel, err := c.channel(r.ChannelID)
+	if err != nil {
+		return &errorEvent{err}
+	}
+	channelID := r.ChannelID
+	if channel.ThreadMetadata != nil {
+		channelID = channel.ParentID
+	}
+	return &reactionEvent{
+		Channel:   channelID,
+		MessageID: r.MessageID,
+		User:      r.UserID,
+		Reaction:  r.Emoji.Name,
+	}
+}
+
 func (c *discordConn) translateMessageEvent(m *discordgo.MessageCreate) event {
 	if m.Author.ID == c.session.State.User.ID {
 		return nil
@@ -180,6 +381,158 @@ func (c *discordConn) translateMessageEvent(m *discordgo.MessageCreate) event {
 	}
 }
 
+// translateInteractionEvent translates a "/repl" slash command into a regular message event, as if the user
+// had tagged the bot, e.g. "/repl script:bash size:tiny" becomes "@replbot bash tiny". Since threads are started
+// from a message, we reply to the interaction and use the reply's message ID as the event ID.
+func (c *discordConn) translateInteractionEvent(i *discordgo.InteractionCreate) event {
+	if i.Type == discordgo.InteractionMessageComponent {
+		return c.translateButtonEvent(i)
+	} else if i.Type != discordgo.InteractionApplicationCommand {
+		return nil
+	}
+	data := i.ApplicationCommandData()
+	if data.Name != discordSlashCommand {
+		return nil
+	}
+	user := discordInteractionUser(i)
+	if user == "" {
+		return nil
+	}
+	fields := []string{c.MentionBot()}
+	for _, option := range data.Options {
+		switch option.Type {
+		case discordgo.ApplicationCommandOptionString:
+			fields = append(fields, option.StringValue())
+		case discordgo.ApplicationCommandOptionBoolean:
+			fields = append(fields, c.slashCommandBoolField(option.Name, option.BoolValue()))
+		}
+	}
+	message := strings.Join(fields, " ")
+	if err := c.session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Content: discordSlashCommandReply},
+	}); err != nil {
+		return &errorEvent{err}
+	}
+	reply, err := c.session.InteractionResponse(c.session.State.User.ID, i.Interaction)
+	if err != nil {
+		return &errorEvent{err}
+	}
+	return c.translateMessageEvent(&discordgo.MessageCreate{Message: &discordgo.Message{
+		ID:        reply.ID,
+		ChannelID: i.ChannelID,
+		Author:    &discordgo.User{ID: user},
+		Content:   message,
+	}})
+}
+
+// translateButtonEvent translates a click on one of the buttons sent by SendButtons into a buttonEvent. Clicks are
+// acknowledged right away, since Discord shows an error to the user otherwise.
+func (c *discordConn) translateButtonEvent(i *discordgo.InteractionCreate) event {
+	user := discordInteractionUser(i)
+	if user == "" || i.Message == nil {
+		return nil
+	}
+	if err := c.session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	}); err != nil {
+		log.Printf("Warning: cannot acknowledge button click: %s", err.Error())
+	}
+	return &buttonEvent{
+		Channel:   i.ChannelID,
+		MessageID: i.Message.ID,
+		User:      user,
+		Command:   i.MessageComponentData().CustomID,
+	}
+}
+
+// discordInteractionUser returns the ID of the user who triggered the interaction, which is only set in the member
+// field in servers, and in the user field in direct messages
+func discordInteractionUser(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	} else if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
+
+func (c *discordConn) slashCommandBoolField(name string, value bool) string {
+	switch name {
+	case recordCommand:
+		if value {
+			return recordCommand
+		}
+		return noRecordCommand
+	case webCommand:
+		if value {
+			return webCommand
+		}
+		return noWebCommand
+	}
+	return ""
+}
+
+func (c *discordConn) slashCommands() []*discordgo.ApplicationCommand {
+	scripts := c.config.Scripts()
+	sort.Strings(scripts)
+	if c.config.ShareEnabled() {
+		scripts = append(scripts, shareCommand)
+	}
+	scriptChoices := make([]*discordgo.ApplicationCommandOptionChoice, 0)
+	if len(scripts) <= discordMaxCommandChoices {
+		for _, script := range scripts {
+			scriptChoices = append(scriptChoices, &discordgo.ApplicationCommandOptionChoice{Name: script, Value: script})
+		}
+	}
+	options := []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "script",
+			Description: "REPL or shell to run",
+			Required:    true,
+			Choices:     scriptChoices,
+		},
+		discordStringOption("mode", "Where to run the session", string(config.Channel), string(config.Thread), string(config.Split)),
+		discordStringOption("size", "Terminal size", config.Tiny.Name, config.Small.Name, config.Medium.Name, config.Large.Name),
+		discordStringOption("window", "Window mode", string(config.Full), string(config.Trim)),
+		discordStringOption("auth", "Who can send commands", string(config.OnlyMe), string(config.Everyone)),
+		discordStringOption("color", "Keep or strip terminal colors", string(config.Color), string(config.NoColor)),
+		{
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        recordCommand,
+			Description: "Record the session",
+		},
+	}
+	if c.config.WebHost != "" {
+		options = append(options, &discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        webCommand,
+			Description: "Enable the web terminal",
+		})
+	}
+	return []*discordgo.ApplicationCommand{
+		{
+			Name:        discordSlashCommand,
+			Description: "Start a REPL session",
+			Options:     options,
+		},
+	}
+}
+
+func discordStringOption(name, description string, choices ...string) *discordgo.ApplicationCommandOption {
+	option := &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        name,
+		Description: description,
+		Choices:     make([]*discordgo.ApplicationCommandOptionChoice, 0),
+	}
+	for _, choice := range choices {
+		option.Choices = append(option.Choices, &discordgo.ApplicationCommandOptionChoice{Name: choice, Value: choice})
+	}
+	return option
+}
+
 func (c *discordConn) channel(channel string) (*discordgo.Channel, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -215,10 +568,62 @@ func (c *discordConn) maybeCreateThread(target *channelID) (string, error) {
 	if _, ok := c.channels[target.Thread]; ok {
 		return target.Thread, nil
 	}
-	ch, err := c.session.ThreadStartWithMessage(target.Channel, target.Thread, "REPLbot session", discordgo.ArchiveDurationOneHour)
+	ch, err := c.session.ThreadStartWithMessage(target.Channel, target.Thread, discordThreadName, discordgo.ArchiveDurationOneHour)
 	if err != nil {
 		return "", err
 	}
 	c.channels[target.Thread] = ch
 	return target.Thread, nil
 }
+
+// translateDiscordError translates Discord's server errors (HTTP 5xx) to a serverError, so they can be retried,
+// see retryConn, and errors for deleted channels or archived threads to errChannelGone. Rate limits are handled
+// by discordgo itself.
+func translateDiscordError(err error) error {
+	e, ok := err.(*discordgo.RESTError)
+	if !ok {
+		return err
+	} else if e.Response != nil && e.Response.StatusCode >= 500 {
+		return &serverError{StatusCode: e.Response.StatusCode, Message: string(e.ResponseBody)}
+	} else if e.Message != nil && (e.Message.Code == discordgo.ErrCodeUnknownChannel || e.Message.Code == discordErrCodeThreadArchived) {
+		return fmt.Errorf("%w: %s", errChannelGone, e.Message.Message)
+	}
+	return err
+}
+
+// discordButtonRows converts the buttons to rows of up to 5 Discord buttons each
+func discordButtonRows(buttons []*config.Button) []discordgo.MessageComponent {
+	rows := make([]discordgo.MessageComponent, 0)
+	for i := 0; i < len(buttons); i += discordButtonsPerRow {
+		row := discordgo.ActionsRow{Components: make([]discordgo.MessageComponent, 0)}
+		for j := i; j < len(buttons) && j < i+discordButtonsPerRow; j++ {
+			row.Components = append(row.Components, discordgo.Button{
+				Label:    truncateUTF8(buttons[j].Label, discordButtonLabelLimit),
+				Style:    discordgo.ButtonSecondary,
+				CustomID: truncateUTF8(buttons[j].Command, discordButtonCustomIDMax),
+			})
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// discordEmbed converts a status message to an embed, with the fields shown side by side, cropping all texts
+// to Discord's limits
+func discordEmbed(status *statusMessage) *discordgo.MessageEmbed {
+	fields := make([]*discordgo.MessageEmbedField, 0, len(status.Fields))
+	for _, field := range status.Fields {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   truncateUTF8(field.Name, discordEmbedFieldNameLimit),
+			Value:  truncateUTF8(field.Value, discordEmbedFieldValueLimit),
+			Inline: true,
+		})
+	}
+	return &discordgo.MessageEmbed{
+		Type:        discordgo.EmbedTypeRich,
+		Title:       truncateUTF8(status.Title, discordEmbedTitleLimit),
+		Description: truncateUTF8(status.Text, discordEmbedDescriptionLimit),
+		Color:       discordEmbedColors[status.State],
+		Fields:      fields,
+	}
+}
@@ -0,0 +1,28 @@
+package bot
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestDiscordEmbed(t *testing.T) {
+	embed := discordEmbed(&statusMessage{
+		Title: "🚀 bash",
+		Text:  "🚀 REPL session started, <@123>.",
+		Fields: []*statusField{
+			{Name: "Owner", Value: "<@123>"},
+			{Name: "Terminal size", Value: strings.Repeat("x", 2000)},
+		},
+		State: statusExited,
+	})
+	assert.Equal(t, discordgo.EmbedTypeRich, embed.Type)
+	assert.Equal(t, "🚀 bash", embed.Title)
+	assert.Equal(t, "🚀 REPL session started, <@123>.", embed.Description)
+	assert.Equal(t, 0x95a5a6, embed.Color)
+	assert.Equal(t, 2, len(embed.Fields))
+	assert.Equal(t, "Owner", embed.Fields[0].Name)
+	assert.True(t, embed.Fields[0].Inline)
+	assert.Equal(t, discordEmbedFieldValueLimit, len(embed.Fields[1].Value))
+}
@@ -0,0 +1,650 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"heckel.io/replbot/config"
+	"heckel.io/replbot/util"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	matrixMessageLengthLimit = 25000 // Events are limited to 64 KB, and we send every message twice (body and formatted_body)
+	matrixRetryInterval      = 5 * time.Second
+	matrixSyncTimeout        = 30 * time.Second
+	matrixPillPrefix         = "https://matrix.to/#/"
+	matrixSyncFilter         = `{"room":{"timeline":{"limit":50},"state":{"lazy_load_members":true}},"presence":{"types":[]}}`
+	matrixEncryptedMessage   = "🔒 I'm sorry, but I cannot read end-to-end encrypted messages, so I won't see anything you send in this room. " +
+		"Please talk to me in a room without encryption."
+)
+
+var (
+	matrixUserIDRegex      = regexp.MustCompile(`^@[a-z0-9._=\-/+]+:[a-zA-Z0-9.\-]*[a-zA-Z0-9](:\d+)?$`)
+	matrixPillRegex        = regexp.MustCompile(`<a href="https://matrix\.to/#/(@[^"]+)">[^<]*</a>`)
+	matrixReplyRegex       = regexp.MustCompile(`(?s)<mx-reply>.*?</mx-reply>`)
+	matrixBreakRegex       = regexp.MustCompile(`<br\s*/?>|</p>`)
+	matrixTagRegex         = regexp.MustCompile(`<[^>]+>`)
+	matrixCodeBlockRegex   = regexp.MustCompile("(?s)```(?:[a-z]+\n)?(.*?)```")
+	matrixCodeRegex        = regexp.MustCompile("`([^`\n]+)`")
+	matrixBoldRegex        = regexp.MustCompile(`(^|\s)\*([^*\n]+)\*`)
+	matrixItalicRegex      = regexp.MustCompile(`(^|\s)_([^_\n]+)_`)
+	matrixStrikeRegex      = regexp.MustCompile(`(^|\s)~([^~\n]+)~`)
+	matrixEscapedPillRegex = regexp.MustCompile(`https://matrix\.to/#/(@[a-z0-9._=\-/+]+:[a-zA-Z0-9.\-]*[a-zA-Z0-9](:\d+)?)`)
+)
+
+// matrixConn is an implementation of conn for Matrix, using the client-server API. Messages are received via
+// /sync long-polling, and sent as m.room.message events with both a plain text body (Markdown) and an HTML body.
+//
+// Rooms map onto channels, and threads (m.thread relations) map onto threads. Messages are updated by sending
+// an edit (m.replace relation). The bot joins all rooms it is invited to. End-to-end encryption is not supported:
+// if the bot is in an encrypted room, it tells the users and logs an error, instead of silently missing messages.
+type matrixConn struct {
+	config    *config.Config
+	client    *http.Client
+	userID    string
+	since     string
+	dmRooms   map[string]string // user ID -> DM room ID
+	direct    map[string]bool   // room ID -> true, if the room is a DM
+	encrypted map[string]bool   // room ID -> true, if the room is encrypted (and we've told the users)
+	txnID     int64
+	connected bool
+	mu        sync.RWMutex
+}
+
+type matrixSyncResponse struct {
+	NextBatch   string `json:"next_batch"`
+	AccountData struct {
+		Events []*matrixEvent `json:"events"`
+	} `json:"account_data"`
+	Rooms struct {
+		Join map[string]struct {
+			State struct {
+				Events []*matrixEvent `json:"events"`
+			} `json:"state"`
+			Timeline struct {
+				Events []*matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]struct {
+			InviteState struct {
+				Events []*matrixEvent `json:"events"`
+			} `json:"invite_state"`
+		} `json:"invite"`
+	} `json:"rooms"`
+}
+
+type matrixEvent struct {
+	ID       string          `json:"event_id"`
+	Type     string          `json:"type"`
+	Sender   string          `json:"sender"`
+	StateKey *string         `json:"state_key"`
+	Content  json.RawMessage `json:"content"`
+}
+
+type matrixMessageContent struct {
+	MsgType       string           `json:"msgtype"`
+	Body          string           `json:"body"`
+	Format        string           `json:"format"`
+	FormattedBody string           `json:"formatted_body"`
+	RelatesTo     *matrixRelatesTo `json:"m.relates_to"`
+	IsDirect      bool             `json:"is_direct"` // m.room.member only
+}
+
+type matrixRelatesTo struct {
+	RelType string `json:"rel_type"`
+	EventID string `json:"event_id"`
+	Key     string `json:"key"` // m.annotation only
+}
+
+type matrixError struct {
+	ErrCode      string `json:"errcode"`
+	Error        string `json:"error"`
+	RetryAfterMS int64  `json:"retry_after_ms"`
+}
+
+func newMatrixConn(conf *config.Config) *matrixConn {
+	return &matrixConn{
+		config:    conf,
+		client:    &http.Client{Timeout: matrixSyncTimeout + time.Minute},
+		dmRooms:   make(map[string]string),
+		direct:    make(map[string]bool),
+		encrypted: make(map[string]bool),
+	}
+}
+
+func (c *matrixConn) Connect(ctx context.Context) (<-chan event, error) {
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.request(ctx, http.MethodGet, "/account/whoami", nil, &whoami); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.userID = whoami.UserID
+	c.mu.Unlock()
+	if err := c.sync(ctx, nil); err != nil { // Initial sync, to skip old messages
+		return nil, err
+	}
+	log.Printf("Matrix connected as user %s", whoami.UserID)
+	eventChan := make(chan event)
+	go c.syncLoop(ctx, eventChan)
+	return eventChan, nil
+}
+
+func (c *matrixConn) Send(channel *channelID, message string) error {
+	_, err := c.SendWithID(channel, message)
+	return err
+}
+
+func (c *matrixConn) SendWithID(channel *channelID, message string) (string, error) {
+	content := c.messageContent("m.text", cropWindow(message, matrixMessageLengthLimit))
+	if channel.Thread != "" {
+		content["m.relates_to"] = map[string]interface{}{
+			"rel_type":        "m.thread",
+			"event_id":        channel.Thread,
+			"is_falling_back": true,
+			"m.in_reply_to":   map[string]string{"event_id": channel.Thread}, // For clients without thread support
+		}
+	}
+	return c.sendEvent(channel.Channel, "m.room.message", content)
+}
+
+func (c *matrixConn) SendEphemeral(_ *channelID, userID, message string) error {
+	return c.SendDM(userID, message) // Matrix does not have ephemeral messages
+}
+
+func (c *matrixConn) SendDM(userID string, message string) error {
+	roomID, err := c.dmRoom(userID)
+	if err != nil {
+		return err
+	}
+	return c.Send(&channelID{Channel: roomID}, message)
+}
+
+func (c *matrixConn) OpenDM(userID string) (string, error) {
+	return c.dmRoom(userID)
+}
+
+func (c *matrixConn) UploadFile(channel *channelID, message string, filename string, _ string, file io.Reader) error {
+	contents, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	if err := c.Send(channel, message); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.mediaURL("/upload?filename="+url.QueryEscape(filename)), bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	var response struct {
+		ContentURI string `json:"content_uri"`
+	}
+	if err := c.do(req, &response); err != nil {
+		return err
+	}
+	content := map[string]interface{}{
+		"msgtype": "m.file",
+		"body":    filename,
+		"url":     response.ContentURI,
+		"info":    map[string]interface{}{"size": len(contents)},
+	}
+	if channel.Thread != "" {
+		content["m.relates_to"] = map[string]interface{}{"rel_type": "m.thread", "event_id": channel.Thread}
+	}
+	_, err = c.sendEvent(channel.Channel, "m.room.message", content)
+	return err
+}
+
+func (c *matrixConn) Update(channel *channelID, id string, message string) error {
+	message = cropWindow(message, matrixMessageLengthLimit)
+	content := c.messageContent("m.text", "* "+message)
+	content["m.new_content"] = c.messageContent("m.text", message)
+	content["m.relates_to"] = map[string]string{
+		"rel_type": "m.replace",
+		"event_id": id,
+	}
+	_, err := c.sendEvent(channel.Channel, "m.room.message", content)
+	return err
+}
+
+func (c *matrixConn) Delete(_ *channelID, _ string) error {
+	return errDeleteNotSupported
+}
+
+func (c *matrixConn) React(_ *channelID, _ string, _ string) error {
+	return errReactNotSupported
+}
+
+func (c *matrixConn) Archive(_ *channelID) error {
+	return nil
+}
+
+// SetTitle sets the room topic. Threads do not have a title in Matrix.
+func (c *matrixConn) SendStatus(_ *channelID, _ *statusMessage) (string, error) {
+	return "", errStatusNotSupported
+}
+
+func (c *matrixConn) UpdateStatus(_ *channelID, _ string, _ *statusMessage) error {
+	return errStatusNotSupported
+}
+
+func (c *matrixConn) SendButtons(_ *channelID, _ string, _ []*config.Button) (string, error) {
+	return "", errButtonsNotSupported
+}
+
+func (c *matrixConn) SetTitle(channel *channelID, title string) error {
+	if channel.Thread != "" {
+		return errTitleNotSupported
+	}
+	path := fmt.Sprintf("/rooms/%s/state/m.room.topic", url.PathEscape(channel.Channel))
+	return c.request(context.Background(), http.MethodPut, path, map[string]string{"topic": title}, nil)
+}
+
+// Join joins a room by ID or alias, e.g. "#ops:example.com"
+func (c *matrixConn) Join(channel string) error {
+	path := fmt.Sprintf("/join/%s", url.PathEscape(channel))
+	return c.request(context.Background(), http.MethodPost, path, map[string]string{}, nil)
+}
+
+// Leave leaves a room; unlike Join, this requires a room ID, e.g. "!abc123:example.com"
+func (c *matrixConn) Leave(channel string) error {
+	path := fmt.Sprintf("/rooms/%s/leave", url.PathEscape(channel))
+	return c.request(context.Background(), http.MethodPost, path, map[string]string{}, nil)
+}
+
+func (c *matrixConn) Close() error {
+	return nil
+}
+
+func (c *matrixConn) MaxMessageLength() int {
+	return matrixMessageLengthLimit
+}
+
+func (c *matrixConn) SupportsANSI() bool {
+	return false
+}
+
+func (c *matrixConn) CollapseMode() collapseMode {
+	return collapseNone
+}
+
+// Format renders text using the common Markdown flavor, except for plain text, which is sent as is, because
+// backslash escapes are not removed when the message is converted to HTML, see matrixFormatHTML, and code blocks
+func (c *matrixConn) Format(text string, format messageFormat) string {
+	switch format {
+	case formatText:
+		return text
+	case formatCode, formatANSI:
+		return escapedCodeBlock(text, "") // Only three-backtick fences are converted to HTML, see matrixFormatHTML
+	}
+	return renderMarkdown(text, format)
+}
+
+func (c *matrixConn) Connected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected
+}
+
+func (c *matrixConn) MentionBot() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return matrixPillPrefix + c.userID
+}
+
+func (c *matrixConn) Mention(user string) string {
+	return matrixPillPrefix + user
+}
+
+// ParseMention parses a user ID (e.g. @phil:example.com), or a pill (https://matrix.to/#/@phil:example.com)
+func (c *matrixConn) ParseMention(user string) (string, error) {
+	user = strings.TrimPrefix(user, matrixPillPrefix)
+	if !matrixUserIDRegex.MatchString(user) {
+		return "", errors.New("invalid user")
+	}
+	return user, nil
+}
+
+// Unescape removes the bot mention. Formatting is already removed when the event is translated, see messageText.
+func (c *matrixConn) Unescape(s string) string {
+	return strings.ReplaceAll(s, c.MentionBot(), "")
+}
+
+func (c *matrixConn) syncLoop(ctx context.Context, eventChan chan event) {
+	for {
+		err := c.sync(ctx, eventChan)
+		if ctx.Err() != nil {
+			return
+		} else if err == nil {
+			continue
+		}
+		log.Printf("Error: Matrix sync failed: %s", err.Error())
+		c.mu.Lock()
+		c.connected = false
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(matrixRetryInterval):
+		}
+	}
+}
+
+// sync performs one /sync request and forwards the received events. If eventChan is nil (initial sync),
+// messages are not forwarded, but invites and encrypted rooms are still handled.
+func (c *matrixConn) sync(ctx context.Context, eventChan chan event) error {
+	c.mu.RLock()
+	since := c.since
+	c.mu.RUnlock()
+	params := url.Values{}
+	params.Set("filter", matrixSyncFilter)
+	if since != "" {
+		params.Set("since", since)
+		params.Set("timeout", fmt.Sprintf("%d", matrixSyncTimeout.Milliseconds()))
+	}
+	var response matrixSyncResponse
+	if err := c.request(ctx, http.MethodGet, "/sync?"+params.Encode(), nil, &response); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.since = response.NextBatch
+	c.connected = true
+	c.mu.Unlock()
+	for _, ev := range response.AccountData.Events {
+		if ev.Type == "m.direct" {
+			c.handleDirectEvent(ev)
+		}
+	}
+	for roomID, room := range response.Rooms.Invite {
+		c.handleInvite(ctx, roomID, room.InviteState.Events)
+	}
+	for roomID, room := range response.Rooms.Join {
+		for _, ev := range append(room.State.Events, room.Timeline.Events...) {
+			if ev.Type == "m.room.encryption" || ev.Type == "m.room.encrypted" {
+				c.handleEncryptedRoom(roomID)
+			}
+		}
+		if eventChan == nil {
+			continue
+		}
+		for _, ev := range room.Timeline.Events {
+			if e := c.translateEvent(roomID, ev); e != nil {
+				select {
+				case eventChan <- e:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *matrixConn) translateEvent(roomID string, ev *matrixEvent) event {
+	c.mu.RLock()
+	userID, direct := c.userID, c.direct[roomID]
+	c.mu.RUnlock()
+	if ev.Sender == userID {
+		return nil // Ignore my own events
+	}
+	var content matrixMessageContent
+	if err := json.Unmarshal(ev.Content, &content); err != nil {
+		return &errorEvent{err}
+	}
+	switch ev.Type {
+	case "m.reaction":
+		if content.RelatesTo == nil || content.RelatesTo.RelType != "m.annotation" {
+			return nil
+		}
+		return &reactionEvent{
+			Channel:   roomID,
+			MessageID: content.RelatesTo.EventID,
+			User:      ev.Sender,
+			Reaction:  content.RelatesTo.Key,
+		}
+	case "m.room.message":
+		if content.MsgType != "m.text" || (content.RelatesTo != nil && content.RelatesTo.RelType == "m.replace") {
+			return nil // Ignore notices, files and edits
+		}
+		var thread string
+		if content.RelatesTo != nil && content.RelatesTo.RelType == "m.thread" {
+			thread = content.RelatesTo.EventID
+		}
+		chType := channelTypeChannel
+		if direct {
+			chType = channelTypeDM
+		}
+		return &messageEvent{
+			ID:          ev.ID,
+			Channel:     roomID,
+			ChannelType: chType,
+			Thread:      thread,
+			User:        ev.Sender,
+			Message:     c.messageText(&content),
+		}
+	}
+	return nil
+}
+
+// messageText returns the plain text of a message. If the message has an HTML body, mentions (pills) are
+// translated to their matrix.to link (see MentionBot), and all other formatting is removed. Otherwise, the
+// bot's user ID is translated to its matrix.to link, so that users can mention the bot by typing its ID.
+func (c *matrixConn) messageText(content *matrixMessageContent) string {
+	if content.Format == "org.matrix.custom.html" && content.FormattedBody != "" {
+		s := matrixReplyRegex.ReplaceAllString(content.FormattedBody, "")
+		s = matrixPillRegex.ReplaceAllString(s, matrixPillPrefix+"$1")
+		s = matrixBreakRegex.ReplaceAllString(s, "\n")
+		s = matrixTagRegex.ReplaceAllString(s, "")
+		return strings.TrimSpace(html.UnescapeString(s))
+	}
+	c.mu.RLock()
+	userID := c.userID
+	c.mu.RUnlock()
+	s := strings.ReplaceAll(content.Body, matrixPillPrefix+userID, userID)
+	return strings.ReplaceAll(s, userID, matrixPillPrefix+userID)
+}
+
+// messageContent creates the content of an m.room.message event, with the message as plain text (Markdown)
+// and as HTML, see formatHTML
+func (c *matrixConn) messageContent(msgType, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"msgtype":        msgType,
+		"body":           message,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": matrixFormatHTML(message),
+	}
+}
+
+func (c *matrixConn) handleDirectEvent(ev *matrixEvent) {
+	var direct map[string][]string // user ID -> room IDs
+	if err := json.Unmarshal(ev.Content, &direct); err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for userID, roomIDs := range direct {
+		for _, roomID := range roomIDs {
+			c.direct[roomID] = true
+			c.dmRooms[userID] = roomID
+		}
+	}
+}
+
+// handleInvite joins the room the bot was invited to, and remembers if it is a DM
+func (c *matrixConn) handleInvite(ctx context.Context, roomID string, events []*matrixEvent) {
+	c.mu.RLock()
+	userID := c.userID
+	c.mu.RUnlock()
+	for _, ev := range events {
+		var content matrixMessageContent
+		if ev.Type != "m.room.member" || ev.StateKey == nil || *ev.StateKey != userID || json.Unmarshal(ev.Content, &content) != nil {
+			continue
+		}
+		if content.IsDirect {
+			c.mu.Lock()
+			c.direct[roomID] = true
+			c.dmRooms[ev.Sender] = roomID
+			c.mu.Unlock()
+		}
+	}
+	if err := c.request(ctx, http.MethodPost, fmt.Sprintf("/rooms/%s/join", url.PathEscape(roomID)), map[string]string{}, nil); err != nil {
+		log.Printf("Error: cannot join Matrix room %s: %s", roomID, err.Error())
+	}
+}
+
+// handleEncryptedRoom tells the users of an end-to-end encrypted room (once) that the bot cannot read their messages
+func (c *matrixConn) handleEncryptedRoom(roomID string) {
+	c.mu.Lock()
+	warned := c.encrypted[roomID]
+	c.encrypted[roomID] = true
+	c.mu.Unlock()
+	if warned {
+		return
+	}
+	log.Printf("Error: Matrix room %s is end-to-end encrypted, which is not supported; messages in this room cannot be read", roomID)
+	if _, err := c.sendEvent(roomID, "m.room.message", c.messageContent("m.notice", matrixEncryptedMessage)); err != nil {
+		log.Printf("Error: cannot send message to Matrix room %s: %s", roomID, err.Error())
+	}
+}
+
+func (c *matrixConn) dmRoom(userID string) (string, error) {
+	c.mu.RLock()
+	roomID, ok := c.dmRooms[userID]
+	c.mu.RUnlock()
+	if ok {
+		return roomID, nil
+	}
+	request := map[string]interface{}{
+		"is_direct": true,
+		"invite":    []string{userID},
+		"preset":    "trusted_private_chat",
+	}
+	var response struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := c.request(context.Background(), http.MethodPost, "/createRoom", request, &response); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.dmRooms[userID] = response.RoomID
+	c.direct[response.RoomID] = true
+	c.mu.Unlock()
+	return response.RoomID, nil
+}
+
+func (c *matrixConn) sendEvent(roomID, eventType string, content interface{}) (string, error) {
+	txnID := fmt.Sprintf("replbot_%s_%d", util.RandomString(5), atomic.AddInt64(&c.txnID, 1))
+	path := fmt.Sprintf("/rooms/%s/send/%s/%s", url.PathEscape(roomID), eventType, txnID)
+	var response struct {
+		EventID string `json:"event_id"`
+	}
+	if err := c.request(context.Background(), http.MethodPut, path, content, &response); err != nil {
+		return "", err
+	}
+	return response.EventID, nil
+}
+
+func (c *matrixConn) request(ctx context.Context, method, path string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL(path), reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.do(req, v)
+}
+
+func (c *matrixConn) do(req *http.Request, v interface{}) error {
+	req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 500 {
+		return &serverError{StatusCode: resp.StatusCode, Message: string(body)}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e matrixError
+		if err := json.Unmarshal(body, &e); err != nil {
+			return fmt.Errorf("unexpected response from Matrix (HTTP %d): %s", resp.StatusCode, err.Error())
+		} else if resp.StatusCode == http.StatusTooManyRequests && e.RetryAfterMS > 0 {
+			return &rateLimitedError{RetryAfter: time.Duration(e.RetryAfterMS) * time.Millisecond}
+		} else if resp.StatusCode == http.StatusTooManyRequests {
+			return newRateLimitedError(resp)
+		}
+		return fmt.Errorf("matrix error (HTTP %d): %s %s", resp.StatusCode, e.ErrCode, e.Error)
+	} else if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (c *matrixConn) apiURL(path string) string {
+	return strings.TrimSuffix(c.config.MatrixHomeserver, "/") + "/_matrix/client/v3" + path
+}
+
+func (c *matrixConn) mediaURL(path string) string {
+	return strings.TrimSuffix(c.config.MatrixHomeserver, "/") + "/_matrix/media/v3" + path
+}
+
+// matrixFormatHTML converts the Markdown subset used in REPLbot's messages (code blocks, inline code, bold,
+// italic, strikethrough) to HTML, and turns matrix.to links into mentions (pills)
+func matrixFormatHTML(message string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range matrixCodeBlockRegex.FindAllStringSubmatchIndex(message, -1) {
+		b.WriteString(matrixFormatInlineHTML(message[last:m[0]]))
+		b.WriteString("<pre><code>" + html.EscapeString(message[m[2]:m[3]]) + "</code></pre>")
+		last = m[1]
+	}
+	b.WriteString(matrixFormatInlineHTML(message[last:]))
+	return b.String()
+}
+
+func matrixFormatInlineHTML(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range matrixCodeRegex.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(matrixFormatTextHTML(s[last:m[0]]))
+		b.WriteString("<code>" + html.EscapeString(s[m[2]:m[3]]) + "</code>")
+		last = m[1]
+	}
+	b.WriteString(matrixFormatTextHTML(s[last:]))
+	return b.String()
+}
+
+func matrixFormatTextHTML(s string) string {
+	s = html.EscapeString(s)
+	s = matrixBoldRegex.ReplaceAllString(s, "$1<strong>$2</strong>")
+	s = matrixItalicRegex.ReplaceAllString(s, "$1<em>$2</em>")
+	s = matrixStrikeRegex.ReplaceAllString(s, "$1<del>$2</del>")
+	s = matrixEscapedPillRegex.ReplaceAllString(s, `<a href="https://matrix.to/#/$1">$1</a>`)
+	return strings.ReplaceAll(s, "\n", "<br>")
+}
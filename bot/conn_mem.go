@@ -3,6 +3,7 @@ package bot
 import (
 	"context"
 	"errors"
+	"fmt"
 	"heckel.io/replbot/config"
 	"heckel.io/replbot/util"
 	"io"
@@ -13,10 +14,15 @@ import (
 	"time"
 )
 
-const maxMessageWaitTime = 5 * time.Second
+const (
+	maxMessageWaitTime     = 5 * time.Second
+	memMessageLengthLimit  = 100000
+	memRateLimitRetryAfter = 300 * time.Millisecond
+)
 
 var (
 	memUserMentionRegex = regexp.MustCompile(`@(\S+)`)
+	memChannelRegex     = regexp.MustCompile(`^#\S+$`)
 )
 
 // memConn is an implementation of conn specifically used for testing
@@ -25,6 +31,13 @@ type memConn struct {
 	eventChan chan event
 	messages  map[string]*messageEvent
 	currentID int
+	joined    map[string]bool   // channels joined via Join
+	reactions map[string]string // message ID -> emoji, see React
+	limited   int               // number of SendWithID/Update calls to reject, see RateLimit
+	failing   int               // number of Connect calls to reject, see FailConnect
+	connects  int               // number of successful Connect calls
+	collapse  collapseMode      // see CollapseMode
+	buttons   bool              // true if SendButtons is supported, see EnableButtons
 	mu        sync.RWMutex
 }
 
@@ -33,11 +46,20 @@ func newMemConn(conf *config.Config) *memConn {
 		config:    conf,
 		eventChan: make(chan event),
 		messages:  make(map[string]*messageEvent),
+		joined:    make(map[string]bool),
+		reactions: make(map[string]string),
 		currentID: 0,
 	}
 }
 
 func (c *memConn) Connect(ctx context.Context) (<-chan event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failing > 0 {
+		c.failing--
+		return nil, errors.New("connection refused")
+	}
+	c.connects++
 	return c.eventChan, nil
 }
 
@@ -57,6 +79,10 @@ func (c *memConn) Send(channel *channelID, message string) error {
 func (c *memConn) SendWithID(channel *channelID, message string) (string, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.limited > 0 {
+		c.limited--
+		return "", &rateLimitedError{RetryAfter: memRateLimitRetryAfter}
+	}
 	c.currentID++
 	c.messages[strconv.Itoa(c.currentID)] = &messageEvent{
 		ID:      strconv.Itoa(c.currentID),
@@ -84,6 +110,10 @@ func (c *memConn) SendDM(userID string, message string) error {
 	return nil
 }
 
+func (c *memConn) OpenDM(userID string) (string, error) {
+	return userID, nil // Same as SendDM
+}
+
 func (c *memConn) UploadFile(channel *channelID, message string, filename string, filetype string, file io.Reader) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -105,6 +135,10 @@ func (c *memConn) UploadFile(channel *channelID, message string, filename string
 func (c *memConn) Update(channel *channelID, id string, message string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.limited > 0 {
+		c.limited--
+		return &rateLimitedError{RetryAfter: memRateLimitRetryAfter}
+	}
 	c.messages[id] = &messageEvent{
 		ID:      id,
 		Channel: channel.Channel,
@@ -114,14 +148,97 @@ func (c *memConn) Update(channel *channelID, id string, message string) error {
 	return nil
 }
 
+func (c *memConn) Delete(_ *channelID, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.messages[id]; !ok {
+		return errors.New("message_not_found")
+	}
+	delete(c.messages, id)
+	return nil
+}
+
+func (c *memConn) React(_ *channelID, id string, emoji string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reactions[id] = emoji
+	return nil
+}
+
 func (c *memConn) Archive(_ *channelID) error {
 	return nil
 }
 
+func (c *memConn) SendStatus(_ *channelID, _ *statusMessage) (string, error) {
+	return "", errStatusNotSupported
+}
+
+// SendButtons sends the message, followed by the button labels, e.g. "Controls [Ctrl-C] [Exit]"
+func (c *memConn) SendButtons(channel *channelID, message string, buttons []*config.Button) (string, error) {
+	c.mu.RLock()
+	enabled := c.buttons
+	c.mu.RUnlock()
+	if !enabled {
+		return "", errButtonsNotSupported
+	}
+	for _, button := range buttons {
+		message += fmt.Sprintf(" [%s]", button.Label)
+	}
+	return c.SendWithID(channel, message)
+}
+
+func (c *memConn) UpdateStatus(_ *channelID, _ string, _ *statusMessage) error {
+	return errStatusNotSupported
+}
+
+func (c *memConn) SetTitle(_ *channelID, _ string) error {
+	return errTitleNotSupported
+}
+
+func (c *memConn) Join(channel string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !memChannelRegex.MatchString(channel) {
+		return errors.New("channel not found")
+	}
+	c.joined[channel] = true
+	return nil
+}
+
+func (c *memConn) Leave(channel string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.joined[channel] {
+		return errors.New("not in channel")
+	}
+	delete(c.joined, channel)
+	return nil
+}
+
 func (c *memConn) Close() error {
 	return nil
 }
 
+func (c *memConn) MaxMessageLength() int {
+	return memMessageLengthLimit
+}
+
+func (c *memConn) SupportsANSI() bool {
+	return false
+}
+
+func (c *memConn) CollapseMode() collapseMode {
+	return c.collapse
+}
+
+func (c *memConn) Format(text string, format messageFormat) string {
+	return renderMarkdown(text, format)
+}
+
+func (c *memConn) Connected() bool {
+	return true
+}
+
 func (c *memConn) MentionBot() string {
 	return "@replbot"
 }
@@ -145,6 +262,47 @@ func (c *memConn) Event(ev event) {
 	c.eventChan <- ev
 }
 
+// RateLimit simulates a slow, rate-limited chat platform by rejecting the next n SendWithID/Update calls
+func (c *memConn) RateLimit(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limited = n
+}
+
+// EnableButtons makes SendButtons succeed; it fails by default, so that most tests don't have to account for the
+// extra message
+func (c *memConn) EnableButtons() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buttons = true
+}
+
+// FailConnect makes the next n calls to Connect fail, e.g. to test reconnects
+func (c *memConn) FailConnect(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failing = n
+}
+
+// Connects returns the number of successful calls to Connect
+func (c *memConn) Connects() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connects
+}
+
+// ReactionWait waits until a reaction was added to the given message, and returns it, or an empty string
+// if there was none
+func (c *memConn) ReactionWait(id string) (emoji string) {
+	util.WaitUntil(func() bool {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		emoji = c.reactions[id]
+		return emoji != ""
+	}, maxMessageWaitTime)
+	return
+}
+
 func (c *memConn) Message(id string) *messageEvent {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -0,0 +1,121 @@
+package bot
+
+import (
+	"errors"
+	"heckel.io/replbot/config"
+	"log"
+	"time"
+)
+
+const (
+	// sendRetryMaxBackoff is the max time retryConn waits between two attempts, unless the platform asks for more
+	sendRetryMaxBackoff = 10 * time.Second
+)
+
+// sendFailedError is returned by retryConn if a message could not be sent, either because the error was
+// permanent (see isRetryable), or because all retries failed
+type sendFailedError struct {
+	err error
+}
+
+func (e *sendFailedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sendFailedError) Unwrap() error {
+	return e.err
+}
+
+// retryConn wraps a conn, and retries sending and updating messages if the platform fails with a temporary
+// error (see isRetryable), waiting with a bounded exponential backoff in between. Permanent errors are not
+// retried. Errors that could not be recovered from are returned as sendFailedError.
+//
+// Terminal updates are not retried if the platform rate-limits us, because the next update supersedes them
+// anyway. Sessions skip updates while rate-limited instead, see session.maybeBackOff.
+type retryConn struct {
+	conn
+	retries int
+	backoff time.Duration
+}
+
+func newRetryConn(conn conn, retries int, backoff time.Duration) *retryConn {
+	return &retryConn{
+		conn:    conn,
+		retries: retries,
+		backoff: backoff,
+	}
+}
+
+func (c *retryConn) Send(channel *channelID, message string) error {
+	return c.retry(true, func() error {
+		return c.conn.Send(channel, message)
+	})
+}
+
+func (c *retryConn) SendWithID(channel *channelID, message string) (id string, err error) {
+	err = c.retry(true, func() (err error) {
+		id, err = c.conn.SendWithID(channel, message)
+		return err
+	})
+	return
+}
+
+func (c *retryConn) Update(channel *channelID, id string, message string) error {
+	return c.retry(false, func() error {
+		return c.conn.Update(channel, id, message)
+	})
+}
+
+func (c *retryConn) Delete(channel *channelID, id string) error {
+	return c.retry(true, func() error {
+		return c.conn.Delete(channel, id)
+	})
+}
+
+func (c *retryConn) SendStatus(channel *channelID, status *statusMessage) (id string, err error) {
+	err = c.retry(true, func() (err error) {
+		id, err = c.conn.SendStatus(channel, status)
+		return err
+	})
+	return
+}
+
+func (c *retryConn) SendButtons(channel *channelID, message string, buttons []*config.Button) (id string, err error) {
+	err = c.retry(true, func() (err error) {
+		id, err = c.conn.SendButtons(channel, message, buttons)
+		return err
+	})
+	return
+}
+
+func (c *retryConn) UpdateStatus(channel *channelID, id string, status *statusMessage) error {
+	return c.retry(false, func() error {
+		return c.conn.UpdateStatus(channel, id, status)
+	})
+}
+
+func (c *retryConn) retry(retryRateLimits bool, fn func() error) error {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		var rateLimited *rateLimitedError
+		retryable, wait := isRetryable(err)
+		if errors.As(err, &rateLimited) && !retryRateLimits {
+			return err
+		} else if !retryable || attempt >= c.retries {
+			return &sendFailedError{err: err}
+		}
+		if wait < backoff {
+			wait = backoff
+		}
+		log.Printf("error: %s; retrying in %s (attempt %d of %d)", err.Error(), wait, attempt+1, c.retries)
+		time.Sleep(wait)
+		backoff *= 2
+		if backoff > sendRetryMaxBackoff {
+			backoff = sendRetryMaxBackoff
+		}
+	}
+}
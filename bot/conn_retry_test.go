@@ -0,0 +1,128 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"heckel.io/replbot/config"
+	"heckel.io/replbot/util"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyConn is a memConn that fails the next Send calls with the given errors, one error per call
+type flakyConn struct {
+	*memConn
+	errs  []error
+	calls int
+	mu    sync.Mutex
+}
+
+func (c *flakyConn) Fail(errs ...error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, errs...)
+}
+
+func (c *flakyConn) Send(channel *channelID, message string) error {
+	c.mu.Lock()
+	c.calls++
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		c.mu.Unlock()
+		return err
+	}
+	c.mu.Unlock()
+	return c.memConn.Send(channel, message)
+}
+
+func TestRetryConnRetriesTemporaryErrors(t *testing.T) {
+	flaky := &flakyConn{
+		memConn: newMemConn(config.New("mem")),
+		errs:    []error{&serverError{StatusCode: 502, Message: "bad gateway"}, &rateLimitedError{}},
+	}
+	conn := newRetryConn(flaky, 3, time.Millisecond)
+	assert.Nil(t, conn.Send(&channelID{"channel", ""}, "hi there"))
+	assert.Equal(t, 3, flaky.calls)
+	assert.True(t, flaky.MessageContainsWait("1", "hi there"))
+}
+
+func TestRetryConnGivesUpAfterRetries(t *testing.T) {
+	serverErr := &serverError{StatusCode: 503, Message: "unavailable"}
+	flaky := &flakyConn{
+		memConn: newMemConn(config.New("mem")),
+		errs:    []error{serverErr, serverErr, serverErr},
+	}
+	conn := newRetryConn(flaky, 2, time.Millisecond)
+	err := conn.Send(&channelID{"channel", ""}, "hi there")
+	var sendErr *sendFailedError
+	assert.True(t, errors.As(err, &sendErr))
+	assert.Equal(t, serverErr, sendErr.err)
+	assert.Equal(t, 3, flaky.calls)
+}
+
+func TestRetryConnDoesNotRetryPermanentErrors(t *testing.T) {
+	flaky := &flakyConn{
+		memConn: newMemConn(config.New("mem")),
+		errs:    []error{errors.New("channel_not_found"), &serverError{StatusCode: 500}},
+	}
+	conn := newRetryConn(flaky, 3, time.Millisecond)
+	assert.Error(t, conn.Send(&channelID{"channel", ""}, "hi there"))
+	assert.Equal(t, 1, flaky.calls)
+}
+
+func TestIsRetryable(t *testing.T) {
+	retryable, wait := isRetryable(&rateLimitedError{RetryAfter: time.Second})
+	assert.True(t, retryable)
+	assert.Equal(t, time.Second+additionalRateLimitDuration, wait)
+	retryable, _ = isRetryable(&serverError{StatusCode: 500})
+	assert.True(t, retryable)
+	retryable, _ = isRetryable(&sendFailedError{err: &serverError{StatusCode: 500}})
+	assert.True(t, retryable)
+	retryable, _ = isRetryable(errors.New("invalid_auth"))
+	assert.False(t, retryable)
+	retryable, _ = isRetryable(nil)
+	assert.False(t, retryable)
+}
+
+func TestSessionClosedIfSendFails(t *testing.T) {
+	conf := createConfig(t)
+	conf.SendRetryBackoff = time.Millisecond
+	conn := newMemConn(conf)
+	flaky := &flakyConn{memConn: conn}
+	sess := createSessionWithConn(t, "bash", conf, flaky)
+	defer sess.ForceClose()
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	flaky.Fail(errors.New("channel_not_found"))
+	sess.UserInput("phil", "!info") // Sending the info message fails permanently
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+	assert.True(t, conn.MessageContainsWait("3", "REPL session closed, because I could not send messages here: channel_not_found"))
+}
+
+func TestSessionClosedIfChannelGone(t *testing.T) {
+	conf := createConfig(t)
+	conn := newMemConn(conf)
+	flaky := &flakyConn{memConn: conn}
+	sess := createSessionWithConn(t, "bash", conf, flaky)
+	defer sess.ForceClose()
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	flaky.Fail(fmt.Errorf("%w: channel_not_found", errChannelGone))
+	sess.UserInput("phil", "!info")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+	assert.Equal(t, 1, flaky.calls) // Not retried, and no exit message
+	assert.Nil(t, conn.Message("3"))
+}
+
+func TestRetryConnStatusNotSupported(t *testing.T) {
+	mem := newMemConn(config.New("mem"))
+	conn := newRetryConn(mem, 3, time.Millisecond)
+	_, err := conn.SendStatus(&channelID{"channel", ""}, &statusMessage{Title: "title", Text: "text"})
+	assert.True(t, errors.Is(err, errStatusNotSupported)) // Not retried, so that the session can fall back to text
+	assert.True(t, errors.Is(conn.UpdateStatus(&channelID{"channel", ""}, "1", &statusMessage{}), errStatusNotSupported))
+}
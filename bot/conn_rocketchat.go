@@ -0,0 +1,655 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"heckel.io/replbot/config"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rocketChatMessageLengthLimit = 5000 // Default of the "Message_MaxAllowedSize" server setting
+	rocketChatRetryInterval      = 5 * time.Second
+	rocketChatReadTimeout        = time.Minute // Server pings every ~30s, so this detects dead connections
+	rocketChatSeenMessagesMax    = 1000
+	rocketChatLoginID            = "login"
+	rocketChatSubscribeID        = "sub"
+)
+
+var (
+	rocketChatUserMentionRegex = regexp.MustCompile(`@([a-zA-Z0-9_.-]+)`)
+	rocketChatCodeBlockRegex   = regexp.MustCompile("```([^`]+)```")
+	rocketChatCodeRegex        = regexp.MustCompile("`([^`]+)`")
+)
+
+// rocketChatConn is an implementation of conn for Rocket.Chat, using the Realtime API (DDP over WebSocket)
+// to receive messages, and the REST API to send them.
+//
+// Rooms map onto channels, and threads map onto threads (the "tmid" field of a message). Rocket.Chat streams
+// a message again every time it changes (edits, reactions, thread replies, link previews, ...), so we keep track
+// of the messages we've already seen to only forward new ones. Reactions are detected by comparing the reactions
+// of the bot's own messages to the ones we've seen before.
+type rocketChatConn struct {
+	config    *config.Config
+	client    *http.Client
+	userID    string
+	name      string
+	usernames map[string]string          // user ID -> username
+	userIDs   map[string]string          // username -> user ID
+	seen      map[string]bool            // message ID -> true, see rocketChatSeenMessagesMax
+	seenOrder []string                   // order of seen message IDs, to expire old ones
+	reactions map[string]map[string]bool // message ID -> "reaction|username" -> true
+	dmRooms   map[string]string          // user ID -> DM room ID
+	ws        *websocket.Conn
+	connected bool
+	mu        sync.RWMutex
+}
+
+type rocketChatDDPMessage struct {
+	Msg        string               `json:"msg"`
+	ID         string               `json:"id,omitempty"`
+	Collection string               `json:"collection,omitempty"`
+	Fields     *rocketChatDDPFields `json:"fields,omitempty"`
+	Error      *rocketChatDDPError  `json:"error,omitempty"`
+	Method     string               `json:"method,omitempty"`
+	Name       string               `json:"name,omitempty"`
+	Params     []interface{}        `json:"params,omitempty"`
+	Version    string               `json:"version,omitempty"`
+	Support    []string             `json:"support,omitempty"`
+	Reason     string               `json:"reason,omitempty"`
+}
+
+type rocketChatDDPFields struct {
+	EventName string            `json:"eventName"`
+	Args      []json.RawMessage `json:"args"`
+}
+
+type rocketChatDDPError struct {
+	Error   interface{} `json:"error"`
+	Reason  string      `json:"reason"`
+	Message string      `json:"message"`
+}
+
+type rocketChatUser struct {
+	ID       string `json:"_id"`
+	Username string `json:"username"`
+}
+
+type rocketChatMessage struct {
+	ID        string                             `json:"_id"`
+	RoomID    string                             `json:"rid"`
+	Msg       string                             `json:"msg"`
+	ThreadID  string                             `json:"tmid"`
+	Type      string                             `json:"t"` // Set for system messages only
+	User      rocketChatUser                     `json:"u"`
+	Mentions  []rocketChatUser                   `json:"mentions"`
+	Reactions map[string]rocketChatReactionUsers `json:"reactions"`
+}
+
+type rocketChatReactionUsers struct {
+	Usernames []string `json:"usernames"`
+}
+
+type rocketChatRoomInfo struct {
+	RoomType string `json:"roomType"`
+}
+
+func newRocketChatConn(conf *config.Config) *rocketChatConn {
+	return &rocketChatConn{
+		config:    conf,
+		client:    &http.Client{},
+		usernames: make(map[string]string),
+		userIDs:   make(map[string]string),
+		seen:      make(map[string]bool),
+		seenOrder: make([]string, 0),
+		reactions: make(map[string]map[string]bool),
+		dmRooms:   make(map[string]string),
+	}
+}
+
+func (c *rocketChatConn) Connect(ctx context.Context) (<-chan event, error) {
+	var me rocketChatUser
+	if err := c.request(ctx, http.MethodGet, "/me", nil, &me); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.userID = me.ID
+	c.name = me.Username
+	c.mu.Unlock()
+	c.rememberUser(me.ID, me.Username)
+	ws, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Rocket.Chat connected as user %s/%s", me.Username, me.ID)
+	eventChan := make(chan event)
+	go c.eventLoop(ctx, ws, eventChan)
+	return eventChan, nil
+}
+
+func (c *rocketChatConn) Send(channel *channelID, message string) error {
+	_, err := c.SendWithID(channel, message)
+	return err
+}
+
+func (c *rocketChatConn) SendWithID(channel *channelID, message string) (string, error) {
+	m := map[string]string{
+		"rid": channel.Channel,
+		"msg": cropWindow(message, rocketChatMessageLengthLimit),
+	}
+	if channel.Thread != "" {
+		m["tmid"] = channel.Thread
+	}
+	request := map[string]interface{}{"message": m}
+	var response struct {
+		Message rocketChatMessage `json:"message"`
+	}
+	if err := c.request(context.Background(), http.MethodPost, "/chat.sendMessage", request, &response); err != nil {
+		return "", err
+	}
+	return response.Message.ID, nil
+}
+
+func (c *rocketChatConn) SendEphemeral(_ *channelID, userID, message string) error {
+	return c.SendDM(userID, message) // Rocket.Chat does not support ephemeral messages via the REST API
+}
+
+func (c *rocketChatConn) SendDM(userID string, message string) error {
+	roomID, err := c.dmRoom(userID)
+	if err != nil {
+		return err
+	}
+	return c.Send(&channelID{Channel: roomID}, message)
+}
+
+func (c *rocketChatConn) OpenDM(userID string) (string, error) {
+	return c.dmRoom(userID)
+}
+
+func (c *rocketChatConn) UploadFile(channel *channelID, message string, filename string, _ string, file io.Reader) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	w, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		return err
+	}
+	if err := mw.WriteField("msg", message); err != nil {
+		return err
+	}
+	if channel.Thread != "" {
+		if err := mw.WriteField("tmid", channel.Thread); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.apiURL("/rooms.upload/"+url.PathEscape(channel.Channel)), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.do(req, nil)
+}
+
+func (c *rocketChatConn) Update(channel *channelID, id string, message string) error {
+	request := map[string]string{
+		"roomId": channel.Channel,
+		"msgId":  id,
+		"text":   cropWindow(message, rocketChatMessageLengthLimit),
+	}
+	return c.request(context.Background(), http.MethodPost, "/chat.update", request, nil)
+}
+
+func (c *rocketChatConn) Delete(_ *channelID, _ string) error {
+	return errDeleteNotSupported
+}
+
+func (c *rocketChatConn) React(_ *channelID, _ string, _ string) error {
+	return errReactNotSupported
+}
+
+func (c *rocketChatConn) Archive(_ *channelID) error {
+	return nil
+}
+
+func (c *rocketChatConn) SendStatus(_ *channelID, _ *statusMessage) (string, error) {
+	return "", errStatusNotSupported
+}
+
+func (c *rocketChatConn) UpdateStatus(_ *channelID, _ string, _ *statusMessage) error {
+	return errStatusNotSupported
+}
+
+func (c *rocketChatConn) SendButtons(_ *channelID, _ string, _ []*config.Button) (string, error) {
+	return "", errButtonsNotSupported
+}
+
+func (c *rocketChatConn) SetTitle(_ *channelID, _ string) error {
+	return errTitleNotSupported
+}
+
+func (c *rocketChatConn) Join(_ string) error {
+	return errJoinNotSupported
+}
+
+func (c *rocketChatConn) Leave(_ string) error {
+	return errJoinNotSupported
+}
+
+func (c *rocketChatConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ws == nil {
+		return nil
+	}
+	err := c.ws.Close()
+	c.ws = nil
+	return err
+}
+
+func (c *rocketChatConn) MaxMessageLength() int {
+	return rocketChatMessageLengthLimit
+}
+
+func (c *rocketChatConn) SupportsANSI() bool {
+	return false
+}
+
+func (c *rocketChatConn) CollapseMode() collapseMode {
+	return collapseNone
+}
+
+func (c *rocketChatConn) Format(text string, format messageFormat) string {
+	return renderMarkdown(text, format)
+}
+
+func (c *rocketChatConn) Connected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected
+}
+
+func (c *rocketChatConn) MentionBot() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return "@" + c.name
+}
+
+func (c *rocketChatConn) Mention(user string) string {
+	username, err := c.username(user)
+	if err != nil {
+		return "@" + user
+	}
+	return "@" + username
+}
+
+func (c *rocketChatConn) ParseMention(user string) (string, error) {
+	matches := rocketChatUserMentionRegex.FindStringSubmatch(user)
+	if len(matches) == 0 || matches[0] != user {
+		return "", errors.New("invalid user")
+	}
+	return c.userIDByName(matches[1])
+}
+
+// Unescape removes Rocket.Chat's markdown code formatting and the bot mention. Other @-words are left
+// alone, since they are indistinguishable from things like Python decorators.
+func (c *rocketChatConn) Unescape(s string) string {
+	s = rocketChatCodeBlockRegex.ReplaceAllString(s, "$1")
+	s = rocketChatCodeRegex.ReplaceAllString(s, "$1")
+	s = strings.ReplaceAll(s, c.MentionBot(), "")
+	return s
+}
+
+func (c *rocketChatConn) eventLoop(ctx context.Context, ws *websocket.Conn, eventChan chan event) {
+	for {
+		if ws != nil {
+			if err := c.listen(ctx, ws, eventChan); err != nil && ctx.Err() == nil {
+				log.Printf("Rocket.Chat connection lost: %s", err.Error())
+			}
+		}
+		c.mu.Lock()
+		c.connected = false
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rocketChatRetryInterval):
+		}
+		var err error
+		if ws, err = c.dial(ctx); err != nil {
+			log.Printf("Error: cannot reconnect to Rocket.Chat: %s", err.Error())
+			continue
+		}
+		log.Printf("Rocket.Chat reconnected")
+	}
+}
+
+// dial opens the WebSocket connection, logs in using the personal access token, and subscribes
+// to all messages in the rooms the bot is a member of
+func (c *rocketChatConn) dial(ctx context.Context) (*websocket.Conn, error) {
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, c.websocketURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	requests := []*rocketChatDDPMessage{
+		{Msg: "connect", Version: "1", Support: []string{"1"}},
+		{Msg: "method", ID: rocketChatLoginID, Method: "login", Params: []interface{}{map[string]string{"resume": c.config.Token}}},
+		{Msg: "sub", ID: rocketChatSubscribeID, Name: "stream-room-messages", Params: []interface{}{"__my_messages__", false}},
+	}
+	for _, r := range requests {
+		if err := ws.WriteJSON(r); err != nil {
+			ws.Close()
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	c.ws = ws
+	c.mu.Unlock()
+	return ws, nil
+}
+
+func (c *rocketChatConn) listen(ctx context.Context, ws *websocket.Conn, eventChan chan event) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-done:
+		}
+	}()
+	defer ws.Close()
+	for {
+		var m rocketChatDDPMessage
+		if err := ws.SetReadDeadline(time.Now().Add(rocketChatReadTimeout)); err != nil {
+			return err
+		}
+		if err := ws.ReadJSON(&m); err != nil {
+			return err
+		}
+		switch m.Msg {
+		case "ping":
+			if err := ws.WriteJSON(&rocketChatDDPMessage{Msg: "pong"}); err != nil {
+				return err
+			}
+		case "failed":
+			return errors.New("DDP version not supported by server")
+		case "result":
+			if m.ID == rocketChatLoginID && m.Error != nil {
+				return fmt.Errorf("login failed: %s", m.Error.message())
+			}
+		case "nosub":
+			if m.Error != nil {
+				return fmt.Errorf("subscription failed: %s", m.Error.message())
+			}
+			return errors.New("subscription failed")
+		case "ready":
+			c.mu.Lock()
+			c.connected = true
+			c.mu.Unlock()
+		case "changed":
+			if m.Collection != "stream-room-messages" || m.Fields == nil {
+				continue
+			}
+			if e := c.translateEvent(m.Fields); e != nil {
+				select {
+				case eventChan <- e:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (c *rocketChatConn) translateEvent(fields *rocketChatDDPFields) event {
+	if len(fields.Args) == 0 {
+		return nil
+	}
+	var m rocketChatMessage
+	if err := json.Unmarshal(fields.Args[0], &m); err != nil {
+		return &errorEvent{err}
+	}
+	var room rocketChatRoomInfo
+	if len(fields.Args) > 1 {
+		_ = json.Unmarshal(fields.Args[1], &room)
+	}
+	c.rememberUser(m.User.ID, m.User.Username)
+	for _, u := range m.Mentions {
+		c.rememberUser(u.ID, u.Username)
+	}
+	c.mu.RLock()
+	userID := c.userID
+	c.mu.RUnlock()
+	if m.User.ID == userID {
+		return c.translateReactionEvent(&m) // Ignore my own messages, but not the reactions to them
+	} else if m.Type != "" || !c.markSeen(m.ID) {
+		return nil // Ignore system messages and updates of messages we've seen before
+	}
+	var chType channelType
+	switch room.RoomType {
+	case "c", "p":
+		chType = channelTypeChannel
+	case "d":
+		chType = channelTypeDM
+	default:
+		chType = channelTypeUnknown
+	}
+	return &messageEvent{
+		ID:          m.ID,
+		Channel:     m.RoomID,
+		ChannelType: chType,
+		Thread:      m.ThreadID,
+		User:        m.User.ID,
+		Message:     m.Msg,
+	}
+}
+
+// translateReactionEvent compares the reactions of one of the bot's messages to the ones we've seen before,
+// and returns a reactionEvent for the first new one. Rocket.Chat sends the entire message for every reaction,
+// so there is usually at most one new reaction.
+func (c *rocketChatConn) translateReactionEvent(m *rocketChatMessage) event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	known := c.reactions[m.ID]
+	current := make(map[string]bool)
+	var added *reactionEvent
+	for reaction, users := range m.Reactions {
+		for _, username := range users.Usernames {
+			key := reaction + "|" + username
+			current[key] = true
+			if added == nil && !known[key] && username != c.name {
+				added = &reactionEvent{
+					Channel:   m.RoomID,
+					MessageID: m.ID,
+					User:      c.userIDs[username],
+					Reaction:  strings.Trim(reaction, ":"),
+				}
+			}
+		}
+	}
+	if len(current) > 0 {
+		c.reactions[m.ID] = current
+	} else {
+		delete(c.reactions, m.ID)
+	}
+	if added == nil || added.User == "" {
+		return nil // No new reaction, or reaction from a user we don't know (and hence cannot authorize)
+	}
+	return added
+}
+
+// markSeen records the message ID as seen, and returns true if it has not been seen before
+func (c *rocketChatConn) markSeen(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen[id] {
+		return false
+	}
+	c.seen[id] = true
+	c.seenOrder = append(c.seenOrder, id)
+	if len(c.seenOrder) > rocketChatSeenMessagesMax {
+		delete(c.seen, c.seenOrder[0])
+		c.seenOrder = c.seenOrder[1:]
+	}
+	return true
+}
+
+func (c *rocketChatConn) rememberUser(userID, username string) {
+	if userID == "" || username == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usernames[userID] = username
+	c.userIDs[username] = userID
+}
+
+func (c *rocketChatConn) username(userID string) (string, error) {
+	c.mu.RLock()
+	username, ok := c.usernames[userID]
+	c.mu.RUnlock()
+	if ok {
+		return username, nil
+	}
+	return c.userInfo(url.Values{"userId": {userID}}, func(u *rocketChatUser) string { return u.Username })
+}
+
+func (c *rocketChatConn) userIDByName(username string) (string, error) {
+	c.mu.RLock()
+	userID, ok := c.userIDs[username]
+	c.mu.RUnlock()
+	if ok {
+		return userID, nil
+	}
+	return c.userInfo(url.Values{"username": {username}}, func(u *rocketChatUser) string { return u.ID })
+}
+
+func (c *rocketChatConn) userInfo(params url.Values, field func(u *rocketChatUser) string) (string, error) {
+	var response struct {
+		User rocketChatUser `json:"user"`
+	}
+	if err := c.request(context.Background(), http.MethodGet, "/users.info?"+params.Encode(), nil, &response); err != nil {
+		return "", err
+	}
+	c.rememberUser(response.User.ID, response.User.Username)
+	return field(&response.User), nil
+}
+
+func (c *rocketChatConn) dmRoom(userID string) (string, error) {
+	c.mu.RLock()
+	roomID, ok := c.dmRooms[userID]
+	c.mu.RUnlock()
+	if ok {
+		return roomID, nil
+	}
+	username, err := c.username(userID)
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		Room struct {
+			ID string `json:"_id"`
+		} `json:"room"`
+	}
+	if err := c.request(context.Background(), http.MethodPost, "/im.create", map[string]string{"username": username}, &response); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.dmRooms[userID] = response.Room.ID
+	c.mu.Unlock()
+	return response.Room.ID, nil
+}
+
+func (c *rocketChatConn) request(ctx context.Context, method, path string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL(path), reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.do(req, v)
+}
+
+func (c *rocketChatConn) do(req *http.Request, v interface{}) error {
+	req.Header.Set("X-User-Id", c.config.RocketChatUserID)
+	req.Header.Set("X-Auth-Token", c.config.Token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return newRateLimitedError(resp)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	} else if resp.StatusCode >= 500 {
+		return &serverError{StatusCode: resp.StatusCode, Message: string(body)}
+	}
+	var response struct {
+		Success bool   `json:"success"`
+		Status  string `json:"status"`
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("unexpected response from Rocket.Chat (HTTP %d): %s", resp.StatusCode, err.Error())
+	} else if !response.Success && response.Status != "success" {
+		if response.Error == "" {
+			response.Error = response.Message
+		}
+		return fmt.Errorf("rocket.chat error (HTTP %d): %s", resp.StatusCode, response.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (c *rocketChatConn) apiURL(path string) string {
+	return strings.TrimSuffix(c.config.RocketChatSite, "/") + "/api/v1" + path
+}
+
+func (c *rocketChatConn) websocketURL() string {
+	u := strings.TrimSuffix(c.config.RocketChatSite, "/") + "/websocket"
+	if strings.HasPrefix(u, "https://") {
+		return "wss://" + strings.TrimPrefix(u, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(u, "http://")
+}
+
+func (e *rocketChatDDPError) message() string {
+	if e.Reason != "" {
+		return e.Reason
+	} else if e.Message != "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%v", e.Error)
+}
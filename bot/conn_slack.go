@@ -11,28 +11,43 @@ import (
 	"regexp"
 	"strings"
 	"sync"
-	"time"
 )
 
 var (
+	slackTextEscaper       = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
 	slackLinkWithTextRegex = regexp.MustCompile(`<https?://[^|\s]+\|([^>]+)>`)
 	slackRawLinkRegex      = regexp.MustCompile(`<(https?://[^|\s]+)>`)
 	slackCodeBlockRegex    = regexp.MustCompile("```([^`]+)```")
 	slackCodeRegex         = regexp.MustCompile("`([^`]+)`")
 	slackUserLinkRegex     = regexp.MustCompile(`<@(U[^>]+)>`)
+	slackChannelLinkRegex  = regexp.MustCompile(`^<#([^|>]+)(\|[^>]*)?>$`)
 	slackMacQuotesRegex    = regexp.MustCompile(`[“”]`)
 	slackReplacer          = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">") // see slackutilsx.go, EscapeMessage
+
+	// Errors returned by the Slack API if a channel was archived or deleted, see translateSlackError
+	slackChannelGoneErrors = map[string]bool{
+		"channel_not_found":   true,
+		"is_archived":         true,
+		"channel_is_archived": true,
+	}
+
+	// Slack refers to emojis by name, see React
+	slackEmojiNames = map[string]string{
+		inputForwardedReaction: "white_check_mark",
+		inputDroppedReaction:   "no_entry_sign",
+	}
 )
 
 const (
-	additionalRateLimitDuration = 500 * time.Millisecond
+	slackMessageLengthLimit = 40000 // Longer messages are truncated by Slack; 4,000 is only the recommended length
 )
 
 type slackConn struct {
-	rtm    *slack.RTM
-	userID string
-	config *config.Config
-	mu     sync.RWMutex
+	rtm       *slack.RTM
+	userID    string
+	connected bool
+	config    *config.Config
+	mu        sync.RWMutex
 }
 
 func newSlackConn(conf *config.Config) *slackConn {
@@ -61,52 +76,46 @@ func (c *slackConn) Connect(ctx context.Context) (<-chan event, error) {
 }
 
 func (c *slackConn) Send(channel *channelID, message string) error {
-	_, err := c.SendWithID(channel, message)
-	return err
+	return retryRateLimited(func() error {
+		_, err := c.SendWithID(channel, message)
+		return err
+	})
 }
 
 func (c *slackConn) SendWithID(channel *channelID, message string) (string, error) {
 	options := c.postOptions(channel, slack.MsgOptionText(message, false))
-	for {
-		_, responseTS, err := c.rtm.PostMessage(channel.Channel, options...)
-		if err == nil {
-			return responseTS, nil
-		}
-		if e, ok := err.(*slack.RateLimitedError); ok {
-			log.Printf("error: %s; sleeping before re-sending", err.Error())
-			time.Sleep(e.RetryAfter + additionalRateLimitDuration)
-			continue
-		}
-		return "", err
+	_, responseTS, err := c.rtm.PostMessage(channel.Channel, options...)
+	if err != nil {
+		return "", translateSlackError(err)
 	}
+	return responseTS, nil
 }
 
 func (c *slackConn) SendEphemeral(channel *channelID, userID, message string) error {
 	options := c.postOptions(channel, slack.MsgOptionText(message, false))
-	for {
+	return retryRateLimited(func() error {
 		_, err := c.rtm.PostEphemeral(channel.Channel, userID, options...)
-		if err == nil {
-			return nil
-		}
-		if e, ok := err.(*slack.RateLimitedError); ok {
-			log.Printf("error: %s; sleeping before re-sending", err.Error())
-			time.Sleep(e.RetryAfter + additionalRateLimitDuration)
-			continue
-		}
+		return translateSlackError(err)
+	})
+}
+
+func (c *slackConn) SendDM(userID string, message string) error {
+	channel, err := c.OpenDM(userID)
+	if err != nil {
 		return err
 	}
+	return c.Send(&channelID{channel, ""}, message)
 }
 
-func (c *slackConn) SendDM(userID string, message string) error {
+func (c *slackConn) OpenDM(userID string) (string, error) {
 	ch, _, _, err := c.rtm.OpenConversation(&slack.OpenConversationParameters{
 		ReturnIM: true,
 		Users:    []string{userID},
 	})
 	if err != nil {
-		return err
+		return "", err
 	}
-	channel := &channelID{ch.ID, ""}
-	return c.Send(channel, message)
+	return ch.ID, nil
 }
 
 func (c *slackConn) UploadFile(channel *channelID, message string, filename string, filetype string, file io.Reader) error {
@@ -123,28 +132,105 @@ func (c *slackConn) UploadFile(channel *channelID, message string, filename stri
 
 func (c *slackConn) Update(channel *channelID, id string, message string) error {
 	options := c.postOptions(channel, slack.MsgOptionText(message, false))
-	for {
-		_, _, _, err := c.rtm.UpdateMessage(channel.Channel, id, options...)
-		if err == nil {
-			return nil
-		}
-		if e, ok := err.(*slack.RateLimitedError); ok {
-			log.Printf("error: %s; sleeping before re-sending", err.Error())
-			time.Sleep(e.RetryAfter + additionalRateLimitDuration)
-			continue
-		}
-		return err
+	_, _, _, err := c.rtm.UpdateMessage(channel.Channel, id, options...)
+	return translateSlackError(err)
+}
+
+func (c *slackConn) Delete(channel *channelID, id string) error {
+	_, _, err := c.rtm.DeleteMessage(channel.Channel, id)
+	return translateSlackError(err)
+}
+
+// React adds a reaction to the message. Slack refers to emojis by name, so the emoji is translated,
+// see slackEmojiNames.
+func (c *slackConn) React(channel *channelID, id string, emoji string) error {
+	name, ok := slackEmojiNames[emoji]
+	if !ok {
+		return errReactNotSupported
 	}
+	return translateSlackError(c.rtm.AddReaction(name, slack.NewRefToMessage(channel.Channel, id)))
 }
 
 func (c *slackConn) Archive(_ *channelID) error {
 	return nil
 }
 
+func (c *slackConn) SendStatus(_ *channelID, _ *statusMessage) (string, error) {
+	return "", errStatusNotSupported
+}
+
+func (c *slackConn) UpdateStatus(_ *channelID, _ string, _ *statusMessage) error {
+	return errStatusNotSupported
+}
+
+// SendButtons is not supported, because button clicks are not delivered via the RTM API, but require an
+// interactivity request URL or Socket Mode
+func (c *slackConn) SendButtons(_ *channelID, _ string, _ []*config.Button) (string, error) {
+	return "", errButtonsNotSupported
+}
+
+func (c *slackConn) SetTitle(channel *channelID, title string) error {
+	if channel.Thread != "" {
+		return errTitleNotSupported // Threads have no topic, and we don't want to change the channel's topic
+	}
+	_, err := c.rtm.SetTopicOfConversation(channel.Channel, title)
+	return err
+}
+
+// Join joins a public channel via conversations.join. Private channels cannot be joined; the bot has to be invited.
+func (c *slackConn) Join(channel string) error {
+	_, _, _, err := c.rtm.JoinConversation(slackChannelID(channel))
+	return translateSlackError(err)
+}
+
+func (c *slackConn) Leave(channel string) error {
+	_, err := c.rtm.LeaveConversation(slackChannelID(channel))
+	return translateSlackError(err)
+}
+
+// Close disconnects the RTM connection, so that it does not keep reconnecting in the background
+// after a reconnect, see Bot.runWorkspace
 func (c *slackConn) Close() error {
+	if c.rtm == nil {
+		return nil
+	}
+	if err := c.rtm.Disconnect(); err != nil && err != slack.ErrAlreadyDisconnected {
+		return err
+	}
 	return nil
 }
 
+func (c *slackConn) MaxMessageLength() int {
+	return slackMessageLengthLimit
+}
+
+func (c *slackConn) SupportsANSI() bool {
+	return false
+}
+
+// CollapseMode returns collapseUpload, since Slack shows uploaded text snippets collapsed
+func (c *slackConn) CollapseMode() collapseMode {
+	return collapseUpload
+}
+
+// Format renders text using Slack's mrkdwn. Slack does not support backslash escapes, so "&", "<" and ">" are
+// escaped as HTML entities in plain text, and code fences within code blocks are broken up using spaces.
+func (c *slackConn) Format(text string, format messageFormat) string {
+	switch format {
+	case formatText:
+		return slackTextEscaper.Replace(text)
+	case formatCode, formatANSI: // Slack does not render colors
+		return escapedCodeBlock(text, "") // Slack does not support longer fences
+	}
+	return text
+}
+
+func (c *slackConn) Connected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected
+}
+
 func (c *slackConn) MentionBot() string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -177,10 +263,14 @@ func (c *slackConn) translateEvent(event slack.RTMEvent) event {
 	switch ev := event.Data.(type) {
 	case *slack.ConnectedEvent:
 		return c.handleConnectedEvent(ev)
+	case *slack.DisconnectedEvent:
+		return c.handleDisconnectedEvent(ev)
 	case *slack.ChannelJoinedEvent:
 		return c.handleChannelJoinedEvent(ev)
 	case *slack.MessageEvent:
 		return c.handleMessageEvent(ev)
+	case *slack.ReactionAddedEvent:
+		return c.handleReactionAddedEvent(ev)
 	case *slack.RTMError:
 		return c.handleErrorEvent(ev)
 	case *slack.ConnectionErrorEvent:
@@ -206,6 +296,21 @@ func (c *slackConn) handleMessageEvent(ev *slack.MessageEvent) event {
 	}
 }
 
+func (c *slackConn) handleReactionAddedEvent(ev *slack.ReactionAddedEvent) event {
+	c.mu.RLock()
+	userID := c.userID
+	c.mu.RUnlock()
+	if ev.User == "" || ev.User == userID || ev.Item.Type != "message" {
+		return nil // Ignore my own reactions, and reactions to files
+	}
+	return &reactionEvent{
+		Channel:   ev.Item.Channel,
+		MessageID: ev.Item.Timestamp,
+		User:      ev.User,
+		Reaction:  ev.Reaction,
+	}
+}
+
 func (c *slackConn) handleConnectedEvent(ev *slack.ConnectedEvent) event {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -213,10 +318,21 @@ func (c *slackConn) handleConnectedEvent(ev *slack.ConnectedEvent) event {
 		return errorEvent{errors.New("missing user info in connected event")}
 	}
 	c.userID = ev.Info.User.ID
+	c.connected = true
 	log.Printf("Slack connected as user %s/%s", ev.Info.User.Name, ev.Info.User.ID)
 	return nil
 }
 
+func (c *slackConn) handleDisconnectedEvent(ev *slack.DisconnectedEvent) event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+	if ev.Cause != nil {
+		log.Printf("Slack disconnected: %s", ev.Cause.Error())
+	}
+	return nil
+}
+
 func (c *slackConn) handleChannelJoinedEvent(ev *slack.ChannelJoinedEvent) event {
 	return &channelJoinedEvent{ev.Channel.ID}
 }
@@ -242,3 +358,24 @@ func (c *slackConn) postOptions(channel *channelID, msg slack.MsgOption) []slack
 	}
 	return options
 }
+
+// slackChannelID returns the channel ID from a channel link, e.g. "C0123" from "<#C0123|general>". Anything else
+// is assumed to be a channel ID already.
+func slackChannelID(channel string) string {
+	if matches := slackChannelLinkRegex.FindStringSubmatch(channel); len(matches) > 0 {
+		return matches[1]
+	}
+	return channel
+}
+
+// translateSlackError translates Slack's rate limit error to a rateLimitedError, see retryRateLimited, and errors for
+// archived or deleted channels to errChannelGone. Slack's server errors (HTTP 5xx) don't need to be translated, since
+// they already report their status code, see isRetryable.
+func translateSlackError(err error) error {
+	if e, ok := err.(*slack.RateLimitedError); ok {
+		return &rateLimitedError{RetryAfter: e.RetryAfter}
+	} else if err != nil && slackChannelGoneErrors[err.Error()] {
+		return fmt.Errorf("%w: %s", errChannelGone, err.Error())
+	}
+	return err
+}
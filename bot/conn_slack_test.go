@@ -0,0 +1,17 @@
+package bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"heckel.io/replbot/config"
+	"testing"
+)
+
+func TestSlackMessageLengthFitsAllSizes(t *testing.T) {
+	sess := &session{
+		conf: &sessionConfig{global: config.New("xoxb-slack")},
+		conn: &slackConn{},
+	}
+	for name, size := range config.Sizes {
+		assert.False(t, sess.shouldWarnMessageLength(size), name)
+	}
+}
@@ -0,0 +1,650 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"heckel.io/replbot/config"
+	"html"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	teamsMessagesPath        = "/api/messages"
+	teamsThreadSeparator     = ";messageid="
+	teamsTokenScope          = "https://api.botframework.com/.default"
+	teamsTokenURL            = "https://login.microsoftonline.com/%s/oauth2/v2.0/token"
+	teamsDefaultTenant       = "botframework.com"
+	teamsOpenIDMetadataURL   = "https://login.botframework.com/v1/.well-known/openidconfiguration"
+	teamsTokenIssuer         = "https://api.botframework.com"
+	teamsKeysRefreshInterval = 24 * time.Hour
+	teamsKeysMinRefreshAge   = 5 * time.Minute // Unknown key IDs only trigger a refresh this often, see signingKey
+	teamsClockSkew           = 5 * time.Minute
+	teamsMessageLengthLimit  = 28000 // Teams allows ~28 KB per message, including metadata
+	teamsMaxRequestSize      = 1024 * 1024
+)
+
+var (
+	teamsMentionRegex   = regexp.MustCompile(`<at>([^<]*)</at>`)
+	teamsCodeBlockRegex = regexp.MustCompile("```([^`]+)```")
+	teamsCodeRegex      = regexp.MustCompile("`([^`]+)`")
+	teamsTagRegex       = regexp.MustCompile(`<[^>]+>`)
+)
+
+// teamsConn is an implementation of conn for Microsoft Teams, using the Bot Framework REST API.
+//
+// Unlike the other platforms, Teams pushes incoming activities to an HTTPS endpoint, so teamsConn implements
+// http.Handler and is served by the bot's HTTP server on the teams-addr address (see Bot.Run).
+//
+// Teams channel conversations map onto channels, and reply chains map onto threads: a reply chain is a conversation
+// with the ID "<channel-conversation-id>;messageid=<root-message-id>".
+type teamsConn struct {
+	config        *config.Config
+	client        *http.Client
+	eventChan     chan event
+	serviceURLs   map[string]string // conversation ID -> service URL
+	users         map[string]string // user ID -> name
+	serviceURL    string            // last seen service URL, used for DMs
+	tenantID      string            // last seen tenant ID, used for DMs
+	botName       string
+	token         string
+	tokenExpiry   time.Time
+	keys          map[string]*rsa.PublicKey // key ID -> key, used to verify incoming requests
+	keysExpiry    time.Time
+	keysRefreshed time.Time // last attempt to download the keys, see signingKey
+	mu            sync.RWMutex
+}
+
+type teamsActivity struct {
+	Type         string             `json:"type"`
+	ID           string             `json:"id,omitempty"`
+	ServiceURL   string             `json:"serviceUrl,omitempty"`
+	From         *teamsAccount      `json:"from,omitempty"`
+	Recipient    *teamsAccount      `json:"recipient,omitempty"`
+	Conversation *teamsConversation `json:"conversation,omitempty"`
+	Text         string             `json:"text"`
+	TextFormat   string             `json:"textFormat,omitempty"`
+	Entities     []*teamsEntity     `json:"entities,omitempty"`
+	ChannelData  *teamsChannelData  `json:"channelData,omitempty"`
+	Attachments  []*json.RawMessage `json:"attachments,omitempty"`
+	ReplyToID    string             `json:"replyToId,omitempty"`
+	Reactions    []*teamsReaction   `json:"reactionsAdded,omitempty"`
+}
+
+type teamsReaction struct {
+	Type string `json:"type"`
+}
+
+type teamsAccount struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+type teamsConversation struct {
+	ID               string `json:"id"`
+	ConversationType string `json:"conversationType,omitempty"`
+}
+
+type teamsEntity struct {
+	Type      string        `json:"type"`
+	Mentioned *teamsAccount `json:"mentioned,omitempty"`
+	Text      string        `json:"text,omitempty"`
+}
+
+type teamsChannelData struct {
+	Tenant *struct {
+		ID string `json:"id"`
+	} `json:"tenant,omitempty"`
+}
+
+type teamsJWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type teamsClaims struct {
+	Issuer     string      `json:"iss"`
+	Audience   interface{} `json:"aud"`
+	Expiry     int64       `json:"exp"`
+	NotBefore  int64       `json:"nbf"`
+	ServiceURL string      `json:"serviceurl"`
+}
+
+func newTeamsConn(conf *config.Config) *teamsConn {
+	return &teamsConn{
+		config:      conf,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		eventChan:   make(chan event),
+		serviceURLs: make(map[string]string),
+		users:       make(map[string]string),
+		keys:        make(map[string]*rsa.PublicKey),
+	}
+}
+
+func (c *teamsConn) Connect(ctx context.Context) (<-chan event, error) {
+	if _, err := c.accessToken(); err != nil {
+		return nil, err
+	}
+	log.Printf("Teams connected as app %s, listening for activities on %s%s", c.config.TeamsAppID, c.config.TeamsAddr, teamsMessagesPath)
+	return c.eventChan, nil
+}
+
+func (c *teamsConn) Send(channel *channelID, message string) error {
+	_, err := c.SendWithID(channel, message)
+	return err
+}
+
+func (c *teamsConn) SendWithID(channel *channelID, message string) (string, error) {
+	conversation := c.conversationID(channel)
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err := c.request(http.MethodPost, c.activitiesURL(conversation, ""), c.messageActivity(message), &response); err != nil {
+		return "", err
+	}
+	return response.ID, nil
+}
+
+func (c *teamsConn) SendEphemeral(_ *channelID, userID, message string) error {
+	return c.SendDM(userID, message) // Teams does not support ephemeral messages
+}
+
+func (c *teamsConn) SendDM(userID string, message string) error {
+	conversationID, err := c.OpenDM(userID)
+	if err != nil {
+		return err
+	}
+	return c.Send(&channelID{Channel: conversationID}, message)
+}
+
+// OpenDM creates (or gets) the one-on-one conversation with the user
+func (c *teamsConn) OpenDM(userID string) (string, error) {
+	c.mu.RLock()
+	serviceURL, tenantID := c.serviceURL, c.tenantID
+	c.mu.RUnlock()
+	if serviceURL == "" {
+		return "", errors.New("cannot open direct message, no service URL known yet")
+	}
+	params := map[string]interface{}{
+		"bot":         &teamsAccount{ID: c.config.TeamsAppID},
+		"members":     []*teamsAccount{{ID: userID}},
+		"channelData": map[string]interface{}{"tenant": map[string]string{"id": tenantID}},
+	}
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err := c.request(http.MethodPost, strings.TrimSuffix(serviceURL, "/")+"/v3/conversations", params, &response); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.serviceURLs[response.ID] = serviceURL
+	c.mu.Unlock()
+	return response.ID, nil
+}
+
+func (c *teamsConn) UploadFile(_ *channelID, _ string, _ string, _ string, _ io.Reader) error {
+	return errors.New("file uploads are not supported in Teams")
+}
+
+func (c *teamsConn) Update(channel *channelID, id string, message string) error {
+	conversation := c.conversationID(channel)
+	return c.request(http.MethodPut, c.activitiesURL(conversation, id), c.messageActivity(message), nil)
+}
+
+func (c *teamsConn) Delete(_ *channelID, _ string) error {
+	return errDeleteNotSupported
+}
+
+func (c *teamsConn) React(_ *channelID, _ string, _ string) error {
+	return errReactNotSupported
+}
+
+func (c *teamsConn) Archive(_ *channelID) error {
+	return nil
+}
+
+func (c *teamsConn) SendStatus(_ *channelID, _ *statusMessage) (string, error) {
+	return "", errStatusNotSupported
+}
+
+func (c *teamsConn) UpdateStatus(_ *channelID, _ string, _ *statusMessage) error {
+	return errStatusNotSupported
+}
+
+func (c *teamsConn) SendButtons(_ *channelID, _ string, _ []*config.Button) (string, error) {
+	return "", errButtonsNotSupported
+}
+
+func (c *teamsConn) SetTitle(_ *channelID, _ string) error {
+	return errTitleNotSupported
+}
+
+func (c *teamsConn) Join(_ string) error {
+	return errJoinNotSupported
+}
+
+func (c *teamsConn) Leave(_ string) error {
+	return errJoinNotSupported
+}
+
+func (c *teamsConn) Close() error {
+	return nil
+}
+
+func (c *teamsConn) MaxMessageLength() int {
+	return teamsMessageLengthLimit
+}
+
+func (c *teamsConn) SupportsANSI() bool {
+	return false
+}
+
+func (c *teamsConn) CollapseMode() collapseMode {
+	return collapseNone
+}
+
+func (c *teamsConn) Format(text string, format messageFormat) string {
+	if format == formatCode || format == formatANSI {
+		return escapedCodeBlock(text, "") // Teams only supports three-backtick fences, and no colors
+	}
+	return renderMarkdown(text, format)
+}
+
+func (c *teamsConn) Connected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token != "" && time.Now().Before(c.tokenExpiry)
+}
+
+func (c *teamsConn) MentionBot() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return fmt.Sprintf("<at>%s</at>", c.botName)
+}
+
+func (c *teamsConn) Mention(user string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if name, ok := c.users[user]; ok {
+		return fmt.Sprintf("<at>%s</at>", name)
+	}
+	return user
+}
+
+// ParseMention parses a user mention. Incoming user mentions are normalized to the whitespace-free
+// format <at>user-id</at> (see translateActivity), so they can be parsed as a single field.
+func (c *teamsConn) ParseMention(user string) (string, error) {
+	if matches := teamsMentionRegex.FindStringSubmatch(user); len(matches) > 0 {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		if _, ok := c.users[matches[1]]; ok {
+			return matches[1], nil
+		}
+	}
+	return "", errors.New("invalid user")
+}
+
+func (c *teamsConn) Unescape(s string) string {
+	s = teamsCodeBlockRegex.ReplaceAllString(s, "$1")
+	s = teamsCodeRegex.ReplaceAllString(s, "$1")
+	s = teamsMentionRegex.ReplaceAllString(s, "") // Remove entirely!
+	s = teamsTagRegex.ReplaceAllString(s, "")
+	s = strings.ReplaceAll(html.UnescapeString(s), "\u00a0", " ") // &nbsp;
+	return s
+}
+
+// ServeHTTP handles incoming activities from the Bot Framework, see Bot.Run
+func (c *teamsConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != teamsMessagesPath || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	var activity teamsActivity
+	if err := json.NewDecoder(io.LimitReader(r.Body, teamsMaxRequestSize)).Decode(&activity); err != nil {
+		http.Error(w, "invalid activity", http.StatusBadRequest)
+		return
+	}
+	if err := c.verifyRequest(r, activity.ServiceURL); err != nil {
+		log.Printf("[teams] Rejecting request: %s", err.Error())
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if ev := c.translateActivity(&activity); ev != nil {
+		select {
+		case c.eventChan <- ev:
+		case <-r.Context().Done():
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *teamsConn) translateActivity(activity *teamsActivity) event {
+	if activity.Type == "messageReaction" {
+		return c.translateReactionActivity(activity)
+	} else if activity.Type != "message" || activity.From == nil || activity.Conversation == nil || activity.Recipient == nil {
+		return nil
+	}
+	c.mu.Lock()
+	c.botName = activity.Recipient.Name
+	c.users[activity.From.ID] = activity.From.Name
+	c.serviceURL = activity.ServiceURL
+	if activity.ChannelData != nil && activity.ChannelData.Tenant != nil {
+		c.tenantID = activity.ChannelData.Tenant.ID
+	}
+	channel, thread := activity.Conversation.ID, ""
+	if i := strings.Index(channel, teamsThreadSeparator); i != -1 {
+		channel, thread = channel[:i], channel[i+len(teamsThreadSeparator):]
+	}
+	c.serviceURLs[channel] = activity.ServiceURL
+	text := activity.Text
+	for _, entity := range activity.Entities {
+		if entity.Type != "mention" || entity.Mentioned == nil {
+			continue
+		}
+		if entity.Mentioned.ID == activity.Recipient.ID {
+			text = strings.ReplaceAll(text, entity.Text, fmt.Sprintf("<at>%s</at>", c.botName))
+		} else {
+			c.users[entity.Mentioned.ID] = entity.Mentioned.Name
+			text = strings.ReplaceAll(text, entity.Text, fmt.Sprintf("<at>%s</at>", entity.Mentioned.ID))
+		}
+	}
+	c.mu.Unlock()
+	var chType channelType
+	switch activity.Conversation.ConversationType {
+	case "personal":
+		chType = channelTypeDM
+	case "channel":
+		chType = channelTypeChannel
+	default:
+		chType = channelTypeUnknown // Group chats do not support reply chains
+	}
+	return &messageEvent{
+		ID:          activity.ID,
+		Channel:     channel,
+		ChannelType: chType,
+		Thread:      thread,
+		User:        activity.From.ID,
+		Message:     strings.TrimSpace(text),
+	}
+}
+
+func (c *teamsConn) translateReactionActivity(activity *teamsActivity) event {
+	if activity.From == nil || activity.Conversation == nil || len(activity.Reactions) == 0 {
+		return nil // Ignore removed reactions
+	}
+	channel := activity.Conversation.ID
+	if i := strings.Index(channel, teamsThreadSeparator); i != -1 {
+		channel = channel[:i]
+	}
+	return &reactionEvent{
+		Channel:   channel,
+		MessageID: activity.ReplyToID,
+		User:      activity.From.ID,
+		Reaction:  activity.Reactions[0].Type, // Teams only supports a handful of reactions: like, heart, laugh, ...
+	}
+}
+
+func (c *teamsConn) messageActivity(message string) *teamsActivity {
+	activity := &teamsActivity{
+		Type:       "message",
+		Text:       message,
+		TextFormat: "markdown",
+		Entities:   make([]*teamsEntity, 0),
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for id, name := range c.users {
+		mention := fmt.Sprintf("<at>%s</at>", name)
+		if strings.Contains(message, mention) {
+			activity.Entities = append(activity.Entities, &teamsEntity{
+				Type:      "mention",
+				Mentioned: &teamsAccount{ID: id, Name: name},
+				Text:      mention,
+			})
+		}
+	}
+	return activity
+}
+
+func (c *teamsConn) conversationID(channel *channelID) string {
+	if channel.Thread == "" {
+		return channel.Channel
+	}
+	return channel.Channel + teamsThreadSeparator + channel.Thread
+}
+
+func (c *teamsConn) activitiesURL(conversation, activityID string) string {
+	c.mu.RLock()
+	serviceURL := c.serviceURLs[strings.SplitN(conversation, teamsThreadSeparator, 2)[0]]
+	c.mu.RUnlock()
+	u := fmt.Sprintf("%s/v3/conversations/%s/activities", strings.TrimSuffix(serviceURL, "/"), url.PathEscape(conversation))
+	if activityID != "" {
+		u += "/" + url.PathEscape(activityID)
+	}
+	return u
+}
+
+func (c *teamsConn) request(method, url string, body interface{}, v interface{}) error {
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return newRateLimitedError(resp)
+	} else if resp.StatusCode >= 500 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &serverError{StatusCode: resp.StatusCode, Message: string(message)}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("teams request failed with HTTP %d: %s", resp.StatusCode, string(message))
+	} else if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// accessToken returns a cached Bot Framework access token, or requests a new one if it expired
+func (c *teamsConn) accessToken() (string, error) {
+	c.mu.RLock()
+	token, expiry := c.token, c.tokenExpiry
+	c.mu.RUnlock()
+	if token != "" && time.Now().Add(time.Minute).Before(expiry) {
+		return token, nil
+	}
+	tenant := c.config.TeamsTenantID
+	if tenant == "" {
+		tenant = teamsDefaultTenant
+	}
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", c.config.TeamsAppID)
+	form.Set("client_secret", c.config.Token)
+	form.Set("scope", teamsTokenScope)
+	resp, err := c.client.PostForm(fmt.Sprintf(teamsTokenURL, tenant), form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var response struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", err
+	} else if response.AccessToken == "" {
+		return "", fmt.Errorf("cannot retrieve Teams access token: %s", response.Error)
+	}
+	c.mu.Lock()
+	c.token = response.AccessToken
+	c.tokenExpiry = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	c.mu.Unlock()
+	return response.AccessToken, nil
+}
+
+// verifyRequest verifies the JWT bearer token the Bot Framework sends along with each activity, see
+// https://docs.microsoft.com/en-us/azure/bot-service/rest-api/bot-framework-rest-connector-authentication
+func (c *teamsConn) verifyRequest(r *http.Request, serviceURL string) error {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("missing or malformed bearer token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims teamsClaims
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return err
+	} else if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return err
+	} else if header.Alg != "RS256" {
+		return fmt.Errorf("unexpected algorithm %s", header.Alg)
+	}
+	key, err := c.signingKey(header.Kid)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return errors.New("invalid signature")
+	}
+	now := time.Now()
+	if claims.Issuer != teamsTokenIssuer {
+		return fmt.Errorf("unexpected issuer %s", claims.Issuer)
+	} else if !claims.hasAudience(c.config.TeamsAppID) {
+		return errors.New("unexpected audience")
+	} else if now.After(time.Unix(claims.Expiry, 0).Add(teamsClockSkew)) {
+		return errors.New("token expired")
+	} else if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-teamsClockSkew)) {
+		return errors.New("token not yet valid")
+	} else if claims.ServiceURL != "" && claims.ServiceURL != serviceURL {
+		return errors.New("service URL mismatch")
+	}
+	return nil
+}
+
+// signingKey returns the key with the given ID that incoming requests are signed with. The keys are downloaded again
+// once a day, or if a request refers to an unknown key. Since requests are not authenticated at this point, the latter
+// happens at most every few minutes, so that callers cannot make the bot hammer the Bot Framework with requests.
+func (c *teamsConn) signingKey(kid string) (*rsa.PublicKey, error) {
+	now := time.Now()
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	expired := now.After(c.keysExpiry)
+	refresh := (!ok || expired) && now.Sub(c.keysRefreshed) >= teamsKeysMinRefreshAge
+	if refresh {
+		c.keysRefreshed = now
+	}
+	c.mu.Unlock()
+	if ok && (!expired || !refresh) {
+		return key, nil // Keep using expired keys until the next refresh is allowed
+	} else if !refresh {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	var metadata struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := c.getJSON(teamsOpenIDMetadataURL, &metadata); err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []*teamsJWK `json:"keys"`
+	}
+	if err := c.getJSON(metadata.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	c.mu.Lock()
+	c.keys = keys
+	c.keysExpiry = time.Now().Add(teamsKeysRefreshInterval)
+	c.mu.Unlock()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %s", kid)
+}
+
+func (c *teamsConn) getJSON(url string, v interface{}) error {
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from %s: HTTP %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *teamsClaims) hasAudience(audience string) bool {
+	switch aud := c.Audience.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
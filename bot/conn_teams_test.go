@@ -0,0 +1,56 @@
+package bot
+
+import (
+	"crypto/rsa"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingTransport struct {
+	requests int32
+}
+
+func (t *countingTransport) RoundTrip(_ *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.requests, 1)
+	return nil, errors.New("no network in tests")
+}
+
+func TestTeamsSigningKeyRefreshRateLimited(t *testing.T) {
+	transport := &countingTransport{}
+	key := &rsa.PublicKey{}
+	c := &teamsConn{
+		client:     &http.Client{Transport: transport},
+		keys:       map[string]*rsa.PublicKey{"known": key},
+		keysExpiry: time.Now().Add(time.Hour),
+	}
+
+	// Known keys are served from the cache
+	k, err := c.signingKey("known")
+	assert.Nil(t, err)
+	assert.Equal(t, key, k)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&transport.requests))
+
+	// The first unknown key triggers a refresh, later ones are rejected right away
+	for i := 0; i < 10; i++ {
+		_, err := c.signingKey("unknown")
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&transport.requests))
+
+	// Expired keys are still used until the next refresh is allowed
+	c.keysExpiry = time.Now().Add(-time.Minute)
+	k, err = c.signingKey("known")
+	assert.Nil(t, err)
+	assert.Equal(t, key, k)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&transport.requests))
+
+	// Refresh is allowed again after a while
+	c.keysRefreshed = time.Now().Add(-teamsKeysMinRefreshAge)
+	_, err = c.signingKey("unknown")
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&transport.requests))
+}
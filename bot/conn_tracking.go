@@ -0,0 +1,65 @@
+package bot
+
+import (
+	"heckel.io/replbot/config"
+	"sync"
+)
+
+// trackedMessage is a message sent via a trackingConn
+type trackedMessage struct {
+	channel *channelID
+	id      string
+}
+
+// trackingConn wraps a conn, and remembers the IDs of all messages sent through it, so that they can be deleted
+// when an ephemeral session ends, see session.deleteMessages. Send is translated to SendWithID to learn the ID.
+// Uploaded files are not tracked, since conn.UploadFile does not return an ID.
+type trackingConn struct {
+	conn
+	messages []*trackedMessage
+	mu       sync.Mutex
+}
+
+func newTrackingConn(conn conn) *trackingConn {
+	return &trackingConn{
+		conn:     conn,
+		messages: make([]*trackedMessage, 0),
+	}
+}
+
+func (c *trackingConn) Send(channel *channelID, message string) error {
+	_, err := c.SendWithID(channel, message)
+	return err
+}
+
+func (c *trackingConn) SendWithID(channel *channelID, message string) (string, error) {
+	id, err := c.conn.SendWithID(channel, message)
+	return id, c.track(channel, id, err)
+}
+
+func (c *trackingConn) SendStatus(channel *channelID, status *statusMessage) (string, error) {
+	id, err := c.conn.SendStatus(channel, status)
+	return id, c.track(channel, id, err)
+}
+
+func (c *trackingConn) SendButtons(channel *channelID, message string, buttons []*config.Button) (string, error) {
+	id, err := c.conn.SendButtons(channel, message, buttons)
+	return id, c.track(channel, id, err)
+}
+
+// Messages returns all messages sent so far, oldest first
+func (c *trackingConn) Messages() []*trackedMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*trackedMessage{}, c.messages...)
+}
+
+func (c *trackingConn) track(channel *channelID, id string, err error) error {
+	if err != nil || id == "" {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, &trackedMessage{channel: &channelID{channel.Channel, channel.Thread}, id: id})
+	return nil
+}
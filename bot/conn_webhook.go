@@ -0,0 +1,378 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"heckel.io/replbot/config"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookMessagesPath       = "/messages"
+	webhookBotName            = "replbot"
+	webhookMessageLengthLimit = 64 * 1024
+	webhookMaxRequestSize     = 1024 * 1024
+	webhookMaxPending         = 1000 // Messages buffered for polling; older messages are dropped
+)
+
+// Types of webhookOutput messages
+const (
+	webhookTypeMessage   = "message"
+	webhookTypeUpdate    = "update"
+	webhookTypeEphemeral = "ephemeral"
+	webhookTypeDM        = "dm"
+	webhookTypeFile      = "file"
+)
+
+var (
+	webhookMentionRegex   = regexp.MustCompile(`^@(\S+)$`)
+	webhookCodeBlockRegex = regexp.MustCompile("```([^`]+)```")
+	webhookCodeRegex      = regexp.MustCompile("`([^`]+)`")
+)
+
+// webhookConn is a generic HTTP implementation of conn, to build custom front-ends (a web app, a CLI, ...) on top
+// of REPLbot without a chat platform.
+//
+// Like Teams and WhatsApp, webhookConn implements http.Handler and is served by the bot's HTTP server on the
+// webhook-addr address (see Bot.Run). Clients POST input messages to /messages (see webhookInput). Output is
+// POSTed to webhook-callback-url if it is set, and buffered for polling via GET /messages otherwise (see
+// webhookOutput). All requests are authenticated with the bot token, passed as "Authorization: Bearer <token>".
+//
+// Channels and threads are arbitrary strings chosen by the client. Message IDs are assigned by webhookConn.
+type webhookConn struct {
+	config    *config.Config
+	client    *http.Client
+	eventChan chan event
+	pending   []*webhookOutput
+	currentID int
+	connected bool
+	mu        sync.RWMutex
+}
+
+// webhookInput is a message sent to the bot via POST /messages. In channels, the bot must be mentioned (@replbot)
+// to start a session, just like on any other platform; direct messages ("dm": true) don't need a mention.
+type webhookInput struct {
+	ID      string `json:"id,omitempty"`
+	Channel string `json:"channel"`
+	Thread  string `json:"thread,omitempty"`
+	User    string `json:"user"`
+	Message string `json:"message"`
+	DM      bool   `json:"dm,omitempty"`
+}
+
+// webhookOutput is a message sent by the bot, either POSTed to the callback URL or returned by GET /messages.
+// Messages of type "update" replace the message with the same ID.
+type webhookOutput struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Channel  string `json:"channel"`
+	Thread   string `json:"thread,omitempty"`
+	User     string `json:"user,omitempty"` // Recipient of "ephemeral" and "dm" messages
+	Message  string `json:"message"`
+	Filename string `json:"filename,omitempty"`
+	File     []byte `json:"file,omitempty"` // Base64-encoded in JSON
+}
+
+func newWebhookConn(conf *config.Config) *webhookConn {
+	return &webhookConn{
+		config:    conf,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		eventChan: make(chan event),
+		pending:   make([]*webhookOutput, 0),
+	}
+}
+
+func (c *webhookConn) Connect(ctx context.Context) (<-chan event, error) {
+	c.mu.Lock()
+	c.connected = true
+	c.mu.Unlock()
+	if c.config.WebhookCallbackURL != "" {
+		log.Printf("Webhook backend listening on %s%s, sending output to %s", c.config.WebhookAddr, webhookMessagesPath, c.config.WebhookCallbackURL)
+	} else {
+		log.Printf("Webhook backend listening on %s%s, buffering output for polling", c.config.WebhookAddr, webhookMessagesPath)
+	}
+	return c.eventChan, nil
+}
+
+func (c *webhookConn) Send(channel *channelID, message string) error {
+	_, err := c.SendWithID(channel, message)
+	return err
+}
+
+func (c *webhookConn) SendWithID(channel *channelID, message string) (string, error) {
+	return c.send(&webhookOutput{
+		Type:    webhookTypeMessage,
+		Channel: channel.Channel,
+		Thread:  channel.Thread,
+		Message: message,
+	})
+}
+
+func (c *webhookConn) SendEphemeral(channel *channelID, userID, message string) error {
+	_, err := c.send(&webhookOutput{
+		Type:    webhookTypeEphemeral,
+		Channel: channel.Channel,
+		Thread:  channel.Thread,
+		User:    userID,
+		Message: message,
+	})
+	return err
+}
+
+func (c *webhookConn) SendDM(userID string, message string) error {
+	_, err := c.send(&webhookOutput{
+		Type:    webhookTypeDM,
+		Channel: userID,
+		User:    userID,
+		Message: message,
+	})
+	return err
+}
+
+// OpenDM returns the user ID, which clients use as channel ID for direct messages ("dm": true)
+func (c *webhookConn) OpenDM(userID string) (string, error) {
+	return userID, nil
+}
+
+func (c *webhookConn) UploadFile(channel *channelID, message string, filename string, _ string, file io.Reader) error {
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	_, err = c.send(&webhookOutput{
+		Type:     webhookTypeFile,
+		Channel:  channel.Channel,
+		Thread:   channel.Thread,
+		Message:  message,
+		Filename: filename,
+		File:     b,
+	})
+	return err
+}
+
+func (c *webhookConn) Update(channel *channelID, id string, message string) error {
+	_, err := c.send(&webhookOutput{
+		ID:      id,
+		Type:    webhookTypeUpdate,
+		Channel: channel.Channel,
+		Thread:  channel.Thread,
+		Message: message,
+	})
+	return err
+}
+
+func (c *webhookConn) Delete(_ *channelID, _ string) error {
+	return errDeleteNotSupported
+}
+
+func (c *webhookConn) React(_ *channelID, _ string, _ string) error {
+	return errReactNotSupported
+}
+
+func (c *webhookConn) Archive(_ *channelID) error {
+	return nil
+}
+
+func (c *webhookConn) SendStatus(_ *channelID, _ *statusMessage) (string, error) {
+	return "", errStatusNotSupported
+}
+
+func (c *webhookConn) UpdateStatus(_ *channelID, _ string, _ *statusMessage) error {
+	return errStatusNotSupported
+}
+
+func (c *webhookConn) SendButtons(_ *channelID, _ string, _ []*config.Button) (string, error) {
+	return "", errButtonsNotSupported
+}
+
+func (c *webhookConn) SetTitle(_ *channelID, _ string) error {
+	return errTitleNotSupported
+}
+
+func (c *webhookConn) Join(_ string) error {
+	return errJoinNotSupported
+}
+
+func (c *webhookConn) Leave(_ string) error {
+	return errJoinNotSupported
+}
+
+func (c *webhookConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+	return nil
+}
+
+func (c *webhookConn) MaxMessageLength() int {
+	return webhookMessageLengthLimit
+}
+
+func (c *webhookConn) SupportsANSI() bool {
+	return false
+}
+
+func (c *webhookConn) CollapseMode() collapseMode {
+	return collapseNone
+}
+
+func (c *webhookConn) Format(text string, format messageFormat) string {
+	return renderMarkdown(text, format)
+}
+
+func (c *webhookConn) Connected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected
+}
+
+func (c *webhookConn) MentionBot() string {
+	return "@" + webhookBotName
+}
+
+func (c *webhookConn) Mention(user string) string {
+	return "@" + user
+}
+
+func (c *webhookConn) ParseMention(user string) (string, error) {
+	if matches := webhookMentionRegex.FindStringSubmatch(user); len(matches) > 0 {
+		return matches[1], nil
+	}
+	return "", errors.New("invalid user")
+}
+
+func (c *webhookConn) Unescape(s string) string {
+	s = webhookCodeBlockRegex.ReplaceAllString(s, "$1")
+	s = webhookCodeRegex.ReplaceAllString(s, "$1")
+	return s
+}
+
+// ServeHTTP accepts input messages (POST) and returns buffered output messages (GET), see Bot.Run
+func (c *webhookConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != webhookMessagesPath {
+		http.NotFound(w, r)
+		return
+	} else if !c.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		c.handlePoll(w)
+	case http.MethodPost:
+		c.handleInput(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *webhookConn) handleInput(w http.ResponseWriter, r *http.Request) {
+	var input webhookInput
+	if err := json.NewDecoder(io.LimitReader(r.Body, webhookMaxRequestSize)).Decode(&input); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	} else if input.Channel == "" || input.User == "" {
+		http.Error(w, "channel and user are required", http.StatusBadRequest)
+		return
+	}
+	ev := &messageEvent{
+		ID:          input.ID,
+		Channel:     input.Channel,
+		ChannelType: channelTypeChannel,
+		Thread:      input.Thread,
+		User:        input.User,
+		Message:     strings.TrimSpace(input.Message),
+	}
+	if input.DM {
+		ev.ChannelType = channelTypeDM
+	}
+	if ev.ID == "" {
+		ev.ID = c.nextID()
+	}
+	select {
+	case c.eventChan <- ev:
+	case <-r.Context().Done():
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"id": ev.ID})
+}
+
+// handlePoll returns all buffered output messages, and removes them from the buffer
+func (c *webhookConn) handlePoll(w http.ResponseWriter) {
+	c.mu.Lock()
+	messages := c.pending
+	c.pending = make([]*webhookOutput, 0)
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(messages)
+}
+
+func (c *webhookConn) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return hmac.Equal([]byte(token), []byte(c.config.Token))
+}
+
+// send assigns an ID to the message (unless it is an update), and either POSTs it to the callback URL,
+// or buffers it for polling
+func (c *webhookConn) send(message *webhookOutput) (string, error) {
+	if message.ID == "" {
+		message.ID = c.nextID()
+	}
+	if c.config.WebhookCallbackURL != "" {
+		return message.ID, c.post(message)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, message)
+	if len(c.pending) > webhookMaxPending {
+		c.pending = c.pending[len(c.pending)-webhookMaxPending:]
+	}
+	return message.ID, nil
+}
+
+func (c *webhookConn) post(message *webhookOutput) error {
+	b, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.config.WebhookCallbackURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return newRateLimitedError(resp)
+	} else if resp.StatusCode >= 500 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &serverError{StatusCode: resp.StatusCode, Message: string(message)}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook callback failed with HTTP %d: %s", resp.StatusCode, string(message))
+	}
+	return nil
+}
+
+func (c *webhookConn) nextID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.currentID++
+	return strconv.Itoa(c.currentID)
+}
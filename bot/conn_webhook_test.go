@@ -0,0 +1,86 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"heckel.io/replbot/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookInputAndPoll(t *testing.T) {
+	conf := config.New("some-secret")
+	conf.WebhookAddr = ":3980"
+	c := newWebhookConn(conf)
+	events, err := c.Connect(context.Background())
+	require.Nil(t, err)
+
+	// Unauthorized
+	req := httptest.NewRequest(http.MethodPost, webhookMessagesPath, strings.NewReader(`{}`))
+	rr := httptest.NewRecorder()
+	c.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Input message
+	go func() {
+		req := httptest.NewRequest(http.MethodPost, webhookMessagesPath, strings.NewReader(`{"channel":"c1","user":"phil","message":" bash ","dm":true}`))
+		req.Header.Set("Authorization", "Bearer some-secret")
+		c.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	ev := (<-events).(*messageEvent)
+	assert.Equal(t, "c1", ev.Channel)
+	assert.Equal(t, channelTypeDM, ev.ChannelType)
+	assert.Equal(t, "phil", ev.User)
+	assert.Equal(t, "bash", ev.Message)
+	assert.NotEmpty(t, ev.ID)
+
+	// Output is buffered for polling
+	id, err := c.SendWithID(&channelID{Channel: "c1", Thread: "t1"}, "hi there")
+	require.Nil(t, err)
+	require.Nil(t, c.Update(&channelID{Channel: "c1", Thread: "t1"}, id, "hi again"))
+	req = httptest.NewRequest(http.MethodGet, webhookMessagesPath, nil)
+	req.Header.Set("Authorization", "Bearer some-secret")
+	rr = httptest.NewRecorder()
+	c.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var messages []*webhookOutput
+	require.Nil(t, json.NewDecoder(rr.Body).Decode(&messages))
+	require.Equal(t, 2, len(messages))
+	assert.Equal(t, webhookTypeMessage, messages[0].Type)
+	assert.Equal(t, "t1", messages[0].Thread)
+	assert.Equal(t, "hi there", messages[0].Message)
+	assert.Equal(t, webhookTypeUpdate, messages[1].Type)
+	assert.Equal(t, id, messages[1].ID)
+	assert.Equal(t, "hi again", messages[1].Message)
+
+	// Buffer is empty after polling
+	rr = httptest.NewRecorder()
+	c.ServeHTTP(rr, req)
+	assert.Equal(t, "[]\n", rr.Body.String())
+}
+
+func TestWebhookCallback(t *testing.T) {
+	received := make(chan *webhookOutput, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer some-secret", r.Header.Get("Authorization"))
+		var message webhookOutput
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&message))
+		received <- &message
+	}))
+	defer server.Close()
+
+	conf := config.New("some-secret")
+	conf.WebhookAddr = ":3980"
+	conf.WebhookCallbackURL = server.URL
+	c := newWebhookConn(conf)
+	require.Nil(t, c.UploadFile(&channelID{Channel: "c1"}, "your recording", "REPLbot session.zip", "application/zip", strings.NewReader("zipzip")))
+	message := <-received
+	assert.Equal(t, webhookTypeFile, message.Type)
+	assert.Equal(t, "REPLbot session.zip", message.Filename)
+	assert.Equal(t, "zipzip", string(message.File))
+	assert.Equal(t, 0, len(c.pending))
+}
@@ -0,0 +1,426 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"heckel.io/replbot/config"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	whatsAppWebhookPath        = "/whatsapp/webhook"
+	whatsAppGraphURL           = "https://graph.facebook.com/v19.0"
+	whatsAppSignatureHeader    = "X-Hub-Signature-256"
+	whatsAppSignaturePrefix    = "sha256="
+	whatsAppMessageLengthLimit = 4096
+	whatsAppMaxRequestSize     = 1024 * 1024
+)
+
+var (
+	whatsAppMentionRegex   = regexp.MustCompile(`^@\+?(\d+)$`)
+	whatsAppCodeBlockRegex = regexp.MustCompile("```([^`]+)```")
+	whatsAppCodeRegex      = regexp.MustCompile("`([^`]+)`")
+)
+
+// whatsAppConn is an implementation of conn for WhatsApp, using the WhatsApp Business Cloud API.
+//
+// Like Teams, WhatsApp pushes incoming messages to an HTTPS endpoint (a webhook), so whatsAppConn implements
+// http.Handler and is served by the bot's HTTP server on the whatsapp-addr address (see Bot.Run). There is no
+// pairing step: the access token (bot-token) and the phone number ID identify the bot's number.
+//
+// The Cloud API only supports one-on-one chats, so every chat is a direct message, and the channel ID is the
+// user's phone number (WhatsApp ID). Messages cannot be edited or threaded, see Update and Bot.applySessionConfigDefaults.
+type whatsAppConn struct {
+	config    *config.Config
+	client    *http.Client
+	eventChan chan event
+	botNumber string
+	connected bool
+	mu        sync.RWMutex
+}
+
+type whatsAppWebhook struct {
+	Object string `json:"object"`
+	Entry  []*struct {
+		Changes []*struct {
+			Field string `json:"field"`
+			Value struct {
+				Metadata *struct {
+					DisplayPhoneNumber string `json:"display_phone_number"`
+					PhoneNumberID      string `json:"phone_number_id"`
+				} `json:"metadata"`
+				Messages []*whatsAppMessage `json:"messages"`
+			} `json:"value"`
+		} `json:"changes"`
+	} `json:"entry"`
+}
+
+type whatsAppMessage struct {
+	ID   string `json:"id"`
+	From string `json:"from"`
+	Type string `json:"type"`
+	Text *struct {
+		Body string `json:"body"`
+	} `json:"text,omitempty"`
+	Reaction *struct {
+		MessageID string `json:"message_id"`
+		Emoji     string `json:"emoji"`
+	} `json:"reaction,omitempty"`
+}
+
+type whatsAppResponse struct {
+	ID       string `json:"id"`
+	Messages []*struct {
+		ID string `json:"id"`
+	} `json:"messages"`
+	DisplayPhoneNumber string `json:"display_phone_number"`
+}
+
+func newWhatsAppConn(conf *config.Config) *whatsAppConn {
+	return &whatsAppConn{
+		config:    conf,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		eventChan: make(chan event),
+	}
+}
+
+func (c *whatsAppConn) Connect(ctx context.Context) (<-chan event, error) {
+	var response whatsAppResponse
+	if err := c.request(http.MethodGet, c.phoneNumberURL("?fields=display_phone_number"), "", nil, &response); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.botNumber = strings.TrimPrefix(strings.ReplaceAll(response.DisplayPhoneNumber, " ", ""), "+")
+	c.connected = true
+	c.mu.Unlock()
+	log.Printf("WhatsApp connected as +%s, listening for webhooks on %s%s", c.botNumber, c.config.WhatsAppAddr, whatsAppWebhookPath)
+	return c.eventChan, nil
+}
+
+func (c *whatsAppConn) Send(channel *channelID, message string) error {
+	_, err := c.SendWithID(channel, message)
+	return err
+}
+
+func (c *whatsAppConn) SendWithID(channel *channelID, message string) (string, error) {
+	params := map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"recipient_type":    "individual",
+		"to":                channel.Channel,
+		"type":              "text",
+		"text":              map[string]interface{}{"body": message, "preview_url": false},
+	}
+	return c.sendMessage(params)
+}
+
+func (c *whatsAppConn) SendEphemeral(channel *channelID, _, message string) error {
+	return c.Send(channel, message) // Every chat is a DM, so the message is only visible to the user anyway
+}
+
+func (c *whatsAppConn) SendDM(userID string, message string) error {
+	return c.Send(&channelID{Channel: userID}, message)
+}
+
+func (c *whatsAppConn) OpenDM(userID string) (string, error) {
+	return userID, nil // Every chat is a DM, and the channel ID is the user's phone number
+}
+
+func (c *whatsAppConn) UploadFile(channel *channelID, message string, filename string, _ string, file io.Reader) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err := writer.WriteField("messaging_product", "whatsapp"); err != nil {
+		return err
+	} else if err := writer.WriteField("type", "text/plain"); err != nil {
+		return err
+	}
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	} else if _, err := io.Copy(part, file); err != nil {
+		return err
+	} else if err := writer.Close(); err != nil {
+		return err
+	}
+	var response whatsAppResponse
+	if err := c.request(http.MethodPost, c.phoneNumberURL("/media"), writer.FormDataContentType(), &body, &response); err != nil {
+		return err
+	}
+	params := map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"recipient_type":    "individual",
+		"to":                channel.Channel,
+		"type":              "document",
+		"document":          map[string]interface{}{"id": response.ID, "filename": filename, "caption": message},
+	}
+	_, err = c.sendMessage(params)
+	return err
+}
+
+// Update posts the message as a new message, since WhatsApp does not support editing messages sent by the bot
+func (c *whatsAppConn) Update(channel *channelID, _ string, message string) error {
+	return c.Send(channel, message)
+}
+
+func (c *whatsAppConn) Delete(_ *channelID, _ string) error {
+	return errDeleteNotSupported
+}
+
+func (c *whatsAppConn) React(_ *channelID, _ string, _ string) error {
+	return errReactNotSupported
+}
+
+func (c *whatsAppConn) Archive(_ *channelID) error {
+	return nil
+}
+
+func (c *whatsAppConn) SendStatus(_ *channelID, _ *statusMessage) (string, error) {
+	return "", errStatusNotSupported
+}
+
+func (c *whatsAppConn) UpdateStatus(_ *channelID, _ string, _ *statusMessage) error {
+	return errStatusNotSupported
+}
+
+func (c *whatsAppConn) SendButtons(_ *channelID, _ string, _ []*config.Button) (string, error) {
+	return "", errButtonsNotSupported
+}
+
+func (c *whatsAppConn) SetTitle(_ *channelID, _ string) error {
+	return errTitleNotSupported
+}
+
+func (c *whatsAppConn) Join(_ string) error {
+	return errJoinNotSupported
+}
+
+func (c *whatsAppConn) Leave(_ string) error {
+	return errJoinNotSupported
+}
+
+func (c *whatsAppConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+	return nil
+}
+
+func (c *whatsAppConn) MaxMessageLength() int {
+	return whatsAppMessageLengthLimit
+}
+
+func (c *whatsAppConn) SupportsANSI() bool {
+	return false
+}
+
+func (c *whatsAppConn) CollapseMode() collapseMode {
+	return collapseNone
+}
+
+// Format renders text using the common Markdown flavor, except for plain text, which is sent as is, because
+// WhatsApp does not support backslash escapes, and code blocks, see escapedCodeBlock
+func (c *whatsAppConn) Format(text string, format messageFormat) string {
+	switch format {
+	case formatText:
+		return text
+	case formatCode, formatANSI:
+		return escapedCodeBlock(text, "") // WhatsApp only supports three-backtick fences, and no colors
+	}
+	return renderMarkdown(text, format)
+}
+
+func (c *whatsAppConn) Connected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected
+}
+
+func (c *whatsAppConn) MentionBot() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return "@" + c.botNumber
+}
+
+func (c *whatsAppConn) Mention(user string) string {
+	return "@" + user
+}
+
+// ParseMention parses a user mention of the form @<phone>, e.g. @491701234567 or @+491701234567
+func (c *whatsAppConn) ParseMention(user string) (string, error) {
+	if matches := whatsAppMentionRegex.FindStringSubmatch(user); len(matches) > 0 {
+		return matches[1], nil
+	}
+	return "", errors.New("invalid user")
+}
+
+func (c *whatsAppConn) Unescape(s string) string {
+	s = whatsAppCodeBlockRegex.ReplaceAllString(s, "$1")
+	s = whatsAppCodeRegex.ReplaceAllString(s, "$1")
+	return s
+}
+
+// ServeHTTP handles the webhook verification request and incoming webhooks from WhatsApp, see Bot.Run
+func (c *whatsAppConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != whatsAppWebhookPath {
+		http.NotFound(w, r)
+		return
+	} else if r.Method == http.MethodGet {
+		c.handleVerification(w, r)
+		return
+	} else if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, whatsAppMaxRequestSize))
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := c.verifySignature(r.Header.Get(whatsAppSignatureHeader), body); err != nil {
+		log.Printf("[whatsapp] Rejecting request: %s", err.Error())
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var webhook whatsAppWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		http.Error(w, "invalid webhook", http.StatusBadRequest)
+		return
+	}
+	for _, ev := range c.translateWebhook(&webhook) {
+		select {
+		case c.eventChan <- ev:
+		case <-r.Context().Done():
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleVerification answers the challenge WhatsApp sends when the webhook is configured, see
+// https://developers.facebook.com/docs/graph-api/webhooks/getting-started#verification-requests
+func (c *whatsAppConn) handleVerification(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	token := query.Get("hub.verify_token")
+	if query.Get("hub.mode") != "subscribe" || !hmac.Equal([]byte(token), []byte(c.config.WhatsAppVerifyToken)) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	_, _ = io.WriteString(w, query.Get("hub.challenge"))
+}
+
+// verifySignature verifies the HMAC-SHA256 signature of the request body, using the app secret
+func (c *whatsAppConn) verifySignature(signature string, body []byte) error {
+	if !strings.HasPrefix(signature, whatsAppSignaturePrefix) {
+		return errors.New("missing or malformed signature")
+	}
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, whatsAppSignaturePrefix))
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	mac := hmac.New(sha256.New, []byte(c.config.WhatsAppAppSecret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func (c *whatsAppConn) translateWebhook(webhook *whatsAppWebhook) []event {
+	events := make([]event, 0)
+	if webhook.Object != "whatsapp_business_account" {
+		return events
+	}
+	for _, entry := range webhook.Entry {
+		for _, change := range entry.Changes {
+			if change.Field != "messages" {
+				continue
+			} else if change.Value.Metadata != nil && change.Value.Metadata.PhoneNumberID != c.config.WhatsAppPhoneID {
+				continue // Webhooks are per app, so they may include other numbers of the same business account
+			}
+			for _, message := range change.Value.Messages {
+				if ev := c.translateMessage(message); ev != nil {
+					events = append(events, ev)
+				}
+			}
+		}
+	}
+	return events
+}
+
+func (c *whatsAppConn) translateMessage(message *whatsAppMessage) event {
+	switch {
+	case message.Type == "text" && message.Text != nil:
+		return &messageEvent{
+			ID:          message.ID,
+			Channel:     message.From,
+			ChannelType: channelTypeDM,
+			User:        message.From,
+			Message:     strings.TrimSpace(message.Text.Body),
+		}
+	case message.Type == "reaction" && message.Reaction != nil && message.Reaction.Emoji != "": // Empty if removed
+		return &reactionEvent{
+			Channel:   message.From,
+			MessageID: message.Reaction.MessageID,
+			User:      message.From,
+			Reaction:  message.Reaction.Emoji,
+		}
+	}
+	return nil // Ignore media, locations, status updates, ...
+}
+
+func (c *whatsAppConn) sendMessage(params map[string]interface{}) (string, error) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	var response whatsAppResponse
+	if err := c.request(http.MethodPost, c.phoneNumberURL("/messages"), "application/json", bytes.NewReader(b), &response); err != nil {
+		return "", err
+	} else if len(response.Messages) == 0 {
+		return "", errors.New("whatsapp response did not include a message ID")
+	}
+	return response.Messages[0].ID, nil
+}
+
+func (c *whatsAppConn) phoneNumberURL(suffix string) string {
+	return fmt.Sprintf("%s/%s%s", whatsAppGraphURL, c.config.WhatsAppPhoneID, suffix)
+}
+
+func (c *whatsAppConn) request(method, url, contentType string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return newRateLimitedError(resp)
+	} else if resp.StatusCode >= 500 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &serverError{StatusCode: resp.StatusCode, Message: string(message)}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("whatsapp request failed with HTTP %d: %s", resp.StatusCode, string(message))
+	} else if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
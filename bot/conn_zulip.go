@@ -0,0 +1,503 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"heckel.io/replbot/config"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	zulipMessageLengthLimit = 10000
+	zulipChannelTopic       = "REPLbot" // Topic used for messages that are not in a "thread", see zulipConn
+	zulipDMChannelPrefix    = "dm:"
+	zulipRetryInterval      = 5 * time.Second
+	zulipErrBadEventQueueID = "BAD_EVENT_QUEUE_ID"
+)
+
+var (
+	zulipUserMentionRegex = regexp.MustCompile(`@_?\*\*([^*|]*)(?:\|(\d+))?\*\*`)
+	zulipCodeBlockRegex   = regexp.MustCompile("```([^`]+)```")
+	zulipCodeRegex        = regexp.MustCompile("`([^`]+)`")
+)
+
+// zulipConn is an implementation of conn for Zulip, using the REST API and the real-time events API.
+//
+// Zulip's streams and topics map onto channels and threads: the channel is the stream name, and the
+// thread is the topic. Since every Zulip message has a topic, messages in the zulipChannelTopic topic are
+// treated as "main channel" messages (empty thread), and messages to the main channel are sent to that topic.
+// Direct messages use the channel "dm:<user-id>".
+type zulipConn struct {
+	config    *config.Config
+	client    *http.Client
+	userID    string
+	name      string
+	names     map[string]string // user ID -> full name
+	queue     string
+	connected bool
+	mu        sync.RWMutex
+}
+
+type zulipResponse struct {
+	Result string `json:"result"`
+	Msg    string `json:"msg"`
+	Code   string `json:"code"`
+}
+
+type zulipUser struct {
+	UserID   int    `json:"user_id"`
+	FullName string `json:"full_name"`
+}
+
+type zulipEvent struct {
+	ID        int           `json:"id"`
+	Type      string        `json:"type"`
+	Op        string        `json:"op"`
+	Message   *zulipMessage `json:"message"`
+	MessageID int           `json:"message_id"` // reaction events only
+	UserID    int           `json:"user_id"`    // reaction events only
+	EmojiName string        `json:"emoji_name"` // reaction events only
+}
+
+type zulipMessage struct {
+	ID               int             `json:"id"`
+	Type             string          `json:"type"`
+	SenderID         int             `json:"sender_id"`
+	SenderFullName   string          `json:"sender_full_name"`
+	DisplayRecipient json.RawMessage `json:"display_recipient"`
+	Subject          string          `json:"subject"`
+	Content          string          `json:"content"`
+}
+
+func newZulipConn(conf *config.Config) *zulipConn {
+	return &zulipConn{
+		config: conf,
+		client: &http.Client{},
+		names:  make(map[string]string),
+	}
+}
+
+func (c *zulipConn) Connect(ctx context.Context) (<-chan event, error) {
+	var me zulipUser
+	if err := c.request(ctx, http.MethodGet, "/users/me", nil, &me); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.userID = strconv.Itoa(me.UserID)
+	c.name = me.FullName
+	c.mu.Unlock()
+	log.Printf("Zulip connected as user %s/%d", me.FullName, me.UserID)
+	eventChan := make(chan event)
+	go c.eventLoop(ctx, eventChan)
+	return eventChan, nil
+}
+
+func (c *zulipConn) Send(channel *channelID, message string) error {
+	_, err := c.SendWithID(channel, message)
+	return err
+}
+
+func (c *zulipConn) SendWithID(channel *channelID, message string) (string, error) {
+	params := c.messageParams(channel)
+	params.Set("content", cropWindow(message, zulipMessageLengthLimit))
+	var response struct {
+		ID int `json:"id"`
+	}
+	if err := c.request(context.Background(), http.MethodPost, "/messages", params, &response); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(response.ID), nil
+}
+
+func (c *zulipConn) SendEphemeral(_ *channelID, userID, message string) error {
+	return c.SendDM(userID, message) // Zulip does not support ephemeral messages
+}
+
+func (c *zulipConn) SendDM(userID string, message string) error {
+	return c.Send(&channelID{Channel: zulipDMChannelPrefix + userID}, message)
+}
+
+func (c *zulipConn) OpenDM(userID string) (string, error) {
+	return zulipDMChannelPrefix + userID, nil
+}
+
+func (c *zulipConn) UploadFile(channel *channelID, message string, filename string, _ string, file io.Reader) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	w, err := mw.CreateFormFile("filename", filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.apiURL("/user_uploads"), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var response struct {
+		URI string `json:"uri"`
+	}
+	if err := c.do(req, &response); err != nil {
+		return err
+	}
+	return c.Send(channel, fmt.Sprintf("%s\n\n[%s](%s)", message, filename, response.URI))
+}
+
+func (c *zulipConn) Update(_ *channelID, id string, message string) error {
+	params := url.Values{}
+	params.Set("content", cropWindow(message, zulipMessageLengthLimit))
+	return c.request(context.Background(), http.MethodPatch, "/messages/"+id, params, nil)
+}
+
+func (c *zulipConn) Delete(_ *channelID, _ string) error {
+	return errDeleteNotSupported
+}
+
+func (c *zulipConn) React(_ *channelID, _ string, _ string) error {
+	return errReactNotSupported
+}
+
+func (c *zulipConn) Archive(_ *channelID) error {
+	return nil
+}
+
+func (c *zulipConn) SendStatus(_ *channelID, _ *statusMessage) (string, error) {
+	return "", errStatusNotSupported
+}
+
+func (c *zulipConn) UpdateStatus(_ *channelID, _ string, _ *statusMessage) error {
+	return errStatusNotSupported
+}
+
+func (c *zulipConn) SendButtons(_ *channelID, _ string, _ []*config.Button) (string, error) {
+	return "", errButtonsNotSupported
+}
+
+func (c *zulipConn) SetTitle(_ *channelID, _ string) error {
+	return errTitleNotSupported
+}
+
+func (c *zulipConn) Join(_ string) error {
+	return errJoinNotSupported
+}
+
+func (c *zulipConn) Leave(_ string) error {
+	return errJoinNotSupported
+}
+
+func (c *zulipConn) Close() error {
+	c.mu.RLock()
+	queue := c.queue
+	c.mu.RUnlock()
+	if queue == "" {
+		return nil
+	}
+	params := url.Values{}
+	params.Set("queue_id", queue)
+	return c.request(context.Background(), http.MethodDelete, "/events", params, nil)
+}
+
+func (c *zulipConn) MaxMessageLength() int {
+	return zulipMessageLengthLimit
+}
+
+func (c *zulipConn) SupportsANSI() bool {
+	return false
+}
+
+func (c *zulipConn) CollapseMode() collapseMode {
+	return collapseNone
+}
+
+func (c *zulipConn) Format(text string, format messageFormat) string {
+	return renderMarkdown(text, format)
+}
+
+func (c *zulipConn) Connected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected
+}
+
+func (c *zulipConn) MentionBot() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return fmt.Sprintf("@**%s**", c.name)
+}
+
+func (c *zulipConn) Mention(user string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return fmt.Sprintf("@**%s|%s**", c.names[user], user)
+}
+
+// ParseMention parses a user mention. Incoming messages are normalized to the whitespace-free format
+// @**|<user-id>** (see normalizeMentions), so user mentions can be parsed as a single field.
+func (c *zulipConn) ParseMention(user string) (string, error) {
+	if matches := zulipUserMentionRegex.FindStringSubmatch(user); len(matches) > 0 && matches[2] != "" {
+		return matches[2], nil
+	}
+	return "", errors.New("invalid user")
+}
+
+func (c *zulipConn) Unescape(s string) string {
+	s = zulipCodeBlockRegex.ReplaceAllString(s, "$1")
+	s = zulipCodeRegex.ReplaceAllString(s, "$1")
+	s = zulipUserMentionRegex.ReplaceAllString(s, "") // Remove entirely!
+	return s
+}
+
+func (c *zulipConn) eventLoop(ctx context.Context, eventChan chan event) {
+	lastEventID := -1
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		c.mu.RLock()
+		queue := c.queue
+		c.mu.RUnlock()
+		if queue == "" {
+			var err error
+			if queue, lastEventID, err = c.register(ctx); err != nil {
+				eventChan <- &errorEvent{err}
+				return
+			}
+		}
+		events, err := c.events(ctx, queue, lastEventID)
+		c.mu.Lock()
+		c.connected = err == nil
+		c.mu.Unlock()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error: %s", err.Error())
+			if err.Error() == zulipErrBadEventQueueID {
+				c.mu.Lock()
+				c.queue = "" // Queue expired, re-register
+				c.mu.Unlock()
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(zulipRetryInterval):
+				continue
+			}
+		}
+		for _, ev := range events {
+			lastEventID = ev.ID
+			if e := c.translateEvent(ev); e != nil {
+				eventChan <- e
+			}
+		}
+	}
+}
+
+func (c *zulipConn) translateReactionEvent(ev *zulipEvent) event {
+	user := strconv.Itoa(ev.UserID)
+	c.mu.RLock()
+	userID := c.userID
+	c.mu.RUnlock()
+	if ev.Op != "add" || user == userID {
+		return nil // Ignore removed and my own reactions
+	}
+	return &reactionEvent{
+		MessageID: strconv.Itoa(ev.MessageID),
+		User:      user,
+		Reaction:  ev.EmojiName,
+	}
+}
+
+func (c *zulipConn) register(ctx context.Context) (queue string, lastEventID int, err error) {
+	params := url.Values{}
+	params.Set("event_types", `["message","reaction"]`)
+	params.Set("apply_markdown", "false")
+	var response struct {
+		QueueID     string `json:"queue_id"`
+		LastEventID int    `json:"last_event_id"`
+	}
+	if err := c.request(ctx, http.MethodPost, "/register", params, &response); err != nil {
+		return "", 0, err
+	}
+	c.mu.Lock()
+	c.queue = response.QueueID
+	c.mu.Unlock()
+	return response.QueueID, response.LastEventID, nil
+}
+
+func (c *zulipConn) events(ctx context.Context, queue string, lastEventID int) ([]*zulipEvent, error) {
+	params := url.Values{}
+	params.Set("queue_id", queue)
+	params.Set("last_event_id", strconv.Itoa(lastEventID))
+	var response struct {
+		Events []*zulipEvent `json:"events"`
+	}
+	if err := c.request(ctx, http.MethodGet, "/events", params, &response); err != nil {
+		return nil, err
+	}
+	return response.Events, nil
+}
+
+func (c *zulipConn) translateEvent(ev *zulipEvent) event {
+	if ev.Type == "reaction" {
+		return c.translateReactionEvent(ev)
+	} else if ev.Type != "message" || ev.Message == nil {
+		return nil // Ignore heartbeats and other events
+	}
+	m := ev.Message
+	sender := strconv.Itoa(m.SenderID)
+	c.mu.Lock()
+	c.names[sender] = m.SenderFullName
+	userID := c.userID
+	c.mu.Unlock()
+	if sender == userID {
+		return nil // Ignore my own messages
+	}
+	var channel, thread string
+	var chType channelType
+	switch m.Type {
+	case "stream":
+		if err := json.Unmarshal(m.DisplayRecipient, &channel); err != nil {
+			return &errorEvent{err}
+		}
+		if m.Subject != zulipChannelTopic {
+			thread = m.Subject
+		}
+		chType = channelTypeChannel
+	case "private":
+		var recipients []*zulipUser
+		if err := json.Unmarshal(m.DisplayRecipient, &recipients); err != nil {
+			return &errorEvent{err}
+		}
+		channel = zulipDMChannelPrefix + sender
+		chType = channelTypeDM
+		if len(recipients) > 2 {
+			chType = channelTypeUnknown // Group DMs are not supported
+		}
+	default:
+		return nil
+	}
+	return &messageEvent{
+		ID:          strconv.Itoa(m.ID),
+		Channel:     channel,
+		ChannelType: chType,
+		Thread:      thread,
+		User:        sender,
+		Message:     c.normalizeMentions(m.Content),
+	}
+}
+
+// normalizeMentions rewrites mentions of the bot to the exact string returned by MentionBot, and all other
+// user mentions to the whitespace-free format @**|<user-id>**, so they can be parsed by ParseMention.
+func (c *zulipConn) normalizeMentions(s string) string {
+	return zulipUserMentionRegex.ReplaceAllStringFunc(s, func(mention string) string {
+		matches := zulipUserMentionRegex.FindStringSubmatch(mention)
+		name, id := matches[1], matches[2]
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		if id == c.userID || (id == "" && name == c.name) {
+			return fmt.Sprintf("@**%s**", c.name)
+		}
+		if id == "" {
+			for userID, fullName := range c.names {
+				if fullName == name {
+					id = userID
+					break
+				}
+			}
+		}
+		if id == "" {
+			return mention
+		}
+		return fmt.Sprintf("@**|%s**", id)
+	})
+}
+
+func (c *zulipConn) messageParams(channel *channelID) url.Values {
+	params := url.Values{}
+	if strings.HasPrefix(channel.Channel, zulipDMChannelPrefix) {
+		params.Set("type", "private")
+		params.Set("to", fmt.Sprintf("[%s]", strings.TrimPrefix(channel.Channel, zulipDMChannelPrefix)))
+		return params
+	}
+	topic := channel.Thread
+	if topic == "" {
+		topic = zulipChannelTopic
+	}
+	params.Set("type", "stream")
+	params.Set("to", channel.Channel)
+	params.Set("topic", topic)
+	return params
+}
+
+func (c *zulipConn) request(ctx context.Context, method, path string, params url.Values, v interface{}) error {
+	var req *http.Request
+	var err error
+	if method == http.MethodGet || method == http.MethodDelete {
+		req, err = http.NewRequestWithContext(ctx, method, c.apiURL(path)+"?"+params.Encode(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, c.apiURL(path), strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return c.do(req, v)
+}
+
+func (c *zulipConn) do(req *http.Request, v interface{}) error {
+	req.SetBasicAuth(c.config.ZulipEmail, c.config.Token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return newRateLimitedError(resp)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	} else if resp.StatusCode >= 500 {
+		return &serverError{StatusCode: resp.StatusCode, Message: string(body)}
+	}
+	var response zulipResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("unexpected response from Zulip (HTTP %d): %s", resp.StatusCode, err.Error())
+	} else if response.Result != "success" {
+		if response.Code == zulipErrBadEventQueueID {
+			return errors.New(zulipErrBadEventQueueID)
+		}
+		return fmt.Errorf("zulip error: %s", response.Msg)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (c *zulipConn) apiURL(path string) string {
+	return strings.TrimSuffix(c.config.ZulipSite, "/") + "/api/v1" + path
+}
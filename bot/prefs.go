@@ -0,0 +1,89 @@
+package bot
+
+import (
+	"encoding/json"
+	"heckel.io/replbot/config"
+	"os"
+	"sync"
+)
+
+// userPrefs are a user's own defaults for new sessions, see Bot.handlePrefsCommand. Empty values
+// are not set, i.e. the script and global defaults apply.
+type userPrefs struct {
+	Size        string             `json:"size,omitempty"`
+	WindowMode  config.WindowMode  `json:"window,omitempty"`
+	ControlMode config.ControlMode `json:"control,omitempty"`
+}
+
+// prefsStore holds the preferences of all users, keyed by the platform user ID. If a file name is given,
+// the preferences are persisted to that file as JSON, and loaded from it when the store is created.
+type prefsStore struct {
+	filename string
+	prefs    map[string]*userPrefs
+	mu       sync.Mutex
+}
+
+func newPrefsStore(filename string) (*prefsStore, error) {
+	s := &prefsStore{
+		filename: filename,
+		prefs:    make(map[string]*userPrefs),
+	}
+	if filename == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.prefs); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns a copy of the user's preferences, or empty preferences if the user has none
+func (s *prefsStore) Get(user string) *userPrefs {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prefs, ok := s.prefs[user]; ok {
+		p := *prefs
+		return &p
+	}
+	return &userPrefs{}
+}
+
+// Set replaces the user's preferences, and persists the store
+func (s *prefsStore) Set(user string, prefs *userPrefs) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := *prefs
+	s.prefs[user] = &p
+	return s.save()
+}
+
+// Reset removes the user's preferences, and persists the store
+func (s *prefsStore) Reset(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.prefs, user)
+	return s.save()
+}
+
+// save writes the preferences to the store's file, if any. The file is replaced atomically, so that a
+// crash cannot leave a partially written file behind. The caller must hold the lock.
+func (s *prefsStore) save() error {
+	if s.filename == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.prefs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFile := s.filename + ".tmp"
+	if err := os.WriteFile(tempFile, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, s.filename)
+}
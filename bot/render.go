@@ -0,0 +1,84 @@
+package bot
+
+import (
+	"sort"
+)
+
+const (
+	// defaultRenderer is the name of the renderer used if the user did not pick one via "render:<name>"
+	defaultRenderer = "code"
+)
+
+// outputRenderers maps the renderer names that can be picked when starting a session via "render:<name>" to
+// the functions that create them. New ways to show the terminal (e.g. as an image) can be plugged in here.
+var outputRenderers = map[string]func(s *session) outputRenderer{
+	"code":  newCodeRenderer,
+	"text":  newTextRenderer,
+	"image": newImageRenderer,
+}
+
+// outputRenderer turns the terminal window into the terminal message, see session.maybeRefreshTerminal
+type outputRenderer interface {
+	// Render returns the message for the given window. raw is the window as captured from the terminal, including
+	// all escape sequences; it is empty if not available, e.g. after the REPL exited. window is the sanitized window
+	// (see session.sanitizeWindow), which may still contain colors if they are enabled. If notice is not empty,
+	// it must be shown below the terminal.
+	Render(raw, window, notice string) string
+}
+
+// backgroundRenderer is implemented by renderers that need to do work outside of Render, e.g. to upload the terminal
+// periodically. run is started when the session starts, and must return when the session exits.
+type backgroundRenderer interface {
+	run() error
+}
+
+// rendererNames returns the sorted names of all renderers, see outputRenderers
+func rendererNames() []string {
+	names := make([]string, 0, len(outputRenderers))
+	for name := range outputRenderers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// codeRenderer shows the terminal as a code block, and crops it so the message does not exceed the max
+// message length (see session.maxMessageLength). This is the default.
+type codeRenderer struct {
+	s *session
+}
+
+func newCodeRenderer(s *session) outputRenderer {
+	return &codeRenderer{s: s}
+}
+
+func (r *codeRenderer) Render(_, window, notice string) string {
+	if notice == "" {
+		return r.s.formatCode(cropWindow(window, r.s.maxMessageLength()-len(r.s.formatCode(""))))
+	}
+	maxLength := r.s.maxMessageLength() - len(r.s.formatCode("")) - len(notice) - 1
+	return r.s.formatCode(cropWindow(window, maxLength)) + "\n" + notice
+}
+
+// textRenderer shows the terminal as plain text without colors, which is easier to read on some platforms
+// (e.g. on phones), but does not keep the columns aligned
+type textRenderer struct {
+	s *session
+}
+
+func newTextRenderer(s *session) outputRenderer {
+	return &textRenderer{s: s}
+}
+
+func (r *textRenderer) Render(_, window, notice string) string {
+	window = sanitizeWindow(window) // Strips colors, if any
+	maxLength := r.s.maxMessageLength()
+	if notice != "" {
+		maxLength -= len(notice) + 1
+	}
+	text := cropWindow(r.s.conn.Format(window, formatText), maxLength)
+	if notice != "" {
+		text += "\n" + notice
+	}
+	return text
+}
@@ -0,0 +1,165 @@
+package bot
+
+import (
+	"bytes"
+	_ "embed" // go:embed requires this
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	imageRenderedMessage = "🖼 The terminal is shown as an image below, refreshed every %s if it changed."
+	imageExitedMessage   = "🖼 The terminal was shown as an image. (REPL exited.)"
+	imageUploadedMessage = "Terminal (%dx%d)"
+	imageFileName        = "terminal.png"
+	imageFileType        = "image/png"
+
+	// Geometry of the glyphs in render_font.png: 96 glyphs (ASCII 0x20-0x7e and U+FFFD for everything else),
+	// stacked vertically, each fontWidth x fontHeight pixels. Glyphs are fontAdvance pixels apart in the image.
+	fontWidth       = 6
+	fontHeight      = 13
+	fontAdvance     = 7
+	fontFirst       = 0x20
+	fontLast        = 0x7e
+	fontReplacement = fontLast - fontFirst + 1
+	imagePadding    = 8
+)
+
+var (
+	// fontSource is the 6x13 "fixed" font from the X11 misc-fixed font files (public domain), see render_font.png
+	//go:embed render_font.png
+	fontSource []byte
+	fontMask   = mustDecodeFont(fontSource)
+
+	imageBackground = color.RGBA{R: 0x1e, G: 0x1e, B: 0x1e, A: 0xff}
+	imageForeground = color.RGBA{R: 0xd4, G: 0xd4, B: 0xd4, A: 0xff}
+)
+
+// imageRenderer shows the terminal as a PNG image, so that tables and full-screen programs (e.g. htop) keep their
+// layout exactly. Since images cannot be replaced on most platforms, a new image is uploaded to the terminal channel
+// at most every config.Config.ImageRefreshInterval, and only if the terminal changed. The terminal message itself
+// only points to the images.
+type imageRenderer struct {
+	s        *session
+	window   string // latest window, as passed to Render
+	uploaded string // window of the last uploaded image
+	mu       sync.Mutex
+}
+
+func newImageRenderer(s *session) outputRenderer {
+	return &imageRenderer{s: s}
+}
+
+func (r *imageRenderer) Render(raw, window, notice string) string {
+	message := fmt.Sprintf(imageRenderedMessage, r.s.conf.global.ImageRefreshInterval)
+	if raw == "" {
+		message = imageExitedMessage
+	} else {
+		r.mu.Lock()
+		r.window = sanitizeWindow(window) // Strips colors, if any
+		r.mu.Unlock()
+	}
+	if notice != "" {
+		message += "\n" + notice
+	}
+	return message
+}
+
+// run periodically uploads the latest window as an image, until the session exits. It is started by the session
+// because imageRenderer implements backgroundRenderer.
+func (r *imageRenderer) run() error {
+	for {
+		select {
+		case <-r.s.ctx.Done():
+			return errExit
+		case <-time.After(r.s.conf.global.ImageRefreshInterval):
+			if err := r.maybeUpload(); err != nil {
+				r.s.logf("warning", "Warning: unable to upload terminal image: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (r *imageRenderer) maybeUpload() error {
+	r.mu.Lock()
+	window := r.window
+	r.mu.Unlock()
+	if window == "" || window == r.uploaded {
+		return nil
+	}
+	r.s.mu.RLock()
+	width, height := r.s.conf.size.Width, r.s.conf.size.Height
+	r.s.mu.RUnlock()
+	b, err := renderImage(window, width, height)
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf(imageUploadedMessage, width, height)
+	terminal, _ := r.s.terminalTarget("")
+	if err := r.s.conn.UploadFile(terminal, message, imageFileName, imageFileType, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	r.uploaded = window
+	return nil
+}
+
+// renderImage draws the window onto a PNG image of a terminal with the given geometry (in characters). Lines and
+// columns outside the terminal are cut off, so the image size stays the same as long as the terminal is not resized.
+func renderImage(window string, width, height int) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, width*fontAdvance+2*imagePadding, height*fontHeight+2*imagePadding))
+	draw.Draw(img, img.Bounds(), image.NewUniform(imageBackground), image.Point{}, draw.Src)
+	fg := image.NewUniform(imageForeground)
+	for y, line := range strings.Split(window, "\n") {
+		if y >= height {
+			break
+		}
+		x := 0
+		for _, c := range line {
+			if x >= width {
+				break
+			}
+			cell := image.Rect(0, 0, fontAdvance, fontHeight).Add(image.Pt(imagePadding+x*fontAdvance, imagePadding+y*fontHeight))
+			if c == '█' { // Cursor, see addCursor
+				draw.Draw(img, cell, fg, image.Point{}, draw.Src)
+			} else if c != ' ' {
+				draw.DrawMask(img, cell, fg, image.Point{}, fontMask, image.Pt(0, glyphIndex(c)*fontHeight), draw.Over)
+			}
+			x++
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// glyphIndex returns the index of the glyph for c in fontMask; characters that the font does not have
+// are drawn as U+FFFD (replacement character)
+func glyphIndex(c rune) int {
+	if c < fontFirst || c > fontLast {
+		return fontReplacement
+	}
+	return int(c - fontFirst)
+}
+
+// mustDecodeFont converts the embedded grayscale font image to an alpha mask, so that glyphs can be drawn in any color
+func mustDecodeFont(b []byte) *image.Alpha {
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		panic(err)
+	}
+	mask := image.NewAlpha(img.Bounds())
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			mask.SetAlpha(x, y, color.Alpha{A: color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y})
+		}
+	}
+	return mask
+}
@@ -5,17 +5,20 @@ import (
 	"bufio"
 	"context"
 	_ "embed" // go:embed requires this
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 	"golang.org/x/sync/errgroup"
 	"heckel.io/replbot/config"
 	"heckel.io/replbot/util"
 	"io"
-	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -23,6 +26,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
 	"unicode"
@@ -31,21 +35,66 @@ import (
 const (
 	sessionStartedMessage = "🚀 REPL session started, %s. Type `!help` to see a list of available commands, or `!exit` to forcefully " +
 		"exit the REPL."
+	readOnlyModeStartedMessage = "🚀 REPL session started, %s. 📺 I'm in *read-only mode*, so you can watch, but nobody can type into this session. " +
+		"It ends when the REPL exits, or after %s."
 	splitModeThreadMessage              = "Use this thread to enter your commands. Your output will appear in the main channel."
 	onlyMeModeMessage                   = "*Only you as the session owner* can send commands. Use the `!allow` command to let other users control the session."
 	everyoneModeMessage                 = "*Everyone in this channel* can send commands. Use the `!deny` command specifically revoke access from users."
 	sessionExitedMessage                = "👋 REPL exited. See you later!"
+	downloadHelpMessage                 = "Use the `!download` command to download a file from the session's working directory, like so: `!download build/output.log`. Files may be up to %d MB."
+	downloadNotSupportedMessage         = "🙁 I'm sorry, but downloads are only possible if the session has a working directory. Ask your REPLbot admin to set `work-dir`."
+	downloadNotAllowedMessage           = "🙁 I cannot send you _%s_. Only regular files inside the session's working directory can be downloaded."
+	downloadTooLargeMessage             = "🙁 I'm sorry, but _%s_ is too large. Files may be up to %d MB."
+	downloadFailedMessage               = "🙁 I'm sorry, but I could not upload _%s_: %s"
+	downloadMessage                     = "📦 Here's the file _%s_ you asked for."
+	sendFileHelpMessage                 = "Use the `!send-file-contents` command to paste a file from the session's working directory into the terminal, e.g. to load function definitions into a REPL: `!send-file-contents lib/utils.py`. Files may be up to %d KB."
+	sendFileNotSupportedMessage         = "🙁 I'm sorry, but sending files is only possible if the session has a working directory. Ask your REPLbot admin to set `work-dir`."
+	sendFileNotAllowedMessage           = "🙁 I cannot paste _%s_. Only regular files inside the session's working directory can be sent."
+	sendFileTooLargeMessage             = "🙁 I'm sorry, but _%s_ is too large. Files may be up to %d KB."
+	cdHelpMessage                       = "Use the `!cd` command to change the directory I use when the REPL is restarted, and for `!download` and `!send-file-contents`, like so: `!cd src`. The current directory is _%s_."
+	cdNotSupportedMessage               = "🙁 I'm sorry, but changing directories is only possible if the session has a working directory. Ask your REPLbot admin to set `work-dir`."
+	cdNotAllowedMessage                 = "🙁 I cannot change to _%s_. Only directories inside the session's working directory are allowed."
+	cdChangedMessage                    = "📂 Okay, the current directory is now _%s_. It is used when the REPL is restarted, and for `!download` and `!send-file-contents`."
+	ephemeralMessage                    = "🗑️ This session is *ephemeral*: I'll delete all my messages when it ends, so the output won't be retrievable afterwards."
+	readyWaitMessage                    = "⏳ The REPL is still starting. I'll hold on to your input until it's ready."
+	readyMessage                        = "✅ The REPL is ready."
+	readyTimeoutMessage                 = "⚠️ The REPL did not seem to be ready after %s, so I'm sending your input anyway."
+	restartedMessage                    = "🔄 Restarted _%s_."
+	restartNotSupportedMessage          = "🙁 I'm sorry, but recorded sessions and terminal sharing sessions cannot be restarted."
+	killedMessage                       = "🛑 Okay, I sent SIGTERM to the running command."
+	killNoCommandMessage                = "🤷 There is no command running in the REPL right now. To interrupt it, use `!stop`; to end the session, use `!exit`."
+	killFailedMessage                   = "🙁 I couldn't terminate the running command: %s"
+	buttonsMessage                      = "🎛️ Click a button to send it to the REPL, or type `!help` to see all commands."
+	outputLimitMessage                  = "🛑 Output limit reached (%s), interrupting the command with Ctrl-C."
+	outputLimitClosingMessage           = "🛑 Output limit reached (%s) again, even though I interrupted the command. Closing the session."
+	colorSnapshotMessage                = "🎨 Colors can't be shown in the terminal here, so here's a colored snapshot of it."
+	historyUploadedMessage              = "📜 Here's the terminal history you asked for."
+	transcriptUploadedMessage           = "📜 Here's the transcript of this session so far, including everyone's input."
+	transcriptHistoryUploadedMessage    = "📜 Session logging is not enabled, so here's the entire scrollback history of this session instead."
+	transcriptTruncatedMessage          = "[... transcript truncated, showing the last %d MB ...]\n"
+	outputSkippedMessage                = "_(Some output was skipped, because the chat is rate-limiting me.)_"
+	lastInputMessage                    = "_(Last input by %s)_"
+	partialLineTimeoutMessage           = "⏱️ %s did not finish their line within %s, so I'm sending the input of others that I held back."
+	binaryOutputSuppressedMessage       = "(binary output suppressed, %d bytes)"
+	binaryOutputUploadedMessage         = "📦 The REPL printed binary output, which I cannot show here. You can find it in the file below."
+	sessionTerminatedMessage            = "💥 REPL session terminated unexpectedly. It looks like the terminal was killed outside of REPLbot."
+	stderrThreadMessage                 = "🪵 This thread shows the error output (stderr) of the REPL session, so that it doesn't clutter the terminal."
+	sessionSendFailedMessage            = "💥 REPL session closed, because I could not send messages here: %s"
 	sessionExitedWithRecordingMessage   = "👋 REPL exited. You can find a recording of the session in the file below."
 	sessionAsciinemaLinkMessage         = "Here's a link to the recording: %s"
 	sessionAsciinemaExpiryMessage       = "(expires in %s)"
-	timeoutWarningMessage               = "⏱️ Are you still there, %s? Your session will time out in one minute. Type `!alive` to keep your session active."
+	timeoutWarningMessage               = "⚠️ Are you still there, %s? This session will close in %s due to inactivity. Type anything (or `!alive`) to keep it alive."
+	timeoutWarningClearedMessage        = "~This session was about to close due to inactivity.~ Welcome back, %s! 👋"
+	maxDurationWarningMessage           = "⏳ Heads up, %s: this session will close in %s, because sessions can run for at most %s."
+	maxDurationReachedMessage           = "⏰ This session has been running for %s, which is the maximum. Closing it now."
 	forceCloseMessage                   = "🏃 REPLbot has to go. Urgent REPL-related business. Sorry about that!"
-	resizeCommandHelpMessage            = "Use the `!resize` command to resize the terminal, like so: !resize medium.\n\nAllowed sizes are `tiny`, `small`, `medium` or `large`."
-	messageLimitWarningMessage          = "Note that Discord has a message size limit of 2000 characters, so your messages may be truncated if they get to large."
+	resizeCommandHelpMessage            = "Use the `!resize` command to resize the terminal, like so: !resize medium.\n\nAllowed sizes are `tiny`, `small`, `medium` or `large`, or a custom size like `120x40`."
+	messageLimitWarningMessage          = "Note that messages are limited to %d characters here, so the terminal will be cropped if it gets too large."
 	usersAddedToAllowList               = "👍 Okay, I added the user(s) to the allow list."
 	usersAddedToDenyList                = "👍 Okay, I added the user(s) to the deny list."
 	cannotAddOwnerToDenyList            = "🙁 I don't think adding the session owner to the deny list is a good idea. I must protest."
 	recordingTooLargeMessage            = "🙁 I'm sorry, but you've produced too much output in this session. You may want to run a session with `norecord` to avoid this problem."
+	shareStartWebSocketMessage          = "\n\nIf you don't have SSH, you can use Node.js 22 or later instead:\n\n```node -e \"$(curl -fsS http://%s/share/%s/client.js)\"```"
 	shareStartCommandMessage            = "To start your terminal sharing session, please run the following command from your terminal:\n\n```bash -c \"$(ssh -T -p %s %s@%s $USER)\"```"
 	sessionWithWebStartReadOnlyMessage  = "Everyone can also view the session via http://%s/%s. Use `!web rw` to switch the web terminal to read-write mode, or `!web off` to turn if off."
 	sessionWithWebStartReadWriteMessage = "Everyone can also *view and control* the session via http://%s/%s. Use `!web ro` to switch the web terminal to read-only mode, or `!web off` to turn if off."
@@ -57,8 +106,81 @@ const (
 		"This is similar `echo -n` in a shell."
 	escapeHelpMessage = "Use the `!e` command to interpret the escape sequences `\\n` (new line), `\\r` (carriage return), `\\t` (tab), `\\b` (backspace) and `\\x..` (hex " +
 		"representation of any byte), e.g. `Hi\\bI` will show up as `HI`. This is is similar to `echo -e` in a shell."
+	keyHelpMessage          = "Use the `!key` command to send named keys, e.g. to drive full-screen programs like `vim` or `htop`, like so: `!key esc`, or `!key home end`. Available keys: %s, and `f1` to `f12`."
+	sendHexHelpMessage      = "Use the `!send` command to send raw bytes in hex, e.g. `!send 1b5b41` for the up key (ESC [ A), or `!send 1b 3a 77 71 0d` to save and quit in `vim`. At most %d bytes can be sent at once."
+	sendHexInvalidMessage   = "🙁 I couldn't read that as hex: %s. Use two hex digits per byte, like so: `!send 1b5b41`."
+	sendHexTooLongMessage   = "🙁 That's too many bytes. At most %d bytes can be sent at once."
+	forceHelpMessage        = "Use the `!force` command to send a command that I held back because it looked dangerous, e.g. `!force rm -rf build/`. Only the session owner can use it."
+	dangerousCommandMessage = "⚠️ I did not send this, because it looks like a dangerous command (it matches `%s`). " +
+		"If you really mean it, the session owner can send it anyway with `!force ...`."
 	sendKeysHelpMessage = "Use any of the send-key commands (`!c`, `!esc`, ...) to send common keyboard shortcuts, e.g. `!d` to send Ctrl-D, or `!up` to send the up key.\n\n" +
 		"You may also combine them in a sequence, like so: `!c-b d` (Ctrl-B + d), or `!up !up !down !down !left !right !left !right b a`."
+	completeHelpMessage = "Use the `!complete` command to see what the REPL would complete, like so: `!complete os.pa`. I'll type the text, hit tab, " +
+		"show you what the REPL suggested, and then clear the line again."
+	completeMessage        = "Here's what the REPL suggested for _%s_:\n%s"
+	completeNoneMessage    = "🤷 The REPL didn't suggest anything for _%s_."
+	pasteStartedMessage    = "📋 Okay, I'm in paste mode. Send the lines you'd like to paste, and type `!end` when you're done. I'll send them all at once."
+	pasteTimeoutMessage    = "⏱️ I didn't get an `!end` from you, so I pasted what I had so far."
+	pasteNotStartedMessage = "Use the `!paste` command to start pasting a multi-line block, and `!end` to send it."
+	sleepHelpMessage       = "Use the `!sleep` command to wait before sending the next input, e.g. to give a service time to start, like so: `!sleep 5s`. " +
+		"This is most useful in macros and `!paste` blocks. Session commands like `!c` or `!exit` are not delayed. I'll wait for at most %s."
+	sessionBusyMessage      = "⏳ I'm sorry, but the session is busy, so I dropped your input. Please try again in a moment."
+	authCommandHelpMessage  = "Use the `!auth` command to change who can send commands, like so: `!auth everyone`, `!auth only-me`, or `!auth users:%s,%s`"
+	authUsersModeMessage    = "*Only you and the following users* can send commands: %s"
+	ownerOnlyCommandMessage = "🙁 I'm sorry, but only the session owner can use the `%s` command."
+	readOnlyEnabledMessage  = "🔒 This session is now *read-only*. Everyone can still watch, but only the session owner can send commands. Type `!readonly off` to turn it off."
+	readOnlyDisabledMessage = "🔓 This session is no longer read-only. "
+	macroHelpMessage        = "Use `!macro NAME = TEXT` to define a macro, and then type `!NAME` to send _TEXT_, like so: `!macro deploy = kubectl apply -f deploy.yaml`. " +
+		"Macros may span multiple lines, and may contain commands like `!c` or `!e`, or other macros.\n\nUse `!macro list` to list all macros, and `!macro rm NAME` to remove one."
+	macroSavedMessage         = "👍 Okay, I saved the macro. Type `!%s` to run it."
+	macroRemovedMessage       = "👍 Okay, I removed the macro `!%s`."
+	macroNotFoundMessage      = "🙁 There is no macro called `!%s`. Type `!macro list` to see all macros."
+	macroInvalidNameMessage   = "🙁 I'm sorry, but _%s_ cannot be used as a macro name. Names must start with a letter, may only contain letters, digits, `-` and `_`, and must not be the name of a command."
+	macroTooManyMessage       = "🙁 I'm sorry, but a session can have at most %d macros. Use `!macro rm NAME` to remove one."
+	macroTooDeepMessage       = "🙁 I stopped running the macro `!%s`, because macros can only call each other %d levels deep."
+	macroListMessage          = "Here are the macros of this session:\n%s"
+	macroListEmptyMessage     = "There are no macros in this session yet. Use `!macro NAME = TEXT` to define one."
+	modeHelpMessage           = "Use `!mode thread` to show the terminal in this thread, or `!mode split` to show it in the main channel (currently: _%s_)."
+	modeChangedMessage        = "👍 Okay, the session is now in _%s_ mode. The terminal will be shown here from now on."
+	modeMovedMessage          = "🚚 The session switched to _%s_ mode, so the terminal moved. Commands still go to the session's thread."
+	modeUnchangedMessage      = "The session is already in _%s_ mode."
+	modeChannelMessage        = "🙁 I'm sorry, but the session's thread cannot be moved to the main channel. Use `!mode split` to show the terminal there."
+	modeNotSupportedMessage   = "🙁 I'm sorry, but sessions started in the main channel cannot change their mode, since there is no thread to move the terminal to."
+	dmHelpMessage             = "Use `!dm` to control this session from a direct message with me, so that this channel stays quiet. The terminal stays where it is, unless you type `!dm all`."
+	dmMovedMessage            = "📬 %s now controls this session from a direct message with me. The terminal stays here."
+	dmMovedAllMessage         = "📬 %s moved this session to a direct message with me, including the terminal."
+	dmStartedMessage          = "📬 This session is now controlled from here. Type your commands here, or `!help` to see what you can do."
+	dmAlreadyMessage          = "This session is already controlled from a direct message."
+	dmTakenMessage            = "🙁 I'm sorry, but another session is already controlled from your direct messages with me. Exit that one first."
+	dmFailedMessage           = "🙁 I'm sorry, but I couldn't open a direct message with you."
+	detachedMessage           = "🔌 Detached from session _%s_. It keeps running, and you can reconnect from anywhere by tagging me like so: %s attach %s"
+	detachNotNamedMessage     = "🙁 I'm sorry, but only named sessions can be detached. Start one with `name:<name>`, e.g. `@replbot bash name:myshell`."
+	attachedMessage           = "🔌 Attached to session _%s_. Type your commands here, or `!help` to see what you can do."
+	attachedElsewhereMessage  = "🔌 %s attached to this session somewhere else, so it is no longer controlled from here."
+	readOnlyHelpMessage       = "Use `!readonly on` to make the session read-only for everyone but the session owner, and `!readonly off` to turn it back off."
+	pausedMessage             = "⏸️ Terminal updates are *paused*. The REPL keeps running, and I'll hold on to its output until you type `!resume`."
+	pausedAlreadyMessage      = "The terminal is already paused. Type `!resume` to show what happened in the meantime."
+	resumedMessage            = "▶️ Terminal updates resumed. Here's the output of the last %s:"
+	resumedEmptyMessage       = "▶️ Terminal updates resumed. There was no new output while the terminal was paused."
+	resumedDroppedMessage     = "⚠️ Only the last %d lines are shown, %d earlier line(s) were dropped."
+	envMessage                = "Here are the environment variables I set for the REPL, on top of my own environment (secrets are redacted):\n%s"
+	resumeNotPausedMessage    = "The terminal is not paused. Use `!pause` to hold back terminal updates, e.g. while a command prints lots of output."
+	historyCommandHelpMessage = "Use the `!history` command to show the last lines of the terminal, including lines that scrolled out of view, " +
+		"like so: !history 50\n\nYou may show up to %d lines (default: %d)."
+	infoMessage = "ℹ️ Here's what I know about this session:\n\n" +
+		"  Script: _%s_\n" +
+		"  Owner: %s\n" +
+		"  Control mode: _%s_\n" +
+		"  Window mode: _%s_\n" +
+		"  Auth mode: _%s_\n" +
+		"  Terminal size: _%s_ (%dx%d)\n" +
+		"  Uptime: %s"
+	infoShareMessage        = "\n  Terminal sharing: via `%s`"
+	infoTagsMessage         = "\n  Tags: %s"
+	infoNameMessage         = "\n  Name: _%s_ (use `!detach` to detach, idle timeout: %s)"
+	infoAttachMessage       = "\n  Local attach: `%s` (on the REPLbot host, detach with %s)"
+	infoMaxDurationMessage  = "\n  Max duration: %s (closes in %s)"
+	infoShareOwnerMessage   = "Your terminal sharing session uses the relay port %d. Here's the command to connect again:\n\n```bash -c \"$(ssh -T -p %s %s@%s $USER)\"```"
 	authModeChangeMessage   = "👍 Okay, I updated the auth mode: "
 	sessionKeptAliveMessage = "I'm glad you're still here 😀"
 	webStoppedMessage       = "👍 Okay, I stopped the web terminal."
@@ -69,38 +191,152 @@ const (
 	webHelpMessage          = "To enable it, simply type `!web rw` (read-write) or `!web ro` (read-only). Type `!web off` to turn if back off."
 	webNotWorkingMessage    = "🙁 I'm sorry, but I can't start the web terminal for you."
 	webNotSupportedMessage  = "🙁 I'm sorry, but the web terminal feature is not enabled."
-	helpMessage             = "Alright, buckle up. Here's a list of all the things you can do in this REPL session.\n\n" +
+	titleHelpMessage        = "Use the `!title` command to give this session a meaningful title, like so: `!title python - debugging issue #42`"
+	titleHeaderMessage      = "📌 *%s*\n\n"
+
+	// Titles and field names of status messages, see statusMessage
+	statusStartedTitle     = "🚀 %s"
+	statusTitleTitle       = "📌 %s"
+	statusExitedTitle      = "👋 %s"
+	statusHelpTitle        = "ℹ️ Session commands"
+	statusOwnerField       = "Owner"
+	statusControlModeField = "Control mode"
+	statusWindowModeField  = "Window mode"
+	statusAuthModeField    = "Auth mode"
+	statusSizeField        = "Terminal size"
+	statusUptimeField      = "Uptime"
+	titleChangedMessage    = "👍 Okay, I changed the session title to _%s_."
+	commentHelpMessage     = "  `%s ..` - Comment, ignored entirely\n"
+	helpMessage            = "Alright, buckle up. Here's a list of all the things you can do in this REPL session.\n\n" +
 		"Sending text:\n" +
 		"  `TEXT` - Sends _TEXT\\n_\n" +
 		"  `!n TEXT` - Sends _TEXT_ (no new line)\n" +
-		"  `!e TEXT` - Sends _TEXT_ (interprets _\\n_, _\\r_, _\\t_, _\\b_ & _\\x.._)\n\n" +
+		"  `!e TEXT` - Sends _TEXT_ (interprets _\\n_, _\\r_, _\\t_, _\\b_ & _\\x.._)\n" +
+		"  `!paste`, `!end` - Sends multi-line block at once\n" +
+		"  `!sleep 5s` - Waits before sending the next input\n" +
+		"  `!force TEXT` - Sends _TEXT\\n_, even if it looks dangerous\n\n" +
 		"Sending keys (can be combined):\n" +
 		"  `!r` - Return key\n" +
-		"  `!t`, `!tt` - Tab / double-tab\n" +
+		"  `!t`, `!tab`, `!tt` - Tab / double-tab\n" +
 		"  `!up`, `!down`, `!left`, `!right` - Cursor\n" +
 		"  `!pu`, `!pd` - Page up / page down\n" +
 		"  `!a`, `!b`, `!c`, `!d`, `!c-..` - Ctrl-..\n" +
-		"  `!esc`, `!space` - Escape/Space\n\n" +
+		"  `!stop` - Ctrl-C, interrupts the running command\n" +
+		"  `!esc`, `!space` - Escape/Space\n" +
+		"  `!home`, `!bs`, `!del` - Home/Backspace/Delete\n" +
+		"  `!key NAME ..` - Named keys, e.g. _end_, _pagedown_\n" +
+		"  `!send HEX` - Raw bytes, e.g. _1b5b41_ (up)\n" +
 		"  `!f1`, `!f2`, ... - F1, F2, ...\n\n" +
 		"Other commands:\n" +
-		"  `!! ..` - Comment, ignored entirely\n" +
+		"%s" + // Comment, see commentHelpMessage
 		"  `!allow ..`, `!deny ..` - Allow/deny users\n" +
+		"  `!auth ..` - Change who can send commands\n" +
+		"  `!readonly on|off` - Only owner can send commands\n" +
 		"  `!web` - Start/stop web terminal\n" +
 		"  `!resize ..` - Resize window\n" +
+		"  `!mode thread|split` - Move the terminal\n" +
+		"  `!dm`, `!dm all` - Move the session to a DM\n" +
+		"  `!detach` - Detach from a named session\n" +
+		"  `!macro ..` - Define/list/remove macros\n" +
+		"  `!complete ..` - Show tab completions\n" +
 		"  `!screen`, `!s` - Re-send terminal\n" +
+		"  `!history ..` - Show scrollback history\n" +
+		"  `!copy`, `!transcript` - Upload session transcript\n" +
+		"  `!clear` - Clear terminal and history\n" +
+		"  `!pause`, `!resume` - Pause/resume terminal updates\n" +
+		"  `!kill` - Terminate the running command (SIGTERM)\n" +
+		"  `!restart` - Restart the REPL\n" +
+		"  `!download ..` - Download a file\n" +
+		"  `!send-file-contents ..` - Paste a file\n" +
+		"  `!cd ..` - Change directory for restart/files\n" +
+		"  `!info` - Show session info\n" +
+		"  `!env` - Show REPL environment\n" +
+		"  `!title ..` - Set session title\n" +
 		"  `!alive` - Reset session timeout\n" +
 		"  `!help`, `!h` - Show this help screen\n" +
-		"  `!exit`, `!q` - Exit REPL"
+		"  `!exit`, `!q` - Exit REPL and end the session"
 
 	// updateMessageUserInputCountLimit is the max number of input messages before re-sending a new screen
 	updateMessageUserInputCountLimit = 5
 
+	// historyDefaultLines and historyMaxLines define how many lines of scrollback history are shown by "!history"
+	historyDefaultLines = 20
+	historyMaxLines     = 500
+
+	// pauseMaxLines is the max number of lines of output held back while the terminal is paused, see "!pause"
+	pauseMaxLines = 1000
+
+	// macroMaxCount is the max number of macros per session, and macroMaxDepth is how deeply macros may call each
+	// other, which also prevents macros from calling themselves forever, see runMacro
+	macroMaxCount = 50
+	macroMaxDepth = 5
+
+	// completeSettleDelay is the time to wait for more output once the screen changed after a tab, see "!complete"
+	completeSettleDelay = 100 * time.Millisecond
+
+	// sendHexMaxBytes is the max number of bytes that can be sent with "!send"
+	sendHexMaxBytes = 256
+
+	// sleepMaxDuration is the max time "!sleep" may pause the input, so that sessions cannot be stalled indefinitely
+	sleepMaxDuration = time.Minute
+
+	// pasteTimeout is the time after which a paste block is sent, even if "!end" was not received
+	pasteTimeout = time.Minute
+
+	// partialLineTimeout is the time after which input of other users is sent, even if the user who started a line
+	// without newline ("!n") did not finish it, see holdInput
+	partialLineTimeout = 30 * time.Second
+
 	recordingFileName    = "REPLbot session.zip"
 	recordingFileType    = "application/zip"
 	recordingFileSizeMax = 50 * 1024 * 1024
 
+	downloadFileSizeMax = 10 * 1024 * 1024
+	downloadFileType    = "application/octet-stream"
+
+	// sendFileSizeMax is the max size of a file pasted via "!send-file-contents". Files are pasted in chunks of
+	// sendFileChunkSize bytes, with a short pause in between, so that the REPL can keep up.
+	sendFileSizeMax    = 256 * 1024
+	sendFileChunkSize  = 4096
+	sendFileChunkDelay = 50 * time.Millisecond
+
+	colorSnapshotFileName = "terminal.html"
+	colorSnapshotFileType = "text/html"
+
+	historyFileName = "history.txt"
+	historyFileType = "text/plain"
+
+	// transcriptFileSizeMax is the max size of the transcript uploaded by "!copy"; longer transcripts are cut
+	// at the beginning, so that the most recent part of the session is kept
+	transcriptFileName    = "transcript.txt"
+	transcriptFileSizeMax = 10 * 1024 * 1024
+
+	// spoilerStart and spoilerEnd wrap collapsed output on platforms that support spoilers, see collapseMode
+	spoilerStart = "||"
+	spoilerEnd   = "||"
+
+	sessionLogRedacted = "[REDACTED]"
+
+	binaryOutputFileName = "output.bin"
+	binaryOutputFileType = "application/octet-stream"
+
+	// commandPrefix is the internal command prefix, see parseCommand
+	commandPrefix = "!"
+
 	scriptRunCommand  = "run"
 	scriptKillCommand = "kill"
+
+	// stderrForwardInterval is the interval at which the error output of the REPL is sent to the stderr thread, and
+	// stderrReadMax the max number of bytes read each time, see forwardStderr
+	stderrForwardInterval = time.Second
+	stderrReadMax         = 64 * 1024
+
+	// processExitCheckInterval is the interval at which the processes of a session are checked when it ends, see
+	// waitProcessesExited
+	processExitCheckInterval = 100 * time.Millisecond
+
+	dockerScriptPath = "/replbot-script"
+	dockerWorkDir    = "/work"
 )
 
 var (
@@ -111,8 +347,10 @@ var (
 		"!a":     "^A",
 		"!b":     "^B",
 		"!c":     "^C",
+		"!stop":  "^C", // Same as "!c", easier to remember
 		"!d":     "^D",
 		"!t":     "\t",
+		"!tab":   "\t",
 		"!tt":    "\t\t",
 		"!esc":   "escape", // ESC
 		"!up":    "up",     // Cursor up
@@ -122,18 +360,54 @@ var (
 		"!space": "space",  // Space
 		"!pu":    "ppage",  // Page up
 		"!pd":    "npage",  // Page down
-	}
+		"!home":  "home",   // Home
+		"!bs":    "bspace", // Backspace
+		"!del":   "dc",     // Delete
+	}
+	// keyNames maps the key names of the "!key" command to tmux(1) key names, see handleKeyCommand
+	keyNames = map[string]string{
+		"up":        "up",
+		"down":      "down",
+		"left":      "left",
+		"right":     "right",
+		"home":      "home",
+		"end":       "end",
+		"pageup":    "ppage",
+		"pagedown":  "npage",
+		"insert":    "ic",
+		"delete":    "dc",
+		"backspace": "bspace",
+		"esc":       "escape",
+		"tab":       "\t",
+		"enter":     "^M",
+		"space":     "space",
+	}
+	// ownerOnlyCommands is a list of commands that may only be executed by the session owner
+	ownerOnlyCommands = []string{"!auth", "!title", "!pause", "!resume", "!force", "!copy", "!transcript", "!mode", "!dm", "!detach"}
+
+	// envSecretRegex matches the names of environment variables whose values are never shown, see handleEnvCommand
+	envSecretRegex = regexp.MustCompile(`(?i)(TOKEN|SECRET|PASSWORD|PASSWD|CREDENTIAL|PRIVATE_KEY)`)
+
+	// macroNameRegex matches valid macro names, see validMacroName
+	macroNameRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
 	ctrlCommandRegex         = regexp.MustCompile(`^!c-([a-z])$`)
 	fKeysRegex               = regexp.MustCompile(`^!f([0-9][012]?)$`)
+	keyNameFKeysRegex        = regexp.MustCompile(`^f([1-9]|1[012])$`)
 	alphanumericRegex        = regexp.MustCompile(`^([a-zA-Z0-9])$`)
 	asciinemaUploadURLRegex  = regexp.MustCompile(`(https?://\S+)`)
 	asciinemaUploadDaysRegex = regexp.MustCompile(`(\d+) days?`)
 	errExit                  = errors.New("exited REPL")
+	errMacroTooDeep          = errors.New("macros call each other too deeply")
 
 	//go:embed share_client.sh.gotmpl
 	shareClientScriptSource   string
 	shareClientScriptTemplate = template.Must(template.New("share_client").Parse(shareClientScriptSource))
 
+	//go:embed share_client.js.gotmpl
+	shareWebSocketClientScriptSource   string
+	shareWebSocketClientScriptTemplate = template.Must(template.New("share_client_js").Parse(shareWebSocketClientScriptSource))
+
 	//go:embed recording.md
 	recordingReadmeSource string
 )
@@ -141,64 +415,157 @@ var (
 // session represents a REPL session
 //
 // Slack:
-//   Channels and DMs have an ID (fields: Channel, Timestamp), and may have a ThreadTimestamp field
-//   to identify if they belong to a thread.
+//
+//	Channels and DMs have an ID (fields: Channel, Timestamp), and may have a ThreadTimestamp field
+//	to identify if they belong to a thread.
+//
 // Discord:
-//   Channels, DMs and Threads are all channels with an ID
+//
+//	Channels, DMs and Threads are all channels with an ID
 type session struct {
-	conf           *sessionConfig
-	conn           conn
-	commands       []*sessionCommand
-	userInputChan  chan [2]string // user, message
-	userInputCount int32
-	forceResend    chan bool
-	g              *errgroup.Group
-	ctx            context.Context
-	cancelFn       context.CancelFunc
-	active         bool
-	warnTimer      *time.Timer
-	closeTimer     *time.Timer
-	scriptID       string
-	authUsers      map[string]bool // true = allow, false = deny, n/a = default
-	tmux           *util.Tmux
-	cursorOn       bool
-	cursorUpdated  time.Time
-	maxSize        *config.Size
-	shareConn      io.Closer
-	webCmd         *exec.Cmd
-	webWritable    bool
-	webPort        int
-	webPrefix      string
-	mu             sync.RWMutex
+	conf             *sessionConfig
+	conn             conn
+	tracker          *trackingConn // remembers sent messages in ephemeral sessions (wraps conn), nil otherwise
+	commands         []*sessionCommand
+	userInputChan    chan [2]string // user, message
+	userInputCount   int32
+	outputBytes      int64 // bytes of changed terminal lines since the last user input, see maybeLimitOutput
+	outputMessages   int32 // terminal updates sent since the last user input
+	outputLimited    int32 // 1 if the command was interrupted for reaching an output limit since the last user input
+	forceResend      chan bool
+	g                *errgroup.Group
+	ctx              context.Context
+	cancelFn         context.CancelFunc
+	active           bool
+	warnTimer        *time.Timer
+	closeTimer       *time.Timer
+	pasting          bool
+	pasteBuffer      []string
+	pasteTimer       *time.Timer
+	partialLineUser  string          // user whose line without newline ("!n") is pending in the REPL, see holdInput
+	partialLineTimer *time.Timer     // releases the held input if partialLineUser does not finish the line
+	heldInput        [][2]string     // user, message; input of other users held back until the line is finished
+	sleeping         bool            // true while "!sleep" delays the input, see handleSleepCommand
+	sleepTimer       *time.Timer     // ends the delay, see resumeInput
+	sleepQueue       []*queuedInput  // input delayed by "!sleep", sent in order when sleepTimer fires
+	inputUsers       map[string]bool // users who sent input, to show who typed what once there are several, see lastInput
+	lastInputUser    string          // user who sent the last input, see lastInput
+	scriptID         string
+	authUsers        map[string]bool   // true = allow, false = deny, n/a = default
+	readOnly         bool              // if true, only the owner may send commands, regardless of authUsers
+	paused           bool              // if true, the terminal is not updated, see handlePauseCommand
+	detached         bool              // if true, the terminal is not updated until the owner attaches again, see handleDetachCommand
+	pausedAt         time.Time         // time the terminal was paused
+	pausedLines      int               // number of history lines when the terminal was paused
+	env              map[string]string // environment variables the REPL was started with, see getEnv and handleEnvCommand
+	macros           map[string]string // macro name (without prefix) -> input lines, see handleMacroCommand
+	term             util.Terminal
+	processSession   int        // process session ID of the terminal's command, see reapProcesses
+	stderrTarget     *channelID // thread that the REPL's stderr is sent to, created with the first output, see forwardStderr
+	stderrOffset     int64      // number of bytes of the stderr file that were already sent
+	stderrMu         sync.Mutex // protects stderrTarget and stderrOffset
+	cursorOn         bool
+	cursorUpdated    time.Time
+	maxSize          *config.Size
+	shareConn        io.Closer
+	webCmd           *exec.Cmd
+	webWritable      bool
+	webPort          int
+	webPrefix        string
+	terminated       bool   // terminal (tmux/screen) was killed externally
+	tempDir          string // temporary working directory, removed when the session exits
+	terminalID       string // message ID of the terminal window, see TerminalID
+	binaryUploaded   bool   // binary output was uploaded, only accessed by commandOutputLoop
+	idleWarningID    string // message ID of the idle timeout warning, cleared when the user returns
+	started          time.Time
+	startID          string // ID of the "session started" message, updated by "!title" if the platform cannot set titles
+	startMessage     string
+	startStatus      *statusMessage // "session started" message, as sent, see sendStatus
+	buttonsID        string         // ID of the message with the control buttons, see maybeSendButtons
+	rateLimitedUntil time.Time      // terminal updates are paused until then, only accessed by commandOutputLoop
+	outputSkipped    bool           // true if terminal updates were skipped due to rate limiting, only accessed by commandOutputLoop
+	auditFile        *os.File       // audit log, see openAuditLog
+	auditLast        string         // last window written to the audit log, only accessed by commandOutputLoop
+	auditMu          sync.Mutex     // protects writes to auditFile
+	sendFailure      error          // set if the session is closing because messages could not be sent, see goLoop
+	cwd              string         // current directory inside the working directory, see handleCdCommand
+	termMu           sync.Mutex     // held while the terminal is captured or restarted, see handleRestartCommand
+	controlMu        sync.RWMutex   // protects conf.control, which moves via "!dm" or Attach, see control
+	renderer         outputRenderer
+	mu               sync.RWMutex
 }
 
 type sessionConfig struct {
-	global      *config.Config
-	id          string
-	user        string
-	control     *channelID
-	terminal    *channelID
-	script      string
-	controlMode config.ControlMode
-	windowMode  config.WindowMode
-	authMode    config.AuthMode
-	size        *config.Size
-	share       *shareConfig
-	record      bool
-	web         bool
-	notifyWeb   func(s *session, enabled bool, prefix string)
+	global            *config.Config
+	id                string
+	user              string
+	control           *channelID
+	terminal          *channelID
+	script            string
+	image             string // if set, the script is run inside a disposable Docker container, see createCommand
+	workDir           string
+	controlMode       config.ControlMode
+	windowMode        config.WindowMode
+	colorMode         config.ColorMode
+	authMode          config.AuthMode
+	size              *config.Size
+	share             *shareConfig
+	record            bool
+	web               bool
+	tags              []string       // set via "tag:<name>", see Bot.handleFindCommand
+	name              string         // set via "name:<name>"; named sessions can be detached and attached, see Attach
+	maxDuration       time.Duration  // session is closed after this duration regardless of activity, 0 means no limit
+	maxOutputBytes    int            // running command is interrupted after sending this many bytes, 0 means no limit, see maybeLimitOutput
+	maxOutputMessages int            // running command is interrupted after this many terminal updates, 0 means no limit
+	collapse          bool           // hide long output behind a spoiler or upload it, if the platform supports it, see collapseMode
+	ephemeral         bool           // delete all messages when the session ends, see deleteMessages
+	separateStderr    bool           // send the script's stderr to a separate thread instead of the terminal, see forwardStderr
+	quiet             bool           // leave out the start and exit messages, see quietSessionStartedMessage
+	prompt            *regexp.Regexp // if set, repeated bare prompts are collapsed, see collapsePrompts
+	ready             *regexp.Regexp // if set, user input is held back until the terminal matches, see waitUntilReady
+	renderer          string         // name of the output renderer, see outputRenderers; defaults to defaultRenderer
+	notifyWeb         func(s *session, enabled bool, prefix string)
+	moveControl       func(s *session, control *channelID) bool // see Bot.controlMoved
+	detach            func(s *session)                          // see Bot.controlDetached
+}
+
+// idleTimeout returns the time after which the session is closed if there is no user input. Named sessions are
+// meant to be detached from, so they get a longer one.
+func (c *sessionConfig) idleTimeout() time.Duration {
+	if c.name != "" {
+		return c.global.NamedIdleTimeout
+	}
+	return c.global.IdleTimeout
 }
 
 type shareConfig struct {
 	user          string
+	token         string // authenticates the WebSocket client, see Bot.shareWebSocketHandler
 	relayPort     int
 	hostKeyPair   *util.SSHKeyPair
 	clientKeyPair *util.SSHKeyPair
 }
 
+// queuedInput is input that is delayed by "!sleep", see handleSleepCommand. It is either a message typed by a user,
+// a line of a macro, or the remaining lines of a "!paste" block.
+type queuedInput struct {
+	user    string
+	message string
+	typed   bool     // true if the user typed the message, i.e. it is handled like new input
+	macro   string   // name of the macro the line is from, if any
+	depth   int      // see handleInput
+	paste   []string // remaining lines of a paste block, if any
+}
+
 type sessionCommand struct {
 	prefix  string
-	execute func(input string) error
+	execute func(user, input string) error
+}
+
+type wsShareSession struct {
+	URL    string
+	Width  int
+	Height int
 }
 
 type sshSession struct {
@@ -215,21 +582,42 @@ func newSession(conf *sessionConfig, conn conn) *session {
 	ctx, cancel := context.WithCancel(context.Background())
 	g, ctx := errgroup.WithContext(ctx)
 	s := &session{
-		conf:           conf,
-		conn:           conn,
-		scriptID:       fmt.Sprintf("replbot_%s", conf.id),
-		authUsers:      make(map[string]bool),
-		tmux:           util.NewTmux(conf.id, conf.size.Width, conf.size.Height),
-		userInputChan:  make(chan [2]string, 10), // buffered!
-		userInputCount: 0,
-		forceResend:    make(chan bool),
-		g:              g,
-		ctx:            ctx,
-		cancelFn:       cancel,
-		active:         true,
-		warnTimer:      time.NewTimer(conf.global.IdleTimeout - time.Minute),
-		closeTimer:     time.NewTimer(conf.global.IdleTimeout),
-		maxSize:        conf.size,
+		conf:             conf,
+		conn:             newRetryConn(conn, conf.global.SendRetries, conf.global.SendRetryBackoff),
+		scriptID:         fmt.Sprintf("replbot_%s", conf.id),
+		authUsers:        make(map[string]bool),
+		macros:           make(map[string]string),
+		term:             newTerminal(conf),
+		userInputChan:    make(chan [2]string, 10), // buffered!
+		userInputCount:   0,
+		forceResend:      make(chan bool),
+		g:                g,
+		ctx:              ctx,
+		cancelFn:         cancel,
+		active:           true,
+		warnTimer:        time.NewTimer(conf.idleTimeout() - conf.global.IdleWarning),
+		closeTimer:       time.NewTimer(conf.idleTimeout()),
+		pasteTimer:       time.NewTimer(pasteTimeout),
+		partialLineTimer: time.NewTimer(partialLineTimeout),
+		sleepTimer:       time.NewTimer(sleepMaxDuration),
+		inputUsers:       make(map[string]bool),
+		maxSize:          conf.size,
+		started:          time.Now(),
+	}
+	if newRenderer, ok := outputRenderers[conf.renderer]; ok {
+		s.renderer = newRenderer(s)
+	} else {
+		s.renderer = outputRenderers[defaultRenderer](s)
+	}
+	s.pasteTimer.Stop()
+	s.partialLineTimer.Stop()
+	s.sleepTimer.Stop()
+	if conf.global.IdleWarning <= 0 || conf.global.ReadOnlyMode {
+		s.warnTimer.Stop() // Nobody can type "!alive" in read-only mode anyway
+	}
+	if conf.ephemeral {
+		s.tracker = newTrackingConn(s.conn)
+		s.conn = s.tracker
 	}
 	return initSessionCommands(s)
 }
@@ -240,13 +628,39 @@ func initSessionCommands(s *session) *session {
 		{"!help", s.handleHelpCommand},
 		{"!n", s.handleNoNewlineCommand},
 		{"!e", s.handleEscapeCommand},
+		{"!key", s.handleKeyCommand},
+		{"!send", s.handleSendHexCommand},
+		{"!force", s.handleForceCommand},
+		{"!paste", s.handlePasteCommand},
+		{"!end", s.handlePasteEndCommand},
+		{"!sleep", s.handleSleepCommand},
 		{"!alive", s.handleKeepaliveCommand},
 		{"!allow", s.handleAllowCommand},
 		{"!deny", s.handleDenyCommand},
-		{"!!", s.handleCommentCommand},
+		{"!auth", s.handleAuthCommand},
+		{"!readonly", s.handleReadOnlyCommand},
 		{"!screen", s.handleScreenCommand},
 		{"!s", s.handleScreenCommand},
+		{"!history", s.handleHistoryCommand},
+		{"!copy", s.handleTranscriptCommand},
+		{"!transcript", s.handleTranscriptCommand},
+		{"!clear", s.handleClearCommand},
+		{"!pause", s.handlePauseCommand},
+		{"!resume", s.handleResumeCommand},
+		{"!restart", s.handleRestartCommand},
+		{"!kill", s.handleKillCommand},
+		{"!download", s.handleDownloadCommand},
+		{"!send-file-contents", s.handleSendFileContentsCommand},
+		{"!cd", s.handleCdCommand},
+		{"!info", s.handleInfoCommand},
+		{"!env", s.handleEnvCommand},
+		{"!title", s.handleTitleCommand},
 		{"!resize", s.handleResizeCommand},
+		{"!mode", s.handleModeCommand},
+		{"!dm", s.handleDMCommand},
+		{"!detach", s.handleDetachCommand},
+		{"!macro", s.handleMacroCommand},
+		{"!complete", s.handleCompleteCommand},
 		{"!web", s.handleWebCommand},
 		{"!c-", s.handleSendKeysCommand}, // more see below!
 		{"!f", s.handleSendKeysCommand},  // more see below!
@@ -264,33 +678,51 @@ func initSessionCommands(s *session) *session {
 
 // Run executes a REPL session. This function only returns on error or when gracefully exiting the session.
 func (s *session) Run() error {
-	log.Printf("[%s] Started REPL session", s.conf.id)
-	defer log.Printf("[%s] Closed REPL session", s.conf.id)
+	s.logf("session_started", "Started REPL session")
+	defer s.logf("session_closed", "Closed REPL session")
 	env, err := s.getEnv()
 	if err != nil {
 		return err
 	}
+	s.setEnv(env)
+	workDir, err := s.maybeCreateTempDir()
+	if err != nil {
+		return err
+	}
+	if err := s.openAuditLog(); err != nil {
+		return err
+	}
+	defer s.closeAuditLog() // In case we exit early; usually closed by shutdownHandler
 	command := s.createCommand()
-	if err := s.tmux.Start(env, command...); err != nil {
-		log.Printf("[%s] Failed to start tmux: %s", s.conf.id, err.Error())
+	if err := s.term.Start(env, workDir, command...); err != nil {
+		s.logf("error", "Failed to start %s: %s", s.conf.global.TerminalBackend, err.Error())
 		return err
 	}
+	s.rememberProcessSession()
+	s.updateTerminalTitle()
 	if err := s.maybeStartWeb(); err != nil {
-		log.Printf("[%s] Cannot start ttyd: %s", s.conf.id, err.Error())
+		s.logf("warning", "Cannot start ttyd: %s", err.Error())
 		// We just disabled it, so we continue here
 	}
-	if err := s.conn.Send(s.conf.control, s.sessionStartedMessage()); err != nil {
+	if err := s.sendStartedMessage(); err != nil {
 		return err
 	}
 	if err := s.maybeSendStartShareMessage(); err != nil {
 		return err
 	}
-	s.g.Go(s.userInputLoop)
-	s.g.Go(s.commandOutputLoop)
-	s.g.Go(s.activityMonitor)
-	s.g.Go(s.shutdownHandler)
+	s.maybeSendButtons()
+	s.goLoop(s.userInputLoop)
+	s.goLoop(s.commandOutputLoop)
+	s.goLoop(s.activityMonitor)
+	s.goLoop(s.shutdownHandler)
 	if s.conf.record {
-		s.g.Go(s.monitorRecording)
+		s.goLoop(s.monitorRecording)
+	}
+	if s.conf.separateStderr {
+		s.goLoop(s.forwardStderr)
+	}
+	if r, ok := s.renderer.(backgroundRenderer); ok {
+		s.goLoop(r.run)
 	}
 	if err := s.g.Wait(); err != nil && err != errExit {
 		return err
@@ -298,20 +730,75 @@ func (s *session) Run() error {
 	return nil
 }
 
-// UserInput handles user input by forwarding to the underlying shell
-func (s *session) UserInput(user, message string) {
+// goLoop runs fn in the session's errgroup. If fn fails because a message could not be sent (see retryConn),
+// the error is remembered before the session is closed, so that the exit message can tell the user why.
+func (s *session) goLoop(fn func() error) {
+	s.g.Go(func() error {
+		err := fn()
+		var sendErr *sendFailedError
+		if errors.As(err, &sendErr) {
+			s.mu.Lock()
+			if s.sendFailure == nil {
+				s.sendFailure = sendErr.err
+			}
+			s.mu.Unlock()
+		}
+		return err
+	})
+}
+
+// channelGone returns true if the session is closing because its channel was archived or deleted
+func (s *session) channelGone() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return errors.Is(s.sendFailure, errChannelGone)
+}
+
+// UserInput handles user input by forwarding to the underlying shell. It returns false if the input was dropped,
+// because the session is not active (anymore), or because the user is not allowed to send commands.
+func (s *session) UserInput(user, message string) bool {
 	if !s.Active() || !s.allowUser(user) {
-		return
+		return false
 	}
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
 	// Reset timeout timers
-	s.warnTimer.Reset(s.conf.global.IdleTimeout - time.Minute)
-	s.closeTimer.Reset(s.conf.global.IdleTimeout)
+	if s.conf.global.IdleWarning > 0 {
+		s.warnTimer.Reset(s.conf.idleTimeout() - s.conf.global.IdleWarning)
+	}
+	s.closeTimer.Reset(s.conf.idleTimeout())
 
-	// Forward to input channel
-	s.userInputChan <- [2]string{user, message}
+	s.mu.Unlock()
+
+	// Forward to input channel. The bot calls this while holding its lock, so this must never block: if the input loop
+	// is busy (e.g. waiting for the REPL to become ready) and the channel is full, the input is dropped.
+	select {
+	case s.userInputChan <- [2]string{user, message}:
+		return true
+	default:
+		s.logUserf(user, "input_dropped", "Session is busy, dropping input from %s", user)
+		go func() {
+			if err := s.conn.Send(s.control(), sessionBusyMessage); err != nil {
+				s.logf("warning", "Warning: unable to send busy message: %s", err.Error())
+			}
+		}()
+		return false
+	}
+}
+
+// maybeClearIdleWarning updates the idle timeout warning, if any, once the user is back. This talks to the chat
+// API, so it is done in the input loop rather than in UserInput, which is called while the bot holds its lock.
+func (s *session) maybeClearIdleWarning() {
+	s.mu.Lock()
+	idleWarningID := s.idleWarningID
+	s.idleWarningID = ""
+	s.mu.Unlock()
+	if idleWarningID == "" {
+		return
+	}
+	if err := s.conn.Update(s.control(), idleWarningID, fmt.Sprintf(timeoutWarningClearedMessage, s.conn.Mention(s.conf.user))); err != nil {
+		s.logf("warning", "Warning: unable to update idle warning: %s", err.Error())
+	}
 }
 
 func (s *session) Active() bool {
@@ -320,8 +807,46 @@ func (s *session) Active() bool {
 	return s.active
 }
 
+// TerminalID returns the message ID of the current terminal window message, or an empty string
+func (s *session) TerminalID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.terminalID
+}
+
+// ButtonsID returns the ID of the message with the control buttons, or an empty string if there is none
+func (s *session) ButtonsID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.buttonsID
+}
+
+// maybeSendButtons sends the control buttons (see config.Buttons) to the control channel, if the platform supports
+// them. Clicks are forwarded to the session like typed commands, see Bot.handleButtonEvent.
+func (s *session) maybeSendButtons() {
+	if len(s.conf.global.Buttons) == 0 || s.conf.global.ReadOnlyMode {
+		return
+	}
+	id, err := s.conn.SendButtons(s.control(), buttonsMessage, s.conf.global.Buttons)
+	if errors.Is(err, errButtonsNotSupported) {
+		return
+	} else if err != nil {
+		s.logf("warning", "Warning: unable to send control buttons: %s", err.Error())
+		return
+	}
+	s.mu.Lock()
+	s.buttonsID = id
+	s.mu.Unlock()
+}
+
+// ForceClose tells the user that the session is ending, and closes it
 func (s *session) ForceClose() error {
-	_ = s.conn.Send(s.conf.control, forceCloseMessage)
+	_ = s.conn.Send(s.control(), forceCloseMessage)
+	return s.Close()
+}
+
+// Close closes the session without notifying the user first, see ForceClose
+func (s *session) Close() error {
 	s.cancelFn()
 	if err := s.g.Wait(); err != nil && err != errExit {
 		return err
@@ -350,6 +875,31 @@ func (s *session) WriteShareClientScript(w io.Writer) error {
 	return shareClientScriptTemplate.Execute(w, sessionInfo)
 }
 
+// WriteShareWebSocketClientScript writes the Node.js client for terminal sharing via WebSocket, an alternative to
+// the SSH-based client (see WriteShareClientScript) for users without ssh and sshd
+func (s *session) WriteShareWebSocketClientScript(w io.Writer) error {
+	if s.conf.share == nil {
+		return errors.New("not a share session")
+	}
+	sessionInfo := &wsShareSession{
+		URL:    fmt.Sprintf("ws://%s/share/%s/ws", s.conf.global.WebHost, s.conf.share.token),
+		Width:  s.conf.size.Width,
+		Height: s.conf.size.Height,
+	}
+	return shareWebSocketClientScriptTemplate.Execute(w, sessionInfo)
+}
+
+// WriteShareWebSocketFile tells the share server script that a WebSocket client is connected, and that REPLbot
+// is waiting for the script to connect to the relay port, see Bot.relayShareWebSocket
+func (s *session) WriteShareWebSocketFile() error {
+	return os.WriteFile(s.shareWebSocketFile(), []byte{}, 0600)
+}
+
+// RemoveShareWebSocketFile removes the file written by WriteShareWebSocketFile, if the script did not pick it up
+func (s *session) RemoveShareWebSocketFile() {
+	_ = os.Remove(s.shareWebSocketFile())
+}
+
 func (s *session) WriteShareUserFile(user string) error {
 	return os.WriteFile(s.sshUserFile(), []byte(user), 0600)
 }
@@ -364,37 +914,279 @@ func (s *session) RegisterShareConn(conn io.Closer) {
 }
 
 func (s *session) userInputLoop() error {
+	if err := s.waitUntilReady(); err != nil {
+		return err
+	}
 	for {
 		select {
 		case m := <-s.userInputChan:
 			if err := s.handleUserInput(m[0], m[1]); err != nil {
+				if s.checkTerminated() {
+					return errExit
+				}
+				return err
+			}
+		case <-s.pasteTimer.C:
+			if err := s.flushPaste(); err != nil {
+				return err
+			}
+			if err := s.conn.Send(s.control(), s.withPrefix(pasteTimeoutMessage)); err != nil {
 				return err
 			}
+		case <-s.sleepTimer.C:
+			if err := s.resumeInput(); err != nil {
+				if s.checkTerminated() {
+					return errExit
+				}
+				return err
+			}
+		case <-s.partialLineTimer.C:
+			if err := s.conn.Send(s.control(), fmt.Sprintf(partialLineTimeoutMessage, s.conn.Mention(s.partialLineUser), partialLineTimeout)); err != nil {
+				return err
+			}
+			s.partialLineUser = ""
+			if err := s.releaseHeldInput(); err != nil {
+				return err
+			}
+		case <-s.ctx.Done():
+			return errExit
+		}
+	}
+}
+
+// waitUntilReady blocks until the terminal matches the script's readiness probe (see config.ScriptConfig.Ready), so
+// that input is not lost while slow REPLs are starting. Until then, user input is queued in userInputChan. If the
+// REPL does not become ready in time, the user is warned, and the input is sent anyway.
+func (s *session) waitUntilReady() error {
+	if s.conf.ready == nil {
+		return nil
+	}
+	timeout := time.After(s.conf.global.ReadyTimeout)
+	for {
+		if window, err := s.term.Capture(); err == nil && s.conf.ready.MatchString(sanitizeWindow(removeTmuxBorder(window))) {
+			s.logf("session_ready", "REPL is ready")
+			return s.conn.Send(s.control(), readyMessage)
+		}
+		select {
 		case <-s.ctx.Done():
 			return errExit
+		case <-timeout:
+			s.logf("warning", "Warning: REPL did not become ready within %s", s.conf.global.ReadyTimeout)
+			return s.conn.Send(s.control(), fmt.Sprintf(readyTimeoutMessage, s.conf.global.ReadyTimeout))
+		case <-time.After(s.conf.global.RefreshInterval):
 		}
 	}
 }
 
+// logf logs a message with the session's structured log fields, attributed to the session owner, see util.Log
+func (s *session) logf(event, format string, args ...interface{}) {
+	s.logUserf(s.conf.user, event, format, args...)
+}
+
+// logUserf is like logf, but attributes the message to the given user
+func (s *session) logUserf(user, event, format string, args ...interface{}) {
+	util.Log(sessionLogFields(s.conf, user, event), format, args...)
+}
+
+// newTerminal creates the terminal multiplexer for the session, depending on the configured backend
+func newTerminal(conf *sessionConfig) util.Terminal {
+	if conf.global.TerminalBackend == config.Screen {
+		return util.NewScreen(conf.id, conf.size.Width, conf.size.Height, conf.global.TempDir, conf.global.ShmDir)
+	}
+	return util.NewTmux(conf.id, conf.size.Width, conf.size.Height, conf.global.TempDir, conf.global.ShmDir)
+}
+
+// checkTerminated checks if the terminal was killed externally (e.g. via "tmux kill-server"), as opposed to the
+// REPL exiting on its own, and marks the session as terminated if that is the case.
+func (s *session) checkTerminated() bool {
+	if s.term.Active() || s.term.Exited() {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.terminated {
+		s.logf("session_terminated", "%s session was killed externally", s.conf.global.TerminalBackend)
+		s.terminated = true
+	}
+	return true
+}
+
 func (s *session) handleUserInput(user, message string) error {
-	log.Printf("[%s] User %s> %s", s.conf.id, user, message)
+	s.maybeClearIdleWarning()
+	if s.delayInput(user, message) {
+		return nil
+	} else if s.holdInput(user, message) {
+		return nil
+	}
+	s.logUserf(user, "user_input", "User %s> %s", user, message)
+	s.auditInput(user, message)
+	s.rememberInputUser(user)
 	atomic.AddInt32(&s.userInputCount, 1)
+	s.resetOutputLimit()
+	if err := s.handleInput(user, message, 0); err != nil {
+		return err
+	}
+	return s.releaseHeldInput()
+}
+
+// holdInput keeps lines of different users from being mixed up in the REPL: If a user started a line without
+// newline ("!n"), the input of all other users is held back until that user finishes the line (with any other
+// input), or until partialLineTimeout passes. It returns true if the input was held back. Input of the user who
+// started the line is never held back, and finishes the line.
+func (s *session) holdInput(user, message string) bool {
+	if s.partialLineUser == "" {
+		return false
+	} else if user != s.partialLineUser {
+		s.heldInput = append(s.heldInput, [2]string{user, message})
+		return true
+	}
+	s.partialLineUser = ""
+	s.partialLineTimer.Stop()
+	return false
+}
+
+// releaseHeldInput handles the input held back by holdInput, in the order it was received, unless it started
+// another line without newline
+func (s *session) releaseHeldInput() error {
+	for len(s.heldInput) > 0 && s.partialLineUser == "" {
+		m := s.heldInput[0]
+		s.heldInput = s.heldInput[1:]
+		if err := s.handleUserInput(m[0], m[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delayInput queues the input while "!sleep" delays the input, and returns true if it did. Session commands (e.g.
+// "!c" or "!exit") are never delayed, so that a sleeping macro can always be interrupted.
+func (s *session) delayInput(user, message string) bool {
+	if !s.sleeping || s.pasting {
+		return false
+	} else if command, ok := s.parseCommand(message); ok && s.macros[strings.TrimPrefix(command, commandPrefix)] == "" {
+		return false
+	}
+	s.sleepQueue = append(s.sleepQueue, &queuedInput{user: user, message: message, typed: true})
+	return true
+}
+
+// resumeInput handles the input delayed by "!sleep" in the order it was queued, until the next "!sleep", if any
+func (s *session) resumeInput() error {
+	s.sleeping = false
+	queue := s.sleepQueue
+	s.sleepQueue = nil
+	for i, in := range queue {
+		var err error
+		if in.typed {
+			err = s.handleUserInput(in.user, in.message)
+		} else if in.paste != nil {
+			err = s.pasteLines(in.paste)
+		} else if err = s.handleInput(in.user, in.message, in.depth); errors.Is(err, errMacroTooDeep) {
+			err = s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(macroTooDeepMessage, in.macro, macroMaxDepth)))
+		}
+		if err != nil {
+			return err
+		} else if s.sleeping {
+			s.sleepQueue = append(s.sleepQueue, queue[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// rememberInputUser remembers the user who sent the last input, see lastInput
+func (s *session) rememberInputUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inputUsers[user] = true
+	s.lastInputUser = user
+}
+
+// lastInput returns the user who sent the last input, so that the terminal can show who typed what. This is only
+// useful in "everyone" mode, and only once more than one user sent input, so otherwise an empty string is returned.
+func (s *session) lastInput() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.conf.authMode != config.Everyone || len(s.inputUsers) < 2 {
+		return ""
+	}
+	return s.lastInputUser
+}
+
+// handleInput handles a single message, either typed by the user or from a macro, see runMacro. The depth is the
+// number of macros that this message was expanded from.
+func (s *session) handleInput(user, message string, depth int) error {
+	if s.pasting {
+		return s.handlePasteInput(message)
+	} else if s.isComment(message) {
+		return nil // Ignore comments
+	}
+	message = s.stripInlineComment(message)
+	command, ok := s.parseCommand(message)
+	if !ok {
+		return s.handlePassthrough(message)
+	} else if name := strings.TrimPrefix(command, commandPrefix); s.macros[name] != "" {
+		return s.runMacro(user, name, depth)
+	}
 	for _, c := range s.commands {
-		if strings.HasPrefix(message, c.prefix) {
-			return c.execute(message)
+		if strings.HasPrefix(command, c.prefix) {
+			if util.InStringList(ownerOnlyCommands, c.prefix) && user != s.conf.user {
+				return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(ownerOnlyCommandMessage, c.prefix)))
+			}
+			return c.execute(user, command)
 		}
 	}
 	return s.handlePassthrough(message)
 }
 
+// isComment returns true if the message starts with the configured comment prefix, see config.Config.CommentPrefix
+func (s *session) isComment(message string) bool {
+	prefix := s.conf.global.CommentPrefix
+	return prefix != "" && strings.HasPrefix(message, prefix)
+}
+
+// stripInlineComment removes a trailing comment from the message, e.g. "ls -l !! list all files" becomes "ls -l",
+// if inline comments are enabled. The comment prefix must follow a space, so it can still be used inside words.
+func (s *session) stripInlineComment(message string) string {
+	prefix := s.conf.global.CommentPrefix
+	if prefix == "" || !s.conf.global.StripInlineComments {
+		return message
+	}
+	if i := strings.Index(message, " "+prefix); i != -1 {
+		return strings.TrimRightFunc(message[:i], unicode.IsSpace)
+	}
+	return message
+}
+
+// parseCommand translates a message starting with the configured command prefix to a command with the
+// internal prefix "!", e.g. ";;help" to "!help". If the message does not start with the prefix, it is
+// not a command, and false is returned.
+func (s *session) parseCommand(message string) (string, bool) {
+	prefix := s.conf.global.CommandPrefix
+	if !strings.HasPrefix(message, prefix) {
+		return "", false
+	}
+	return commandPrefix + strings.TrimPrefix(message, prefix), true
+}
+
+// withPrefix replaces the internal command prefix "!" in commands mentioned in the given message
+// with the configured command prefix, e.g. "`!help`" with "`;;help`"
+func (s *session) withPrefix(message string) string {
+	prefix := s.conf.global.CommandPrefix
+	if prefix == commandPrefix {
+		return message
+	}
+	return strings.NewReplacer("`"+commandPrefix, "`"+prefix, " "+commandPrefix, " "+prefix).Replace(message)
+}
+
 func (s *session) commandOutputLoop() error {
 	var last, lastID string
 	var err error
 	for {
 		select {
 		case <-s.ctx.Done():
-			if lastID != "" {
-				_ = s.conn.Update(s.conf.terminal, lastID, util.FormatMarkdownCode(addExitedMessage(sanitizeWindow(removeTmuxBorder(last))))) // Show "(REPL exited.)" in terminal
+			if terminal, id := s.terminalTarget(lastID); id != "" {
+				_ = s.conn.Update(terminal, id, s.renderer.Render("", addExitedMessage(s.sanitizeWindow(removeTmuxBorder(last))), "")) // Show "(REPL exited.)" in terminal
 			}
 			return errExit
 		case <-s.forceResend:
@@ -412,31 +1204,233 @@ func (s *session) commandOutputLoop() error {
 }
 
 func (s *session) maybeRefreshTerminal(last, lastID string) (string, string, error) {
-	current, err := s.tmux.Capture()
+	s.termMu.Lock()
+	defer s.termMu.Unlock()
+	terminal, id := s.terminalTarget(lastID)
+	if id != lastID {
+		last, lastID = "", "" // The terminal moved, see handleModeCommand
+	}
+	raw, err := s.captureWindow()
 	if err != nil {
+		if s.term.Active() && !s.term.Exited() {
+			return last, lastID, nil // Capturing failed, but the command is still running; never guess that it exited
+		}
+		s.checkTerminated()
 		if lastID != "" {
-			_ = s.conn.Update(s.conf.terminal, lastID, util.FormatMarkdownCode(addExitedMessage(sanitizeWindow(removeTmuxBorder(last))))) // Show "(REPL exited.)" in terminal
+			_ = s.conn.Update(terminal, lastID, s.renderer.Render("", addExitedMessage(s.sanitizeWindow(removeTmuxBorder(last))), "")) // Show "(REPL exited.)" in terminal
 		}
 		return "", "", errExit // The command may have ended, gracefully exit
 	}
-	current = s.maybeAddCursor(s.maybeTrimWindow(sanitizeWindow(removeTmuxBorder(current))))
-	if current == last {
-		return last, lastID, nil
+	var current string
+	if isBinary(raw) {
+		current = s.binaryWindow(raw)
+	} else {
+		s.binaryUploaded = false
+		current = s.maybeTrimWindow(filterOutput(s.sanitizeWindow(removeTmuxBorder(raw)), s.conf.global.OutputFilters))
+		s.auditOutput(current)
+		current = s.maybeAddCursor(current)
+		if s.conf.prompt != nil {
+			current = collapsePrompts(current, s.conf.prompt) // Cosmetic only; the audit log and recordings are untouched
+		}
+	}
+	if current == last || time.Now().Before(s.rateLimitedUntil) {
+		return last, lastID, nil // Nothing changed, or backing off; we'll send the latest window once we're allowed to
+	}
+	s.mu.RLock()
+	paused, detached := s.paused, s.detached
+	s.mu.RUnlock()
+	if paused || detached {
+		return last, lastID, nil // Output is held back in the scrollback history until "!resume" or Attach
+	}
+	notices := make([]string, 0)
+	if s.outputSkipped {
+		notices = append(notices, outputSkippedMessage)
+	}
+	if user := s.lastInput(); user != "" {
+		notices = append(notices, fmt.Sprintf(lastInputMessage, s.conn.Mention(user)))
+	}
+	message := s.renderer.Render(filterOutput(raw, s.conf.global.OutputFilters), current, strings.Join(notices, "\n"))
+	if err := s.maybeLimitOutput(last, current); err != nil {
+		return "", "", err
 	}
 	if s.shouldUpdateTerminal(lastID) {
-		if err := s.conn.Update(s.conf.terminal, lastID, util.FormatMarkdownCode(current)); err == nil {
+		err := s.conn.Update(terminal, lastID, message)
+		if err == nil {
+			s.outputSkipped = false
 			return current, lastID, nil
+		} else if s.maybeBackOff(err) {
+			return last, lastID, nil
+		} else if errors.Is(err, errChannelGone) {
+			return "", "", err // No point in re-sending the terminal, see sendExitedMessage
 		}
 	}
-	if lastID, err = s.conn.SendWithID(s.conf.terminal, util.FormatMarkdownCode(current)); err != nil {
+	id, err = s.conn.SendWithID(terminal, message)
+	if s.maybeBackOff(err) {
+		return last, lastID, nil
+	} else if err != nil {
 		return "", "", err
 	}
+	s.outputSkipped = false
+	s.mu.Lock()
+	s.terminalID = id
+	s.mu.Unlock()
 	atomic.StoreInt32(&s.userInputCount, 0)
-	return current, lastID, nil
+	return current, id, nil
+}
+
+// maybeLimitOutput counts the terminal update against the output limits of the session (see sessionConfig), which
+// protect the channel from runaway commands, e.g. "seq inf". If a limit is reached, the running command is interrupted
+// with Ctrl-C. If it is reached again before the next user input, the command ignored the interrupt, and the session
+// is closed. The update itself is still sent, so that the user sees what happened. Only lines that changed since the
+// last update count towards the byte limit (see changedBytes), so that e.g. "top" or a progress bar is not interrupted.
+func (s *session) maybeLimitOutput(last, current string) error {
+	bytes := atomic.AddInt64(&s.outputBytes, int64(changedBytes(last, current)))
+	messages := atomic.AddInt32(&s.outputMessages, 1)
+	bytesExceeded := s.conf.maxOutputBytes > 0 && bytes > int64(s.conf.maxOutputBytes)
+	messagesExceeded := s.conf.maxOutputMessages > 0 && int(messages) > s.conf.maxOutputMessages
+	if !bytesExceeded && !messagesExceeded {
+		return nil
+	}
+	limit := formatOutputLimit(s.conf.maxOutputBytes, 0)
+	if messagesExceeded {
+		limit = formatOutputLimit(0, s.conf.maxOutputMessages)
+	}
+	atomic.StoreInt64(&s.outputBytes, 0)
+	atomic.StoreInt32(&s.outputMessages, 0)
+	if !atomic.CompareAndSwapInt32(&s.outputLimited, 0, 1) {
+		s.logf("output_limit", "Output limit of %s reached again, closing session", limit)
+		if err := s.conn.Send(s.control(), fmt.Sprintf(outputLimitClosingMessage, limit)); err != nil {
+			return err
+		}
+		return errExit
+	}
+	s.logf("output_limit", "Output limit of %s reached, interrupting command", limit)
+	if err := s.term.SendKeys(sendKeysMapping["!stop"]); err != nil {
+		return err
+	}
+	return s.conn.Send(s.control(), fmt.Sprintf(outputLimitMessage, limit))
+}
+
+// resetOutputLimit resets the output counters when the user sends input, i.e. usually when a new command is started
+func (s *session) resetOutputLimit() {
+	atomic.StoreInt64(&s.outputBytes, 0)
+	atomic.StoreInt32(&s.outputMessages, 0)
+	atomic.StoreInt32(&s.outputLimited, 0)
+}
+
+// maybeBackOff checks if err is a rateLimitedError, and if so, pauses terminal updates for as long as the platform
+// asks us to (plus some jitter). The terminal is captured as usual while backing off, so intermediate output is
+// coalesced into the next update, instead of piling up behind the rate limit.
+func (s *session) maybeBackOff(err error) bool {
+	var e *rateLimitedError
+	if !errors.As(err, &e) {
+		return false
+	}
+	backoff := e.RetryAfter + time.Duration(rand.Int63n(int64(e.RetryAfter)/2+1))
+	s.logf("rate_limited", "Terminal update was rate limited, backing off for %s", backoff.Round(time.Millisecond))
+	s.rateLimitedUntil = time.Now().Add(backoff)
+	s.outputSkipped = true
+	return true
+}
+
+// binaryWindow returns what to show in the terminal instead of binary output, depending on the
+// configured binary mode. In upload mode, the raw output is uploaded once per burst of binary output.
+func (s *session) binaryWindow(window string) string {
+	window = strings.TrimRightFunc(window, unicode.IsSpace)
+	switch s.conf.global.BinaryMode {
+	case config.Hexdump:
+		return hexdump(window, s.conf.size.Height)
+	case config.Upload:
+		if !s.binaryUploaded {
+			s.binaryUploaded = true
+			if err := s.conn.UploadFile(s.control(), binaryOutputUploadedMessage, binaryOutputFileName, binaryOutputFileType, strings.NewReader(window)); err != nil {
+				s.logf("warning", "Warning: unable to upload binary output: %s", err.Error())
+			}
+		}
+	}
+	return fmt.Sprintf(binaryOutputSuppressedMessage, len(window))
+}
+
+// colorEnabled returns true if colors should be preserved in the terminal window. Colors are only
+// rendered on platforms that support "ansi" code blocks (see conn.SupportsANSI); on all other platforms,
+// the "!screen" command uploads a colored HTML snapshot instead, see maybeUploadColorSnapshot.
+func (s *session) colorEnabled() bool {
+	return s.conf.colorMode == config.Color && s.conn.SupportsANSI()
+}
+
+func (s *session) captureWindow() (string, error) {
+	if s.colorEnabled() {
+		return s.term.CaptureWithEscapes()
+	}
+	return s.term.Capture()
+}
+
+func (s *session) sanitizeWindow(window string) string {
+	if s.colorEnabled() {
+		return sanitizeWindowWithColors(ansiFormat(window, s.conf.global.ColorMap))
+	}
+	return sanitizeWindow(window)
+}
+
+func (s *session) formatCode(window string) string {
+	var code string
+	if s.colorEnabled() {
+		code = s.conn.Format(window, formatANSI)
+	} else {
+		code = s.conn.Format(window, formatCode)
+	}
+	if s.collapseMode() == collapseSpoiler {
+		return spoilerStart + code + spoilerEnd
+	}
+	return code
+}
+
+// collapseMode returns how long output is collapsed in this session, see conn.CollapseMode. Output is only
+// collapsed if the user asked for it using the "collapse" keyword.
+func (s *session) collapseMode() collapseMode {
+	if !s.conf.collapse {
+		return collapseNone
+	}
+	return s.conn.CollapseMode()
+}
+
+// maxMessageLength returns the platform's message length limit (see conn.MaxMessageLength), or the
+// configured max message length, if it is lower
+func (s *session) maxMessageLength() int {
+	limit := s.conn.MaxMessageLength()
+	if s.conf.global.MaxMessageLength > 0 && s.conf.global.MaxMessageLength < limit {
+		return s.conf.global.MaxMessageLength
+	}
+	return limit
+}
+
+// terminalTarget returns the channel/thread that the terminal is shown in, and the ID of the terminal message there.
+// The ID is lastID, unless the terminal was moved by "!mode" since, in which case it is empty.
+func (s *session) terminalTarget(lastID string) (*channelID, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if lastID != s.terminalID {
+		return s.conf.terminal, ""
+	}
+	return s.conf.terminal, lastID
+}
+
+// control returns the channel/thread the session is controlled from. It only changes if the owner moves it to a
+// direct message, see handleDMCommand.
+func (s *session) control() *channelID {
+	s.controlMu.RLock()
+	defer s.controlMu.RUnlock()
+	return s.conf.control
+}
+
+func (s *session) controlMode() config.ControlMode {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conf.controlMode
 }
 
 func (s *session) shouldUpdateTerminal(lastID string) bool {
-	if s.conf.controlMode == config.Split {
+	if s.controlMode() == config.Split {
 		return lastID != ""
 	}
 	return lastID != "" && atomic.LoadInt32(&s.userInputCount) < updateMessageUserInputCountLimit
@@ -447,13 +1441,13 @@ func (s *session) maybeAddCursor(window string) string {
 	case config.CursorOff:
 		return window
 	case config.CursorOn:
-		show, x, y, err := s.tmux.Cursor()
+		show, x, y, err := s.term.Cursor()
 		if !show || err != nil {
 			return window
 		}
 		return addCursor(window, x, y)
 	default:
-		show, x, y, err := s.tmux.Cursor()
+		show, x, y, err := s.term.Cursor()
 		if !show || err != nil {
 			return window
 		}
@@ -470,22 +1464,33 @@ func (s *session) maybeAddCursor(window string) string {
 
 func (s *session) shutdownHandler() error {
 	<-s.ctx.Done()
-	if err := s.tmux.Stop(); err != nil {
-		log.Printf("[%s] Warning: unable to stop tmux: %s", s.conf.id, err.Error())
-	}
-	cmd := exec.Command(s.conf.script, scriptKillCommand, s.scriptID)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		log.Printf("[%s] Warning: unable to kill command: %s; command output: %s", s.conf.id, err.Error(), string(output))
+	s.stopTerminal()
+	if s.conf.separateStderr && !s.channelGone() {
+		if err := s.sendStderr(); err != nil {
+			s.logf("warning", "Warning: unable to send stderr: %s", err.Error())
+		}
 	}
 	if err := s.sendExitedMessage(); err != nil {
-		log.Printf("[%s] Warning: unable to exit message: %s", s.conf.id, err.Error())
+		s.logf("warning", "Warning: unable to exit message: %s", err.Error())
 	}
-	if err := s.conn.Archive(s.conf.control); err != nil {
-		log.Printf("[%s] Warning: unable to archive thread: %s", s.conf.id, err.Error())
+	if s.tracker != nil && !s.channelGone() {
+		s.deleteMessages()
 	}
-	_ = os.Remove(s.sshUserFile())
+	if !s.channelGone() {
+		if err := s.conn.Archive(s.control()); err != nil {
+			s.logf("warning", "Warning: unable to archive thread: %s", err.Error())
+		}
+	}
+	_ = os.Remove(s.sshUserFile())
 	_ = os.Remove(s.sshClientKeyFile())
-	_ = os.Remove(s.tmux.RecordingFile())
+	_ = os.Remove(s.shareWebSocketFile())
+	_ = os.Remove(s.stderrFile())
+	_ = os.Remove(s.stderrWrapperFile())
+	if s.tempDir != "" {
+		_ = os.RemoveAll(s.tempDir)
+	}
+	_ = os.Remove(s.term.RecordingFile())
+	s.closeAuditLog()
 	s.mu.Lock()
 	s.active = false
 	if s.shareConn != nil {
@@ -498,49 +1503,285 @@ func (s *session) shutdownHandler() error {
 	return nil
 }
 
+// deleteMessages deletes all messages of an ephemeral session, including the exit message. Messages are deleted
+// newest first, so that the terminal disappears before the messages above it.
+func (s *session) deleteMessages() {
+	messages := s.tracker.Messages()
+	deleted := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		if err := s.conn.Delete(messages[i].channel, messages[i].id); errors.Is(err, errDeleteNotSupported) {
+			s.logf("warning", "Warning: cannot delete messages of ephemeral session: %s", err.Error())
+			return
+		} else if err != nil {
+			s.logf("warning", "Warning: unable to delete message %s: %s", messages[i].id, err.Error())
+			continue
+		}
+		deleted++
+	}
+	s.logf("session_messages_deleted", "Deleted %d of %d message(s) of ephemeral session", deleted, len(messages))
+}
+
+// stopTerminal stops the terminal, and kills the script (or its container) in case it is still running. Processes
+// that survive this are killed as well, see reapProcesses.
+func (s *session) stopTerminal() {
+	s.mu.Lock()
+	sid := s.processSession
+	s.mu.Unlock()
+	if sid == 0 {
+		sid = s.terminalProcessSession() // The command may have been slow to start, see Screen.PID
+	}
+	if err := s.term.Stop(); err != nil {
+		s.logf("warning", "Warning: unable to stop %s: %s", s.conf.global.TerminalBackend, err.Error())
+	}
+	kill := s.scriptCommand(scriptKillCommand)
+	cmd := exec.Command(kill[0], kill[1:]...)
+	if s.conf.image != "" {
+		cmd = exec.Command("docker", "rm", "--force", s.scriptID) // Kills and removes the container, if it's still there
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		s.logf("warning", "Warning: unable to kill command: %s; command output: %s", err.Error(), string(output))
+	}
+	if sid > 0 {
+		s.reapProcesses(sid)
+	}
+}
+
+// reapProcesses makes sure that no processes of the terminal's process session are left after the terminal was
+// stopped and the script was killed, e.g. background processes that ignore SIGHUP. Remaining processes are sent
+// the configured kill signals one after the other, waiting for the kill grace period after each of them.
+func (s *session) reapProcesses(sid int) {
+	if len(util.SessionProcesses(sid)) == 0 {
+		return
+	}
+	stage, signals := "stopping the terminal", s.conf.global.KillSignals
+	for i := 0; !s.waitProcessesExited(sid); i++ {
+		if i == len(signals) {
+			s.logf("warning", "Warning: processes %v of the session are still running after %s", util.SessionProcesses(sid), stage)
+			return
+		}
+		stage = "SIG" + signals[i]
+		for _, pid := range util.SessionProcesses(sid) {
+			_ = syscall.Kill(pid, config.KillSignals[signals[i]])
+		}
+	}
+	s.logf("session_processes_reaped", "All processes of the session exited after %s", stage)
+}
+
+// waitProcessesExited waits up to the kill grace period for all processes of the process session to exit,
+// and returns true if they did
+func (s *session) waitProcessesExited(sid int) bool {
+	deadline := time.Now().Add(s.conf.global.KillGracePeriod)
+	for len(util.SessionProcesses(sid)) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(processExitCheckInterval)
+	}
+	return true
+}
+
+// rememberProcessSession remembers the process session of the terminal's command after it was started, so that its
+// processes can be found even after the command exited, see reapProcesses
+func (s *session) rememberProcessSession() {
+	sid := s.terminalProcessSession()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.processSession = sid
+}
+
+// updateTerminalTitle sets the title and status line of the terminal to the session name, owner and mode, so that
+// operators attaching locally (or via the web terminal) can tell which session they are looking at
+func (s *session) updateTerminalTitle() {
+	title := filepath.Base(s.conf.script)
+	if s.conf.name != "" {
+		title = s.conf.name
+	}
+	status := fmt.Sprintf("replbot: %s | script: %s | owner: %s | mode: %s", title, filepath.Base(s.conf.script), s.conf.user, s.controlMode())
+	if err := s.term.SetTitle(title); err != nil {
+		s.logf("warning", "Warning: unable to set terminal title: %s", err.Error())
+	}
+	if err := s.term.SetStatus(status); err != nil {
+		s.logf("warning", "Warning: unable to set terminal status: %s", err.Error())
+	}
+}
+
+// terminalProcessSession returns the process session ID of the terminal's command, or 0 if it cannot be determined
+func (s *session) terminalProcessSession() int {
+	pid, err := s.term.PID()
+	if err != nil {
+		return 0
+	}
+	sid, err := util.ProcessSession(pid)
+	if err != nil {
+		return 0
+	}
+	return sid
+}
+
 func (s *session) activityMonitor() error {
 	defer func() {
 		s.warnTimer.Stop()
 		s.closeTimer.Stop()
 	}()
+	var maxDurationWarnC, maxDurationCloseC <-chan time.Time // nil channels block forever, i.e. no limit
+	if s.conf.maxDuration > 0 {
+		remaining := s.conf.maxDuration - time.Since(s.started)
+		closeTimer := time.NewTimer(remaining)
+		defer closeTimer.Stop()
+		maxDurationCloseC = closeTimer.C
+		if warning := s.conf.global.MaxSessionWarning; warning > 0 && warning < s.conf.maxDuration {
+			warnTimer := time.NewTimer(remaining - warning)
+			defer warnTimer.Stop()
+			maxDurationWarnC = warnTimer.C
+		}
+	}
 	for {
 		select {
 		case <-s.ctx.Done():
 			return errExit
 		case <-s.warnTimer.C:
-			_ = s.conn.Send(s.conf.control, fmt.Sprintf(timeoutWarningMessage, s.conn.Mention(s.conf.user)))
-			log.Printf("[%s] Session has been idle for a long time. Warning sent to user.", s.conf.id)
+			message := s.withPrefix(fmt.Sprintf(timeoutWarningMessage, s.conn.Mention(s.conf.user), s.conf.global.IdleWarning.String()))
+			id, err := s.conn.SendWithID(s.control(), message)
+			if err != nil {
+				s.logf("warning", "Warning: unable to send idle warning: %s", err.Error())
+				continue
+			}
+			s.mu.Lock()
+			s.idleWarningID = id
+			s.mu.Unlock()
+			s.logf("idle_warning", "Session has been idle for a long time. Warning sent to user.")
 		case <-s.closeTimer.C:
-			log.Printf("[%s] Idle timeout reached. Closing session.", s.conf.id)
+			s.logf("idle_timeout", "Idle timeout reached. Closing session.")
+			return errExit
+		case <-maxDurationWarnC:
+			message := s.withPrefix(fmt.Sprintf(maxDurationWarningMessage, s.conn.Mention(s.conf.user), s.conf.global.MaxSessionWarning, s.conf.maxDuration))
+			if err := s.conn.Send(s.control(), message); err != nil {
+				s.logf("warning", "Warning: unable to send max duration warning: %s", err.Error())
+			}
+			s.logf("max_duration_warning", "Session is about to reach its max duration. Warning sent to user.")
+		case <-maxDurationCloseC:
+			s.logf("max_duration", "Max session duration reached. Closing session.")
+			if err := s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(maxDurationReachedMessage, s.conf.maxDuration))); err != nil {
+				s.logf("warning", "Warning: unable to send max duration message: %s", err.Error())
+			}
 			return errExit
 		}
 	}
 }
 
-func (s *session) sessionStartedMessage() string {
-	message := fmt.Sprintf(sessionStartedMessage, s.conn.Mention(s.conf.user))
-	if s.conf.controlMode == config.Split {
-		message += "\n\n" + splitModeThreadMessage
-	}
-	switch s.conf.authMode {
-	case config.OnlyMe:
-		message += "\n\n" + onlyMeModeMessage
-	case config.Everyone:
-		message += "\n\n" + everyoneModeMessage
-	}
-	if s.webCmd != nil {
-		if s.webWritable {
-			message += "\n\n" + fmt.Sprintf(sessionWithWebStartReadWriteMessage, s.conf.global.WebHost, s.webPrefix)
+// sessionStartedStatus returns the "session started" message as a status message, with the session details as fields
+func (s *session) sessionStartedStatus() *statusMessage {
+	return &statusMessage{
+		Title: fmt.Sprintf(statusStartedTitle, filepath.Base(s.conf.script)),
+		Text:  s.startMessage,
+		Fields: []*statusField{
+			{Name: statusOwnerField, Value: s.conn.Mention(s.conf.user)},
+			{Name: statusControlModeField, Value: string(s.conf.controlMode)},
+			{Name: statusWindowModeField, Value: string(s.conf.windowMode)},
+			{Name: statusAuthModeField, Value: string(s.conf.authMode)},
+			{Name: statusSizeField, Value: fmt.Sprintf("%s (%dx%d)", s.conf.size.Name, s.conf.size.Width, s.conf.size.Height)},
+		},
+		State: statusActive,
+	}
+}
+
+// sendStatus sends a status message to the control channel, as plain text if the platform does not support
+// structured status messages, see conn.SendStatus
+func (s *session) sendStatus(status *statusMessage) (string, error) {
+	id, err := s.conn.SendStatus(s.control(), status)
+	if errors.Is(err, errStatusNotSupported) {
+		return s.conn.SendWithID(s.control(), status.Text)
+	}
+	return id, err
+}
+
+// updateStatus updates a status message in the control channel, see sendStatus
+func (s *session) updateStatus(id string, status *statusMessage) error {
+	err := s.conn.UpdateStatus(s.control(), id, status)
+	if errors.Is(err, errStatusNotSupported) {
+		return s.conn.Update(s.control(), id, status.Text)
+	}
+	return err
+}
+
+// sendStartedMessage sends the "session started" message, and remembers it for "!title". In quiet mode, only the
+// parts users need to act on are sent as a plain message, or nothing at all if there are none.
+func (s *session) sendStartedMessage() error {
+	if s.conf.quiet {
+		s.startMessage = s.withPrefix(s.quietSessionStartedMessage())
+	} else {
+		s.startMessage = s.withPrefix(s.sessionStartedMessage())
+	}
+	s.startStatus = s.sessionStartedStatus()
+	if s.conf.quiet && s.startMessage == "" {
+		return nil
+	}
+	return retryRateLimited(func() (err error) {
+		if s.conf.quiet {
+			s.startID, err = s.conn.SendWithID(s.control(), s.startMessage)
 		} else {
-			message += "\n\n" + fmt.Sprintf(sessionWithWebStartReadOnlyMessage, s.conf.global.WebHost, s.webPrefix)
+			s.startID, err = s.sendStatus(s.startStatus)
+		}
+		return err
+	})
+}
+
+func (s *session) sessionStartedMessage() string {
+	var message string
+	if s.conf.global.ReadOnlyMode {
+		message = fmt.Sprintf(readOnlyModeStartedMessage, s.conn.Mention(s.conf.user), s.conf.global.IdleTimeout)
+	} else {
+		message = fmt.Sprintf(sessionStartedMessage, s.conn.Mention(s.conf.user))
+		if s.conf.controlMode == config.Split {
+			message += "\n\n" + splitModeThreadMessage
 		}
+		switch s.conf.authMode {
+		case config.OnlyMe:
+			message += "\n\n" + onlyMeModeMessage
+		case config.Everyone:
+			message += "\n\n" + everyoneModeMessage
+		}
+	}
+	if web := s.webStartedMessage(); web != "" {
+		message += "\n\n" + web
 	}
 	if s.shouldWarnMessageLength(s.conf.size) {
-		message += "\n\n" + messageLimitWarningMessage
+		message += "\n\n" + fmt.Sprintf(messageLimitWarningMessage, s.maxMessageLength())
+	}
+	if s.conf.ready != nil {
+		message += "\n\n" + readyWaitMessage
+	}
+	if s.conf.ephemeral {
+		message += "\n\n" + ephemeralMessage
 	}
 	return message
 }
 
+// quietSessionStartedMessage returns the parts of the "session started" message that users need to act on, e.g.
+// the web terminal link, or an empty string if there are none, see sessionConfig.quiet
+func (s *session) quietSessionStartedMessage() string {
+	parts := make([]string, 0)
+	if s.conf.controlMode == config.Split && !s.conf.global.ReadOnlyMode {
+		parts = append(parts, splitModeThreadMessage)
+	}
+	if web := s.webStartedMessage(); web != "" {
+		parts = append(parts, web)
+	}
+	if s.shouldWarnMessageLength(s.conf.size) {
+		parts = append(parts, fmt.Sprintf(messageLimitWarningMessage, s.maxMessageLength()))
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func (s *session) webStartedMessage() string {
+	if s.webCmd == nil {
+		return ""
+	} else if s.webWritable {
+		return fmt.Sprintf(sessionWithWebStartReadWriteMessage, s.conf.global.WebHost, s.webPrefix)
+	}
+	return fmt.Sprintf(sessionWithWebStartReadOnlyMessage, s.conf.global.WebHost, s.webPrefix)
+}
+
 func (s *session) maybeTrimWindow(window string) string {
 	switch s.conf.windowMode {
 	case config.Full:
@@ -556,11 +1797,12 @@ func (s *session) maybeTrimWindow(window string) string {
 }
 
 func (s *session) getEnv() (map[string]string, error) {
-	var sshUserFile, sshKeyFile, relayPort string
+	var sshUserFile, sshKeyFile, shareWebSocketFile, relayPort string
 	if s.conf.share != nil {
 		shareConf := s.conf.share
 		relayPort = strconv.Itoa(shareConf.relayPort)
 		sshUserFile = s.sshUserFile()
+		shareWebSocketFile = s.shareWebSocketFile()
 		sshKeyFile = s.sshClientKeyFile()
 		if err := os.WriteFile(sshKeyFile, []byte(shareConf.clientKeyPair.PrivateKey), 0600); err != nil {
 			return nil, err
@@ -569,11 +1811,18 @@ func (s *session) getEnv() (map[string]string, error) {
 	return map[string]string{
 		"REPLBOT_SSH_KEY_FILE":       sshKeyFile,
 		"REPLBOT_SSH_USER_FILE":      sshUserFile,
+		"REPLBOT_SHARE_WS_FILE":      shareWebSocketFile,
 		"REPLBOT_SSH_RELAY_PORT":     relayPort,
 		"REPLBOT_MAX_TOTAL_SESSIONS": strconv.Itoa(s.conf.global.MaxUserSessions),
 	}, nil
 }
 
+func (s *session) setEnv(env map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.env = env
+}
+
 func (s *session) parseUsers(usersList []string) ([]string, error) {
 	users := make([]string, 0)
 	for _, field := range usersList {
@@ -586,11 +1835,20 @@ func (s *session) parseUsers(usersList []string) ([]string, error) {
 	return users, nil
 }
 
+// everyone returns true if everyone in the channel may send commands, i.e. in "everyone" mode
+func (s *session) everyone() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conf.authMode == config.Everyone
+}
+
 func (s *session) allowUser(user string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if user == s.conf.user {
 		return true // Always allow session owner!
+	} else if s.readOnly {
+		return false
 	}
 	if allow, ok := s.authUsers[user]; ok {
 		return allow
@@ -599,16 +1857,66 @@ func (s *session) allowUser(user string) bool {
 }
 
 func (s *session) createCommand() []string {
-	command := []string{s.conf.script, scriptRunCommand, s.scriptID}
+	command := s.scriptCommand(scriptRunCommand)
+	if s.conf.separateStderr {
+		command = s.wrapStderrCommand(command)
+	}
+	if s.conf.image != "" {
+		command = s.wrapDockerCommand(command)
+	}
 	if s.conf.record {
 		command = s.maybeWrapAsciinemaCommand(command)
 	}
 	return command
 }
 
+// scriptCommand returns the command to call the script with the given script command (run or kill). If a shell is
+// configured (see config.Config.Shell), it runs the script instead of the interpreter in its shebang line. Scripts
+// that run in a container are left alone, since the shell may not exist in the image.
+func (s *session) scriptCommand(scriptCommand string) []string {
+	command := []string{s.conf.script, scriptCommand, s.scriptID}
+	if s.conf.global.Shell != "" && s.conf.image == "" {
+		return append([]string{s.conf.global.Shell}, command...)
+	}
+	return command
+}
+
+// wrapDockerCommand runs the script inside a disposable container of the script's image. The script is mounted
+// into the container and used as its entrypoint; the working directory (if any) is mounted as /work.
+func (s *session) wrapDockerCommand(command []string) []string {
+	args := []string{
+		"docker", "run",
+		"--rm",
+		"--interactive",
+		"--tty",
+		"--name", s.scriptID,
+		"--pids-limit", "512",
+		"--ulimit", "nofile=1024:1024",
+		"--volume", fmt.Sprintf("%s:%s:ro", s.conf.script, dockerScriptPath),
+		"--entrypoint", dockerScriptPath,
+	}
+	if dir := s.workDir(); dir != "" {
+		args = append(args, "--volume", fmt.Sprintf("%s:%s", dir, dockerWorkDir), "--workdir", path.Join(dockerWorkDir, filepath.ToSlash(s.relativeDir())))
+	}
+	return append(append(args, s.conf.image), command[1:]...)
+}
+
+// wrapStderrCommand runs the script via a wrapper script that redirects its stderr to the stderr file, so that it is
+// not shown in the terminal, but sent to the stderr thread instead, see forwardStderr. Restarted REPLs append to
+// the same file. The wrapper is a file, since the terminal's launch script cannot pass on quotes or variables.
+func (s *session) wrapStderrCommand(command []string) []string {
+	wrapper := fmt.Sprintf("#!/bin/sh\nexec 2>>%s\nexec \"$@\"\n", util.Quote(s.stderrFile()))
+	if err := os.WriteFile(s.stderrWrapperFile(), []byte(wrapper), 0700); err != nil {
+		s.logf("warning", "Cannot separate stderr, unable to write wrapper script: %s", err.Error())
+		s.conf.separateStderr = false
+		return command
+	}
+	return append([]string{s.stderrWrapperFile()}, command...)
+}
+
 func (s *session) maybeWrapAsciinemaCommand(command []string) []string {
 	if err := util.Run("asciinema", "--version"); err != nil {
-		log.Printf("[%s] Cannot record session, 'asciinema' command is missing.", s.conf.id)
+		s.logf("warning", "Cannot record session, 'asciinema' command is missing.")
 		s.conf.record = false
 		return command
 	}
@@ -622,20 +1930,143 @@ func (s *session) maybeWrapAsciinemaCommand(command []string) []string {
 	}
 }
 
+// openAuditLog opens the append-only audit log file for this session, if a session log directory is
+// configured. The audit log records who typed what and when, as well as the terminal output.
+func (s *session) openAuditLog() error {
+	if s.conf.global.SessionLogDir == "" {
+		return nil
+	}
+	filename := filepath.Join(s.conf.global.SessionLogDir, fmt.Sprintf("%s_%s.log", s.conf.global.Platform(), s.conf.id))
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.auditMu.Lock()
+	s.auditFile = file
+	s.auditMu.Unlock()
+	s.audit("start", s.conf.user, filepath.Base(s.conf.script))
+	return nil
+}
+
+func (s *session) closeAuditLog() {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	if s.auditFile == nil {
+		return
+	}
+	_, _ = fmt.Fprintf(s.auditFile, "%s [end]\n", time.Now().UTC().Format(time.RFC3339))
+	_ = s.auditFile.Close()
+	s.auditFile = nil
+}
+
+func (s *session) auditInput(user, message string) {
+	s.audit("input", user, message)
+}
+
+// auditOutput writes the terminal window to the audit log, if it changed since it was last written
+func (s *session) auditOutput(window string) {
+	window = consoleCodeRegex.ReplaceAllString(window, "")
+	if window == s.auditLast {
+		return
+	}
+	s.auditLast = window
+	s.audit("output", "", "\n"+strings.TrimRight(window, "\n"))
+}
+
+func (s *session) audit(kind, user, text string) {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	if s.auditFile == nil {
+		return
+	}
+	if s.conf.global.SessionLogRedact != nil {
+		text = s.conf.global.SessionLogRedact.ReplaceAllString(text, sessionLogRedacted)
+	}
+	text = strings.ReplaceAll(text, "\n", "\n| ")
+	if user != "" {
+		user = " " + user + ":"
+	}
+	if _, err := fmt.Fprintf(s.auditFile, "%s [%s]%s %s\n", time.Now().UTC().Format(time.RFC3339), kind, user, text); err != nil {
+		s.logf("warning", "Warning: unable to write to session log: %s", err.Error())
+	}
+}
+
+// maybeCreateTempDir creates a fresh temporary working directory for the session, if configured,
+// and returns the working directory the command should be started in
+func (s *session) maybeCreateTempDir() (string, error) {
+	if s.conf.workDir != config.WorkDirTemp {
+		return s.conf.workDir, nil
+	}
+	dir, err := os.MkdirTemp(s.conf.global.TempDir, "replbot_"+s.conf.id+"_")
+	if err != nil {
+		return "", err
+	}
+	s.tempDir = dir
+	return dir, nil
+}
+
+// workDir returns the working directory of the session, or an empty string if the session
+// inherited REPLbot's working directory
+func (s *session) workDir() string {
+	if s.tempDir != "" {
+		return s.tempDir
+	} else if s.conf.workDir == config.WorkDirTemp {
+		return ""
+	}
+	return s.conf.workDir
+}
+
+// currentDir returns the current directory of the session, as changed by "!cd", or the working directory if it
+// was never changed. Unlike in a shell, the directory is tracked by REPLbot, so that it also applies to REPLs that
+// cannot change their directory themselves, or that spawn a new process per command.
+func (s *session) currentDir() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cwd != "" {
+		return s.cwd
+	}
+	return s.workDir()
+}
+
+// relativeDir returns the current directory relative to the working directory, e.g. "." or "src/lib"
+func (s *session) relativeDir() string {
+	workDir, err := filepath.EvalSymlinks(s.workDir()) // The current directory is resolved, see workDirDir
+	if err != nil {
+		return "."
+	}
+	rel, err := filepath.Rel(workDir, s.currentDir())
+	if err != nil {
+		return "."
+	}
+	return rel
+}
+
 func (s *session) asciinemaFile() string {
-	return filepath.Join(os.TempDir(), "replbot_"+s.conf.id+".asciinema")
+	return filepath.Join(s.conf.global.TempDir, "replbot_"+s.conf.id+".asciinema")
 }
 
 func (s *session) sshClientKeyFile() string {
-	return filepath.Join(os.TempDir(), "replbot_"+s.conf.id+".ssh-client-key")
+	return filepath.Join(s.conf.global.TempDir, "replbot_"+s.conf.id+".ssh-client-key")
+}
+
+func (s *session) stderrFile() string {
+	return filepath.Join(s.conf.global.TempDir, "replbot_"+s.conf.id+".stderr")
+}
+
+func (s *session) stderrWrapperFile() string {
+	return filepath.Join(s.conf.global.TempDir, "replbot_"+s.conf.id+".stderr-wrapper")
 }
 
 func (s *session) sshUserFile() string {
-	return filepath.Join(os.TempDir(), "replbot_"+s.conf.id+".ssh-user")
+	return filepath.Join(s.conf.global.TempDir, "replbot_"+s.conf.id+".ssh-user")
+}
+
+func (s *session) shareWebSocketFile() string {
+	return filepath.Join(s.conf.global.TempDir, "replbot_"+s.conf.id+".share-ws")
 }
 
 func (s *session) createRecordingArchive(filename string) (*os.File, error) {
-	recordingFile := s.tmux.RecordingFile()
+	recordingFile := s.term.RecordingFile()
 	asciinemaFile := s.asciinemaFile()
 	defer func() {
 		os.Remove(recordingFile)
@@ -649,7 +2080,7 @@ func (s *session) createRecordingArchive(filename string) (*os.File, error) {
 	if err := zipAppendEntry(zw, "REPLbot session/README.md", recordingReadmeSource); err != nil {
 		return nil, err
 	}
-	if err := zipAppendFile(zw, "REPLbot session/terminal.txt", recordingFile); err != nil {
+	if err := s.zipAppendRecordingFile(zw, "REPLbot session/terminal.txt", recordingFile); err != nil {
 		return nil, err
 	}
 	if err := zipAppendFile(zw, "REPLbot session/replay.asciinema", asciinemaFile); err != nil {
@@ -664,6 +2095,19 @@ func (s *session) createRecordingArchive(filename string) (*os.File, error) {
 	return file, nil
 }
 
+// zipAppendRecordingFile adds the raw terminal recording to the archive, applying the output filters if
+// config.Config.FilterRecordings is set
+func (s *session) zipAppendRecordingFile(zw *zip.Writer, name string, filename string) error {
+	if !s.conf.global.FilterRecordings || len(s.conf.global.OutputFilters) == 0 {
+		return zipAppendFile(zw, name, filename)
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return zipAppendEntry(zw, name, filterOutput(string(b), s.conf.global.OutputFilters))
+}
+
 func (s *session) monitorRecording() error {
 	for {
 		select {
@@ -674,7 +2118,7 @@ func (s *session) monitorRecording() error {
 			if err != nil {
 				continue
 			} else if stat.Size() > recordingFileSizeMax {
-				if err := s.conn.Send(s.conf.control, recordingTooLargeMessage); err != nil {
+				if err := s.conn.Send(s.control(), recordingTooLargeMessage); err != nil {
 					return err
 				}
 				return errExit
@@ -683,10 +2127,74 @@ func (s *session) monitorRecording() error {
 	}
 }
 
+// forwardStderr sends the error output of the REPL to the stderr thread, if the user asked for it with the
+// "separate-stderr" keyword. Output is collected and sent at most once per stderrForwardInterval, so that chatty
+// programs do not flood the channel. The rest is sent when the session ends, see shutdownHandler.
+func (s *session) forwardStderr() error {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-time.After(stderrForwardInterval):
+			if err := s.sendStderr(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendStderr sends the error output written since it was last called to the stderr thread, and creates the
+// thread with the first output. Only the last lines are sent if the output does not fit into one message.
+func (s *session) sendStderr() error {
+	s.stderrMu.Lock()
+	defer s.stderrMu.Unlock()
+	file, err := os.Open(s.stderrFile())
+	if err != nil {
+		return nil // Nothing written yet
+	}
+	defer file.Close()
+	if _, err := file.Seek(s.stderrOffset, io.SeekStart); err != nil {
+		return err
+	}
+	output, err := io.ReadAll(io.LimitReader(file, stderrReadMax))
+	if err != nil || len(output) == 0 {
+		return err
+	}
+	s.stderrOffset += int64(len(output))
+	stderr := filterOutput(consoleCodeRegex.ReplaceAllString(string(output), ""), s.conf.global.OutputFilters)
+	if strings.TrimSpace(stderr) == "" {
+		return nil
+	}
+	if s.stderrTarget == nil {
+		channel := s.control().Channel
+		id, err := s.conn.SendWithID(&channelID{Channel: channel}, s.withPrefix(stderrThreadMessage))
+		if err != nil {
+			return err
+		}
+		s.stderrTarget = &channelID{Channel: channel, Thread: id}
+	}
+	stderr = trimLeadingLines(stderr, s.maxMessageLength()-len(s.conn.Format("", formatCode)))
+	return s.conn.Send(s.stderrTarget, s.conn.Format(stderr, formatCode))
+}
+
 func (s *session) sendExitedMessage() error {
-	if s.conf.record {
+	s.mu.RLock()
+	terminated, sendFailure := s.terminated, s.sendFailure
+	s.mu.RUnlock()
+	if terminated {
+		return s.conn.Send(s.control(), sessionTerminatedMessage)
+	} else if errors.Is(sendFailure, errChannelGone) {
+		s.logf("session_channel_gone", "Closing session: %s", sendFailure.Error())
+		return nil
+	} else if sendFailure != nil {
+		s.logf("session_send_failed", "Closing session, because messages could not be sent: %s", sendFailure.Error())
+		return s.conn.Send(s.control(), fmt.Sprintf(sessionSendFailedMessage, sendFailure.Error())) // Best effort, likely fails too
+	}
+	if s.conf.quiet && !s.conf.record {
+		return nil
+	} else if s.conf.record {
 		if err := s.sendExitedMessageWithRecording(); err != nil {
-			log.Printf("[%s] Warning: unable to upload recording: %s", s.conf.id, err.Error())
+			s.logf("warning", "Warning: unable to upload recording: %s", err.Error())
 			return s.sendExitedMessageWithoutRecording()
 		}
 		return nil
@@ -695,18 +2203,24 @@ func (s *session) sendExitedMessage() error {
 }
 
 func (s *session) sendExitedMessageWithoutRecording() error {
-	return s.conn.Send(s.conf.control, sessionExitedMessage)
+	_, err := s.sendStatus(&statusMessage{
+		Title:  fmt.Sprintf(statusExitedTitle, filepath.Base(s.conf.script)),
+		Text:   sessionExitedMessage,
+		Fields: []*statusField{{Name: statusUptimeField, Value: time.Since(s.started).Round(time.Second).String()}},
+		State:  statusExited,
+	})
+	return err
 }
 
 func (s *session) sendExitedMessageWithRecording() error {
 	if err := s.maybePatchAsciinemaRecordingFile(); err != nil {
-		log.Printf("[%s] Cannot patch asciinema session file: %s", s.conf.id, err.Error())
+		s.logf("warning", "Cannot patch asciinema session file: %s", err.Error())
 	}
 	url, expiry, err := s.maybeUploadAsciinemaRecording()
 	if err != nil {
-		log.Printf("[%s] Cannot upload recorded asciinema session: %s", s.conf.id, err.Error())
+		s.logf("warning", "Cannot upload recorded asciinema session: %s", err.Error())
 	}
-	filename := filepath.Join(os.TempDir(), "replbot_"+s.conf.id+".recording.zip")
+	filename := filepath.Join(s.conf.global.TempDir, "replbot_"+s.conf.id+".recording.zip")
 	file, err := s.createRecordingArchive(filename)
 	if err != nil {
 		return err
@@ -722,14 +2236,14 @@ func (s *session) sendExitedMessageWithRecording() error {
 	if expiry != "" {
 		message += " " + fmt.Sprintf(sessionAsciinemaExpiryMessage, expiry)
 	}
-	return s.conn.UploadFile(s.conf.control, message, recordingFileName, recordingFileType, file)
+	return s.conn.UploadFile(s.control(), message, recordingFileName, recordingFileType, file)
 }
 
 func (s *session) maybeStartWeb() error {
 	if !s.conf.web {
 		return nil
 	}
-	permitWrite := s.conf.authMode == config.Everyone
+	permitWrite := s.conf.authMode == config.Everyone && !s.conf.global.ReadOnlyMode
 	return s.startWeb(permitWrite)
 }
 
@@ -742,7 +2256,10 @@ func (s *session) maybeSendStartShareMessage() error {
 		return err
 	}
 	message := fmt.Sprintf(shareStartCommandMessage, port, s.conf.share.user, host)
-	if err := s.conn.SendEphemeral(s.conf.control, s.conf.user, message); err != nil {
+	if s.conf.global.WebHost != "" {
+		message += fmt.Sprintf(shareStartWebSocketMessage, s.conf.global.WebHost, s.conf.share.token)
+	}
+	if err := s.conn.SendEphemeral(s.control(), s.conf.user, message); err != nil {
 		return err
 	}
 	return nil
@@ -750,45 +2267,197 @@ func (s *session) maybeSendStartShareMessage() error {
 
 func (s *session) maybeSendMessageLengthWarning(size *config.Size) error {
 	if s.shouldWarnMessageLength(size) {
-		return s.conn.Send(s.conf.control, messageLimitWarningMessage)
+		return s.conn.Send(s.control(), fmt.Sprintf(messageLimitWarningMessage, s.maxMessageLength()))
 	}
 	return nil
 }
 
 func (s *session) shouldWarnMessageLength(size *config.Size) bool {
-	return s.conf.global.Platform() == config.Discord && (size == config.Medium || size == config.Large)
+	return (size.Width+1)*size.Height > s.maxMessageLength()-len(s.formatCode("")) // +1 for the new line
 }
 
 func (s *session) handlePassthrough(input string) error {
-	return s.tmux.Paste(fmt.Sprintf("%s\n", s.conn.Unescape(input)))
+	input = s.conn.Unescape(input)
+	if rejected, err := s.maybeRejectDangerous(input); rejected {
+		return err
+	} else if strings.Contains(strings.TrimRight(input, "\n"), "\n") && s.everyone() {
+		// Paste multi-line messages as one block, so that they are not mixed up with the input of others
+		if err := s.term.PasteBracketed(input); err != nil {
+			return err
+		}
+		return s.term.SendKeys(sendKeysMapping["!r"]) // Bracketed paste does not execute the input, so we hit return
+	}
+	return s.term.Paste(fmt.Sprintf("%s\n", input))
+}
+
+// handleForceCommand sends the input like handlePassthrough, but skips the dangerous command check
+func (s *session) handleForceCommand(_, input string) error {
+	input = s.conn.Unescape(strings.TrimSpace(strings.TrimPrefix(input, "!force")))
+	if input == "" {
+		return s.conn.Send(s.control(), s.withPrefix(forceHelpMessage))
+	}
+	s.logf("dangerous_command_forced", "Sending command flagged as dangerous: %s", input)
+	return s.term.Paste(fmt.Sprintf("%s\n", input))
+}
+
+// maybeRejectDangerous checks the input against the configured dangerous command patterns (see
+// config.Config.DangerousCommands). If one of them matches, the input must not be sent, and the user is told
+// to use "!force" instead. This guards against accidents, e.g. in "everyone" mode, but it is not a security
+// boundary: there are countless ways around it.
+func (s *session) maybeRejectDangerous(input string) (rejected bool, err error) {
+	for _, pattern := range s.conf.global.DangerousCommands {
+		if pattern.MatchString(input) {
+			s.logf("dangerous_command", "Not sending input, because it matches %s: %s", pattern.String(), input)
+			return true, s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(dangerousCommandMessage, pattern.String())))
+		}
+	}
+	return false, nil
 }
 
-func (s *session) handleHelpCommand(_ string) error {
+func (s *session) handleHelpCommand(_, _ string) error {
 	atomic.AddInt32(&s.userInputCount, updateMessageUserInputCountLimit)
-	return s.conn.Send(s.conf.control, helpMessage)
+	var commentHelp string
+	if s.conf.global.CommentPrefix != "" {
+		commentHelp = fmt.Sprintf(commentHelpMessage, s.conf.global.CommentPrefix)
+	}
+	_, err := s.sendStatus(&statusMessage{
+		Title: statusHelpTitle,
+		Text:  fmt.Sprintf(s.withPrefix(helpMessage), commentHelp),
+		State: statusInfo,
+	})
+	return err
 }
 
-func (s *session) handleNoNewlineCommand(input string) error {
+func (s *session) handleNoNewlineCommand(user, input string) error {
 	input = s.conn.Unescape(strings.TrimSpace(strings.TrimPrefix(input, "!n")))
 	if input == "" {
-		return s.conn.Send(s.conf.control, noNewlineHelpMessage)
+		return s.conn.Send(s.control(), s.withPrefix(noNewlineHelpMessage))
+	} else if rejected, err := s.maybeRejectDangerous(input); rejected {
+		return err
+	}
+	if err := s.term.Paste(input); err != nil {
+		return err
 	}
-	return s.tmux.Paste(input)
+	s.partialLineUser = user // Hold back input of others until the line is finished, see holdInput
+	s.partialLineTimer.Reset(partialLineTimeout)
+	return nil
 }
 
-func (s *session) handleEscapeCommand(input string) error {
+func (s *session) handleEscapeCommand(_, input string) error {
 	input = unquote(s.conn.Unescape(strings.TrimSpace(strings.TrimPrefix(input, "!e"))))
 	if input == "" {
-		return s.conn.Send(s.conf.control, escapeHelpMessage)
+		return s.conn.Send(s.control(), s.withPrefix(escapeHelpMessage))
+	} else if rejected, err := s.maybeRejectDangerous(input); rejected {
+		return err
+	}
+	return s.term.Paste(input)
+}
+
+func (s *session) handlePasteCommand(_, input string) error {
+	s.pasting = true
+	s.pasteBuffer = make([]string, 0)
+	s.pasteTimer.Reset(pasteTimeout)
+	if err := s.conn.Send(s.control(), s.withPrefix(pasteStartedMessage)); err != nil {
+		return err
+	}
+	input = strings.TrimLeft(strings.TrimPrefix(input, "!paste"), " \n")
+	if input == "" {
+		return nil
+	}
+	return s.handlePasteInput(input) // "!paste" may be followed by lines in the same message
+}
+
+func (s *session) handlePasteEndCommand(_, _ string) error {
+	return s.conn.Send(s.control(), s.withPrefix(pasteNotStartedMessage)) // Only called if not in paste mode
+}
+
+// handlePasteInput buffers the input lines until a line "!end" (with the configured command prefix) is
+// received. The input may contain multiple lines, and the "!end" may be the last line of a message.
+func (s *session) handlePasteInput(input string) error {
+	lines := strings.Split(s.conn.Unescape(input), "\n")
+	if strings.TrimSpace(lines[len(lines)-1]) == s.conf.global.CommandPrefix+"end" {
+		s.pasteBuffer = append(s.pasteBuffer, lines[:len(lines)-1]...)
+		return s.flushPaste()
+	}
+	s.pasteBuffer = append(s.pasteBuffer, lines...)
+	return nil
+}
+
+// flushPaste sends the paste buffer as one block. Lines with a "!sleep" command split the buffer into multiple blocks,
+// with a pause in between, see pasteLines.
+func (s *session) flushPaste() error {
+	s.pasteTimer.Stop()
+	s.pasting = false
+	lines := s.pasteBuffer
+	s.pasteBuffer = nil
+	return s.pasteLines(lines)
+}
+
+// pasteLines pastes the lines up to the first "!sleep" line as one block. The remaining lines are queued until the
+// sleep is over, see handleSleepCommand.
+func (s *session) pasteLines(lines []string) error {
+	if s.sleeping {
+		if len(lines) > 0 {
+			s.sleepQueue = append(s.sleepQueue, &queuedInput{paste: lines})
+		}
+		return nil
+	}
+	for i, line := range lines {
+		if command, ok := s.parseCommand(strings.TrimSpace(line)); ok && strings.HasPrefix(command, "!sleep") {
+			if err := s.pasteBlock(lines[:i]); err != nil {
+				return err
+			} else if err := s.handleSleepCommand("", command); err != nil {
+				return err
+			}
+			return s.pasteLines(lines[i+1:])
+		}
+	}
+	return s.pasteBlock(lines)
+}
+
+func (s *session) pasteBlock(lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	input := strings.Join(lines, "\n")
+	if rejected, err := s.maybeRejectDangerous(input); rejected {
+		return err
+	}
+	if err := s.term.PasteBracketed(input); err != nil {
+		return err
+	}
+	return s.term.SendKeys(sendKeysMapping["!r"]) // Bracketed paste does not execute the input, so we hit return
+}
+
+// handleSleepCommand delays the input, i.e. the next input is only sent to the REPL after the given duration (e.g.
+// "!sleep 5s", or "!sleep 5" for seconds). The input loop is not blocked: the rest of a macro or paste block, and
+// input typed in the meantime, is queued (see delayInput), while session commands are still handled right away.
+func (s *session) handleSleepCommand(_, input string) error {
+	arg := strings.TrimSpace(strings.TrimPrefix(input, "!sleep"))
+	if _, err := strconv.ParseFloat(arg, 64); err == nil {
+		arg += "s"
+	}
+	duration, err := time.ParseDuration(arg)
+	if err != nil || duration <= 0 || duration > sleepMaxDuration {
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(sleepHelpMessage, sleepMaxDuration)))
+	}
+	s.logf("sleep", "Pausing input for %s", duration)
+	if !s.sleepTimer.Stop() {
+		select {
+		case <-s.sleepTimer.C: // Drain, in case the timer fired, but resumeInput did not run yet
+		default:
+		}
 	}
-	return s.tmux.Paste(input)
+	s.sleeping = true
+	s.sleepTimer.Reset(duration)
+	return nil
 }
 
-func (s *session) handleKeepaliveCommand(_ string) error {
-	return s.conn.Send(s.conf.control, sessionKeptAliveMessage)
+func (s *session) handleKeepaliveCommand(_, _ string) error {
+	return s.conn.Send(s.control(), sessionKeptAliveMessage)
 }
 
-func (s *session) handleAllowCommand(input string) error {
+func (s *session) handleAllowCommand(_, input string) error {
 	fields := strings.Fields(strings.TrimSpace(strings.TrimPrefix(input, "!allow")))
 	if util.InStringList(fields, "all") || util.InStringList(fields, "everyone") {
 		return s.resetAuthMode(config.Everyone)
@@ -798,7 +2467,7 @@ func (s *session) handleAllowCommand(input string) error {
 	}
 	users, err := s.parseUsers(fields)
 	if err != nil || len(users) == 0 {
-		return s.conn.Send(s.conf.control, fmt.Sprintf(allowCommandHelpMessage, s.conn.MentionBot()))
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(allowCommandHelpMessage, s.conn.MentionBot())))
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -806,45 +2475,95 @@ func (s *session) handleAllowCommand(input string) error {
 		s.authUsers[user] = true
 	}
 	message := usersAddedToAllowList
-	return s.conn.Send(s.conf.control, message)
+	return s.conn.Send(s.control(), s.withPrefix(message))
 }
 
-func (s *session) handleDenyCommand(input string) error {
+func (s *session) handleDenyCommand(_, input string) error {
 	fields := strings.Fields(strings.TrimSpace(strings.TrimPrefix(input, "!deny")))
 	if util.InStringList(fields, "all") || util.InStringList(fields, "everyone") {
 		return s.resetAuthMode(config.OnlyMe)
 	}
 	users, err := s.parseUsers(fields)
 	if err != nil || len(users) == 0 {
-		return s.conn.Send(s.conf.control, fmt.Sprintf(denyCommandHelpMessage, s.conn.MentionBot()))
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(denyCommandHelpMessage, s.conn.MentionBot())))
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for _, user := range users {
 		if s.conf.user == user {
-			return s.conn.Send(s.conf.control, cannotAddOwnerToDenyList)
+			return s.conn.Send(s.control(), cannotAddOwnerToDenyList)
 		}
 		s.authUsers[user] = false
 	}
 	message := usersAddedToDenyList
-	return s.conn.Send(s.conf.control, message)
+	return s.conn.Send(s.control(), s.withPrefix(message))
 }
 
-func (s *session) resetAuthMode(authMode config.AuthMode) error {
-	s.mu.Lock()
+func (s *session) handleAuthCommand(_, input string) error {
+	arg := strings.TrimSpace(strings.TrimPrefix(input, "!auth"))
+	switch {
+	case arg == "everyone" || arg == "all":
+		return s.resetAuthMode(config.Everyone)
+	case arg == "only-me" || arg == "nobody":
+		return s.resetAuthMode(config.OnlyMe)
+	case strings.HasPrefix(arg, "users:"):
+		fields := strings.FieldsFunc(strings.TrimPrefix(arg, "users:"), func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+		users, err := s.parseUsers(fields)
+		if err != nil || len(users) == 0 {
+			break
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.conf.authMode = config.OnlyMe
+		s.authUsers = make(map[string]bool)
+		mentions := make([]string, 0)
+		for _, user := range users {
+			s.authUsers[user] = true
+			mentions = append(mentions, s.conn.Mention(user))
+		}
+		return s.conn.Send(s.control(), s.withPrefix(authModeChangeMessage+fmt.Sprintf(authUsersModeMessage, strings.Join(mentions, ", "))))
+	}
+	return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(authCommandHelpMessage, s.conn.MentionBot(), s.conn.MentionBot())))
+}
+
+func (s *session) handleReadOnlyCommand(_, input string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.TrimSpace(strings.TrimPrefix(input, "!readonly")) {
+	case "on":
+		s.readOnly = true
+		return s.conn.Send(s.control(), s.withPrefix(readOnlyEnabledMessage))
+	case "off":
+		s.readOnly = false
+		if s.conf.authMode == config.Everyone {
+			return s.conn.Send(s.control(), s.withPrefix(readOnlyDisabledMessage+everyoneModeMessage))
+		}
+		return s.conn.Send(s.control(), s.withPrefix(readOnlyDisabledMessage+onlyMeModeMessage))
+	default:
+		return s.conn.Send(s.control(), s.withPrefix(readOnlyHelpMessage))
+	}
+}
+
+func (s *session) resetAuthMode(authMode config.AuthMode) error {
+	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.conf.authMode = authMode
 	s.authUsers = make(map[string]bool)
 	if authMode == config.Everyone {
-		return s.conn.Send(s.conf.control, authModeChangeMessage+everyoneModeMessage)
+		return s.conn.Send(s.control(), s.withPrefix(authModeChangeMessage+everyoneModeMessage))
 	}
-	return s.conn.Send(s.conf.control, authModeChangeMessage+onlyMeModeMessage)
+	return s.conn.Send(s.control(), s.withPrefix(authModeChangeMessage+onlyMeModeMessage))
 }
 
-func (s *session) handleSendKeysCommand(input string) error {
+func (s *session) handleSendKeysCommand(_, input string) error {
 	fields := strings.Fields(strings.TrimSpace(input))
 	keys := make([]string, 0)
 	for _, field := range fields {
+		if command, ok := s.parseCommand(field); ok {
+			field = command // The first field is already translated, all others are not
+		}
 		if matches := ctrlCommandRegex.FindStringSubmatch(field); len(matches) > 0 {
 			keys = append(keys, "^"+strings.ToUpper(matches[1]))
 		} else if matches := fKeysRegex.FindStringSubmatch(field); len(matches) > 0 {
@@ -854,24 +2573,566 @@ func (s *session) handleSendKeysCommand(input string) error {
 		} else if controlChar, ok := sendKeysMapping[field]; ok {
 			keys = append(keys, controlChar)
 		} else {
-			return s.conn.Send(s.conf.control, sendKeysHelpMessage)
+			return s.conn.Send(s.control(), s.withPrefix(sendKeysHelpMessage))
+		}
+	}
+	return s.term.SendKeys(keys...)
+}
+
+// handleKeyCommand sends the named keys (see keyNames), e.g. "!key esc" or "!key home end", so that keys without
+// their own send-key command can be sent as well
+func (s *session) handleKeyCommand(_, input string) error {
+	names := strings.Fields(strings.ToLower(strings.TrimPrefix(strings.TrimSpace(input), "!key")))
+	keys := make([]string, 0)
+	for _, name := range names {
+		if key, ok := keyNames[name]; ok {
+			keys = append(keys, key)
+		} else if keyNameFKeysRegex.MatchString(name) {
+			keys = append(keys, strings.ToUpper(name))
+		} else {
+			keys = nil
+			break
+		}
+	}
+	if len(keys) == 0 {
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(keyHelpMessage, formatScripts(sortedKeys(keyNames)))))
+	}
+	return s.term.SendKeys(keys...)
+}
+
+// handleSendHexCommand sends raw bytes given in hex to the terminal, e.g. "!send 1b5b41" for the up key. Spaces
+// between the bytes are allowed.
+func (s *session) handleSendHexCommand(_, input string) error {
+	hexInput := strings.Join(strings.Fields(strings.TrimPrefix(strings.TrimSpace(input), "!send")), "")
+	if hexInput == "" {
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(sendHexHelpMessage, sendHexMaxBytes)))
+	} else if len(hexInput) > 2*sendHexMaxBytes {
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(sendHexTooLongMessage, sendHexMaxBytes)))
+	}
+	b, err := hex.DecodeString(hexInput)
+	if err != nil {
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(sendHexInvalidMessage, err.Error())))
+	} else if rejected, err := s.maybeRejectDangerous(string(b)); rejected {
+		return err
+	}
+	return s.term.Paste(string(b))
+}
+
+// isSendKeysCommand returns true if the given command is a single key command handled by handleSendKeysCommand
+func isSendKeysCommand(command string) bool {
+	_, ok := sendKeysMapping[command]
+	return ok || ctrlCommandRegex.MatchString(command) || fKeysRegex.MatchString(command)
+}
+
+// handleCompleteCommand types the partial input, hits tab and shows what the REPL printed, e.g. the candidates
+// for "!complete os.pa" in Python. If the first tab does not change the screen (bash only rings the bell if there
+// is more than one candidate), it hits tab again. The line is cleared with Ctrl-U afterwards.
+func (s *session) handleCompleteCommand(_, input string) error {
+	partial := s.conn.Unescape(strings.TrimSpace(strings.TrimPrefix(input, "!complete")))
+	if partial == "" {
+		return s.conn.Send(s.control(), s.withPrefix(completeHelpMessage))
+	} else if err := s.term.Paste(partial); err != nil {
+		return err
+	}
+	var before string
+	util.WaitUntil(func() bool {
+		before = s.captureCompletion()
+		return strings.HasSuffix(before, partial) // The REPL echoed the partial input after its prompt
+	}, s.conf.global.CompleteTimeout)
+	after, err := s.waitForCompletion(before)
+	if err != nil {
+		return err
+	} else if after == before {
+		if after, err = s.waitForCompletion(before); err != nil {
+			return err
+		}
+	}
+	if err := s.term.SendKeys("^U"); err != nil {
+		return err
+	} else if after == before {
+		return s.conn.Send(s.control(), fmt.Sprintf(completeNoneMessage, s.conn.Format(partial, formatText)))
+	}
+	suggestions := trimLeadingLines(newLines(before, after), s.maxMessageLength()-len(completeMessage)-len(partial)-len(s.conn.Format("", formatCode)))
+	return s.conn.Send(s.control(), fmt.Sprintf(completeMessage, s.conn.Format(partial, formatText), s.conn.Format(suggestions, formatCode)))
+}
+
+// waitForCompletion hits tab, and waits until the screen changes, or until the complete timeout passes
+func (s *session) waitForCompletion(before string) (after string, err error) {
+	if err := s.term.SendKeys(sendKeysMapping["!tab"]); err != nil {
+		return "", err
+	}
+	after = before
+	changed := util.WaitUntil(func() bool {
+		after = s.captureCompletion()
+		return after != before
+	}, s.conf.global.CompleteTimeout)
+	if changed {
+		time.Sleep(completeSettleDelay) // The REPL may still be printing, e.g. bash redraws the prompt after the candidates
+		after = s.captureCompletion()
+	}
+	return after, nil
+}
+
+func (s *session) captureCompletion() string {
+	window, err := s.term.Capture()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRightFunc(sanitizeWindow(removeTmuxBorder(window)), unicode.IsSpace)
+}
+
+func (s *session) handleScreenCommand(_, _ string) error {
+	s.forceResend <- true
+	return s.maybeUploadColorSnapshot()
+}
+
+// maybeUploadColorSnapshot uploads the colored terminal as an HTML file, if colors are enabled but
+// cannot be rendered in the terminal message itself, see colorEnabled
+func (s *session) maybeUploadColorSnapshot() error {
+	if s.conf.colorMode != config.Color || s.conn.SupportsANSI() {
+		return nil
+	}
+	window, err := s.term.CaptureWithEscapes()
+	if err != nil {
+		return err
+	}
+	snapshot := ansiToHTML(filterOutput(ansiFormat(removeTmuxBorder(window), s.conf.global.ColorMap), s.conf.global.OutputFilters))
+	return s.conn.UploadFile(s.control(), colorSnapshotMessage, colorSnapshotFileName, colorSnapshotFileType, strings.NewReader(snapshot))
+}
+
+func (s *session) handleHistoryCommand(_, input string) error {
+	lines := historyDefaultLines
+	if arg := strings.TrimSpace(strings.TrimPrefix(input, "!history")); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > historyMaxLines {
+			return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(historyCommandHelpMessage, historyMaxLines, historyDefaultLines)))
+		}
+		lines = n
+	}
+	history, err := s.term.CaptureHistory()
+	if err != nil {
+		return err
+	}
+	atomic.AddInt32(&s.userInputCount, updateMessageUserInputCountLimit) // Terminal is re-sent below the history
+	history = lastLines(filterOutput(sanitizeWindow(removeTmuxBorder(history)), s.conf.global.OutputFilters), lines)
+	switch s.collapseMode() {
+	case collapseUpload:
+		return s.conn.UploadFile(s.control(), historyUploadedMessage, historyFileName, historyFileType, strings.NewReader(history))
+	case collapseSpoiler:
+		history = trimLeadingLines(history, s.maxMessageLength()-len(spoilerStart+s.conn.Format("", formatCode)+spoilerEnd))
+		return s.conn.Send(s.control(), spoilerStart+s.conn.Format(history, formatCode)+spoilerEnd)
+	}
+	history = trimLeadingLines(history, s.maxMessageLength()-len(s.conn.Format("", formatCode)))
+	return s.conn.Send(s.control(), s.conn.Format(history, formatCode))
+}
+
+// handleTranscriptCommand uploads the entire session as a text file. If a session log directory is configured, the
+// transcript is the session's audit log (see openAuditLog), which includes everyone's input. Otherwise, the entire
+// scrollback history of the terminal is uploaded instead.
+func (s *session) handleTranscriptCommand(_, _ string) error {
+	s.auditMu.Lock()
+	var filename string
+	if s.auditFile != nil {
+		filename = s.auditFile.Name()
+	}
+	s.auditMu.Unlock()
+	if filename == "" {
+		history, err := s.term.CaptureHistory()
+		if err != nil {
+			return err
+		}
+		history = filterOutput(sanitizeWindow(removeTmuxBorder(history)), s.conf.global.OutputFilters)
+		return s.uploadTranscript(transcriptHistoryUploadedMessage, strings.NewReader(history), int64(len(history)))
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return s.uploadTranscript(transcriptUploadedMessage, file, stat.Size())
+}
+
+// uploadTranscript uploads the transcript, keeping only the last transcriptFileSizeMax bytes if it is too large
+func (s *session) uploadTranscript(message string, transcript io.ReadSeeker, size int64) error {
+	var reader io.Reader = transcript
+	if size > transcriptFileSizeMax {
+		if _, err := transcript.Seek(size-transcriptFileSizeMax, io.SeekStart); err != nil {
+			return err
 		}
+		notice := fmt.Sprintf(transcriptTruncatedMessage, transcriptFileSizeMax/1024/1024)
+		reader = io.MultiReader(strings.NewReader(notice), transcript)
 	}
-	return s.tmux.SendKeys(keys...)
+	return s.conn.UploadFile(s.control(), message, transcriptFileName, historyFileType, reader)
 }
 
-func (s *session) handleCommentCommand(_ string) error {
-	return nil // Ignore comments
+// handlePauseCommand stops updating the terminal message, e.g. while a command prints lots of output. The REPL
+// keeps running, and its output piles up in the scrollback history, which is summarized by handleResumeCommand.
+func (s *session) handlePauseCommand(_, _ string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused {
+		return s.conn.Send(s.control(), s.withPrefix(pausedAlreadyMessage))
+	}
+	history, err := s.term.CaptureHistory()
+	if err != nil {
+		return err
+	}
+	s.paused = true
+	s.pausedAt = time.Now()
+	s.pausedLines = len(windowLines(sanitizeWindow(removeTmuxBorder(history))))
+	return s.conn.Send(s.control(), s.withPrefix(pausedMessage))
 }
 
-func (s *session) handleScreenCommand(_ string) error {
+// handleResumeCommand sends the output that was held back since "!pause" (up to pauseMaxLines lines), and then
+// resumes updating the terminal. The summary starts at the line the terminal cursor was on when it was paused.
+func (s *session) handleResumeCommand(_, _ string) error {
+	s.mu.Lock()
+	if !s.paused {
+		s.mu.Unlock()
+		return s.conn.Send(s.control(), s.withPrefix(resumeNotPausedMessage))
+	}
+	s.paused = false
+	pausedAt, pausedLines := s.pausedAt, s.pausedLines
+	s.mu.Unlock()
+	defer func() { s.forceResend <- true }()
+	history, err := s.term.CaptureHistory()
+	if err != nil {
+		return err
+	}
+	lines := windowLines(filterOutput(sanitizeWindow(removeTmuxBorder(history)), s.conf.global.OutputFilters))
+	if pausedLines > 0 && pausedLines <= len(lines) {
+		lines = lines[pausedLines-1:] // Earlier lines were shown before pausing; if the history was cleared, show all of it
+	}
+	if len(lines) <= 1 {
+		return s.conn.Send(s.control(), resumedEmptyMessage)
+	}
+	if len(lines) > pauseMaxLines {
+		dropped := len(lines) - pauseMaxLines
+		lines = lines[dropped:]
+		if err := s.conn.Send(s.control(), fmt.Sprintf(resumedDroppedMessage, pauseMaxLines, dropped)); err != nil {
+			return err
+		}
+	}
+	output := strings.Join(lines, "\n")
+	atomic.AddInt32(&s.userInputCount, updateMessageUserInputCountLimit) // Terminal is re-sent below the output
+	if err := s.conn.Send(s.control(), fmt.Sprintf(resumedMessage, time.Since(pausedAt).Round(time.Second))); err != nil {
+		return err
+	}
+	if s.collapseMode() == collapseUpload {
+		return s.conn.UploadFile(s.control(), historyUploadedMessage, historyFileName, historyFileType, strings.NewReader(output))
+	}
+	output = trimLeadingLines(output, s.maxMessageLength()-len(s.conn.Format("", formatCode)))
+	return s.conn.Send(s.control(), s.conn.Format(output, formatCode))
+}
+
+func (s *session) handleClearCommand(_, _ string) error {
+	return s.term.Clear() // The terminal message is updated on the next refresh
+}
+
+// handleRestartCommand kills the REPL and starts it again with the same script and settings, e.g. if it is wedged.
+// The terminal is not captured while restarting (see termMu), so output of the old and the new REPL is never mixed.
+func (s *session) handleRestartCommand(_, _ string) error {
+	if s.conf.record || s.conf.share != nil {
+		return s.conn.Send(s.control(), restartNotSupportedMessage)
+	}
+	if err := s.restartTerminal(); err != nil {
+		s.logf("error", "Failed to restart %s: %s", s.conf.global.TerminalBackend, err.Error())
+		return err
+	}
+	s.logf("session_restarted", "Restarted REPL")
+	if err := s.conn.Send(s.control(), fmt.Sprintf(restartedMessage, filepath.Base(s.conf.script))); err != nil {
+		return err
+	}
 	s.forceResend <- true
 	return nil
 }
 
-func (s *session) handleWebCommand(input string) error {
+// handleKillCommand terminates the command running in the REPL (e.g. a program that ignores Ctrl-C), by sending
+// SIGTERM to the foreground process group of the terminal. Unlike "!exit", this does not end the session.
+func (s *session) handleKillCommand(_, _ string) error {
+	err := s.term.Signal(syscall.SIGTERM)
+	if err == util.ErrNoForegroundProcess {
+		return s.conn.Send(s.control(), killNoCommandMessage)
+	} else if err != nil {
+		s.logf("warning", "Cannot terminate running command: %s", err.Error())
+		return s.conn.Send(s.control(), fmt.Sprintf(killFailedMessage, err.Error()))
+	}
+	s.logf("command_killed", "Sent SIGTERM to running command")
+	return s.conn.Send(s.control(), killedMessage)
+}
+
+func (s *session) restartTerminal() error {
+	s.termMu.Lock()
+	defer s.termMu.Unlock()
+	s.stopTerminal()
+	env, err := s.getEnv()
+	if err != nil {
+		return err
+	}
+	s.setEnv(env)
+	if err := s.term.Start(env, s.currentDir(), s.createCommand()...); err != nil {
+		return err
+	}
+	s.rememberProcessSession()
+	s.updateTerminalTitle()
+	return nil
+}
+
+func (s *session) handleDownloadCommand(_, input string) error {
+	path := strings.TrimSpace(strings.TrimPrefix(input, "!download"))
+	workDir, currentDir := s.workDir(), s.currentDir()
+	if path == "" {
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(downloadHelpMessage, downloadFileSizeMax/1024/1024)))
+	} else if workDir == "" {
+		return s.conn.Send(s.control(), s.withPrefix(downloadNotSupportedMessage))
+	}
+	filename, stat, err := workDirFile(workDir, currentDir, path)
+	if err != nil {
+		return s.conn.Send(s.control(), fmt.Sprintf(downloadNotAllowedMessage, path))
+	} else if stat.Size() > downloadFileSizeMax {
+		return s.conn.Send(s.control(), fmt.Sprintf(downloadTooLargeMessage, path, downloadFileSizeMax/1024/1024))
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return s.conn.Send(s.control(), fmt.Sprintf(downloadNotAllowedMessage, path))
+	}
+	defer file.Close()
+	name := filepath.Base(filename)
+	if err := s.conn.UploadFile(s.control(), fmt.Sprintf(downloadMessage, name), name, downloadFileType, file); err != nil {
+		s.logf("warning", "Cannot upload file %s: %s", filename, err.Error())
+		return s.conn.Send(s.control(), fmt.Sprintf(downloadFailedMessage, path, err.Error()))
+	}
+	return nil
+}
+
+// handleSendFileContentsCommand pastes the contents of a file in the session's working directory into the terminal,
+// e.g. to load a function definition into a Python or Node REPL. Unlike running the file, this behaves as if the
+// user pasted the file, so bracketed paste is used to avoid executing the input line by line.
+func (s *session) handleSendFileContentsCommand(_, input string) error {
+	path := strings.TrimSpace(strings.TrimPrefix(input, "!send-file-contents"))
+	workDir, currentDir := s.workDir(), s.currentDir()
+	if path == "" {
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(sendFileHelpMessage, sendFileSizeMax/1024)))
+	} else if workDir == "" {
+		return s.conn.Send(s.control(), s.withPrefix(sendFileNotSupportedMessage))
+	}
+	filename, stat, err := workDirFile(workDir, currentDir, path)
+	if err != nil {
+		return s.conn.Send(s.control(), fmt.Sprintf(sendFileNotAllowedMessage, path))
+	} else if stat.Size() > sendFileSizeMax {
+		return s.conn.Send(s.control(), fmt.Sprintf(sendFileTooLargeMessage, path, sendFileSizeMax/1024))
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return s.conn.Send(s.control(), fmt.Sprintf(sendFileNotAllowedMessage, path))
+	}
+	for i, chunk := range pasteChunks(strings.TrimSuffix(string(b), "\n"), sendFileChunkSize) {
+		if i > 0 {
+			select {
+			case <-s.ctx.Done():
+				return errExit
+			case <-time.After(sendFileChunkDelay):
+			}
+		}
+		if err := s.term.PasteBracketed(chunk); err != nil {
+			return err
+		}
+	}
+	return s.term.SendKeys(sendKeysMapping["!r"]) // Bracketed paste does not execute the input, so we hit return
+}
+
+// handleCdCommand changes the current directory of the session (see currentDir). Relative paths are resolved against
+// the current directory, and the new directory must be inside the session's working directory.
+func (s *session) handleCdCommand(_, input string) error {
+	dir := strings.TrimSpace(strings.TrimPrefix(input, "!cd"))
+	workDir := s.workDir()
+	if workDir == "" {
+		return s.conn.Send(s.control(), s.withPrefix(cdNotSupportedMessage))
+	} else if dir == "" {
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(cdHelpMessage, s.relativeDir())))
+	}
+	resolved, err := workDirDir(workDir, s.currentDir(), dir)
+	if err != nil {
+		return s.conn.Send(s.control(), fmt.Sprintf(cdNotAllowedMessage, dir))
+	}
+	s.mu.Lock()
+	s.cwd = resolved
+	s.mu.Unlock()
+	s.logf("session_cd", "Changed current directory to %s", resolved)
+	return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(cdChangedMessage, s.relativeDir())))
+}
+
+// workDirDir resolves the given path relative to the current directory, and returns it if it is an existing
+// directory inside the working directory
+func workDirDir(workDir, currentDir, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(currentDir, path)
+	}
+	dir, err := util.ResolvePathWithin(workDir, path)
+	if err != nil {
+		return "", err
+	}
+	if stat, err := os.Stat(dir); err != nil {
+		return "", err
+	} else if !stat.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return dir, nil
+}
+
+// workDirFile resolves the given path relative to the current directory, and returns the file name and its
+// file info. Paths outside the working directory and anything that is not a regular file are rejected.
+func workDirFile(workDir, currentDir, path string) (string, os.FileInfo, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(currentDir, path)
+	}
+	filename, err := util.ResolvePathWithin(workDir, path)
+	if err != nil {
+		return "", nil, err
+	}
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return "", nil, err
+	} else if !stat.Mode().IsRegular() {
+		return "", nil, fmt.Errorf("%s is not a regular file", filename)
+	}
+	return filename, stat, nil
+}
+
+// pasteChunks splits the input into chunks of at most size bytes, preferably at line breaks
+func pasteChunks(input string, size int) []string {
+	chunks := make([]string, 0)
+	for len(input) > size {
+		end := strings.LastIndex(input[:size], "\n") + 1
+		if end == 0 {
+			end = size // Line is longer than a chunk
+		}
+		chunks = append(chunks, input[:end])
+		input = input[end:]
+	}
+	if input != "" {
+		chunks = append(chunks, input)
+	}
+	return chunks
+}
+
+// handleEnvCommand shows the environment variables REPLbot set for the REPL when it was (re-)started. Unlike running
+// "env" in the REPL, this shows exactly what REPLbot set. Values of secret-looking variables are redacted, as are
+// matches of the session-log-redact option.
+func (s *session) handleEnvCommand(_, _ string) error {
+	s.mu.RLock()
+	env := s.env
+	s.mu.RUnlock()
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := env[key]
+		if envSecretRegex.MatchString(key) {
+			value = sessionLogRedacted
+		} else if s.conf.global.SessionLogRedact != nil {
+			value = s.conf.global.SessionLogRedact.ReplaceAllString(value, sessionLogRedacted)
+		}
+		lines = append(lines, key+"="+value)
+	}
+	return s.conn.Send(s.control(), fmt.Sprintf(envMessage, s.conn.Format(strings.Join(lines, "\n"), formatCode)))
+}
+
+// handleInfoCommand shows the session's current configuration. Since the control channel may be shared with
+// other users, the relay port and connect command for terminal sharing are only sent to the owner, as an
+// ephemeral message.
+func (s *session) handleInfoCommand(user, _ string) error {
+	s.mu.RLock()
+	authMode := string(s.conf.authMode)
+	if s.readOnly {
+		authMode = "read-only"
+	} else if len(s.authUsers) > 0 {
+		authMode += " (with exceptions, see `!allow`/`!deny`)"
+	}
+	size := s.conf.size
+	s.mu.RUnlock()
+	uptime := time.Since(s.started).Round(time.Second).String()
+	message := fmt.Sprintf(infoMessage, filepath.Base(s.conf.script), s.conn.Mention(s.conf.user), s.controlMode(),
+		s.conf.windowMode, authMode, size.Name, size.Width, size.Height, uptime)
+	if s.conf.share != nil {
+		message += fmt.Sprintf(infoShareMessage, s.conf.global.ShareHost)
+	}
+	if s.conf.maxDuration > 0 {
+		remaining := (s.conf.maxDuration - time.Since(s.started)).Round(time.Second)
+		message += fmt.Sprintf(infoMaxDurationMessage, s.conf.maxDuration, remaining)
+	}
+	if len(s.conf.tags) > 0 {
+		message += fmt.Sprintf(infoTagsMessage, "`"+strings.Join(s.conf.tags, "`, `")+"`")
+	}
+	if s.conf.name != "" {
+		message += fmt.Sprintf(infoNameMessage, s.conf.name, s.conf.idleTimeout())
+	}
+	if s.conf.global.LocalAttach {
+		if attachCommand := s.term.AttachCommand(false); attachCommand != nil {
+			detachKey := "`Ctrl-F12`"
+			if s.conf.global.TerminalBackend == config.Screen {
+				detachKey = "`Ctrl-a d`"
+			}
+			message += fmt.Sprintf(infoAttachMessage, strings.Join(attachCommand, " "), detachKey)
+		}
+	}
+	if err := s.conn.Send(s.control(), s.withPrefix(message)); err != nil {
+		return err
+	}
+	if s.conf.share != nil && user == s.conf.user {
+		host, port, err := net.SplitHostPort(s.conf.global.ShareHost)
+		if err != nil {
+			return err
+		}
+		message := fmt.Sprintf(infoShareOwnerMessage, s.conf.share.relayPort, port, s.conf.share.user, host)
+		if s.conf.global.WebHost != "" {
+			message += fmt.Sprintf(shareStartWebSocketMessage, s.conf.global.WebHost, s.conf.share.token)
+		}
+		return s.conn.SendEphemeral(s.control(), s.conf.user, message)
+	}
+	return nil
+}
+
+// handleTitleCommand sets the title of the session's thread or channel, if the platform supports it. Otherwise,
+// the title is added to the "session started" message.
+func (s *session) handleTitleCommand(_, input string) error {
+	title := strings.TrimSpace(strings.TrimPrefix(input, "!title"))
+	if title == "" {
+		return s.conn.Send(s.control(), s.withPrefix(titleHelpMessage))
+	}
+	if err := s.conn.SetTitle(s.control(), title); err != nil {
+		if err != errTitleNotSupported {
+			s.logf("warning", "Warning: unable to set title, updating start message instead: %s", err.Error())
+		}
+		header := fmt.Sprintf(titleHeaderMessage, s.conn.Format(title, formatText))
+		if s.startID == "" {
+			// Quiet sessions may not have a "session started" message, see sendStartedMessage
+		} else if s.conf.quiet {
+			if err := s.conn.Update(s.control(), s.startID, header+s.startMessage); err != nil {
+				return err
+			}
+		} else {
+			status := *s.startStatus
+			status.Title = fmt.Sprintf(statusTitleTitle, title)
+			status.Text = header + s.startMessage
+			if err := s.updateStatus(s.startID, &status); err != nil {
+				return err
+			}
+		}
+	}
+	return s.conn.Send(s.control(), fmt.Sprintf(titleChangedMessage, s.conn.Format(title, formatText)))
+}
+
+func (s *session) handleWebCommand(_, input string) error {
 	if s.conf.global.WebHost == "" {
-		return s.conn.Send(s.conf.control, webNotSupportedMessage)
+		return s.conn.Send(s.control(), s.withPrefix(webNotSupportedMessage))
 	}
 	toggle := strings.TrimSpace(strings.TrimPrefix(input, "!web"))
 	s.mu.RLock()
@@ -885,17 +3146,17 @@ func (s *session) handleWebCommand(input string) error {
 			return s.sendWebHelpMessage(enabled, writable)
 		}
 		if err := s.startWeb(shouldBeWritable); err != nil {
-			return s.conn.Send(s.conf.control, webNotWorkingMessage)
+			return s.conn.Send(s.control(), s.withPrefix(webNotWorkingMessage))
 		}
 		return s.sendWebHelpMessage(true, shouldBeWritable)
 	case "off":
 		if !enabled {
-			return s.conn.Send(s.conf.control, webDisabledMessage)
+			return s.conn.Send(s.control(), s.withPrefix(webDisabledMessage))
 		}
 		if err := s.stopWeb(); err != nil {
 			return err
 		}
-		return s.conn.Send(s.conf.control, webStoppedMessage+"\n\n"+webHelpMessage)
+		return s.conn.Send(s.control(), s.withPrefix(webStoppedMessage+"\n\n"+webHelpMessage))
 	default:
 		return s.sendWebHelpMessage(enabled, writable)
 	}
@@ -909,9 +3170,9 @@ func (s *session) sendWebHelpMessage(enabled, writable bool) error {
 		} else {
 			message += "\n\n" + webIsReadOnlyMessage
 		}
-		return s.conn.Send(s.conf.control, message)
+		return s.conn.Send(s.control(), s.withPrefix(message))
 	}
-	return s.conn.Send(s.conf.control, webDisabledMessage+"\n\n"+webHelpMessage)
+	return s.conn.Send(s.control(), s.withPrefix(webDisabledMessage+"\n\n"+webHelpMessage))
 }
 
 func (s *session) startWeb(writable bool) error {
@@ -932,23 +3193,19 @@ func (s *session) startWeb(writable bool) error {
 		s.webPrefix = util.RandomString(10)
 	}
 	s.webWritable = writable
-	var args []string
-	if s.webWritable {
-		args = []string{
-			"--interface", "lo",
-			"--port", strconv.Itoa(s.webPort),
-			"--check-origin",
-			"tmux", "attach", "-t", s.tmux.MainID(),
-		}
-	} else {
-		args = []string{
-			"--interface", "lo",
-			"--port", strconv.Itoa(s.webPort),
-			"--check-origin",
-			"--readonly",                                  // ttyd is read-only
-			"tmux", "attach", "-r", "-t", s.tmux.MainID(), // tmux is also read-only
-		}
+	attachCommand := s.term.AttachCommand(!s.webWritable) // Attach read-only, if supported
+	if attachCommand == nil {
+		return fmt.Errorf("%s does not support attaching in this mode", s.conf.global.TerminalBackend)
 	}
+	args := []string{
+		"--interface", "lo",
+		"--port", strconv.Itoa(s.webPort),
+		"--check-origin",
+	}
+	if !s.webWritable {
+		args = append(args, "--readonly") // ttyd is read-only
+	}
+	args = append(args, attachCommand...)
 	s.webCmd = exec.Command("ttyd", args...)
 	if err := s.webCmd.Start(); err != nil {
 		s.webCmd = nil // Disable web!
@@ -972,23 +3229,266 @@ func (s *session) stopWeb() error {
 	return nil
 }
 
-func (s *session) handleResizeCommand(input string) error {
+func (s *session) handleResizeCommand(_, input string) error {
 	size, err := config.ParseSize(strings.TrimSpace(strings.TrimPrefix(input, "!resize")))
 	if err != nil {
-		return s.conn.Send(s.conf.control, resizeCommandHelpMessage)
+		return s.conn.Send(s.control(), s.withPrefix(resizeCommandHelpMessage))
 	}
 	if err := s.maybeSendMessageLengthWarning(size); err != nil {
 		return err
 	}
+	s.mu.Lock()
+	s.conf.size = size
 	if s.maxSize.Max(size) == size {
-		s.mu.Lock()
 		s.maxSize = size
-		s.mu.Unlock()
 	}
-	return s.tmux.Resize(size.Width, size.Height)
+	s.mu.Unlock()
+	return s.term.Resize(size.Width, size.Height)
+}
+
+// handleModeCommand switches between thread and split mode, by moving the terminal between the session's thread and
+// the main channel. The session's thread itself (and with it, where commands are sent) cannot be moved, so sessions
+// started in channel mode cannot switch, and sessions cannot switch to channel mode.
+func (s *session) handleModeCommand(_, input string) error {
+	mode := config.ControlMode(strings.TrimSpace(strings.TrimPrefix(input, "!mode")))
+	current := s.controlMode()
+	if current == config.Channel {
+		return s.conn.Send(s.control(), modeNotSupportedMessage)
+	} else if mode == config.Channel {
+		return s.conn.Send(s.control(), s.withPrefix(modeChannelMessage))
+	} else if mode != config.Thread && mode != config.Split {
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(modeHelpMessage, current)))
+	} else if mode == current {
+		return s.conn.Send(s.control(), fmt.Sprintf(modeUnchangedMessage, mode))
+	}
+	s.termMu.Lock() // Don't update the terminal before the notices are sent, see maybeRefreshTerminal
+	s.mu.RLock()
+	previous, next := s.conf.terminal, s.control()
+	s.mu.RUnlock()
+	if mode == config.Split {
+		next = &channelID{Channel: next.Channel, Thread: ""}
+	}
+	if err := s.conn.Send(previous, fmt.Sprintf(modeMovedMessage, mode)); err != nil {
+		s.termMu.Unlock()
+		return err
+	}
+	if err := s.conn.Send(next, fmt.Sprintf(modeChangedMessage, mode)); err != nil {
+		s.termMu.Unlock()
+		return err
+	}
+	s.mu.Lock()
+	s.conf.terminal = next
+	s.conf.controlMode = mode
+	s.terminalID = ""
+	s.mu.Unlock()
+	select {
+	case s.forceResend <- true:
+	default: // The output loop is busy; its next refresh re-sends the terminal anyway, since terminalID was reset
+	}
+	s.termMu.Unlock()
+	s.updateTerminalTitle()
+	return nil
 }
 
-func (s *session) handleExitCommand(_ string) error {
+// handleDMCommand moves the session's control channel to a direct message with the owner, e.g. to keep a busy
+// channel quiet. The terminal stays where it is (like in split mode), unless "!dm all" moves it as well. The bot
+// forwards messages in the DM to the session from then on, see Bot.controlMoved.
+func (s *session) handleDMCommand(_, input string) error {
+	arg := strings.TrimSpace(strings.TrimPrefix(input, "!dm"))
+	if arg != "" && arg != "all" {
+		return s.conn.Send(s.control(), s.withPrefix(dmHelpMessage))
+	}
+	previous := s.control()
+	dm, err := s.conn.OpenDM(s.conf.user)
+	if err != nil {
+		s.logf("warning", "Warning: unable to open direct message: %s", err.Error())
+		return s.conn.Send(previous, dmFailedMessage)
+	}
+	control := &channelID{Channel: dm}
+	if *previous == *control {
+		return s.conn.Send(previous, dmAlreadyMessage)
+	} else if !s.conf.moveControl(s, control) {
+		return s.conn.Send(previous, dmTakenMessage)
+	}
+	moveTerminal := arg == "all"
+	s.termMu.Lock() // Don't move the terminal in the middle of an update, see maybeRefreshTerminal
+	s.mu.Lock()
+	s.controlMu.Lock()
+	s.conf.control = control
+	s.controlMu.Unlock()
+	if moveTerminal {
+		s.conf.terminal = control
+		s.conf.controlMode = config.Channel
+		s.terminalID = ""
+	} else {
+		s.conf.controlMode = config.Split
+	}
+	s.mu.Unlock()
+	s.termMu.Unlock()
+	message := dmMovedMessage
+	if moveTerminal {
+		message = dmMovedAllMessage
+	}
+	if err := s.conn.Send(previous, fmt.Sprintf(message, s.conn.Mention(s.conf.user))); err != nil {
+		return err
+	} else if err := s.conn.Send(control, dmStartedMessage); err != nil {
+		return err
+	}
+	if moveTerminal {
+		select {
+		case s.forceResend <- true:
+		case <-s.ctx.Done():
+		}
+	}
+	return nil
+}
+
+// handleDetachCommand detaches the owner from a named session: the REPL keeps running (until the named idle timeout),
+// but the terminal is no longer updated, and messages here are no longer forwarded. The owner can reconnect from
+// anywhere with "attach <name>", see Attach.
+func (s *session) handleDetachCommand(_, _ string) error {
+	if s.conf.name == "" {
+		return s.conn.Send(s.control(), detachNotNamedMessage)
+	}
+	s.mu.Lock()
+	s.detached = true
+	s.mu.Unlock()
+	s.conf.detach(s)
+	return s.conn.Send(s.control(), fmt.Sprintf(detachedMessage, s.conf.name, s.conn.MentionBot(), s.conf.name))
+}
+
+// Attach moves the control channel and the terminal of a named session to the given channel/thread, and resumes
+// terminal updates if the owner detached before. The bot forwards messages there from then on, see
+// Bot.handleAttachCommand.
+func (s *session) Attach(control *channelID) error {
+	previous := s.control()
+	s.termMu.Lock() // Don't move the terminal in the middle of an update, see maybeRefreshTerminal
+	s.mu.Lock()
+	detached := s.detached
+	s.detached = false
+	s.controlMu.Lock()
+	s.conf.control = control
+	s.controlMu.Unlock()
+	s.conf.terminal = control
+	s.conf.controlMode = config.Channel
+	s.terminalID = ""
+	s.mu.Unlock()
+	s.termMu.Unlock()
+	s.logf("session_attached", "Session attached in channel %s", control.Channel)
+	if !detached && *previous != *control {
+		if err := s.conn.Send(previous, fmt.Sprintf(attachedElsewhereMessage, s.conn.Mention(s.conf.user))); err != nil {
+			s.logf("warning", "Warning: unable to send attach message: %s", err.Error())
+		}
+	}
+	if err := s.conn.Send(control, fmt.Sprintf(attachedMessage, s.conf.name)); err != nil {
+		return err
+	}
+	select {
+	case s.forceResend <- true:
+	case <-s.ctx.Done():
+	}
+	return nil
+}
+
+// Name returns the name of a named session, or an empty string, see sessionConfig.name
+func (s *session) Name() string {
+	return s.conf.name
+}
+
+// Detached returns true if the owner detached from the session, see handleDetachCommand
+func (s *session) Detached() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.detached
+}
+
+// handleMacroCommand defines, lists and removes macros. A macro is a sequence of input lines, which are sent as
+// if the user typed them when the macro is run, e.g. via "!deploy", see runMacro.
+func (s *session) handleMacroCommand(_, input string) error {
+	args := strings.TrimSpace(strings.TrimPrefix(input, "!macro"))
+	fields := strings.Fields(args)
+	if len(fields) == 1 && fields[0] == "list" {
+		return s.handleMacroListCommand()
+	} else if len(fields) == 2 && fields[0] == "rm" {
+		name := strings.TrimPrefix(fields[1], s.conf.global.CommandPrefix)
+		if _, ok := s.macros[name]; !ok {
+			return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(macroNotFoundMessage, name)))
+		}
+		delete(s.macros, name)
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(macroRemovedMessage, name)))
+	}
+	index := strings.Index(args, "=")
+	if index == -1 {
+		return s.conn.Send(s.control(), s.withPrefix(macroHelpMessage))
+	}
+	name, text := strings.TrimSpace(args[:index]), strings.TrimSpace(args[index+1:])
+	if text == "" {
+		return s.conn.Send(s.control(), s.withPrefix(macroHelpMessage))
+	} else if !s.validMacroName(name) {
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(macroInvalidNameMessage, name)))
+	} else if _, ok := s.macros[name]; !ok && len(s.macros) >= macroMaxCount {
+		return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(macroTooManyMessage, macroMaxCount)))
+	}
+	s.macros[name] = text
+	return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(macroSavedMessage, name)))
+}
+
+func (s *session) handleMacroListCommand() error {
+	if len(s.macros) == 0 {
+		return s.conn.Send(s.control(), s.withPrefix(macroListEmptyMessage))
+	}
+	names := make([]string, 0, len(s.macros))
+	for name := range s.macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s%s = %s", s.conf.global.CommandPrefix, name, strings.ReplaceAll(s.macros[name], "\n", "\n    ")))
+	}
+	return s.conn.Send(s.control(), fmt.Sprintf(macroListMessage, s.conn.Format(strings.Join(lines, "\n"), formatCode)))
+}
+
+// validMacroName returns true if name can be used as a macro name, i.e. if it does not shadow a session command
+// or a key (e.g. "!c" or "!up"), since macros are checked first, see handleInput
+func (s *session) validMacroName(name string) bool {
+	if !macroNameRegex.MatchString(name) || isSendKeysCommand(commandPrefix+name) {
+		return false
+	}
+	for _, c := range s.commands {
+		if c.prefix == commandPrefix+name {
+			return false
+		}
+	}
+	return true
+}
+
+// runMacro sends the lines of the given macro, as if the user typed them one by one. Lines that run other macros
+// are expanded up to macroMaxDepth levels deep, so that macros calling each other (or themselves) cannot loop forever.
+func (s *session) runMacro(user, name string, depth int) error {
+	if depth >= macroMaxDepth {
+		return errMacroTooDeep
+	}
+	s.logf("macro", "Running macro %s", name)
+	lines := strings.Split(s.macros[name], "\n")
+	for i, line := range lines {
+		if s.sleeping {
+			for _, rest := range lines[i:] { // Sent once the sleep is over, see resumeInput
+				s.sleepQueue = append(s.sleepQueue, &queuedInput{user: user, message: rest, macro: name, depth: depth + 1})
+			}
+			return nil
+		}
+		err := s.handleInput(user, line, depth+1)
+		if err == errMacroTooDeep && depth == 0 {
+			return s.conn.Send(s.control(), s.withPrefix(fmt.Sprintf(macroTooDeepMessage, name, macroMaxDepth)))
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *session) handleExitCommand(_, _ string) error {
 	return errExit
 }
 
@@ -1043,7 +3543,7 @@ func (s *session) maybePatchAsciinemaRecordingFile() error {
 	if _, err := out.WriteString(header); err != nil {
 		return err
 	}
-	if _, err := io.Copy(out, rd); err != nil {
+	if err := s.copyAsciinemaEvents(out, rd); err != nil {
 		return err
 	}
 	if err := out.Close(); err != nil {
@@ -1054,3 +3554,30 @@ func (s *session) maybePatchAsciinemaRecordingFile() error {
 	}
 	return os.Rename(tempReplayFile, replayFile)
 }
+
+// copyAsciinemaEvents copies the events of an asciinema recording (one JSON array per line, e.g. [0.5, "o", "text"]),
+// and applies the output filters to each event if config.Config.FilterRecordings is set. Filters are applied per
+// event, so a secret that is split across two events is not redacted.
+func (s *session) copyAsciinemaEvents(w io.Writer, rd *bufio.Reader) error {
+	if !s.conf.global.FilterRecordings || len(s.conf.global.OutputFilters) == 0 {
+		_, err := io.Copy(w, rd)
+		return err
+	}
+	for {
+		line, readErr := rd.ReadString('\n')
+		if data := gjson.Get(line, "2"); data.Type == gjson.String {
+			var err error
+			if line, err = sjson.Set(line, "2", filterOutput(data.String(), s.conf.global.OutputFilters)); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+		if readErr == io.EOF {
+			return nil
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package bot
 
 import (
+	"bufio"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"heckel.io/replbot/config"
 	"heckel.io/replbot/util"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -78,6 +84,869 @@ func TestSessionCommands(t *testing.T) {
 	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
 }
 
+func TestSessionExitTextInOutput(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo exited; echo 'the process (REPL exited.) mid-line'; echo done")
+	assert.True(t, conn.MessageContainsWait("2", "\ndone"))
+	time.Sleep(300 * time.Millisecond)
+	assert.True(t, sess.Active())
+
+	sess.UserInput("phil", "echo still alive")
+	assert.True(t, conn.MessageContainsWait("2", "\nstill alive"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionBackticksInOutput(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", `printf '\140\140\140go\nfmt.Println()\n\140\140\140\n'`)
+	assert.True(t, conn.MessageContainsWait("2", "\n```go\nfmt.Println()\n```\n"))
+	assert.True(t, strings.HasPrefix(conn.Message("2").Message, "````\n"))
+	assert.True(t, strings.HasSuffix(conn.Message("2").Message, "\n````"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionAuditLog(t *testing.T) {
+	conf := createConfig(t)
+	conf.SessionLogDir = t.TempDir()
+	conf.SessionLogRedact = regexp.MustCompile(`secret\d+`)
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo secret123 is hidden")
+	assert.True(t, conn.MessageContainsWait("2", "\nsecret123 is hidden"))
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+
+	files, err := os.ReadDir(conf.SessionLogDir)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(files))
+	assert.True(t, strings.HasSuffix(files[0].Name(), "_"+sess.conf.id+".log"))
+	b, err := os.ReadFile(filepath.Join(conf.SessionLogDir, files[0].Name()))
+	require.Nil(t, err)
+	content := string(b)
+	assert.Contains(t, content, "[input] phil: echo [REDACTED] is hidden")
+	assert.Contains(t, content, "\n| [REDACTED] is hidden")
+	assert.Contains(t, content, "[end]")
+	assert.NotContains(t, content, "secret123")
+}
+
+func TestSessionTranscript(t *testing.T) {
+	conf := createConfig(t)
+	conf.SessionLogDir = t.TempDir()
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo transcript $((6*7))")
+	assert.True(t, conn.MessageContainsWait("2", "transcript 42"))
+
+	sess.UserInput("bob", "!copy")
+	assert.True(t, conn.MessageContainsWait("3", "only the session owner"))
+
+	sess.UserInput("phil", "!transcript")
+	assert.True(t, conn.MessageContainsWait("4", "Here's the transcript of this session"))
+	transcript := string(conn.Message("4").File)
+	assert.Contains(t, transcript, "[input] phil: echo transcript $((6*7))")
+	assert.Contains(t, transcript, "\n| transcript 42")
+	assert.Contains(t, transcript, "[input] bob: !copy")
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionTranscriptWithoutSessionLog(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "seq 1 100")
+	assert.True(t, conn.MessageContainsWait("2", "\n100\n"))
+
+	sess.UserInput("phil", "!copy")
+	assert.True(t, conn.MessageContainsWait("3", "Session logging is not enabled"))
+	assert.Contains(t, string(conn.Message("3").File), "\n1\n2\n3\n")
+	assert.Contains(t, string(conn.Message("3").File), "\n100\n")
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionClear(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo noisy output")
+	assert.True(t, conn.MessageContainsWait("2", "\nnoisy output"))
+
+	sess.UserInput("phil", "!clear")
+	assert.True(t, util.WaitUntil(func() bool {
+		return !strings.Contains(conn.Message("2").Message, "noisy output")
+	}, maxWaitTime))
+	assert.NotContains(t, conn.Message("2").Message, "!clear") // Not forwarded to the terminal
+	assert.Nil(t, conn.Message("3"))                           // Silent
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionPaste(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	dir := t.TempDir()
+	sess.UserInput("phil", "cd "+dir)
+	assert.True(t, conn.MessageContainsWait("2", dir))
+
+	sess.UserInput("phil", "!paste")
+	assert.True(t, conn.MessageContainsWait("3", "paste mode"))
+
+	sess.UserInput("phil", "echo pasting")
+	sess.UserInput("phil", "touch pasted.txt")
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, util.FileExists(filepath.Join(dir, "pasted.txt")))
+
+	sess.UserInput("phil", "echo done\n!end")
+	assert.True(t, util.WaitUntil(func() bool {
+		return util.FileExists(filepath.Join(dir, "pasted.txt"))
+	}, maxWaitTime))
+	assert.True(t, conn.MessageContainsWait("2", "done"))
+
+	sess.UserInput("phil", "!end")
+	assert.True(t, conn.MessageContainsWait("4", "Use the `!paste` command"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionConcurrentInput(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	dir := t.TempDir()
+	sess.UserInput("phil", "cd "+dir)
+	assert.True(t, conn.MessageContainsWait("2", dir))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sess.UserInput("alice", "!n touch alice-")
+		sess.UserInput("alice", "was-here")
+	}()
+	go func() {
+		defer wg.Done()
+		sess.UserInput("bob", "touch bob-was-here")
+	}()
+	wg.Wait()
+	assert.True(t, util.WaitUntil(func() bool {
+		return util.FileExists(filepath.Join(dir, "alice-was-here")) && util.FileExists(filepath.Join(dir, "bob-was-here"))
+	}, maxWaitTime))
+
+	sess.UserInput("bob", "echo multi\necho line")
+	assert.True(t, conn.MessageContainsWait("2", "Last input by @bob"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionHistory(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "seq 1 100")
+	assert.True(t, conn.MessageContainsWait("2", "\n100\n"))
+
+	sess.UserInput("phil", "!history 60")
+	assert.True(t, conn.MessageContainsWait("3", "\n47\n48\n"))
+	assert.NotContains(t, conn.Message("3").Message, "\n30\n")
+
+	sess.UserInput("phil", "!history abc")
+	assert.True(t, conn.MessageContainsWait("4", "Use the `!history` command"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionPauseResume(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo before $((6*7))")
+	assert.True(t, conn.MessageContainsWait("2", "before 42"))
+
+	sess.UserInput("phil", "!pause")
+	assert.True(t, conn.MessageContainsWait("3", "*paused*"))
+
+	sess.UserInput("bob", "!resume")
+	assert.True(t, conn.MessageContainsWait("4", "only the session owner"))
+
+	sess.UserInput("phil", "seq 1 5 | sed 's/^/while paused /'")
+	assert.True(t, util.WaitUntil(func() bool {
+		window, _ := sess.term.Capture()
+		return strings.Contains(window, "while paused 5")
+	}, maxWaitTime))
+	assert.NotContains(t, conn.Message("2").Message, "while paused 5")
+
+	sess.UserInput("phil", "!resume")
+	assert.True(t, conn.MessageContainsWait("5", "Terminal updates resumed"))
+	assert.True(t, conn.MessageContainsWait("6", "while paused 5"))
+	assert.NotContains(t, conn.Message("6").Message, "echo before")
+	assert.True(t, conn.MessageContainsWait("7", "while paused 5")) // Terminal is re-sent
+
+	sess.UserInput("phil", "!resume")
+	assert.True(t, conn.MessageContainsWait("8", "not paused"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionOutputFilters(t *testing.T) {
+	conf := createConfig(t)
+	conf.OutputFilters = []*config.OutputFilter{
+		{Regex: regexp.MustCompile(`token=\S+`), Replacement: "token=[REDACTED]"},
+		{Regex: regexp.MustCompile(`([a-z]+)\.internal\.example\.com`), Replacement: "${1}.<internal>"},
+	}
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo token=abc$((6*7)) host db.internal.example.com is up")
+	assert.True(t, conn.MessageContainsWait("2", "token=[REDACTED] host db.<internal> is up"))
+	assert.NotContains(t, conn.Message("2").Message, "abc42")
+	assert.NotContains(t, conn.Message("2").Message, "internal.example.com")
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionFilterRecording(t *testing.T) {
+	conf := createConfig(t)
+	conf.OutputFilters = []*config.OutputFilter{{Regex: regexp.MustCompile(`secret\d+`), Replacement: "***"}}
+	sess := &session{conf: &sessionConfig{global: conf}}
+	recording := "[0.5, \"o\", \"my secret123\\r\\n\"]\n[1.2, \"o\", \"$ \"]"
+
+	var out strings.Builder
+	require.Nil(t, sess.copyAsciinemaEvents(&out, bufio.NewReader(strings.NewReader(recording))))
+	assert.Equal(t, recording, out.String()) // Recordings are not filtered by default
+
+	conf.FilterRecordings = true
+	out.Reset()
+	require.Nil(t, sess.copyAsciinemaEvents(&out, bufio.NewReader(strings.NewReader(recording))))
+	assert.Equal(t, "[0.5, \"o\", \"my ***\\r\\n\"]\n[1.2, \"o\", \"$ \"]", out.String())
+}
+
+func TestSessionDangerousCommands(t *testing.T) {
+	conf := createConfig(t)
+	conf.DangerousCommands = []*regexp.Regexp{regexp.MustCompile(`rm\s+-rf\s+/\s*$`), regexp.MustCompile(`danger\s+zone`)}
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo ready $((1+1))")
+	assert.True(t, conn.MessageContainsWait("2", "ready 2"))
+
+	sess.UserInput("bob", "echo highway to the danger zone")
+	assert.True(t, conn.MessageContainsWait("3", "looks like a dangerous command (it matches `danger\\s+zone`)"))
+
+	sess.UserInput("bob", "!force echo highway to the danger zone")
+	assert.True(t, conn.MessageContainsWait("4", "only the session owner can use the `!force` command"))
+
+	sess.UserInput("phil", "!e echo rm -rf /")
+	assert.True(t, conn.MessageContainsWait("5", "looks like a dangerous command"))
+	assert.NotContains(t, conn.Message("2").Message, "danger")
+
+	sess.UserInput("phil", "!force echo highway to the danger $((6*7)) zone")
+	assert.True(t, conn.MessageContainsWait("2", "highway to the danger 42 zone"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionReadOnly(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	sess.UserInput("phil", "!readonly on")
+	assert.True(t, conn.MessageContainsWait("3", "now *read-only*"))
+
+	sess.UserInput("bob", "echo bob was here")
+	sess.UserInput("phil", "echo phil was here")
+	assert.True(t, conn.MessageContainsWait("2", "phil was here"))
+	assert.NotContains(t, conn.Message("2").Message, "bob was here")
+
+	sess.UserInput("phil", "!readonly off")
+	assert.True(t, conn.MessageContainsWait("4", "no longer read-only"))
+
+	sess.UserInput("bob", "echo bob is back")
+	assert.True(t, conn.MessageContainsWait("2", "bob is back"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionRateLimited(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo before")
+	assert.True(t, conn.MessageContainsWait("2", "\nbefore"))
+
+	conn.RateLimit(3)
+	sess.UserInput("phil", "for i in 1 2 3 4 5; do echo line $i; sleep 0.1; done")
+	assert.True(t, conn.MessageContainsWait("2", "\nline 5"))
+	assert.Contains(t, conn.Message("2").Message, "\nline 1") // Coalesced into one update
+	assert.Contains(t, conn.Message("2").Message, "Some output was skipped")
+	assert.True(t, sess.Active())
+
+	sess.UserInput("phil", "echo after")
+	assert.True(t, conn.MessageContainsWait("2", "\nafter"))
+	assert.NotContains(t, conn.Message("2").Message, "Some output was skipped")
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionTitle(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	sess.UserInput("bob", "!title bob's session")
+	assert.True(t, conn.MessageContainsWait("3", "only the session owner can use the `!title` command"))
+
+	sess.UserInput("phil", "!title python - debugging issue #42")
+	assert.True(t, conn.MessageContainsWait("4", "changed the session title to _python - debugging issue #42_"))
+	assert.True(t, strings.HasPrefix(conn.Message("1").Message, "📌 *python - debugging issue #42*\n\n🚀 REPL session started"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionAuthCommand(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	sess.UserInput("bob", "!auth only-me")
+	assert.True(t, conn.MessageContainsWait("3", "only the session owner can use the `!auth` command"))
+
+	sess.UserInput("phil", "!auth users:@bob")
+	assert.True(t, conn.MessageContainsWait("4", "following users* can send commands: @bob"))
+
+	sess.UserInput("alice", "echo alice was here")
+	sess.UserInput("bob", "echo bob was here")
+	assert.True(t, conn.MessageContainsWait("2", "bob was here"))
+	assert.NotContains(t, conn.Message("2").Message, "alice was here")
+
+	sess.UserInput("phil", "!auth everyone")
+	assert.True(t, conn.MessageContainsWait("5", "*Everyone in this channel* can send commands"))
+
+	sess.UserInput("phil", "!auth something")
+	assert.True(t, conn.MessageContainsWait("6", "Use the `!auth` command"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionInfo(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	sess.UserInput("bob", "!info")
+	assert.True(t, conn.MessageContainsWait("3", "Script: _bash_"))
+	assert.Contains(t, conn.Message("3").Message, "Control mode: _split_")
+	assert.Contains(t, conn.Message("3").Message, "Terminal size: _small_ (80x24)")
+	assert.NotContains(t, conn.Message("3").Message, "Terminal sharing")
+	assert.NotContains(t, conn.Message("3").Message, "Local attach")
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionInfoLocalAttach(t *testing.T) {
+	conf := createConfig(t)
+	conf.LocalAttach = true
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	sess.UserInput("phil", "!info")
+	attachCommand := "tmux attach -t " + sess.term.(*util.Tmux).MainID()
+	assert.True(t, conn.MessageContainsWait("3", "Local attach: `"+attachCommand+"` (on the REPLbot host, detach with `Ctrl-F12`)"))
+
+	assert.Nil(t, util.Run("tmux", "has-session", "-t", sess.term.(*util.Tmux).MainID()))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionMode(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo before $((6*7))")
+	assert.True(t, conn.MessageContainsWait("2", "before 42"))
+	assert.Equal(t, "", conn.Message("2").Thread)
+
+	sess.UserInput("bob", "!mode thread")
+	assert.True(t, conn.MessageContainsWait("3", "only the session owner"))
+
+	sess.UserInput("phil", "!mode channel")
+	assert.True(t, conn.MessageContainsWait("4", "cannot be moved to the main channel"))
+
+	sess.UserInput("phil", "!mode thread")
+	assert.True(t, conn.MessageContainsWait("5", "the terminal moved"))
+	assert.Equal(t, "", conn.Message("5").Thread)
+	assert.True(t, conn.MessageContainsWait("6", "now in _thread_ mode"))
+	assert.Equal(t, "thread", conn.Message("6").Thread)
+	assert.True(t, conn.MessageContainsWait("7", "before 42")) // Terminal is re-sent after the notices
+	assert.Equal(t, "thread", conn.Message("7").Thread)
+	assert.True(t, util.WaitUntil(func() bool { return sess.TerminalID() == "7" }, maxWaitTime))
+
+	sess.UserInput("phil", "echo after $((6*7))")
+	assert.True(t, conn.MessageContainsWait("7", "after 42"))
+	assert.NotContains(t, conn.Message("2").Message, "after 42")
+
+	sess.UserInput("phil", "!mode thread")
+	assert.True(t, conn.MessageContainsWait("8", "already in _thread_ mode"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionComplete(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "complete-alpha"), []byte{}, 0600))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "complete-beta"), []byte{}, 0600))
+	sess.UserInput("phil", "cd "+dir+" && echo ready $((6*7))")
+	assert.True(t, util.WaitUntil(func() bool { // Wait for the prompt, so that bash does not echo the input before it
+		window, _ := sess.term.Capture()
+		return regexp.MustCompile(`ready 42\n.+[#$]\s*$`).MatchString(window)
+	}, maxWaitTime))
+
+	sess.UserInput("phil", "!complete")
+	assert.True(t, conn.MessageContainsWait("3", "Use the `!complete` command"))
+
+	sess.UserInput("phil", "!complete ls complete-")
+	assert.True(t, conn.MessageContainsWait("4", "Here's what the REPL suggested for _ls complete-_"))
+	assert.True(t, conn.MessageContainsWait("4", "complete-alpha"))
+	assert.True(t, conn.MessageContainsWait("4", "complete-beta"))
+
+	sess.UserInput("phil", "!complete ls complete-a")
+	assert.True(t, conn.MessageContainsWait("5", "ls complete-alpha"))
+	assert.NotContains(t, conn.Message("5").Message, "complete-beta")
+
+	sess.UserInput("phil", "echo the line was cleared $((7*8))") // The line was cleared with Ctrl-U
+	assert.True(t, conn.MessageContainsWait("2", "\nthe line was cleared 56"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionMacros(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	sess.UserInput("phil", "!macro answer = echo answer $((6*7))\necho second $((7*8))")
+	assert.True(t, conn.MessageContainsWait("3", "saved the macro. Type `!answer`"))
+
+	sess.UserInput("bob", "!macro both = !answer\necho third $((8*9))")
+	assert.True(t, conn.MessageContainsWait("4", "saved the macro"))
+
+	sess.UserInput("bob", "!both")
+	assert.True(t, conn.MessageContainsWait("2", "answer 42"))
+	assert.True(t, conn.MessageContainsWait("2", "second 56"))
+	assert.True(t, conn.MessageContainsWait("2", "third 72"))
+
+	sess.UserInput("phil", "!macro loop = !loop\n!loop")
+	assert.True(t, conn.MessageContainsWait("5", "saved the macro"))
+	sess.UserInput("phil", "!loop")
+	assert.True(t, conn.MessageContainsWait("6", "I stopped running the macro `!loop`"))
+
+	sess.UserInput("phil", "!macro up = echo nope")
+	assert.True(t, conn.MessageContainsWait("7", "_up_ cannot be used as a macro name"))
+
+	sess.UserInput("phil", "!macro list")
+	assert.True(t, conn.MessageContainsWait("8", "!answer = echo answer $((6*7))\n    echo second $((7*8))\n!both = !answer"))
+
+	sess.UserInput("phil", "!macro rm answer")
+	assert.True(t, conn.MessageContainsWait("9", "removed the macro `!answer`"))
+	sess.UserInput("phil", "!macro rm answer")
+	assert.True(t, conn.MessageContainsWait("10", "There is no macro called `!answer`"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionSleep(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	sess.UserInput("phil", "!macro wait = echo before $((6*7)); sleep 0.2; echo streamed\n!sleep 1500ms\necho after $((7*8))")
+	assert.True(t, conn.MessageContainsWait("3", "saved the macro"))
+
+	start := time.Now()
+	sess.UserInput("phil", "!wait")
+	assert.True(t, conn.MessageContainsWait("2", "streamed")) // Output is not held back while sleeping
+	assert.NotContains(t, conn.Message("2").Message, "after 56")
+	assert.True(t, conn.MessageContainsWait("2", "after 56"))
+	assert.True(t, time.Since(start) >= 1500*time.Millisecond)
+
+	start = time.Now()
+	sess.UserInput("phil", "!paste\necho one $((1+1))\n!sleep 1\necho two $((2+2))\n!end")
+	assert.True(t, conn.MessageContainsWait("2", "one 2"))
+	assert.True(t, conn.MessageContainsWait("2", "two 4"))
+	assert.True(t, time.Since(start) >= time.Second)
+
+	sess.UserInput("phil", "!sleep 2h")
+	assert.True(t, conn.MessageContainsWait("5", "I'll wait for at most 1m0s"))
+
+	// Input typed while sleeping is queued, but session commands are not delayed
+	sess.UserInput("phil", "!macro long = echo start $((2*3))\n!sleep 50s\necho never")
+	assert.True(t, conn.MessageContainsWait("6", "saved the macro"))
+	sess.UserInput("phil", "!long")
+	assert.True(t, conn.MessageContainsWait("2", "start 6"))
+	sess.UserInput("phil", "echo queued $((3*3))")
+	sess.UserInput("phil", "!sleep 2h")
+	assert.True(t, conn.MessageContainsWait("7", "I'll wait for at most 1m0s"))
+	assert.NotContains(t, conn.Message("2").Message, "queued 9")
+
+	start = time.Now()
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+	assert.True(t, time.Since(start) < maxWaitTime)
+}
+
+func TestSessionUserInputBusy(t *testing.T) {
+	conf := createConfig(t)
+	conn := newMemConn(conf)
+	sess := newSession(&sessionConfig{
+		global:   conf,
+		id:       "sess_busy",
+		user:     "phil",
+		control:  &channelID{"channel", "thread"},
+		terminal: &channelID{"channel", ""},
+		authMode: config.Everyone,
+		size:     config.Small,
+	}, conn)
+	defer sess.cancelFn()
+
+	// The input loop is not running, so the input channel fills up; input must be dropped rather than block
+	for i := 0; i < cap(sess.userInputChan); i++ {
+		assert.True(t, sess.UserInput("phil", fmt.Sprintf("echo %d", i)))
+	}
+	assert.False(t, sess.UserInput("phil", "echo dropped"))
+	assert.True(t, conn.MessageContainsWait("1", "the session is busy"))
+}
+
+func TestSessionEnv(t *testing.T) {
+	conf := createConfig(t)
+	conf.SessionLogRedact = regexp.MustCompile(`^\d+$`)
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	sess.UserInput("bob", "!env")
+	assert.True(t, conn.MessageContainsWait("3", "Here are the environment variables I set for the REPL"))
+	assert.Contains(t, conn.Message("3").Message, "REPLBOT_MAX_TOTAL_SESSIONS=[REDACTED]\nREPLBOT_SHARE_WS_FILE=\n")
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionCustomCommandPrefix(t *testing.T) {
+	conf := createConfig(t)
+	conf.CommandPrefix = ";;"
+	conf.CommentPrefix = ";;!"
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	sess.UserInput("phil", "!n echo this is not a command")
+	assert.True(t, conn.MessageContainsWait("2", "!n: event not found")) // bash history expansion, passed through as-is
+
+	sess.UserInput("phil", ";;n echo this")
+	sess.UserInput("phil", "is it")
+	assert.True(t, conn.MessageContainsWait("2", "thisis it"))
+
+	sess.UserInput("phil", ";;help")
+	assert.True(t, conn.MessageContainsWait("3", "`;;exit`, `;;q` - Exit REPL"))
+	assert.NotContains(t, conn.Message("3").Message, "`!")
+
+	sess.UserInput("phil", ";;q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionComments(t *testing.T) {
+	conf := createConfig(t)
+	conf.CommentPrefix = "#"
+	conf.StripInlineComments = true
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "# echo this is ignored")
+	sess.UserInput("phil", "echo trailing # this is stripped")
+	assert.True(t, conn.MessageContainsWait("2", "\ntrailing"))
+	assert.NotContains(t, conn.Message("2").Message, "ignored")
+	assert.NotContains(t, conn.Message("2").Message, "stripped")
+
+	sess.UserInput("phil", "echo literal#input")
+	assert.True(t, conn.MessageContainsWait("2", "\nliteral#input"))
+
+	sess.UserInput("phil", "!help")
+	assert.True(t, conn.MessageContainsWait("3", "`# ..` - Comment, ignored entirely"))
+}
+
+func TestSessionInlineCommentsNotStripped(t *testing.T) {
+	conf := createConfig(t)
+	conf.CommentPrefix = "#"
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "# echo this is ignored")
+	sess.UserInput("phil", "echo kept # passed to bash")
+	assert.True(t, conn.MessageContainsWait("2", "echo kept # passed to bash\nkept"))
+	assert.NotContains(t, conn.Message("2").Message, "ignored")
+}
+
+func TestSessionCommentsDisabled(t *testing.T) {
+	conf := createConfig(t)
+	conf.CommentPrefix = ""
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "set +H") // Disable history expansion
+	sess.UserInput("phil", "!! echo sent to the shell")
+	assert.True(t, conn.MessageContainsWait("2", "!!: command not found"))
+
+	sess.UserInput("phil", "!help")
+	assert.True(t, conn.MessageContainsWait("3", "Return key"))
+	assert.NotContains(t, conn.Message("3").Message, "Comment, ignored entirely")
+}
+
+func TestSessionMaxMessageLength(t *testing.T) {
+	conf := createConfig(t)
+	conf.MaxMessageLength = 500
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+	assert.True(t, conn.MessageContainsWait("1", "messages are limited to 500 characters"))
+
+	sess.UserInput("phil", "seq -s ' ' 1 500")
+	assert.True(t, conn.MessageContainsWait("2", "(Cropped due to"))
+	assert.True(t, len(conn.Message("2").Message) <= 500)
+
+	sess.UserInput("phil", "seq 1000 1200")
+	assert.True(t, conn.MessageContainsWait("2", "\n1200\n"))
+
+	sess.UserInput("phil", "!history 200")
+	assert.True(t, conn.MessageContainsWait("3", "\n1199\n"))
+	assert.True(t, len(conn.Message("3").Message) <= 500)
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionIdleWarning(t *testing.T) {
+	conf := createConfig(t)
+	conf.IdleTimeout = 3 * time.Second
+	conf.IdleWarning = 2 * time.Second
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	assert.True(t, conn.MessageContainsWait("3", "This session will close in 2s due to inactivity"))
+	sess.UserInput("phil", "echo still here")
+	assert.True(t, conn.MessageContainsWait("3", "Welcome back"))
+	assert.True(t, conn.MessageContainsWait("2", "\nstill here"))
+	assert.True(t, sess.Active())
+
+	assert.True(t, conn.MessageContainsWait("4", "This session will close in 2s due to inactivity"))
+	assert.True(t, util.WaitUntilNot(sess.Active, 5*time.Second))
+}
+
+func TestSessionSendFileContents(t *testing.T) {
+	conf := createConfig(t)
+	conf.WorkDir = config.WorkDirTemp
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "printf 'greet() {\\n  echo \"hello $1\"\\n}\\n' > lib.sh && echo written")
+	assert.True(t, conn.MessageContainsWait("2", "\nwritten"))
+
+	sess.UserInput("phil", "!send-file-contents lib.sh")
+	sess.UserInput("phil", "greet world")
+	assert.True(t, conn.MessageContainsWait("2", "\nhello world"))
+
+	sess.UserInput("phil", "!send-file-contents ../../../etc/passwd")
+	assert.True(t, conn.MessageContainsWait("3", "Only regular files inside the session's working directory can be sent"))
+
+	sess.UserInput("phil", "!send-file-contents")
+	assert.True(t, conn.MessageContainsWait("4", "Use the `!send-file-contents` command"))
+}
+
+func TestSessionRestart(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "export MARKER=before-restart && echo $MARKER")
+	assert.True(t, conn.MessageContainsWait("2", "\nbefore-restart"))
+
+	sess.UserInput("phil", "!restart")
+	assert.True(t, conn.MessageContainsWait("3", "Restarted _bash"))
+	assert.True(t, conn.MessageContainsWait("4", "```"))
+
+	sess.UserInput("phil", "echo \"marker=$MARKER\" $((6 * 7))")
+	assert.True(t, conn.MessageContainsWait("4", "\nmarker= 42"))
+	assert.NotContains(t, conn.Message("4").Message, "before-restart")
+	assert.True(t, sess.Active())
+}
+
+func TestPasteChunks(t *testing.T) {
+	assert.Equal(t, []string{}, pasteChunks("", 10))
+	assert.Equal(t, []string{"short"}, pasteChunks("short", 10))
+	assert.Equal(t, []string{"line 1\n", "line 2\n", "line 3"}, pasteChunks("line 1\nline 2\nline 3", 10))
+	assert.Equal(t, []string{"0123456789", "abc\nx"}, pasteChunks("0123456789abc\nx", 10))
+}
+
+func TestSessionMaxDuration(t *testing.T) {
+	conf := createConfig(t)
+	conf.MaxSessionDuration = 4 * time.Second
+	conf.MaxSessionWarning = 2 * time.Second
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+	sess.UserInput("phil", "echo hi")
+	assert.True(t, conn.MessageContainsWait("2", "hi"))
+
+	assert.True(t, conn.MessageContainsWait("3", "this session will close in 2s, because sessions can run for at most 4s"))
+	sess.UserInput("phil", "echo still here") // Activity does not keep the session alive
+	assert.True(t, conn.MessageContainsWait("2", "\nstill here"))
+	assert.True(t, conn.MessageContainsWait("4", "This session has been running for 4s, which is the maximum"))
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionDownload(t *testing.T) {
+	conf := createConfig(t)
+	conf.WorkDir = config.WorkDirTemp
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo hello > out.txt && echo written")
+	assert.True(t, conn.MessageContainsWait("2", "\nwritten"))
+
+	sess.UserInput("phil", "!download out.txt")
+	assert.True(t, conn.MessageContainsWait("3", "Here's the file _out.txt_"))
+	assert.Equal(t, "hello\n", string(conn.Message("3").File))
+
+	sess.UserInput("phil", "!download ../../../etc/passwd")
+	assert.True(t, conn.MessageContainsWait("4", "Only regular files inside the session's working directory"))
+
+	sess.UserInput("phil", "!download")
+	assert.True(t, conn.MessageContainsWait("5", "Use the `!download` command"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionCd(t *testing.T) {
+	conf := createConfig(t)
+	conf.WorkDir = config.WorkDirTemp
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "mkdir -p src/lib && echo hello > src/lib/out.txt && echo written")
+	assert.True(t, conn.MessageContainsWait("2", "\nwritten"))
+
+	sess.UserInput("phil", "!cd src")
+	assert.True(t, conn.MessageContainsWait("3", "the current directory is now _src_"))
+	sess.UserInput("phil", "!cd lib")
+	assert.True(t, conn.MessageContainsWait("4", "the current directory is now _src/lib_"))
+
+	sess.UserInput("phil", "!download out.txt")
+	assert.True(t, conn.MessageContainsWait("5", "Here's the file _out.txt_"))
+	assert.Equal(t, "hello\n", string(conn.Message("5").File))
+
+	sess.UserInput("phil", "!cd ../../..")
+	assert.True(t, conn.MessageContainsWait("6", "I cannot change to _../../.._"))
+	sess.UserInput("phil", "!cd out.txt")
+	assert.True(t, conn.MessageContainsWait("7", "I cannot change to _out.txt_"))
+
+	sess.UserInput("phil", "!cd ../..")
+	assert.True(t, conn.MessageContainsWait("8", "the current directory is now _._"))
+	sess.UserInput("phil", "!cd")
+	assert.True(t, conn.MessageContainsWait("9", "The current directory is _._"))
+
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionDockerCommand(t *testing.T) {
+	conf := createConfig(t)
+	sess := newSession(&sessionConfig{
+		global:  conf,
+		id:      "sess_docker",
+		script:  "/etc/replbot/script.d/python",
+		image:   "python:3-alpine",
+		workDir: "/home/repos/replbot",
+		size:    config.Small,
+	}, newMemConn(conf))
+	command := sess.createCommand()
+	assert.Equal(t, []string{"docker", "run", "--rm"}, command[:3])
+	assert.Contains(t, command, "/etc/replbot/script.d/python:/replbot-script:ro")
+	assert.Contains(t, command, "/home/repos/replbot:/work")
+	assert.Equal(t, []string{"python:3-alpine", "run", "replbot_sess_docker"}, command[len(command)-3:])
+}
+
+func TestSessionShell(t *testing.T) {
+	dir := t.TempDir()
+	shell := filepath.Join(dir, "myshell")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\nexec sh \"$@\"\n", filepath.Join(dir, "calls.txt"))
+	require.Nil(t, os.WriteFile(shell, []byte(script), 0700))
+
+	conf := createConfig(t)
+	conf.Shell = shell
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo hello from $((6 * 7))")
+	assert.True(t, conn.MessageContainsWait("2", "hello from 42"))
+	sess.UserInput("phil", "!q")
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+
+	calls, err := os.ReadFile(filepath.Join(dir, "calls.txt"))
+	require.Nil(t, err)
+	assert.Contains(t, string(calls), filepath.Join(conf.ScriptDir, "bash")+" run "+sess.scriptID+"\n")
+	assert.Contains(t, string(calls), filepath.Join(conf.ScriptDir, "bash")+" kill "+sess.scriptID+"\n")
+}
+
 func TestSessionResize(t *testing.T) {
 	// FIXME stty size reports 39 99, why??
 
@@ -100,8 +969,15 @@ func TestSessionResize(t *testing.T) {
 }
 
 func createSession(t *testing.T, script string) (*session, *memConn) {
-	conf := createConfig(t)
+	return createSessionWithConfig(t, script, createConfig(t))
+}
+
+func createSessionWithConfig(t *testing.T, script string, conf *config.Config) (*session, *memConn) {
 	conn := newMemConn(conf)
+	return createSessionWithConn(t, script, conf, conn), conn
+}
+
+func createSessionWithConn(t *testing.T, script string, conf *config.Config, conn conn) *session {
 	sconfig := &sessionConfig{
 		global:      conf,
 		id:          "sess_" + util.RandomString(5),
@@ -109,12 +985,99 @@ func createSession(t *testing.T, script string) (*session, *memConn) {
 		control:     &channelID{"channel", "thread"},
 		terminal:    &channelID{"channel", ""},
 		script:      conf.Script(script),
+		workDir:     conf.WorkDir,
 		controlMode: config.Split,
 		windowMode:  config.Full,
 		authMode:    config.Everyone,
 		size:        config.Small,
+		maxDuration: conf.MaxSessionDuration,
+
+		maxOutputBytes:    conf.MaxOutputBytes,
+		maxOutputMessages: conf.MaxOutputMessages,
 	}
 	sess := newSession(sconfig, conn)
 	go sess.Run()
-	return sess, conn
+	return sess
+}
+
+func TestSessionOutputLimit(t *testing.T) {
+	conf := createConfig(t)
+	conf.MaxOutputMessages = 5
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "for i in $(seq 1 100000); do echo $i; sleep 0.05; done")
+	assert.True(t, conn.MessageContainsWait("3", "Output limit reached (5 messages), interrupting the command"))
+	sess.UserInput("phil", "echo done $((6 * 7))")
+	assert.True(t, conn.MessageContainsWait("2", "done 42"))
+
+	// Commands that ignore Ctrl-C close the session
+	sess.UserInput("phil", "trap '' INT; while true; do echo $RANDOM; sleep 0.05; done")
+	assert.True(t, conn.MessageContainsWait("4", "interrupting the command"))
+	assert.True(t, conn.MessageContainsWait("5", "Closing the session"))
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+}
+
+func TestSessionStopAndKill(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "echo ready $((6 * 7))")
+	assert.True(t, conn.MessageContainsWait("2", "ready 42"))
+
+	sess.UserInput("phil", "sleep 30; echo interrupted $((6 * 7))")
+	time.Sleep(300 * time.Millisecond)
+	sess.UserInput("phil", "!stop")
+	sess.UserInput("phil", "echo stopped $((6 * 7))")
+	assert.True(t, conn.MessageContainsWait("2", "stopped 42"))
+	assert.NotContains(t, conn.Message("2").Message, "interrupted 42")
+
+	sess.UserInput("phil", "bash -c \"trap '' INT; sleep 30\"; echo killed $((6 * 7))")
+	time.Sleep(300 * time.Millisecond)
+	sess.UserInput("phil", "!kill")
+	assert.True(t, conn.MessageContainsWait("3", "sent SIGTERM"))
+	assert.True(t, conn.MessageContainsWait("2", "killed 42"))
+	assert.True(t, sess.Active())
+}
+
+func TestSessionReapProcesses(t *testing.T) {
+	conf := createConfig(t)
+	conf.KillGracePeriod = 200 * time.Millisecond
+	sess, conn := createSessionWithConfig(t, "bash", conf)
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "(trap '' HUP TERM; exec sleep 30) & echo started $((6 * 7))")
+	assert.True(t, conn.MessageContainsWait("2", "started 42"))
+	sess.mu.Lock()
+	sid := sess.processSession
+	sess.mu.Unlock()
+	require.NotZero(t, sid)
+	require.NotEmpty(t, util.SessionProcesses(sid))
+
+	// The background process ignores SIGHUP and SIGTERM, so it is only gone after SIGKILL
+	sess.ForceClose()
+	assert.True(t, util.WaitUntilNot(sess.Active, maxWaitTime))
+	assert.Empty(t, util.SessionProcesses(sid))
+}
+
+func TestSessionKeyAndSendHex(t *testing.T) {
+	sess, conn := createSession(t, "bash")
+	defer sess.ForceClose()
+
+	sess.UserInput("phil", "!send 6563686f2068657820242828362a37292920")
+	sess.UserInput("phil", "!r")
+	assert.True(t, conn.MessageContainsWait("2", "hex 42"))
+
+	sess.UserInput("phil", "!n echo $((6 * 7))")
+	sess.UserInput("phil", "!key home")
+	sess.UserInput("phil", "!n echo keys")
+	sess.UserInput("phil", "!key space end enter")
+	assert.True(t, conn.MessageContainsWait("2", "keys echo 42"))
+
+	sess.UserInput("phil", "!send 1b5x")
+	assert.True(t, conn.MessageContainsWait("3", "I couldn't read that as hex"))
+	sess.UserInput("phil", "!send "+strings.Repeat("20", sendHexMaxBytes+1))
+	assert.True(t, conn.MessageContainsWait("4", "That's too many bytes"))
+	sess.UserInput("phil", "!key hyper")
+	assert.True(t, conn.MessageContainsWait("5", "Available keys: `backspace`, `delete`, `down`"))
 }
@@ -0,0 +1,98 @@
+package bot
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	errShareTooManyConns        = errors.New("too many share connections")
+	errShareTooManySessionConns = errors.New("too many connections for this share session")
+)
+
+// shareConnLimiter enforces the connection limits of the share server (see config.Config ShareMaxConns and
+// ShareMaxSessionConns). Connections are counted towards the total limit as soon as they are accepted, and
+// towards the session limit once the SSH handshake is done, since the session (SSH user) is not known before.
+type shareConnLimiter struct {
+	maxConns        int
+	maxSessionConns int
+	conns           int
+	sessionConns    map[string]int // SSH user -> number of connections
+	mu              sync.Mutex
+}
+
+func newShareConnLimiter(maxConns, maxSessionConns int) *shareConnLimiter {
+	return &shareConnLimiter{
+		maxConns:        maxConns,
+		maxSessionConns: maxSessionConns,
+		sessionConns:    make(map[string]int),
+	}
+}
+
+// Accept wraps a newly accepted connection, or returns errShareTooManyConns if the total limit is reached.
+// The connection is released when it is closed.
+func (l *shareConnLimiter) Accept(conn net.Conn) (*shareNetConn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns >= l.maxConns {
+		return nil, errShareTooManyConns
+	}
+	l.conns++
+	return &shareNetConn{Conn: conn, limiter: l}, nil
+}
+
+// Attach counts the connection towards the session limit of the given SSH user, or returns
+// errShareTooManySessionConns if the limit is reached. Attaching a connection twice is a no-op.
+func (l *shareConnLimiter) Attach(conn *shareNetConn, user string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if conn.closed || conn.user != "" {
+		return nil
+	} else if l.sessionConns[user] >= l.maxSessionConns {
+		return errShareTooManySessionConns
+	}
+	conn.user = user
+	l.sessionConns[user]++
+	return nil
+}
+
+// Conns returns the number of open connections, in total and for the given SSH user
+func (l *shareConnLimiter) Conns(user string) (total int, session int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conns, l.sessionConns[user]
+}
+
+func (l *shareConnLimiter) release(conn *shareNetConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+	l.conns--
+	if conn.user != "" {
+		l.sessionConns[conn.user]--
+		if l.sessionConns[conn.user] <= 0 {
+			delete(l.sessionConns, conn.user)
+		}
+	}
+}
+
+// shareNetConn is a connection to the share server, tracked by a shareConnLimiter. Its fields are guarded
+// by the limiter's mutex.
+type shareNetConn struct {
+	net.Conn
+	limiter *shareConnLimiter
+	user    string // SSH user, set by shareConnLimiter.Attach
+	closed  bool
+}
+
+func (c *shareNetConn) Close() error {
+	c.limiter.release(c)
+	return c.Conn.Close()
+}
+
+// shareConnContextKey is the ssh.Context key for the *shareNetConn of a share connection, see Bot.sshConnCallback
+type shareConnContextKey struct{}
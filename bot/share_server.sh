@@ -4,7 +4,7 @@
 case "$1" in
   run)
     cleanup() {
-      rm -f "${REPLBOT_SSH_KEY_FILE}" "${REPLBOT_SSH_USER_FILE}"
+      rm -f "${REPLBOT_SSH_KEY_FILE}" "${REPLBOT_SSH_USER_FILE}" "${REPLBOT_SHARE_WS_FILE}"
       clear
       echo "Terminal sharing session has ended."
       sleep 1 # Let the output loop grab this script
@@ -20,18 +20,29 @@ case "$1" in
       retry=1
       while [ -n "$retry" ]; do
         sleep 1
-        if [ ! -f "${REPLBOT_SSH_USER_FILE}" ]; then
-          continue
-        fi
-        ssh_user="$(cat "${REPLBOT_SSH_USER_FILE}")"
-        if ! ssh -t -p "${REPLBOT_SSH_RELAY_PORT}" -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o "IdentityFile=${REPLBOT_SSH_KEY_FILE}" "${ssh_user}@127.0.0.1" 2>/dev/null; then
+        if [ -f "${REPLBOT_SHARE_WS_FILE}" ]; then
+          # WebSocket client: REPLbot listens on the relay port, and relays the raw terminal to the client
+          rm -f "${REPLBOT_SHARE_WS_FILE}"
+          stty raw -echo
+          bash -c 'exec 3<>"/dev/tcp/127.0.0.1/$1" 4<&0 || exit 1; cat <&4 >&3 & writer=$!; cat <&3; kill "${writer}" 2>/dev/null; exit 0' -- "${REPLBOT_SSH_RELAY_PORT}" 2>/dev/null
+          code=$?
+          stty sane
+          if [ $code -ne 0 ]; then
+            continue
+          fi
+        elif [ -f "${REPLBOT_SSH_USER_FILE}" ]; then
+          ssh_user="$(cat "${REPLBOT_SSH_USER_FILE}")"
+          if ! ssh -t -p "${REPLBOT_SSH_RELAY_PORT}" -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o "IdentityFile=${REPLBOT_SSH_KEY_FILE}" "${ssh_user}@127.0.0.1" 2>/dev/null; then
+            continue
+          fi
+          rm -f "${REPLBOT_SSH_USER_FILE}"
+        else
           continue
         fi
         clear
         echo "Terminal session ended. You may reconnect to it using the same"
         echo 'command, or type !exit to quit the session.'
         retry=
-        rm -f "${REPLBOT_SSH_USER_FILE}"
       done
     done
     ;;
@@ -0,0 +1,42 @@
+package bot
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestShareConnLimiter(t *testing.T) {
+	l := newShareConnLimiter(3, 2)
+	conns := make([]*shareNetConn, 0)
+	for i := 0; i < 3; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		conn, err := l.Accept(server)
+		require.Nil(t, err)
+		conns = append(conns, conn)
+	}
+	_, server := net.Pipe()
+	_, err := l.Accept(server)
+	assert.Equal(t, errShareTooManyConns, err)
+
+	// Session limit
+	assert.Nil(t, l.Attach(conns[0], "user1"))
+	assert.Nil(t, l.Attach(conns[0], "user1")) // No-op
+	assert.Nil(t, l.Attach(conns[1], "user1"))
+	assert.Equal(t, errShareTooManySessionConns, l.Attach(conns[2], "user1"))
+	assert.Nil(t, l.Attach(conns[2], "user2"))
+	total, session := l.Conns("user1")
+	assert.Equal(t, 3, total)
+	assert.Equal(t, 2, session)
+
+	// Closing releases the connection, twice is fine
+	require.Nil(t, conns[0].Close())
+	_ = conns[0].Close()
+	total, session = l.Conns("user1")
+	assert.Equal(t, 2, total)
+	assert.Equal(t, 1, session)
+	_, err = l.Accept(server)
+	assert.Nil(t, err)
+}
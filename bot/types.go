@@ -12,6 +12,20 @@ type messageEvent struct {
 	File        []byte // used for tests only
 }
 
+type reactionEvent struct {
+	Channel   string // may be empty, if the platform does not provide it
+	MessageID string // ID of the message the reaction was added to
+	User      string
+	Reaction  string // Emoji name (Slack, Zulip, Teams, Rocket.Chat) or emoji (Discord, Matrix)
+}
+
+type buttonEvent struct {
+	Channel   string
+	MessageID string // ID of the message with the button, see conn.SendButtons
+	User      string
+	Command   string // Command of the clicked button, see config.Button
+}
+
 type channelJoinedEvent struct {
 	Channel string
 }
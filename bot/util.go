@@ -3,21 +3,64 @@ package bot
 import (
 	"archive/zip"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"heckel.io/replbot/config"
+	"html"
 	"io"
 	"math"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// binaryMinSuspicious and binaryMinSuspiciousRatio define when a window is considered binary, see isBinary
+	binaryMinSuspicious      = 8
+	binaryMinSuspiciousRatio = 0.1
+
+	// hexdumpBytesPerLine is the number of bytes per line in the output of hex.Dump
+	hexdumpBytesPerLine = 16
+
+	// maxTypoDistance is the max Levenshtein distance of a mistyped script name to the script, see closestMatch
+	maxTypoDistance = 2
+
+	ansiHTMLHeader = "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>REPLbot terminal</title></head>\n" +
+		"<body style=\"background-color:#1e1e1e;color:#e5e5e5\"><pre style=\"font-family:monospace\">"
+	ansiHTMLFooter = "</pre></body></html>\n"
+
+	// codeFence starts and ends a Markdown code block. If the code contains a backtick sequence, the fence is
+	// either made longer (see fencedCodeBlock), or the sequence is broken up using zero-width spaces (see
+	// escapedCodeBlock), depending on what the platform supports.
+	codeFence      = "```"
+	zeroWidthSpace = "\u200b"
 )
 
 var (
+	// markdownEscaper escapes the characters that most Markdown flavors interpret as formatting, see renderMarkdown
+	markdownEscaper = strings.NewReplacer("\\", "\\\\", "*", "\\*", "_", "\\_", "~", "\\~", "`", "\\`")
+
+	// backtickRunRegex matches backtick sequences, to find a code fence that is longer than all of them, see fencedCodeBlock
+	backtickRunRegex = regexp.MustCompile("`+")
+
+	// ansiColors are the CSS colors for the 16 standard ANSI colors (normal and bright), see ansiToHTML
+	ansiColors = []string{
+		"#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+		"#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff",
+	}
+
 	// consoleCodeRegex is a regex describing console escape sequences that we're stripping out. This regex
 	// only matches ECMA-48 CSI sequences (ESC [ ... <char>), which is enough since, we're using tmux's capture-pane.
 	// See https://man7.org/linux/man-pages/man4/console_codes.4.html
 	consoleCodeRegex = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
 
+	// consoleCodePrefixRegex matches a console escape sequence at the beginning of a string (see consoleCodeRegex)
+	consoleCodePrefixRegex = regexp.MustCompile(`^\x1b\[[0-9;]*[a-zA-Z]`)
+
 	unquoteReplacer = strings.NewReplacer(
 		"\\n", "\n", // new line
 		"\\r", "\r", // line feed
@@ -29,16 +72,29 @@ var (
 	tmuxWindowRegex = regexp.MustCompile(`│·*$|─+$|─*┘·*$|·+$|·*\(size \d+x\d+ from a smaller client\)\s*$`)
 )
 
+// addCursor replaces the character at the given position with a block cursor. Console escape sequences
+// are not counted as characters, so this works for windows with and without colors.
 func addCursor(window string, x, y int) string {
 	lines := strings.Split(window, "\n")
 	if len(lines) <= y {
 		return window
 	}
 	line := lines[y]
-	if len(line) < x+1 {
-		line += strings.Repeat(" ", x-len(line)+1)
+	col := 0
+	for i := 0; i < len(line); {
+		if loc := consoleCodePrefixRegex.FindStringIndex(line[i:]); loc != nil {
+			i += loc[1]
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(line[i:])
+		if col == x {
+			lines[y] = line[:i] + "█" + line[i+size:]
+			return strings.Join(lines, "\n")
+		}
+		col++
+		i += size
 	}
-	lines[y] = line[0:x] + "█" + line[x+1:]
+	lines[y] = line + strings.Repeat(" ", x-col) + "█"
 	return strings.Join(lines, "\n")
 }
 
@@ -67,29 +123,170 @@ func expandWindow(window string) string {
 	return strings.Join(lines, "\n")
 }
 
+// changedBytes returns the number of bytes of the lines in window that were not shown in the previous window, i.e.
+// new output, or lines that a full-screen program (e.g. top) repainted. Lines that merely scrolled up are not counted.
+func changedBytes(previous, window string) int {
+	seen := make(map[string]int)
+	for _, line := range strings.Split(previous, "\n") {
+		seen[line]++
+	}
+	changed := 0
+	for _, line := range strings.Split(window, "\n") {
+		if seen[line] > 0 {
+			seen[line]--
+			continue
+		}
+		changed += len(line) + 1 // +1 for the new line
+	}
+	return changed
+}
+
 func cropWindow(window string, limit int) string {
 	if len(window) < limit {
 		return window
 	}
 	lines := strings.Split(window, "\n")
 	if len(lines) <= 2 {
-		return window[:limit-1]
+		return truncateUTF8(window, limit-1)
 	}
 	cropMessage := "   (Cropped due to platform limit)   "
 	if len(lines[1]) < len(cropMessage) {
 		lines[1] = cropMessage
 	} else {
-		lines[1] = cropMessage + lines[1][len(cropMessage):]
+		lines[1] = cropMessage + trimPrefixUTF8(lines[1], len(cropMessage))
 	}
 	maxlen := int(math.Ceil(float64(limit)/float64(len(lines)))) - 1
 	for i := range lines {
-		if len(lines[i]) > maxlen {
-			lines[i] = lines[i][:maxlen]
-		}
+		lines[i] = truncateUTF8(lines[i], maxlen)
 	}
 	return strings.Join(lines, "\n")
 }
 
+// truncateUTF8 truncates s to at most n bytes, without splitting a multi-byte UTF-8 character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// trimPrefixUTF8 removes the first n bytes from s, and the rest of a multi-byte UTF-8 character if the
+// n-th byte is in the middle of one
+func trimPrefixUTF8(s string, n int) string {
+	for n < len(s) && !utf8.RuneStart(s[n]) {
+		n++
+	}
+	return s[n:]
+}
+
+// lastLines returns the last n lines of the given window, ignoring trailing empty lines
+func lastLines(window string, n int) string {
+	lines := windowLines(window)
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// windowLines splits the window into lines, ignoring trailing empty lines
+func windowLines(window string) []string {
+	return strings.Split(strings.TrimRightFunc(window, unicode.IsSpace), "\n")
+}
+
+// newLines returns the lines of the window after that are not in the window before, e.g. the completions a REPL
+// printed below the prompt. If the window scrolled in between, the lines that scrolled out of view are skipped.
+// The last line of before (usually the prompt) is always included, since it may have changed.
+func newLines(before, after string) string {
+	beforeLines, afterLines := windowLines(before), windowLines(after)
+	unchanged := beforeLines[:len(beforeLines)-1]
+	for scrolled := 0; scrolled < len(unchanged); scrolled++ {
+		n := len(unchanged) - scrolled
+		if n <= len(afterLines) && strings.Join(unchanged[scrolled:], "\n") == strings.Join(afterLines[:n], "\n") {
+			return strings.Join(afterLines[n:], "\n")
+		}
+	}
+	return strings.Join(afterLines, "\n")
+}
+
+// isBinary returns true if the given raw window (as captured from tmux, before stripping console codes) contains
+// a significant amount of invalid UTF-8, replacement characters or control characters, which is typically the result
+// of a command writing binary data to the terminal. Since capture-pane returns whole cells, multi-byte characters
+// are never split, so invalid UTF-8 is never a false positive.
+func isBinary(window string) bool {
+	var total, suspicious int
+	for _, r := range window { // Invalid UTF-8 is returned as utf8.RuneError
+		if unicode.IsSpace(r) {
+			continue
+		}
+		total++
+		if r == utf8.RuneError || (unicode.IsControl(r) && r != '\x1b') || unicode.Is(unicode.Co, r) {
+			suspicious++
+		}
+	}
+	return suspicious >= binaryMinSuspicious && float64(suspicious) >= float64(total)*binaryMinSuspiciousRatio
+}
+
+// hexdump returns a hex dump (see hex.Dump) of the last bytes of data, limited to the given number of lines
+func hexdump(data string, lines int) string {
+	if max := lines * hexdumpBytesPerLine; len(data) > max {
+		data = data[len(data)-max:]
+	}
+	return strings.TrimSuffix(hex.Dump([]byte(data)), "\n")
+}
+
+// trimLeadingLines removes lines from the beginning of the window until it is shorter than limit. Unlike
+// cropWindow, it does not crop lines, so it should be used for history and log output.
+func trimLeadingLines(window string, limit int) string {
+	for len(window) > limit {
+		i := strings.Index(window, "\n")
+		if i == -1 {
+			return truncateUTF8(window, limit)
+		}
+		window = window[i+1:]
+	}
+	return window
+}
+
+// collapsePrompts removes the clutter of bare prompts from the window, e.g. when a user hits Return a few times.
+// Repeated prompts at the start of a line (">>> >>> >>> x") are collapsed to the last one (">>> x"), and consecutive
+// identical lines that only contain a prompt are collapsed to a single line. The prompt must match at the start
+// of a line, see config.ScriptConfig.Prompt.
+func collapsePrompts(window string, prompt *regexp.Regexp) string {
+	lines := strings.Split(window, "\n")
+	collapsed := make([]string, 0, len(lines))
+	var lastBarePrompt string
+	for _, line := range lines {
+		var last, rest string
+		for rest = line; ; {
+			loc := prompt.FindStringIndex(rest)
+			if loc == nil || loc[1] == 0 {
+				break
+			}
+			last, rest = rest[:loc[1]], rest[loc[1]:]
+		}
+		if last == "" {
+			collapsed = append(collapsed, line)
+			lastBarePrompt = ""
+			continue
+		}
+		line = last + rest
+		if strings.TrimSpace(rest) != "" {
+			collapsed = append(collapsed, line)
+			lastBarePrompt = ""
+			continue
+		}
+		barePrompt := strings.TrimRightFunc(line, unicode.IsSpace)
+		if barePrompt != lastBarePrompt {
+			collapsed = append(collapsed, line)
+			lastBarePrompt = barePrompt
+		}
+	}
+	return strings.Join(collapsed, "\n")
+}
+
 func unquote(s string) string {
 	s = unquoteReplacer.Replace(s)
 	s = unquoteHexCharRegex.ReplaceAllStringFunc(s, func(r string) string {
@@ -99,6 +296,29 @@ func unquote(s string) string {
 	return s
 }
 
+// countTemplatePlaceholders returns the number of %s placeholders in a message template, and returns an
+// error if the template contains any other formatting directives (other than %%).
+func countTemplatePlaceholders(template string) (int, error) {
+	count := 0
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			continue
+		} else if i == len(template)-1 {
+			return 0, errors.New("template must not end with '%', use '%%' for a literal percent sign")
+		}
+		i++
+		switch template[i] {
+		case 's':
+			count++
+		case '%':
+			// Literal percent sign
+		default:
+			return 0, fmt.Errorf("invalid placeholder '%%%c' in template, only '%%s' and '%%%%' are allowed", template[i])
+		}
+	}
+	return count, nil
+}
+
 func sanitizeWindow(window string) string {
 	sanitized := consoleCodeRegex.ReplaceAllString(window, "")
 	if strings.TrimSpace(sanitized) == "" {
@@ -107,6 +327,249 @@ func sanitizeWindow(window string) string {
 	return sanitized
 }
 
+// sanitizeWindowWithColors is like sanitizeWindow, but keeps the SGR sequences (colors, bold, underline) that
+// can be rendered in an "ansi" code block, and strips all other console escape sequences.
+func sanitizeWindowWithColors(window string) string {
+	if strings.TrimSpace(consoleCodeRegex.ReplaceAllString(window, "")) == "" {
+		return sanitizeWindow(window)
+	}
+	return consoleCodeRegex.ReplaceAllStringFunc(window, convertSGR)
+}
+
+// filterOutput applies the output filters to the window in order, e.g. to redact secrets, see config.Config.OutputFilters
+func filterOutput(window string, filters []*config.OutputFilter) string {
+	for _, filter := range filters {
+		window = filter.Regex.ReplaceAllString(window, filter.Replacement)
+	}
+	return window
+}
+
+// ansiFormat translates the SGR parameters in all SGR sequences of the window according to the given table
+// (see config.ColorMap), e.g. to render strikethrough (9) as underline (4). Parameters mapped to
+// config.ColorMapRemove are removed. Extended colors (38;5;n, 38;2;r;g;b, ...) and non-SGR sequences are left alone.
+func ansiFormat(window string, table map[int]int) string {
+	if len(table) == 0 {
+		return window
+	}
+	return consoleCodeRegex.ReplaceAllStringFunc(window, func(code string) string {
+		if !strings.HasSuffix(code, "m") {
+			return code
+		}
+		params := strings.Split(strings.TrimSuffix(strings.TrimPrefix(code, "\x1b["), "m"), ";")
+		converted := make([]string, 0)
+		for i := 0; i < len(params); i++ {
+			if (params[i] == "38" || params[i] == "48") && i+1 < len(params) {
+				n := 2 // 38;5;n
+				if params[i+1] == "2" {
+					n = 4 // 38;2;r;g;b
+				}
+				end := i + n + 1
+				if end > len(params) {
+					end = len(params)
+				}
+				converted = append(converted, params[i:end]...)
+				i = end - 1
+				continue
+			}
+			param, err := strconv.Atoi(params[i])
+			if err != nil {
+				converted = append(converted, params[i])
+				continue
+			}
+			if mapped, ok := table[param]; ok {
+				if mapped == config.ColorMapRemove {
+					continue
+				}
+				param = mapped
+			}
+			converted = append(converted, strconv.Itoa(param))
+		}
+		if len(converted) == 0 {
+			return ""
+		}
+		return "\x1b[" + strings.Join(converted, ";") + "m"
+	})
+}
+
+// convertSGR converts a single console escape sequence to a sequence that only contains the supported
+// SGR parameters (see convertSGRParam). All non-SGR sequences are removed entirely.
+func convertSGR(code string) string {
+	if !strings.HasSuffix(code, "m") {
+		return ""
+	}
+	params := strings.Split(strings.TrimSuffix(strings.TrimPrefix(code, "\x1b["), "m"), ";")
+	converted := make([]string, 0)
+	for i := 0; i < len(params); i++ {
+		param, err := strconv.Atoi(params[i])
+		if err != nil {
+			param = 0 // "\x1b[m" is the same as "\x1b[0m"
+		}
+		if (param == 38 || param == 48) && i+2 < len(params) && params[i+1] == "5" {
+			// 256 colors: map the first 16 colors, ignore the others
+			if color, err := strconv.Atoi(params[i+2]); err == nil && color < 16 {
+				converted = append(converted, strconv.Itoa(param-8+color%8))
+			}
+			i += 2
+			continue
+		} else if (param == 38 || param == 48) && i+4 < len(params) && params[i+1] == "2" {
+			i += 4 // True color: ignore entirely
+			continue
+		}
+		if supported, ok := convertSGRParam(param); ok {
+			converted = append(converted, strconv.Itoa(supported))
+		}
+	}
+	if len(converted) == 0 {
+		return ""
+	}
+	return "\x1b[" + strings.Join(converted, ";") + "m"
+}
+
+// convertSGRParam returns the SGR parameter that can be rendered in Discord's "ansi" code blocks, see
+// https://gist.github.com/kkrypt0nn/a02506f3712ff2d1c8ca7c9e0aed7c06. Bright colors are mapped to their normal counterparts.
+func convertSGRParam(param int) (int, bool) {
+	switch {
+	case param == 0 || param == 1 || param == 4: // Reset, bold, underline
+		return param, true
+	case (param >= 30 && param <= 37) || (param >= 40 && param <= 47): // Foreground, background
+		return param, true
+	case (param >= 90 && param <= 97) || (param >= 100 && param <= 107): // Bright foreground, bright background
+		return param - 60, true
+	default:
+		return 0, false
+	}
+}
+
+// ansiToHTML renders the window as an HTML document, preserving colors (including 256 colors and true color)
+// and the text attributes bold, italic, underline and strikethrough. This is used on platforms that cannot
+// render colors in messages, see session.colorEnabled. Non-SGR sequences are removed.
+func ansiToHTML(window string) string {
+	var b strings.Builder
+	b.WriteString(ansiHTMLHeader)
+	state := &ansiState{}
+	last := 0
+	for _, loc := range consoleCodeRegex.FindAllStringIndex(window, -1) {
+		state.writeText(&b, window[last:loc[0]])
+		if code := window[loc[0]:loc[1]]; strings.HasSuffix(code, "m") {
+			state.apply(strings.Split(strings.TrimSuffix(strings.TrimPrefix(code, "\x1b["), "m"), ";"))
+		}
+		last = loc[1]
+	}
+	state.writeText(&b, window[last:])
+	b.WriteString(ansiHTMLFooter)
+	return b.String()
+}
+
+type ansiState struct {
+	bold, italic, underline, strike bool
+	fg, bg                          string
+}
+
+func (a *ansiState) apply(params []string) {
+	for i := 0; i < len(params); i++ {
+		param, err := strconv.Atoi(params[i])
+		if err != nil {
+			param = 0
+		}
+		switch {
+		case param == 0:
+			*a = ansiState{}
+		case param == 1:
+			a.bold = true
+		case param == 3:
+			a.italic = true
+		case param == 4:
+			a.underline = true
+		case param == 9:
+			a.strike = true
+		case param == 22:
+			a.bold = false
+		case param == 23:
+			a.italic = false
+		case param == 24:
+			a.underline = false
+		case param == 29:
+			a.strike = false
+		case param >= 30 && param <= 37:
+			a.fg = ansiColors[param-30]
+		case param >= 90 && param <= 97:
+			a.fg = ansiColors[param-90+8]
+		case param == 39:
+			a.fg = ""
+		case param >= 40 && param <= 47:
+			a.bg = ansiColors[param-40]
+		case param >= 100 && param <= 107:
+			a.bg = ansiColors[param-100+8]
+		case param == 49:
+			a.bg = ""
+		case (param == 38 || param == 48) && i+1 < len(params):
+			var color string
+			if params[i+1] == "5" && i+2 < len(params) {
+				color = ansi256Color(params[i+2])
+				i += 2
+			} else if params[i+1] == "2" && i+4 < len(params) {
+				r, _ := strconv.Atoi(params[i+2])
+				g, _ := strconv.Atoi(params[i+3])
+				b, _ := strconv.Atoi(params[i+4])
+				color = fmt.Sprintf("#%02x%02x%02x", r&0xff, g&0xff, b&0xff)
+				i += 4
+			}
+			if param == 38 {
+				a.fg = color
+			} else {
+				a.bg = color
+			}
+		}
+	}
+}
+
+func (a *ansiState) writeText(b *strings.Builder, text string) {
+	if text == "" {
+		return
+	}
+	styles := make([]string, 0)
+	if a.fg != "" {
+		styles = append(styles, "color:"+a.fg)
+	}
+	if a.bg != "" {
+		styles = append(styles, "background-color:"+a.bg)
+	}
+	if a.bold {
+		styles = append(styles, "font-weight:bold")
+	}
+	if a.italic {
+		styles = append(styles, "font-style:italic")
+	}
+	if a.underline && a.strike {
+		styles = append(styles, "text-decoration:underline line-through")
+	} else if a.underline {
+		styles = append(styles, "text-decoration:underline")
+	} else if a.strike {
+		styles = append(styles, "text-decoration:line-through")
+	}
+	if len(styles) == 0 {
+		b.WriteString(html.EscapeString(text))
+		return
+	}
+	fmt.Fprintf(b, `<span style="%s">%s</span>`, strings.Join(styles, ";"), html.EscapeString(text))
+}
+
+// ansi256Color converts a color of the 256-color palette to a CSS color
+func ansi256Color(param string) string {
+	color, err := strconv.Atoi(param)
+	if err != nil || color < 0 || color > 255 {
+		return ""
+	} else if color < 16 {
+		return ansiColors[color]
+	} else if color >= 232 {
+		gray := 8 + (color-232)*10
+		return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+	}
+	color -= 16
+	levels := []int{0, 95, 135, 175, 215, 255}
+	return fmt.Sprintf("#%02x%02x%02x", levels[color/36], levels[(color/6)%6], levels[color%6])
+}
+
 func removeTmuxBorder(window string) string {
 	lines := strings.Split(window, "\n")
 	for i := range lines {
@@ -139,3 +602,199 @@ func zipAppendEntry(zw *zip.Writer, name string, content string) error {
 	}
 	return nil
 }
+
+// renderMarkdown renders text using the Markdown flavor most platforms understand (CommonMark), see conn.Format.
+// Platforms with different rules (e.g. Slack, Discord) implement their own formatting and fall back to this.
+func renderMarkdown(text string, format messageFormat) string {
+	switch format {
+	case formatText:
+		return markdownEscaper.Replace(text)
+	case formatCode:
+		return fencedCodeBlock(text, "")
+	case formatANSI:
+		return fencedCodeBlock(text, "ansi")
+	}
+	return text
+}
+
+// fencedCodeBlock wraps text in a code block, using a fence that is longer than any backtick sequence in the text,
+// like GitHub does. The text is shown exactly as is, but this only works on platforms that follow CommonMark.
+func fencedCodeBlock(text, info string) string {
+	fence := codeFence
+	for _, run := range backtickRunRegex.FindAllString(text, -1) {
+		if len(run) >= len(fence) {
+			fence = strings.Repeat("`", len(run)+1)
+		}
+	}
+	return fence + info + "\n" + text + "\n" + fence
+}
+
+// escapedCodeBlock wraps text in a code block with a regular fence, breaking up backtick sequences in the text
+// using zero-width spaces (see escapeCodeFences). This is for platforms that only understand three-backtick fences.
+func escapedCodeBlock(text, info string) string {
+	if info != "" {
+		info += "\n"
+	}
+	return codeFence + info + escapeCodeFences(text) + codeFence
+}
+
+// escapeCodeFences breaks up backtick sequences within a code block that would otherwise end it, using
+// zero-width spaces. Unlike replacing them with other characters, this keeps the text looking the same.
+func escapeCodeFences(text string) string {
+	text = strings.ReplaceAll(text, codeFence, "`"+zeroWidthSpace+"`"+zeroWidthSpace+"`")
+	if strings.HasPrefix(text, "`") {
+		text = zeroWidthSpace + text
+	}
+	if strings.HasSuffix(text, "`") {
+		text += zeroWidthSpace
+	}
+	return text
+}
+
+// formatScriptList formats the list of available scripts for the help message. If any of the scripts has a
+// category (see config.ScriptCategories), the list is grouped by category, e.g. "*languages*: `node`, `python`;
+// *other*: `bash`". Scripts without a category are listed last.
+func formatScriptList(categories map[string][]string) string {
+	names := categoryNames(categories)
+	if len(names) == 0 {
+		return formatScripts(categories[""])
+	}
+	groups := make([]string, 0)
+	for _, name := range names {
+		scripts := categories[name]
+		if name == otherCategory {
+			scripts = append(scripts, categories[""]...)
+		}
+		groups = append(groups, fmt.Sprintf("*%s*: %s", name, formatScripts(scripts)))
+	}
+	return strings.Join(groups, "; ")
+}
+
+// categoryNames returns the sorted names of all script categories, with the "other" category (for scripts
+// without a category) last. If no script has a category, the result is empty.
+func categoryNames(categories map[string][]string) []string {
+	names := make([]string, 0)
+	for name := range categories {
+		if name != "" && name != otherCategory {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 && len(categories[otherCategory]) == 0 {
+		return names
+	}
+	sort.Strings(names)
+	if len(categories[""]) > 0 || len(categories[otherCategory]) > 0 {
+		names = append(names, otherCategory)
+	}
+	return names
+}
+
+func formatScripts(scripts []string) string {
+	return fmt.Sprintf("`%s`", strings.Join(scripts, "`, `"))
+}
+
+// isButtonCommand returns true if the command belongs to one of the buttons. Commands reported by the platform are
+// not trusted blindly, since clients may send any button ID.
+func isButtonCommand(buttons []*config.Button, command string) bool {
+	for _, button := range buttons {
+		if button.Command == command {
+			return true
+		}
+	}
+	return false
+}
+
+// closestMatch returns the candidate with the smallest Levenshtein distance to s, if s is likely a typo of it, i.e.
+// if the distance is at most maxTypoDistance and at most half the length of s. Exact matches are not returned.
+func closestMatch(s string, candidates []string) string {
+	sort.Strings(candidates) // Deterministic result if more than one candidate has the same distance
+	match, matchDistance := "", maxTypoDistance+1
+	for _, candidate := range candidates {
+		if distance := levenshtein(s, candidate); distance > 0 && distance < matchDistance && distance <= len([]rune(s))/2 {
+			match, matchDistance = candidate, distance
+		}
+	}
+	return match
+}
+
+// levenshtein returns the Levenshtein distance of a and b, i.e. the number of characters that have to be inserted,
+// deleted or substituted to turn a into b
+func levenshtein(a, b string) int {
+	r1, r2 := []rune(a), []rune(b)
+	previous, current := make([]int, len(r2)+1), make([]int, len(r2)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(r1); i++ {
+		current[0] = i
+		for j := 1; j <= len(r2); j++ {
+			cost := 1
+			if r1[i-1] == r2[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(r2)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// sortedKeys returns the keys of the map in alphabetical order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scriptAliases returns the sorted aliases of the given script, see config.ScriptAliases
+func scriptAliases(aliases map[string]string, script string) []string {
+	names := make([]string, 0)
+	for alias, target := range aliases {
+		if target == script {
+			names = append(names, alias)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatErrors joins the messages of the given errors, e.g. to return them as one error
+func formatErrors(errs []error) string {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// formatOutputLimit describes the output limits of a command, e.g. "100000 bytes or 50 messages"; limits
+// that are 0 (no limit) are left out
+func formatOutputLimit(maxBytes, maxMessages int) string {
+	limits := make([]string, 0)
+	if maxBytes > 0 {
+		limits = append(limits, fmt.Sprintf("%d bytes", maxBytes))
+	}
+	if maxMessages > 0 {
+		limits = append(limits, fmt.Sprintf("%d messages", maxMessages))
+	}
+	return strings.Join(limits, " or ")
+}
+
+// isValidSize returns true if the given size is a named or custom size, see config.ParseSize
+func isValidSize(size string) bool {
+	_, err := config.ParseSize(size)
+	return err == nil
+}
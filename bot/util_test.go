@@ -1,7 +1,11 @@
 package bot
 
 import (
+	"heckel.io/replbot/config"
+	"regexp"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 import "github.com/stretchr/testify/assert"
 
@@ -130,6 +134,31 @@ func TestCropWindow(t *testing.T) {
 	assert.Equal(t, expected, actual)
 }
 
+func TestChangedBytes(t *testing.T) {
+	assert.Equal(t, 8, changedBytes("", "abc\ndef"))
+	assert.Equal(t, 0, changedBytes("abc\ndef", "abc\ndef"))
+	assert.Equal(t, 6, changedBytes("abc\ndef\n12:00", "abc\ndef\n12:01")) // Repainted line
+	assert.Equal(t, 4, changedBytes("1\n22\n333\n", "22\n333\n444\n"))     // Scrolled
+}
+
+func TestCropWindowMultiByte(t *testing.T) {
+	line := strings.Repeat("äöü🚀漢字", 8)
+	window := strings.Repeat(line+"\n", 10)
+	actual := cropWindow(window, 500)
+	assert.True(t, utf8.ValidString(actual))
+	assert.NotContains(t, actual, "\uFFFD")
+	assert.True(t, len(actual) < 500)
+	assert.Contains(t, actual, "(Cropped due to platform limit)")
+	for _, l := range strings.Split(actual, "\n") {
+		if !strings.Contains(l, "Cropped") {
+			assert.True(t, strings.HasPrefix(line, l))
+		}
+	}
+
+	actual = cropWindow(strings.Repeat("🚀", 20), 10)
+	assert.Equal(t, "🚀🚀", actual)
+}
+
 func TestRemoveTmuxBorder(t *testing.T) {
 	before := `
 pheckel@plep ~/Code/replbot(main*) »                                      │·····
@@ -186,3 +215,148 @@ pheckel@plep ~/Code/replbot(main*) »
 	actual := removeTmuxBorder(before)
 	assert.Equal(t, expected, actual)
 }
+
+func TestAddCursorWithColors(t *testing.T) {
+	before := "\x1b[1m\x1b[32mroot@89cee82bafd5\x1b[0m:/# ls\n"
+	expected := "\x1b[1m\x1b[32mroot@89cee82bafd5\x1b[0m:/#█ls\n"
+	actual := addCursor(before, 20, 0)
+	assert.Equal(t, expected, actual)
+}
+
+func TestSanitizeWindowWithColors(t *testing.T) {
+	before := "\x1b[1;38;5;9mred\x1b[39m \x1b[92mgreen\x1b[m \x1b[38;2;1;2;3mtrue\x1b[0m \x1b[2Jcleared"
+	expected := "\x1b[1;31mred \x1b[32mgreen\x1b[0m true\x1b[0m cleared"
+	assert.Equal(t, expected, sanitizeWindowWithColors(before))
+	assert.Equal(t, "(screen is empty) \n\n", sanitizeWindowWithColors("\x1b[0m\n\n"))
+}
+
+func TestAnsiFormat(t *testing.T) {
+	before := "\x1b[1;9mstrike\x1b[0m \x1b[5;38;5;9mblink\x1b[0m \x1b[2Jcleared"
+	expected := "\x1b[1;4mstrike\x1b[0m \x1b[38;5;9mblink\x1b[0m \x1b[2Jcleared"
+	assert.Equal(t, expected, ansiFormat(before, map[int]int{9: 4, 5: config.ColorMapRemove}))
+	assert.Equal(t, before, ansiFormat(before, nil))
+}
+
+func TestAnsiToHTML(t *testing.T) {
+	actual := ansiToHTML("\x1b[1;31m<red>\x1b[0m plain \x1b[38;2;1;2;3;9mtrue\x1b[m\x1b[2J")
+	assert.Contains(t, actual, `<span style="color:#cd3131;font-weight:bold">&lt;red&gt;</span> plain `)
+	assert.Contains(t, actual, `<span style="color:#010203;text-decoration:line-through">true</span></pre>`)
+}
+
+func TestCountTemplatePlaceholders(t *testing.T) {
+	count, err := countTemplatePlaceholders("Tag me like so: %s %s. 100%% free!")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = countTemplatePlaceholders("No placeholders")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	_, err = countTemplatePlaceholders("Number %d")
+	assert.Error(t, err)
+
+	_, err = countTemplatePlaceholders("Trailing %")
+	assert.Error(t, err)
+}
+
+func TestLastLines(t *testing.T) {
+	window := "line 1\nline 2\nline 3\nline 4\n\n  \n"
+	assert.Equal(t, "line 3\nline 4", lastLines(window, 2))
+	assert.Equal(t, "line 1\nline 2\nline 3\nline 4", lastLines(window, 10))
+}
+
+func TestIsBinary(t *testing.T) {
+	assert.False(t, isBinary("root@host:~# ls\nfile1  file2\n\n\n"))
+	assert.False(t, isBinary("\x1b[1;31mred\x1b[0m and \x1b[32mgreen\x1b[0m text with ümläüts and emojis 🚀🚀🚀"))
+	assert.False(t, isBinary("one \x00 null byte among many printable characters, which is fine"))
+	assert.True(t, isBinary("root@host:~# cat /bin/ls\n\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x03\x00>\x00\x01\xff\xfe\xc3"))
+	assert.True(t, isBinary("��������� abc"))
+}
+
+func TestHexdump(t *testing.T) {
+	assert.Equal(t, "00000000  41 42 43 00 ff                                    |ABC..|", hexdump("ABC\x00\xff", 2))
+	dump := hexdump(strings.Repeat("A", 40)+strings.Repeat("B", 32), 2)
+	assert.Equal(t, 2, strings.Count(dump, "\n")+1)
+	assert.NotContains(t, dump, "41")
+}
+
+func TestCollapsePromptsPython(t *testing.T) {
+	prompt := regexp.MustCompile(`^(?:>>> ?|\.\.\. ?)`)
+	window := ">>> >>> >>> print(1)\n1\n>>> \n>>> \n>>>\n... \n... \n>>> >>> \n>>> x = 2\n>>> "
+	assert.Equal(t, ">>> print(1)\n1\n>>> \n... \n>>> \n>>> x = 2\n>>> ", collapsePrompts(window, prompt))
+}
+
+func TestCollapsePromptsBash(t *testing.T) {
+	prompt := regexp.MustCompile(`^(?:\S*[$#] )`)
+	window := "phil@host:~$ \nphil@host:~$ \nphil@host:~$ ls\nfile1  file2\nphil@host:~$ \nphil@host:/tmp$ \nphil@host:/tmp$ "
+	assert.Equal(t, "phil@host:~$ \nphil@host:~$ ls\nfile1  file2\nphil@host:~$ \nphil@host:/tmp$ ", collapsePrompts(window, prompt))
+	assert.Equal(t, "no prompts\n\n\nhere", collapsePrompts("no prompts\n\n\nhere", prompt))
+}
+
+func TestNewLines(t *testing.T) {
+	before := "# ls\nfile1\n# ech\n\n\n"
+	assert.Equal(t, "# ech\necho  echo-test\n# ech", newLines(before, "# ls\nfile1\n# ech\necho  echo-test\n# ech\n\n"))
+	assert.Equal(t, "# echo", newLines(before, "# ls\nfile1\n# echo \n"))
+	assert.Equal(t, "# ech\necho  echo-test\n# ech", newLines(before, "file1\n# ech\necho  echo-test\n# ech")) // Scrolled
+	assert.Equal(t, "something else", newLines(before, "something else"))
+}
+
+func TestTrimLeadingLines(t *testing.T) {
+	assert.Equal(t, "3\n4\n5", trimLeadingLines("1\n2\n3\n4\n5", 5))
+	assert.Equal(t, "1\n2", trimLeadingLines("1\n2", 5))
+	assert.Equal(t, "abc", trimLeadingLines("abcdef", 3))
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	assert.Equal(t, "```\nthis is code\n```", renderMarkdown("this is code", formatCode))
+	assert.Equal(t, "```ansi\nthis is code\n```", renderMarkdown("this is code", formatANSI))
+	assert.Equal(t, "````\n```not a fence```\n````", renderMarkdown("```not a fence```", formatCode))
+	assert.Equal(t, "``````\n`a` ``b`` `````c`````\n``````", renderMarkdown("`a` ``b`` `````c`````", formatCode))
+	assert.Equal(t, "\\*not bold\\* or \\`code\\`", renderMarkdown("*not bold* or `code`", formatText))
+	assert.Equal(t, "*bold*", renderMarkdown("*bold*", formatMarkdown))
+}
+
+func TestFormatDiscordAndSlack(t *testing.T) {
+	discord, slack := &discordConn{}, &slackConn{}
+	assert.Equal(t, "```\nbash\nls```", discord.Format("bash\nls", formatCode)) // First word is not taken as language
+	assert.Equal(t, "\\|\\|no spoiler\\|\\|", discord.Format("||no spoiler||", formatText))
+	assert.Equal(t, "```\u200b`\u200b`\u200b`not a fence`\u200b`\u200b`\u200b```", slack.Format("```not a fence```", formatCode))
+	assert.Equal(t, "a &lt;b&gt; &amp; c", slack.Format("a <b> & c", formatText))
+}
+
+func TestEscapedCodeBlock(t *testing.T) {
+	code := "```md\n# Title\n```\n`"
+	block := escapedCodeBlock(code, "ansi")
+	assert.True(t, strings.HasPrefix(block, "```ansi\n"))
+	assert.Equal(t, 2, strings.Count(block, codeFence))
+	assert.Equal(t, "```ansi\n"+code+"```", strings.ReplaceAll(block, zeroWidthSpace, "")) // Renders intact
+}
+
+func TestFormatScriptList(t *testing.T) {
+	assert.Equal(t, "`bash`, `python`", formatScriptList(map[string][]string{"": {"bash", "python"}}))
+	categories := map[string][]string{"": {"bash", "share"}, "ops": {"kubectl"}, "languages": {"node", "python"}}
+	assert.Equal(t, []string{"languages", "ops", "other"}, categoryNames(categories))
+	assert.Equal(t, "*languages*: `node`, `python`; *ops*: `kubectl`; *other*: `bash`, `share`", formatScriptList(categories))
+}
+
+func TestClosestMatch(t *testing.T) {
+	scripts := []string{"bash", "kubectl", "node", "python"}
+	assert.Equal(t, "python", closestMatch("pyhton", scripts))
+	assert.Equal(t, "node", closestMatch("nod", scripts))
+	assert.Equal(t, "kubectl", closestMatch("kubctl", scripts))
+	assert.Equal(t, "", closestMatch("python", scripts)) // Exact match
+	assert.Equal(t, "", closestMatch("ab", scripts))     // Too short to be a typo of "bash"
+	assert.Equal(t, "", closestMatch("ruby", scripts))
+	assert.Equal(t, 3, levenshtein("kitten", "sitting"))
+	assert.Equal(t, 1, levenshtein("über", "uber"))
+}
+
+func TestFilterOutput(t *testing.T) {
+	filters := []*config.OutputFilter{
+		{Regex: regexp.MustCompile(`xox[bp]-[0-9A-Za-z-]+`), Replacement: "[REDACTED]"},
+		{Regex: regexp.MustCompile(`REDACTED`), Replacement: "redacted"},
+	}
+	assert.Equal(t, "SLACK_TOKEN=[redacted] # keep this", filterOutput("SLACK_TOKEN=xoxb-1234-abcd # keep this", filters))
+	assert.Equal(t, "nothing to see here", filterOutput("nothing to see here", filters))
+	assert.Equal(t, "xoxb-1234", filterOutput("xoxb-1234", nil))
+}
@@ -0,0 +1,155 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	gossh "golang.org/x/crypto/ssh"
+	"heckel.io/replbot/config"
+	"heckel.io/replbot/util"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// validationCheck is a single check performed by Validate. On success, it returns a short summary.
+type validationCheck struct {
+	name string
+	fn   func(conf *config.Config) (string, error)
+}
+
+var validationChecks = []*validationCheck{
+	{"platform", validatePlatform},
+	{"scripts", validateScripts},
+	{"terminal backend", validateTerminalBackend},
+	{"shell", validateShell},
+	{"templates", validateTemplates},
+	{"reactions", validateReactions},
+	{"buttons", validateButtons},
+	{"preferences file", validatePrefsFile},
+	{"terminal sharing", validateShare},
+}
+
+// Validate checks the config and scripts without connecting to the chat platform, and writes a report of all
+// checks to w. It returns an error if any of the checks failed. This catches problems that would otherwise only
+// show up at runtime, e.g. a missing script directory (see misconfiguredMessage) or a broken template.
+func Validate(conf *config.Config, w io.Writer) error {
+	failed := 0
+	for _, check := range validationChecks {
+		summary, err := check.fn(conf)
+		if err != nil {
+			fmt.Fprintf(w, "FAIL  %-18s %s\n", check.name, err.Error())
+			failed++
+		} else {
+			fmt.Fprintf(w, "ok    %-18s %s\n", check.name, summary)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("config is invalid, %d of %d checks failed", failed, len(validationChecks))
+	}
+	fmt.Fprintln(w, "Config is valid.")
+	return nil
+}
+
+func validatePlatform(conf *config.Config) (string, error) {
+	platforms := make([]string, 0)
+	for _, workspace := range conf.Workspaces() {
+		platforms = append(platforms, string(workspace.Platform()))
+	}
+	return strings.Join(platforms, ", "), nil
+}
+
+func validateScripts(conf *config.Config) (string, error) {
+	if errs := conf.FetchScripts(); len(errs) > 0 {
+		return "", errs[0]
+	}
+	scripts := conf.Scripts()
+	if len(scripts) == 0 {
+		return "", fmt.Errorf("no scripts found in %s", conf.ScriptDir)
+	} else if errs := conf.CheckScripts(); len(errs) > 0 {
+		return "", errors.New(formatErrors(errs))
+	}
+	for alias, script := range conf.ScriptAliases {
+		if conf.Script(script) == "" {
+			return "", fmt.Errorf("alias %s refers to unknown script %s", alias, script)
+		}
+	}
+	sort.Strings(scripts)
+	for _, script := range scripts {
+		if image := conf.ScriptConfig(script).Image; image != "" {
+			if _, err := exec.LookPath("docker"); err != nil {
+				return "", fmt.Errorf("script %s runs in image %s, but docker is not installed", script, image)
+			}
+		}
+	}
+	return strings.Join(scripts, ", "), nil
+}
+
+func validateTerminalBackend(conf *config.Config) (string, error) {
+	if err := checkTerminalBackend(conf.TerminalBackend); err != nil {
+		return "", err
+	} else if conf.TerminalBackend == config.Tmux {
+		if err := util.CheckTmuxVersion(); err != nil {
+			return "", err
+		}
+	}
+	return string(conf.TerminalBackend), nil
+}
+
+func validateShell(conf *config.Config) (string, error) {
+	if err := checkShell(conf.Shell); err != nil {
+		return "", err
+	} else if conf.Shell == "" {
+		return "shebang line", nil
+	}
+	return conf.Shell, nil
+}
+
+func validateTemplates(conf *config.Config) (string, error) {
+	if _, _, _, err := loadTemplates(conf); err != nil {
+		return "", err
+	}
+	if conf.WelcomeTemplate == "" && conf.HelpTemplate == "" {
+		return "built-in", nil
+	}
+	return "custom", nil
+}
+
+func validateReactions(conf *config.Config) (string, error) {
+	if err := checkReactions(conf.Reactions); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d reaction(s)", len(conf.Reactions)), nil
+}
+
+func validateButtons(conf *config.Config) (string, error) {
+	if err := checkButtons(conf.Buttons); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d button(s)", len(conf.Buttons)), nil
+}
+
+func validatePrefsFile(conf *config.Config) (string, error) {
+	if conf.PrefsFile == "" {
+		return "not persisted", nil
+	} else if _, err := newPrefsStore(conf.PrefsFile); err != nil {
+		return "", fmt.Errorf("cannot load %s: %s", conf.PrefsFile, err.Error())
+	}
+	return conf.PrefsFile, nil
+}
+
+func validateShare(conf *config.Config) (string, error) {
+	if !conf.ShareEnabled() {
+		return "disabled", nil
+	} else if conf.ShareKeyFile == "" {
+		return "", errors.New("share key file is not set")
+	}
+	b, err := os.ReadFile(conf.ShareKeyFile)
+	if err != nil {
+		return "", err
+	} else if _, err := gossh.ParsePrivateKey(b); err != nil {
+		return "", fmt.Errorf("invalid host key in %s: %s", conf.ShareKeyFile, err.Error())
+	}
+	return conf.ShareHost, nil
+}
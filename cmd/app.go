@@ -2,6 +2,7 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
@@ -10,8 +11,13 @@ import (
 	"heckel.io/replbot/config"
 	"heckel.io/replbot/util"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -21,29 +27,103 @@ func New() *cli.App {
 	flags := []cli.Flag{
 		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, EnvVars: []string{"REPLBOT_CONFIG_FILE"}, Value: "/etc/replbot/config.yml", DefaultText: "/etc/replbot/config.yml", Usage: "config file"},
 		&cli.BoolFlag{Name: "debug", EnvVars: []string{"REPLBOT_DEBUG"}, Value: false, Usage: "enable debugging output"},
+		&cli.BoolFlag{Name: "validate", Value: false, Usage: "check the config and scripts, print a report and exit without connecting"},
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "session-log-dir", EnvVars: []string{"REPLBOT_SESSION_LOG_DIR"}, Usage: "directory to write per-session audit logs to"}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "dangerous-commands", EnvVars: []string{"REPLBOT_DANGEROUS_COMMANDS"}, Usage: "regular expressions for user input that is only sent if the session owner uses '!force'"}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "output-filters", EnvVars: []string{"REPLBOT_OUTPUT_FILTERS"}, Usage: "rules to rewrite terminal output before it is sent, as /regex/replacement/ (e.g. /token=\\S+/token=***/)"}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "output-filter-recordings", EnvVars: []string{"REPLBOT_OUTPUT_FILTER_RECORDINGS"}, Value: false, Usage: "apply the output filters to session recordings as well"}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "read-only-mode", EnvVars: []string{"REPLBOT_READ_ONLY_MODE"}, Value: false, Usage: "do not let anyone send input to any session, e.g. for demos and live displays"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "session-log-redact", EnvVars: []string{"REPLBOT_SESSION_LOG_REDACT"}, Usage: "regular expression for secrets that are redacted in session logs"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "terminal-backend", EnvVars: []string{"REPLBOT_TERMINAL_BACKEND"}, Value: string(config.DefaultTerminalBackend), DefaultText: string(config.DefaultTerminalBackend), Usage: "terminal multiplexer to run REPLs in [tmux or screen]"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "shell", EnvVars: []string{"REPLBOT_SHELL"}, DefaultText: "shebang line", Usage: "shell that runs the REPL scripts (e.g. bash), instead of the interpreter in their shebang line"}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "local-attach", EnvVars: []string{"REPLBOT_LOCAL_ATTACH"}, Value: false, Usage: "show how to attach to a session's terminal on the REPLbot host in '!info'"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "log-format", EnvVars: []string{"REPLBOT_LOG_FORMAT"}, Value: string(config.DefaultLogFormat), DefaultText: string(config.DefaultLogFormat), Usage: "log output format [text or json]"}),
 		altsrc.NewStringFlag(&cli.StringFlag{Name: "bot-token", Aliases: []string{"t"}, EnvVars: []string{"REPLBOT_BOT_TOKEN"}, DefaultText: "none", Usage: "bot token"}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "extra-bot-tokens", EnvVars: []string{"REPLBOT_EXTRA_BOT_TOKENS"}, Usage: "Slack or Discord bot tokens of additional workspaces served by the same process"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "zulip-site", EnvVars: []string{"REPLBOT_ZULIP_SITE"}, Usage: "Zulip server URL, e.g. https://example.zulipchat.com (Zulip only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "zulip-email", EnvVars: []string{"REPLBOT_ZULIP_EMAIL"}, Usage: "Zulip bot email address (Zulip only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "teams-app-id", EnvVars: []string{"REPLBOT_TEAMS_APP_ID"}, Usage: "Microsoft Teams bot app ID (Teams only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "teams-tenant-id", EnvVars: []string{"REPLBOT_TEAMS_TENANT_ID"}, Usage: "Microsoft Teams tenant ID, for single-tenant bots (Teams only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "teams-addr", EnvVars: []string{"REPLBOT_TEAMS_ADDR"}, Value: config.DefaultTeamsAddr, Usage: "[host]:port to receive Teams activities on (Teams only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "rocketchat-site", EnvVars: []string{"REPLBOT_ROCKETCHAT_SITE"}, Usage: "Rocket.Chat server URL, e.g. https://chat.example.com (Rocket.Chat only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "rocketchat-user-id", EnvVars: []string{"REPLBOT_ROCKETCHAT_USER_ID"}, Usage: "Rocket.Chat bot user ID (Rocket.Chat only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "matrix-homeserver", EnvVars: []string{"REPLBOT_MATRIX_HOMESERVER"}, Usage: "Matrix homeserver URL, e.g. https://matrix.example.com (Matrix only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "whatsapp-phone-id", EnvVars: []string{"REPLBOT_WHATSAPP_PHONE_ID"}, Usage: "WhatsApp Cloud API phone number ID (WhatsApp only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "whatsapp-app-secret", EnvVars: []string{"REPLBOT_WHATSAPP_APP_SECRET"}, Usage: "app secret used to verify WhatsApp webhooks (WhatsApp only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "whatsapp-verify-token", EnvVars: []string{"REPLBOT_WHATSAPP_VERIFY_TOKEN"}, Usage: "verify token configured for the WhatsApp webhook (WhatsApp only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "whatsapp-addr", EnvVars: []string{"REPLBOT_WHATSAPP_ADDR"}, Value: config.DefaultWhatsAppAddr, Usage: "[host]:port to receive WhatsApp webhooks on (WhatsApp only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "webhook-addr", EnvVars: []string{"REPLBOT_WEBHOOK_ADDR"}, Usage: "[host]:port to serve the generic webhook backend on, instead of connecting to a chat platform"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "webhook-callback-url", EnvVars: []string{"REPLBOT_WEBHOOK_CALLBACK_URL"}, Usage: "URL to POST output messages to; if not set, they are buffered for polling (webhook only)"}),
 		altsrc.NewStringFlag(&cli.StringFlag{Name: "script-dir", Aliases: []string{"d"}, EnvVars: []string{"REPLBOT_SCRIPT_DIR"}, Value: "/etc/replbot/script.d", DefaultText: "/etc/replbot/script.d", Usage: "script directory"}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "script-sources", EnvVars: []string{"REPLBOT_SCRIPT_SOURCES"}, Usage: "remote scripts, as '<url> [sha256:<checksum>]' or 'git+<url>[#<ref>]', fetched at startup"}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "script-aliases", EnvVars: []string{"REPLBOT_SCRIPT_ALIASES"}, Usage: "alternative names for scripts, as alias=script (e.g. py=python)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "script-cache-dir", EnvVars: []string{"REPLBOT_SCRIPT_CACHE_DIR"}, Value: "/var/cache/replbot/script.d", Usage: "directory that remote scripts are fetched to"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "work-dir", EnvVars: []string{"REPLBOT_WORK_DIR"}, Usage: "working directory for sessions, or 'temp' for a fresh temporary directory per session"}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "allowed-work-dirs", EnvVars: []string{"REPLBOT_ALLOWED_WORK_DIRS"}, Usage: "base directories users may pick a working directory from via 'cwd:<path>'"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "temp-dir", EnvVars: []string{"REPLBOT_TEMP_DIR"}, Value: os.TempDir(), Usage: "directory for temporary files, e.g. terminal scripts and recordings"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "shm-dir", EnvVars: []string{"REPLBOT_SHM_DIR"}, Value: config.DefaultShmDir, Usage: "directory for short-lived temporary files, ideally a tmpfs; falls back to temp-dir if it does not exist"}),
 		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "idle-timeout", Aliases: []string{"T"}, EnvVars: []string{"REPLBOT_IDLE_TIMEOUT"}, Value: config.DefaultIdleTimeout, Usage: "timeout after which sessions are ended"}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "idle-warning", EnvVars: []string{"REPLBOT_IDLE_WARNING"}, Value: config.DefaultIdleWarning, Usage: "time before the idle timeout at which users are warned, or 0 to disable"}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "named-idle-timeout", EnvVars: []string{"REPLBOT_NAMED_IDLE_TIMEOUT"}, Value: config.DefaultNamedIdleTimeout, Usage: "timeout after which named sessions (name:..) are ended"}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "max-session-duration", EnvVars: []string{"REPLBOT_MAX_SESSION_DURATION"}, Usage: "max time after which sessions are ended regardless of activity, or 0 for no limit"}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "max-session-warning", EnvVars: []string{"REPLBOT_MAX_SESSION_WARNING"}, Value: config.DefaultMaxSessionWarning, Usage: "time before the max session duration at which users are warned, or 0 to disable"}),
+		altsrc.NewIntFlag(&cli.IntFlag{Name: "max-output-bytes", EnvVars: []string{"REPLBOT_MAX_OUTPUT_BYTES"}, Usage: "max bytes of terminal output a command may send before it is interrupted, or 0 for no limit"}),
+		altsrc.NewIntFlag(&cli.IntFlag{Name: "max-output-messages", EnvVars: []string{"REPLBOT_MAX_OUTPUT_MESSAGES"}, Usage: "max number of terminal updates a command may send before it is interrupted, or 0 for no limit"}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "ready-timeout", EnvVars: []string{"REPLBOT_READY_TIMEOUT"}, Value: config.DefaultReadyTimeout, Usage: "max time to wait for a script's readiness probe (ready=..) before accepting input anyway"}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "complete-timeout", EnvVars: []string{"REPLBOT_COMPLETE_TIMEOUT"}, Value: config.DefaultCompleteTimeout, Usage: "max time to wait for a REPL to show completions after a tab, see !complete"}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "kill-grace-period", EnvVars: []string{"REPLBOT_KILL_GRACE_PERIOD"}, Value: config.DefaultKillGracePeriod, Usage: "time to wait for a session's processes to exit when it ends, before sending the next of the kill signals"}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "kill-signals", EnvVars: []string{"REPLBOT_KILL_SIGNALS"}, Usage: "signals sent one after the other to a session's processes that are still running when it ends (default: TERM,KILL), or 'none'"}),
 		altsrc.NewIntFlag(&cli.IntFlag{Name: "max-total-sessions", Aliases: []string{"S"}, EnvVars: []string{"REPLBOT_MAX_TOTAL_SESSIONS"}, Value: config.DefaultMaxTotalSessions, Usage: "max number of concurrent total sessions"}),
 		altsrc.NewIntFlag(&cli.IntFlag{Name: "max-user-sessions", Aliases: []string{"U"}, EnvVars: []string{"REPLBOT_MAX_USER_SESSIONS"}, Value: config.DefaultMaxUserSessions, Usage: "max number of concurrent sessions per user"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "prefs-file", EnvVars: []string{"REPLBOT_PREFS_FILE"}, Usage: "file to persist the users' own session defaults in (set via 'prefs'); if not set, they are lost on restart"}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "admin-users", EnvVars: []string{"REPLBOT_ADMIN_USERS"}, Usage: "user IDs allowed to list, search and message all active sessions via 'sessions', 'find' and 'broadcast'"}),
 		altsrc.NewStringFlag(&cli.StringFlag{Name: "default-control-mode", Aliases: []string{"m"}, EnvVars: []string{"REPLBOT_DEFAULT_CONTROL_MODE"}, Value: string(config.DefaultControlMode), DefaultText: string(config.DefaultControlMode), Usage: "default control mode [channel, thread or split]"}),
 		altsrc.NewStringFlag(&cli.StringFlag{Name: "default-window-mode", Aliases: []string{"w"}, EnvVars: []string{"REPLBOT_DEFAULT_WINDOW_MODE"}, Value: string(config.DefaultWindowMode), DefaultText: string(config.DefaultWindowMode), Usage: "default window mode [full or trim]"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "default-color-mode", EnvVars: []string{"REPLBOT_DEFAULT_COLOR_MODE"}, Value: string(config.DefaultColorMode), DefaultText: string(config.DefaultColorMode), Usage: "default color mode [color or no-color]"}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "color-map", EnvVars: []string{"REPLBOT_COLOR_MAP"}, Usage: "translation of ANSI SGR codes in color mode, as code=code or code=none (e.g. 9=4)"}),
 		altsrc.NewStringFlag(&cli.StringFlag{Name: "default-auth-mode", Aliases: []string{"a"}, EnvVars: []string{"REPLBOT_DEFAULT_AUTH_MODE"}, Value: string(config.DefaultAuthMode), DefaultText: string(config.DefaultAuthMode), Usage: "default auth mode [only-me or everyone]"}),
-		altsrc.NewStringFlag(&cli.StringFlag{Name: "default-size", Aliases: []string{"s"}, EnvVars: []string{"REPLBOT_DEFAULT_SIZE"}, Value: config.DefaultSize.Name, DefaultText: config.DefaultSize.Name, Usage: "default terminal size [tiny, small, medium, or large]"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "binary-mode", EnvVars: []string{"REPLBOT_BINARY_MODE"}, Value: string(config.DefaultBinaryMode), DefaultText: string(config.DefaultBinaryMode), Usage: "how to show binary output [suppress, hexdump or upload]"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "default-size", Aliases: []string{"s"}, EnvVars: []string{"REPLBOT_DEFAULT_SIZE"}, Value: config.DefaultSize.Name, DefaultText: config.DefaultSize.Name, Usage: "default terminal size [tiny, small, medium, large, or <width>x<height>]"}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "discord-embeds", EnvVars: []string{"REPLBOT_DISCORD_EMBEDS"}, Value: false, Usage: "show session started/exited and help messages as embeds on Discord"}),
+		altsrc.NewIntFlag(&cli.IntFlag{Name: "max-message-length", EnvVars: []string{"REPLBOT_MAX_MESSAGE_LENGTH"}, Usage: "max length of terminal messages, if lower than the platform limit (0 = platform limit)"}),
 		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "default-record", Aliases: []string{"r"}, EnvVars: []string{"REPLBOT_DEFAULT_RECORD"}, Usage: "record sessions by default"}),
 		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "no-default-record", Aliases: []string{"R"}, EnvVars: []string{"REPLBOT_NO_DEFAULT_RECORD"}, Usage: "do not record sessions by default"}),
 		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "upload-recording", Aliases: []string{"z"}, EnvVars: []string{"REPLBOT_UPLOAD_RECORDING"}, Usage: "upload recorded sessions via 'asciinema upload'"}),
 		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "no-upload-recording", Aliases: []string{"Z"}, EnvVars: []string{"REPLBOT_NO_UPLOAD_RECORDING"}, Usage: "do not upload recorded sessions via 'asciinema upload'"}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "image-refresh-interval", EnvVars: []string{"REPLBOT_IMAGE_REFRESH_INTERVAL"}, Value: config.DefaultImageRefreshInterval, Usage: "interval at which the terminal is uploaded as an image in sessions started with 'render:image', if it changed"}),
 		altsrc.NewStringFlag(&cli.StringFlag{Name: "cursor", Aliases: []string{"C"}, EnvVars: []string{"REPLBOT_CURSOR"}, Value: "on", Usage: "cursor blink rate (on, off or duration)"}),
 		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "default-web", Aliases: []string{"x"}, EnvVars: []string{"REPLBOT_DEFAULT_WEB"}, Usage: "turn on web terminal by default"}),
 		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "no-default-web", Aliases: []string{"X"}, EnvVars: []string{"REPLBOT_NO_DEFAULT_WEB"}, Usage: "do not turn on web terminal by default"}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "default-quiet", EnvVars: []string{"REPLBOT_DEFAULT_QUIET"}, Usage: "leave out start, exit and welcome messages by default"}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "no-default-quiet", EnvVars: []string{"REPLBOT_NO_DEFAULT_QUIET"}, Usage: "send start, exit and welcome messages by default"}),
 		altsrc.NewStringFlag(&cli.StringFlag{Name: "web-host", Aliases: []string{"Y"}, EnvVars: []string{"REPLBOT_WEB_ADDRESS"}, Usage: "hostname:port used to provide the web terminal feature"}),
 		altsrc.NewStringFlag(&cli.StringFlag{Name: "share-host", Aliases: []string{"H"}, EnvVars: []string{"REPLBOT_SHARE_HOST"}, Usage: "SSH hostname:port, used for terminal sharing"}),
 		altsrc.NewStringFlag(&cli.StringFlag{Name: "share-key-file", Aliases: []string{"K"}, EnvVars: []string{"REPLBOT_SHARE_KEY_FILE"}, Value: "/etc/replbot/hostkey", Usage: "SSH host key file, used for terminal sharing"}),
+		altsrc.NewIntFlag(&cli.IntFlag{Name: "share-port-min", EnvVars: []string{"REPLBOT_SHARE_PORT_MIN"}, Usage: "lowest relay port used for terminal sharing (default: any free port)"}),
+		altsrc.NewIntFlag(&cli.IntFlag{Name: "share-port-max", EnvVars: []string{"REPLBOT_SHARE_PORT_MAX"}, Usage: "highest relay port used for terminal sharing (default: any free port)"}),
+		altsrc.NewIntFlag(&cli.IntFlag{Name: "share-max-conns", EnvVars: []string{"REPLBOT_SHARE_MAX_CONNS"}, Value: config.DefaultShareMaxConns, Usage: "max number of concurrent connections to the share server"}),
+		altsrc.NewIntFlag(&cli.IntFlag{Name: "share-max-session-conns", EnvVars: []string{"REPLBOT_SHARE_MAX_SESSION_CONNS"}, Value: config.DefaultShareMaxSessionConns, Usage: "max number of concurrent connections per terminal sharing session"}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "share-handshake-timeout", EnvVars: []string{"REPLBOT_SHARE_HANDSHAKE_TIMEOUT"}, Value: config.DefaultShareHandshakeTimeout, Usage: "time after which share connections are closed if the SSH handshake is not done"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "command-prefix", EnvVars: []string{"REPLBOT_COMMAND_PREFIX"}, Value: config.DefaultCommandPrefix, Usage: "prefix for session commands, e.g. '!' for !help"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "comment-prefix", EnvVars: []string{"REPLBOT_COMMENT_PREFIX"}, DefaultText: "command prefix + '!'", Usage: "prefix for comments that are not sent to the REPL, e.g. '!!', or 'off' to disable comments"}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "strip-inline-comments", EnvVars: []string{"REPLBOT_STRIP_INLINE_COMMENTS"}, Value: false, Usage: "remove trailing comments from user input, e.g. 'ls !! list files' sends 'ls'"}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "buttons", EnvVars: []string{"REPLBOT_BUTTONS"}, Usage: "control buttons shown below a session, as label=command (e.g. Ctrl-C=!c), or 'none' to disable"}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "reactions", EnvVars: []string{"REPLBOT_REACTIONS"}, Usage: "emoji reactions that send keys to a session, as emoji=command (e.g. raised_hand=!c)"}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{Name: "ack-reactions", EnvVars: []string{"REPLBOT_ACK_REACTIONS"}, Value: false, Usage: "react to messages sent to a session with ✅ if forwarded, or 🚫 if dropped (Slack and Discord only)"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "welcome-template", EnvVars: []string{"REPLBOT_WELCOME_TEMPLATE"}, Usage: "welcome message, or file containing it"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "help-template", EnvVars: []string{"REPLBOT_HELP_TEMPLATE"}, Usage: "help message template, or file containing it"}),
+		altsrc.NewIntFlag(&cli.IntFlag{Name: "send-retries", EnvVars: []string{"REPLBOT_SEND_RETRIES"}, Value: config.DefaultSendRetries, Usage: "number of times sending a message is retried if the chat platform fails temporarily"}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "send-retry-backoff", EnvVars: []string{"REPLBOT_SEND_RETRY_BACKOFF"}, Value: config.DefaultSendRetryBackoff, Usage: "time to wait before the first retry, doubled for each retry"}),
+		altsrc.NewIntFlag(&cli.IntFlag{Name: "reconnect-retries", EnvVars: []string{"REPLBOT_RECONNECT_RETRIES"}, Value: config.DefaultReconnectRetries, Usage: "number of times in a row to try reconnecting if the connection to the chat platform fails or drops, or 0 to exit right away"}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "reconnect-backoff", EnvVars: []string{"REPLBOT_RECONNECT_BACKOFF"}, Value: config.DefaultReconnectBackoff, Usage: "time to wait before the first reconnect, doubled for each attempt (up to one minute)"}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{Name: "shutdown-timeout", EnvVars: []string{"REPLBOT_SHUTDOWN_TIMEOUT"}, Value: config.DefaultShutdownTimeout, Usage: "time to wait for sessions to close on SIGINT/SIGTERM before exiting anyway, or 0 to wait forever"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "health-addr", EnvVars: []string{"REPLBOT_HEALTH_ADDR"}, Usage: "[host]:port used to provide the /healthz and /readyz endpoints"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "admin-addr", EnvVars: []string{"REPLBOT_ADMIN_ADDR"}, Value: config.DefaultAdminAddr, Usage: "[host]:port used to provide the admin API (/sessions), if an admin token is set"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "admin-token", EnvVars: []string{"REPLBOT_ADMIN_TOKEN"}, Usage: "bearer token for the admin API; the API is disabled if not set"}),
 	}
 	return &cli.App{
 		Name:                   "replbot",
-		Usage:                  "Slack/Discord bot for running interactive REPLs and shells from a chat",
+		Usage:                  "Slack/Discord/Zulip/Teams/Rocket.Chat/Matrix/WhatsApp/webhook bot for running interactive REPLs and shells from a chat",
 		UsageText:              "replbot [OPTION..]",
 		HideHelp:               true,
 		HideVersion:            true,
@@ -59,38 +139,184 @@ func New() *cli.App {
 }
 
 func execRun(c *cli.Context) error {
-	if err := util.CheckTmuxVersion(); err != nil {
-		return err
-	}
 	token := c.String("bot-token")
+	extraBotTokens := c.StringSlice("extra-bot-tokens")
+	zulipSite := c.String("zulip-site")
+	zulipEmail := c.String("zulip-email")
+	teamsAppID := c.String("teams-app-id")
+	teamsTenantID := c.String("teams-tenant-id")
+	teamsAddr := c.String("teams-addr")
+	rocketChatSite := c.String("rocketchat-site")
+	rocketChatUserID := c.String("rocketchat-user-id")
+	matrixHomeserver := c.String("matrix-homeserver")
+	whatsAppPhoneID := c.String("whatsapp-phone-id")
+	whatsAppAppSecret := c.String("whatsapp-app-secret")
+	whatsAppVerifyToken := c.String("whatsapp-verify-token")
+	whatsAppAddr := c.String("whatsapp-addr")
+	webhookAddr := c.String("webhook-addr")
+	webhookCallbackURL := c.String("webhook-callback-url")
 	scriptDir := c.String("script-dir")
+	scriptSources := c.StringSlice("script-sources")
+	scriptCacheDir := c.String("script-cache-dir")
+	workDir := c.String("work-dir")
+	allowedWorkDirs := c.StringSlice("allowed-work-dirs")
+	tempDir := c.String("temp-dir")
+	shmDir := c.String("shm-dir")
 	timeout := c.Duration("idle-timeout")
+	idleWarning := c.Duration("idle-warning")
+	namedIdleTimeout := c.Duration("named-idle-timeout")
+	maxSessionDuration := c.Duration("max-session-duration")
+	maxSessionWarning := c.Duration("max-session-warning")
+	maxOutputBytes := c.Int("max-output-bytes")
+	maxOutputMessages := c.Int("max-output-messages")
+	readyTimeout := c.Duration("ready-timeout")
+	completeTimeout := c.Duration("complete-timeout")
+	killGracePeriod := c.Duration("kill-grace-period")
+	imageRefreshInterval := c.Duration("image-refresh-interval")
 	maxTotalSessions := c.Int("max-total-sessions")
 	maxUserSessions := c.Int("max-user-sessions")
+	adminUsers := c.StringSlice("admin-users")
+	prefsFile := c.String("prefs-file")
 	defaultControlMode := config.ControlMode(c.String("default-control-mode"))
 	defaultWindowMode := config.WindowMode(c.String("default-window-mode"))
+	defaultColorMode := config.ColorMode(c.String("default-color-mode"))
 	defaultAuthMode := config.AuthMode(c.String("default-auth-mode"))
+	binaryMode := config.BinaryMode(c.String("binary-mode"))
+	maxMessageLength := c.Int("max-message-length")
+	discordEmbeds := c.Bool("discord-embeds")
 	cursor := c.String("cursor")
 	webHost := c.String("web-host")
 	shareHost := c.String("share-host")
+	sharePortMin := c.Int("share-port-min")
+	sharePortMax := c.Int("share-port-max")
 	shareKeyFile := c.String("share-key-file")
+	shareMaxConns := c.Int("share-max-conns")
+	shareMaxSessionConns := c.Int("share-max-session-conns")
+	shareHandshakeTimeout := c.Duration("share-handshake-timeout")
+	healthAddr := c.String("health-addr")
+	adminAddr := c.String("admin-addr")
+	adminToken := c.String("admin-token")
+	sendRetries := c.Int("send-retries")
+	sendRetryBackoff := c.Duration("send-retry-backoff")
+	reconnectRetries := c.Int("reconnect-retries")
+	reconnectBackoff := c.Duration("reconnect-backoff")
+	shutdownTimeout := c.Duration("shutdown-timeout")
+	commandPrefix := c.String("command-prefix")
+	commentPrefix := c.String("comment-prefix")
+	stripInlineComments := c.Bool("strip-inline-comments")
+	ackReactions := c.Bool("ack-reactions")
+	welcomeTemplate := c.String("welcome-template")
+	helpTemplate := c.String("help-template")
 	debug := c.Bool("debug")
+	terminalBackend := config.TerminalBackend(c.String("terminal-backend"))
+	shell := c.String("shell")
+	localAttach := c.Bool("local-attach")
+	logFormat := config.LogFormat(c.String("log-format"))
+	sessionLogDir := c.String("session-log-dir")
+	sessionLogRedact := c.String("session-log-redact")
+	filterRecordings := c.Bool("output-filter-recordings")
+	readOnlyMode := c.Bool("read-only-mode")
+	if commentPrefix == "" {
+		commentPrefix = commandPrefix + "!" // e.g. "!!", or ";;!" if the command prefix is ";;"
+	} else if commentPrefix == config.CommentPrefixOff {
+		commentPrefix = ""
+	}
 	if token == "" || token == "MUST_BE_SET" {
 		return errors.New("missing bot token, pass --bot-token, set REPLBOT_BOT_TOKEN env variable or bot-token config option")
-	} else if _, err := os.Stat(scriptDir); err != nil {
+	} else if err := checkExtraBotTokens(token, extraBotTokens); err != nil {
+		return err
+	} else if zulipSite != "" && zulipEmail == "" {
+		return errors.New("zulip email must be set if zulip site is set, check --zulip-email or REPLBOT_ZULIP_EMAIL")
+	} else if teamsAppID != "" && teamsAddr == "" {
+		return errors.New("teams addr must be set if teams app ID is set, check --teams-addr or REPLBOT_TEAMS_ADDR")
+	} else if rocketChatSite != "" && rocketChatUserID == "" {
+		return errors.New("rocket.chat user ID must be set if rocket.chat site is set, check --rocketchat-user-id or REPLBOT_ROCKETCHAT_USER_ID")
+	} else if whatsAppPhoneID != "" && (whatsAppAppSecret == "" || whatsAppVerifyToken == "") {
+		return errors.New("whatsapp app secret and verify token must be set if whatsapp phone ID is set, check --whatsapp-app-secret and --whatsapp-verify-token")
+	} else if whatsAppPhoneID != "" && whatsAppAddr == "" {
+		return errors.New("whatsapp addr must be set if whatsapp phone ID is set, check --whatsapp-addr or REPLBOT_WHATSAPP_ADDR")
+	} else if webhookCallbackURL != "" && webhookAddr == "" {
+		return errors.New("webhook addr must be set if webhook callback URL is set, check --webhook-addr or REPLBOT_WEBHOOK_ADDR")
+	} else if webhookCallbackURL != "" && !strings.HasPrefix(webhookCallbackURL, "http://") && !strings.HasPrefix(webhookCallbackURL, "https://") {
+		return errors.New("webhook callback URL must be an http:// or https:// URL, check --webhook-callback-url or REPLBOT_WEBHOOK_CALLBACK_URL")
+	} else if _, err := os.Stat(scriptDir); err != nil && len(scriptSources) == 0 {
 		return fmt.Errorf("cannot find REPL directory %s, set --script-dir, set REPLBOT_SCRIPT_DIR env variable, or script-dir config option", scriptDir)
+	} else if workDir != "" && workDir != config.WorkDirTemp && !util.FileExists(workDir) {
+		return fmt.Errorf("cannot find working directory %s, check --work-dir or REPLBOT_WORK_DIR", workDir)
+	} else if err := util.CheckDirWritable(tempDir); err != nil {
+		return fmt.Errorf("temp dir %s is not writable, check --temp-dir or REPLBOT_TEMP_DIR: %s", tempDir, err.Error())
+	} else if util.FileExists(shmDir) && util.CheckDirWritable(shmDir) != nil {
+		return fmt.Errorf("shm dir %s is not writable, check --shm-dir or REPLBOT_SHM_DIR", shmDir)
+	} else if prefsFile != "" && !util.FileExists(filepath.Dir(prefsFile)) {
+		return fmt.Errorf("cannot find directory for preferences file %s, check --prefs-file or REPLBOT_PREFS_FILE", prefsFile)
+	} else if sendRetries < 0 || sendRetryBackoff < 0 {
+		return errors.New("send retries and backoff must not be negative, check --send-retries and --send-retry-backoff")
+	} else if reconnectRetries < 0 || reconnectBackoff < 0 {
+		return errors.New("reconnect retries and backoff must not be negative, check --reconnect-retries and --reconnect-backoff")
+	} else if adminToken != "" && adminAddr == "" {
+		return errors.New("admin API address must be set if an admin token is set, check --admin-addr or REPLBOT_ADMIN_ADDR")
+	} else if shutdownTimeout < 0 {
+		return errors.New("shutdown timeout must not be negative, check --shutdown-timeout or REPLBOT_SHUTDOWN_TIMEOUT")
 	} else if timeout < time.Minute {
 		return fmt.Errorf("idle timeout has to be at least one minute")
-	} else if entries, err := os.ReadDir(scriptDir); err != nil || len(entries) == 0 {
+	} else if idleWarning < 0 || idleWarning >= timeout {
+		return fmt.Errorf("idle warning must be shorter than the idle timeout, check --idle-warning or REPLBOT_IDLE_WARNING")
+	} else if namedIdleTimeout < timeout {
+		return fmt.Errorf("named session idle timeout must not be shorter than the idle timeout, check --named-idle-timeout or REPLBOT_NAMED_IDLE_TIMEOUT")
+	} else if maxSessionDuration < 0 || (maxSessionDuration > 0 && maxSessionDuration < time.Minute) {
+		return fmt.Errorf("max session duration has to be at least one minute, or 0 for no limit")
+	} else if maxSessionWarning < 0 || (maxSessionDuration > 0 && maxSessionWarning >= maxSessionDuration) {
+		return fmt.Errorf("max session warning must be shorter than the max session duration, check --max-session-warning or REPLBOT_MAX_SESSION_WARNING")
+	} else if maxOutputBytes < 0 {
+		return errors.New("max output bytes must not be negative, check --max-output-bytes or REPLBOT_MAX_OUTPUT_BYTES")
+	} else if maxOutputMessages < 0 {
+		return errors.New("max output messages must not be negative, check --max-output-messages or REPLBOT_MAX_OUTPUT_MESSAGES")
+	} else if readyTimeout < time.Second {
+		return fmt.Errorf("ready timeout has to be at least one second, check --ready-timeout or REPLBOT_READY_TIMEOUT")
+	} else if completeTimeout < 100*time.Millisecond || completeTimeout > 10*time.Second {
+		return fmt.Errorf("complete timeout has to be between 100ms and 10s, check --complete-timeout or REPLBOT_COMPLETE_TIMEOUT")
+	} else if killGracePeriod < 100*time.Millisecond || killGracePeriod > time.Minute {
+		return errors.New("kill grace period has to be between 100ms and 1m, check --kill-grace-period or REPLBOT_KILL_GRACE_PERIOD")
+	} else if imageRefreshInterval < time.Second {
+		return fmt.Errorf("image refresh interval has to be at least one second, check --image-refresh-interval or REPLBOT_IMAGE_REFRESH_INTERVAL")
+	} else if entries, err := os.ReadDir(scriptDir); (err != nil || len(entries) == 0) && len(scriptSources) == 0 {
 		return errors.New("cannot read script directory, or directory empty")
+	} else if len(scriptSources) > 0 && scriptCacheDir == "" {
+		return errors.New("script cache dir must be set if script sources are set, check --script-cache-dir or REPLBOT_SCRIPT_CACHE_DIR")
 	} else if defaultControlMode != config.Channel && defaultControlMode != config.Thread && defaultControlMode != config.Split {
 		return errors.New("default mode must be 'channel', 'thread' or 'split'")
 	} else if defaultWindowMode != config.Full && defaultWindowMode != config.Trim {
 		return errors.New("default window mode must be 'full' or 'trim'")
+	} else if defaultColorMode != config.Color && defaultColorMode != config.NoColor {
+		return errors.New("default color mode must be 'color' or 'no-color'")
 	} else if defaultAuthMode != config.OnlyMe && defaultAuthMode != config.Everyone {
 		return errors.New("default window mode must be 'full' or 'trim'")
+	} else if binaryMode != config.Suppress && binaryMode != config.Hexdump && binaryMode != config.Upload {
+		return errors.New("binary mode must be 'suppress', 'hexdump' or 'upload'")
+	} else if terminalBackend != config.Tmux && terminalBackend != config.Screen {
+		return errors.New("terminal backend must be 'tmux' or 'screen'")
+	} else if logFormat != config.TextLog && logFormat != config.JSONLog {
+		return errors.New("log format must be 'text' or 'json'")
+	} else if sessionLogDir != "" && !util.FileExists(sessionLogDir) {
+		return fmt.Errorf("cannot find session log directory %s, check --session-log-dir or REPLBOT_SESSION_LOG_DIR", sessionLogDir)
+	} else if maxMessageLength != 0 && maxMessageLength < 500 {
+		return errors.New("max message length must be 0 (platform limit) or at least 500")
 	} else if shareHost != "" && (shareKeyFile == "" || !util.FileExists(shareKeyFile)) {
 		return errors.New("share key file must be set and exist if share host is set, check --share-key-file or REPLBOT_SHARE_KEY_FILE")
+	} else if (sharePortMin != 0 || sharePortMax != 0) && (sharePortMin < 1 || sharePortMax > 65535 || sharePortMin > sharePortMax) {
+		return errors.New("share port range must be set with both a min and max port between 1 and 65535, check --share-port-min/--share-port-max or REPLBOT_SHARE_PORT_MIN/REPLBOT_SHARE_PORT_MAX")
+	} else if sharePortMin != 0 && shareHostPortInRange(shareHost, sharePortMin, sharePortMax) {
+		return errors.New("share port range must not contain the port of the share host, check --share-port-min/--share-port-max or REPLBOT_SHARE_PORT_MIN/REPLBOT_SHARE_PORT_MAX")
+	} else if shareMaxConns < 1 {
+		return errors.New("share max conns must be at least 1, check --share-max-conns or REPLBOT_SHARE_MAX_CONNS")
+	} else if shareMaxSessionConns < 1 || shareMaxSessionConns > shareMaxConns {
+		return errors.New("share max session conns must be between 1 and share max conns, check --share-max-session-conns or REPLBOT_SHARE_MAX_SESSION_CONNS")
+	} else if shareHandshakeTimeout < time.Second {
+		return errors.New("share handshake timeout must be at least 1s, check --share-handshake-timeout or REPLBOT_SHARE_HANDSHAKE_TIMEOUT")
+	} else if commandPrefix == "" || strings.ContainsAny(commandPrefix, " \t\n`") {
+		return errors.New("command prefix must not be empty, and must not contain spaces or backticks, check --command-prefix or REPLBOT_COMMAND_PREFIX")
+	} else if strings.ContainsAny(commentPrefix, " \t\n`") || (commentPrefix != "" && strings.HasPrefix(commandPrefix, commentPrefix)) {
+		return errors.New("comment prefix must not contain spaces or backticks, and must not shadow the command prefix, check --comment-prefix or REPLBOT_COMMENT_PREFIX")
 	} else if maxUserSessions > maxTotalSessions {
 		return errors.New("max total sessions must be larger or equal to max user sessions")
 	} else if err := util.Run("ttyd", "--version"); webHost != "" && err != nil {
@@ -104,6 +330,38 @@ func execRun(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	scriptAliases, err := parseScriptAliases(c.StringSlice("script-aliases"))
+	if err != nil {
+		return err
+	}
+	reactions, err := parseReactions(c.StringSlice("reactions"))
+	if err != nil {
+		return err
+	}
+	buttons, err := parseButtons(c.StringSlice("buttons"))
+	if err != nil {
+		return err
+	}
+	killSignals, err := parseKillSignals(c.StringSlice("kill-signals"))
+	if err != nil {
+		return err
+	}
+	colorMap, err := parseColorMap(c.StringSlice("color-map"))
+	if err != nil {
+		return err
+	}
+	sources, err := parseScriptSources(scriptSources)
+	if err != nil {
+		return err
+	}
+	outputFilters, err := parseOutputFilters(c.StringSlice("output-filters"))
+	if err != nil {
+		return err
+	}
+	dangerousCommands, err := parseDangerousCommands(c.StringSlice("dangerous-commands"))
+	if err != nil {
+		return err
+	}
 	var defaultRecord bool
 	if c.IsSet("no-default-record") {
 		defaultRecord = false
@@ -120,6 +378,14 @@ func execRun(c *cli.Context) error {
 	} else {
 		defaultWeb = config.DefaultWeb
 	}
+	var defaultQuiet bool
+	if c.IsSet("no-default-quiet") {
+		defaultQuiet = false
+	} else if c.IsSet("default-quiet") {
+		defaultQuiet = true
+	} else {
+		defaultQuiet = config.DefaultQuiet
+	}
 	var uploadRecording bool
 	if c.IsSet("no-upload-recording") {
 		uploadRecording = false
@@ -131,34 +397,131 @@ func execRun(c *cli.Context) error {
 
 	// Create main bot
 	conf := config.New(token)
+	conf.ExtraBotTokens = extraBotTokens
+	conf.ZulipSite = zulipSite
+	conf.ZulipEmail = zulipEmail
+	conf.TeamsAppID = teamsAppID
+	conf.TeamsTenantID = teamsTenantID
+	conf.TeamsAddr = teamsAddr
+	conf.RocketChatSite = rocketChatSite
+	conf.RocketChatUserID = rocketChatUserID
+	conf.MatrixHomeserver = matrixHomeserver
+	conf.WhatsAppPhoneID = whatsAppPhoneID
+	conf.WhatsAppAppSecret = whatsAppAppSecret
+	conf.WhatsAppVerifyToken = whatsAppVerifyToken
+	conf.WhatsAppAddr = whatsAppAddr
+	conf.WebhookAddr = webhookAddr
+	conf.WebhookCallbackURL = webhookCallbackURL
 	conf.ScriptDir = scriptDir
+	conf.ScriptSources = sources
+	conf.ScriptCacheDir = scriptCacheDir
+	conf.ScriptAliases = scriptAliases
+	conf.WorkDir = workDir
+	conf.AllowedWorkDirs = allowedWorkDirs
+	conf.TempDir = tempDir
+	conf.ShmDir = shmDir
 	conf.IdleTimeout = timeout
+	conf.IdleWarning = idleWarning
+	conf.NamedIdleTimeout = namedIdleTimeout
+	conf.MaxSessionDuration = maxSessionDuration
+	conf.MaxSessionWarning = maxSessionWarning
+	conf.MaxOutputBytes = maxOutputBytes
+	conf.MaxOutputMessages = maxOutputMessages
+	conf.ReadyTimeout = readyTimeout
+	conf.CompleteTimeout = completeTimeout
+	conf.KillGracePeriod = killGracePeriod
+	conf.KillSignals = killSignals
 	conf.MaxTotalSessions = maxTotalSessions
 	conf.MaxUserSessions = maxUserSessions
+	conf.AdminUsers = adminUsers
+	conf.PrefsFile = prefsFile
 	conf.DefaultControlMode = defaultControlMode
 	conf.DefaultWindowMode = defaultWindowMode
+	conf.DefaultColorMode = defaultColorMode
 	conf.DefaultAuthMode = defaultAuthMode
+	conf.BinaryMode = binaryMode
 	conf.DefaultSize = defaultSize
+	conf.MaxMessageLength = maxMessageLength
+	conf.DiscordEmbeds = discordEmbeds
 	conf.DefaultRecord = defaultRecord
 	conf.UploadRecording = uploadRecording
 	conf.Cursor = cursorRate
+	conf.ImageRefreshInterval = imageRefreshInterval
 	conf.DefaultWeb = defaultWeb
+	conf.DefaultQuiet = defaultQuiet
 	conf.WebHost = webHost
 	conf.ShareHost = shareHost
+	conf.SharePortMin = sharePortMin
+	conf.SharePortMax = sharePortMax
 	conf.ShareKeyFile = shareKeyFile
+	conf.ShareMaxConns = shareMaxConns
+	conf.ShareMaxSessionConns = shareMaxSessionConns
+	conf.ShareHandshakeTimeout = shareHandshakeTimeout
+	conf.HealthAddr = healthAddr
+	conf.AdminAddr = adminAddr
+	conf.AdminToken = adminToken
+	conf.SendRetries = sendRetries
+	conf.SendRetryBackoff = sendRetryBackoff
+	conf.ReconnectRetries = reconnectRetries
+	conf.ReconnectBackoff = reconnectBackoff
+	conf.ShutdownTimeout = shutdownTimeout
+	conf.CommandPrefix = commandPrefix
+	conf.CommentPrefix = commentPrefix
+	conf.StripInlineComments = stripInlineComments
+	conf.Reactions = reactions
+	conf.AckReactions = ackReactions
+	conf.Buttons = buttons
+	conf.ColorMap = colorMap
+	conf.WelcomeTemplate = welcomeTemplate
+	conf.HelpTemplate = helpTemplate
 	conf.Debug = debug
+	conf.TerminalBackend = terminalBackend
+	conf.Shell = shell
+	conf.LocalAttach = localAttach
+	conf.LogFormat = logFormat
+	conf.SessionLogDir = sessionLogDir
+	conf.OutputFilters = outputFilters
+	conf.FilterRecordings = filterRecordings
+	conf.ReadOnlyMode = readOnlyMode
+	conf.DangerousCommands = dangerousCommands
+	if sessionLogRedact != "" {
+		if conf.SessionLogRedact, err = regexp.Compile(sessionLogRedact); err != nil {
+			return fmt.Errorf("invalid session log redaction regex: %s", err.Error())
+		}
+	}
+	if logFormat == config.JSONLog {
+		util.EnableJSONLogs(os.Stderr)
+	}
+	if !util.FileExists(shmDir) {
+		log.Printf("shm dir %s does not exist, using temp dir %s instead", shmDir, tempDir)
+		conf.ShmDir = tempDir
+	}
+	if c.Bool("validate") {
+		return bot.Validate(conf, c.App.Writer)
+	}
+	if terminalBackend == config.Tmux {
+		if err := util.CheckTmuxVersion(); err != nil {
+			return err
+		}
+	}
 	robot, err := bot.New(conf)
 	if err != nil {
 		return err
 	}
 
 	// Set up signal handling
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		<-sigs // Doesn't matter which
-		log.Printf("Signal received. Closing all active sessions.")
-		robot.Stop()
+		select {
+		case <-ctx.Done(): // Doesn't matter which
+			stop() // A second signal kills us immediately
+			log.Printf("Signal received. Closing all active sessions.")
+			stopWithTimeout(robot, conf.ShutdownTimeout)
+		case <-done:
+		}
 	}()
 
 	// Run main bot, can be killed by signal
@@ -170,6 +533,51 @@ func execRun(c *cli.Context) error {
 	return nil
 }
 
+// stopWithTimeout gracefully stops the bot, closing all sessions and killing their processes. If this takes
+// longer than the timeout (e.g. because the chat platform does not respond), we exit without waiting any longer.
+func stopWithTimeout(robot *bot.Bot, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		robot.Stop()
+		close(stopped)
+	}()
+	if timeout == 0 {
+		<-stopped
+		return
+	}
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		log.Printf("Sessions did not close within %s. Exiting anyway.", timeout)
+		os.Exit(1)
+	}
+}
+
+// checkExtraBotTokens makes sure that every additional workspace has its own, non-empty token
+func checkExtraBotTokens(token string, extraBotTokens []string) error {
+	seen := map[string]bool{token: true}
+	for _, extraToken := range extraBotTokens {
+		if extraToken == "" {
+			return errors.New("extra bot tokens must not be empty, check --extra-bot-tokens or REPLBOT_EXTRA_BOT_TOKENS")
+		} else if seen[extraToken] {
+			return errors.New("extra bot tokens must be unique and differ from the bot token, check --extra-bot-tokens or REPLBOT_EXTRA_BOT_TOKENS")
+		}
+		seen[extraToken] = true
+	}
+	return nil
+}
+
+// shareHostPortInRange returns true if the port of the share host (host:port) is within the share port range, in
+// which case relay ports could collide with the SSH server itself
+func shareHostPortInRange(shareHost string, min, max int) bool {
+	_, p, err := net.SplitHostPort(shareHost)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(p)
+	return err == nil && port >= min && port <= max
+}
+
 func parseCursorRate(cursor string) (time.Duration, error) {
 	switch cursor {
 	case "on":
@@ -189,6 +597,145 @@ func parseCursorRate(cursor string) (time.Duration, error) {
 	}
 }
 
+func parseScriptAliases(aliases []string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, alias := range aliases {
+		parts := strings.SplitN(alias, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(alias, " \t\n") {
+			return nil, fmt.Errorf("invalid script alias %s, must be alias=script, e.g. py=python", alias)
+		} else if _, ok := mapping[parts[0]]; ok {
+			return nil, fmt.Errorf("invalid script alias %s, alias %s is defined more than once", alias, parts[0])
+		}
+		mapping[parts[0]] = parts[1]
+	}
+	return mapping, nil
+}
+
+func parseReactions(reactions []string) (map[string]string, error) {
+	if len(reactions) == 0 {
+		return config.DefaultReactions, nil
+	}
+	mapping := make(map[string]string)
+	for _, reaction := range reactions {
+		parts := strings.SplitN(reaction, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid reaction %s, must be emoji=command, e.g. raised_hand=!c", reaction)
+		}
+		mapping[parts[0]] = parts[1]
+	}
+	return mapping, nil
+}
+
+func parseButtons(buttons []string) ([]*config.Button, error) {
+	if len(buttons) == 0 {
+		return config.DefaultButtons, nil
+	} else if len(buttons) == 1 && buttons[0] == "none" {
+		return []*config.Button{}, nil
+	} else if len(buttons) > config.MaxButtons {
+		return nil, fmt.Errorf("too many buttons, at most %d are allowed", config.MaxButtons)
+	}
+	parsed := make([]*config.Button, 0)
+	commands := make(map[string]bool)
+	for _, button := range buttons {
+		parts := strings.SplitN(button, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid button %s, must be label=command, e.g. Ctrl-C=!c", button)
+		} else if commands[parts[1]] {
+			return nil, fmt.Errorf("invalid button %s, command %s is used by more than one button", button, parts[1])
+		}
+		commands[parts[1]] = true
+		parsed = append(parsed, &config.Button{Label: parts[0], Command: parts[1]})
+	}
+	return parsed, nil
+}
+
+// parseKillSignals parses signal names like TERM or SIGKILL, see config.KillSignals
+func parseKillSignals(signals []string) ([]string, error) {
+	if len(signals) == 0 {
+		return config.DefaultKillSignals, nil
+	} else if len(signals) == 1 && signals[0] == "none" {
+		return []string{}, nil
+	}
+	parsed := make([]string, 0)
+	for _, signal := range signals {
+		name := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(signal)), "SIG")
+		if _, ok := config.KillSignals[name]; !ok {
+			return nil, fmt.Errorf("invalid kill signal %s, must be one of HUP, INT, QUIT, TERM or KILL, check --kill-signals or REPLBOT_KILL_SIGNALS", signal)
+		}
+		parsed = append(parsed, name)
+	}
+	return parsed, nil
+}
+
+func parseScriptSources(sources []string) ([]*config.ScriptSource, error) {
+	scriptSources := make([]*config.ScriptSource, 0)
+	for _, s := range sources {
+		source, err := config.ParseScriptSource(s)
+		if err != nil {
+			return nil, err
+		}
+		scriptSources = append(scriptSources, source)
+	}
+	return scriptSources, nil
+}
+
+// parseOutputFilters parses sed-like rules of the form /regex/replacement/. Any character can be used as the
+// delimiter instead of "/", e.g. |https?://[a-z]+\.internal|<internal>|, but it must not appear in regex or replacement.
+func parseOutputFilters(filters []string) ([]*config.OutputFilter, error) {
+	outputFilters := make([]*config.OutputFilter, 0)
+	for _, filter := range filters {
+		if len(filter) < 2 {
+			return nil, fmt.Errorf("invalid output filter %s, must be /regex/replacement/", filter)
+		}
+		parts := strings.Split(filter[1:], filter[:1])
+		if len(parts) != 3 || parts[0] == "" || parts[2] != "" {
+			return nil, fmt.Errorf("invalid output filter %s, must be /regex/replacement/", filter)
+		}
+		regex, err := regexp.Compile(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid output filter %s: %s", filter, err.Error())
+		}
+		outputFilters = append(outputFilters, &config.OutputFilter{Regex: regex, Replacement: parts[1]})
+	}
+	return outputFilters, nil
+}
+
+func parseDangerousCommands(patterns []string) ([]*regexp.Regexp, error) {
+	dangerousCommands := make([]*regexp.Regexp, 0)
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dangerous command pattern %s: %s", pattern, err.Error())
+		}
+		dangerousCommands = append(dangerousCommands, regex)
+	}
+	return dangerousCommands, nil
+}
+
+func parseColorMap(colorMap []string) (map[int]int, error) {
+	mapping := make(map[int]int)
+	for _, entry := range colorMap {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid color map entry %s, must be code=code or code=none, e.g. 9=4", entry)
+		}
+		from, err := strconv.Atoi(parts[0])
+		if err != nil || from < 0 {
+			return nil, fmt.Errorf("invalid color map entry %s, must be code=code or code=none, e.g. 9=4", entry)
+		}
+		if parts[1] == "none" {
+			mapping[from] = config.ColorMapRemove
+			continue
+		}
+		to, err := strconv.Atoi(parts[1])
+		if err != nil || to < 0 {
+			return nil, fmt.Errorf("invalid color map entry %s, must be code=code or code=none, e.g. 9=4", entry)
+		}
+		mapping[from] = to
+	}
+	return mapping, nil
+}
+
 // initConfigFileInputSource is like altsrc.InitInputSourceWithContext and altsrc.NewYamlSourceFromFlagFunc, but checks
 // if the config flag is exists and only loads it if it does. If the flag is set and the file exists, it fails.
 func initConfigFileInputSource(configFlag string, flags []cli.Flag) cli.BeforeFunc {
@@ -2,9 +2,14 @@
 package config
 
 import (
+	"fmt"
+	"heckel.io/replbot/util"
 	"os"
-	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -12,6 +17,59 @@ const (
 	// DefaultIdleTimeout defines the default time after which a session is terminated
 	DefaultIdleTimeout = 10 * time.Minute
 
+	// DefaultIdleWarning defines how long before the idle timeout the user is warned that the session will be closed
+	DefaultIdleWarning = time.Minute
+
+	// DefaultNamedIdleTimeout defines the default time after which a named session is terminated, see IdleTimeout
+	DefaultNamedIdleTimeout = 24 * time.Hour
+
+	// DefaultMaxSessionWarning defines how long before the max session duration the user is warned that the session will be closed
+	DefaultMaxSessionWarning = 5 * time.Minute
+
+	// DefaultSendRetries is the default number of times sending a message is retried if the chat platform fails temporarily
+	DefaultSendRetries = 3
+
+	// DefaultSendRetryBackoff is the default time to wait before the first retry; it is doubled for each retry
+	DefaultSendRetryBackoff = 500 * time.Millisecond
+
+	// DefaultReconnectRetries is the default number of times REPLbot tries to reconnect in a row if the connection to
+	// the chat platform fails or drops, before giving up
+	DefaultReconnectRetries = 10
+
+	// DefaultReconnectBackoff is the default time to wait before the first reconnect; it is doubled for each attempt
+	DefaultReconnectBackoff = time.Second
+
+	// DefaultReadyTimeout is the default max time to wait for a script's readiness probe before accepting input anyway
+	DefaultReadyTimeout = 30 * time.Second
+
+	// DefaultKillGracePeriod is the default time to wait for the processes of a session to exit after the terminal was
+	// stopped, and after each of the KillSignals
+	DefaultKillGracePeriod = 2 * time.Second
+
+	// DefaultCompleteTimeout is the default time to wait for a REPL to show completions, see "!complete"
+	DefaultCompleteTimeout = time.Second
+
+	// DefaultShareMaxConns is the default number of connections the share server accepts concurrently
+	DefaultShareMaxConns = 100
+
+	// DefaultShareMaxSessionConns is the default number of connections per terminal sharing session, which allows
+	// a client to reconnect the tunnel (ssh -R) while the old connection is still open
+	DefaultShareMaxSessionConns = 3
+
+	// DefaultShareHandshakeTimeout is the default time after which share connections are closed if the SSH
+	// handshake is not done
+	DefaultShareHandshakeTimeout = 10 * time.Second
+
+	// DefaultImageRefreshInterval is the default interval at which the terminal is uploaded as an image, if it changed
+	DefaultImageRefreshInterval = 5 * time.Second
+
+	// DefaultAdminAddr is the default listen address of the admin API, which is only enabled if an admin token is set.
+	// It is bound to localhost, so that sessions cannot be listed or closed from the outside by default.
+	DefaultAdminAddr = "127.0.0.1:8081"
+
+	// DefaultShutdownTimeout is the default time to wait for sessions to close gracefully when REPLbot is stopped
+	DefaultShutdownTimeout = 30 * time.Second
+
 	// DefaultMaxTotalSessions is the default number of sessions all users are allowed to run concurrently
 	DefaultMaxTotalSessions = 6
 
@@ -27,60 +85,290 @@ const (
 	// DefaultWeb defines if sessions have a web terminal by default
 	DefaultWeb = false
 
+	// DefaultQuiet defines if sessions leave out the start and exit messages by default
+	DefaultQuiet = false
+
+	// DefaultCommandPrefix is the default prefix for session commands, e.g. "!help"
+	DefaultCommandPrefix = "!"
+
+	// DefaultCommentPrefix is the default prefix for comments, i.e. messages that are not sent to the REPL
+	DefaultCommentPrefix = DefaultCommandPrefix + "!"
+
+	// DefaultTeamsAddr is the default listen address for incoming Microsoft Teams activities
+	DefaultTeamsAddr = ":3978"
+
+	// DefaultWhatsAppAddr is the default listen address for incoming WhatsApp webhooks
+	DefaultWhatsAppAddr = ":3979"
+
+	// ColorMapRemove is a special value in ColorMap, removing the SGR parameter entirely
+	ColorMapRemove = -1
+
+	// DefaultShmDir is the default directory for short-lived temporary files that benefit from a tmpfs, e.g. the
+	// paste buffer of the terminal. If it does not exist, TempDir is used instead.
+	DefaultShmDir = "/dev/shm"
+
+	// CommentPrefixOff is a special value for the comment prefix option, disabling comments entirely
+	CommentPrefixOff = "off"
+
+	// WorkDirTemp is a special value for WorkDir, creating a fresh temporary working directory for each session
+	WorkDirTemp = "temp"
+
 	// defaultRefreshInterval defines the interval at which the terminal refreshed
 	defaultRefreshInterval = 200 * time.Millisecond
 )
 
+// DefaultReactions maps emoji reactions to session commands, allowing users to send common keys by reacting
+// to the terminal message. Slack, Zulip, Teams and Rocket.Chat report emoji names, Discord, Matrix and WhatsApp report the emoji itself.
+var DefaultReactions = map[string]string{
+	"✋":                         "!c",
+	"raised_hand":               "!c",
+	"↩️":                        "!r",
+	"leftwards_arrow_with_hook": "!r",
+	"⬆️":                        "!up",
+	"arrow_up":                  "!up",
+	"⬇️":                        "!down",
+	"arrow_down":                "!down",
+}
+
+// Button is a control button shown below a session on platforms that support interactive buttons (Discord)
+type Button struct {
+	Label   string
+	Command string // Session command sent when the button is clicked, e.g. "!c"
+}
+
+// MaxButtons is the max number of control buttons, since Discord allows at most 5 rows of 5 buttons per message
+const MaxButtons = 25
+
+// DefaultButtons are the control buttons shown below a session, allowing users to click instead of typing commands
+var DefaultButtons = []*Button{
+	{Label: "Ctrl-C", Command: "!c"},
+	{Label: "Enter", Command: "!r"},
+	{Label: "Help", Command: "!help"},
+	{Label: "Exit", Command: "!exit"},
+}
+
+// KillSignals maps the names of the signals that can be used in Config.KillSignals to the signals
+var KillSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"KILL": syscall.SIGKILL,
+}
+
+// DefaultKillSignals are the signals sent to the processes of a session that are still running after the terminal
+// was stopped and the script was killed, e.g. background processes that ignore SIGHUP
+var DefaultKillSignals = []string{"TERM", "KILL"}
+
 // Config is the main config struct for the application. Use New to instantiate a default config struct.
 type Config struct {
-	Token              string
-	ScriptDir          string
-	IdleTimeout        time.Duration
-	MaxTotalSessions   int
-	MaxUserSessions    int
-	DefaultControlMode ControlMode
-	DefaultWindowMode  WindowMode
-	DefaultAuthMode    AuthMode
-	DefaultSize        *Size
-	DefaultWeb         bool
-	WebHost            string
-	ShareHost          string
-	ShareKeyFile       string
-	DefaultRecord      bool
-	UploadRecording    bool
-	Cursor             time.Duration
-	RefreshInterval    time.Duration
-	Debug              bool
+	Token                 string
+	ExtraBotTokens        []string // Slack or Discord bot tokens of additional workspaces, see Workspaces
+	ZulipSite             string
+	ZulipEmail            string
+	TeamsAppID            string
+	TeamsTenantID         string
+	TeamsAddr             string
+	RocketChatSite        string
+	RocketChatUserID      string
+	MatrixHomeserver      string
+	WhatsAppPhoneID       string
+	WhatsAppAppSecret     string
+	WhatsAppVerifyToken   string
+	WhatsAppAddr          string
+	WebhookAddr           string
+	WebhookCallbackURL    string
+	ScriptDir             string
+	ScriptSources         []*ScriptSource   // remote scripts, see FetchScripts
+	ScriptCacheDir        string            // directory that remote scripts are fetched to
+	ScriptAliases         map[string]string // alias -> script name, see ResolveScript
+	store                 *scriptStore      // shared by all Workspaces, so that ReloadScripts affects all of them
+	WorkDir               string
+	AllowedWorkDirs       []string
+	TempDir               string
+	ShmDir                string
+	IdleTimeout           time.Duration
+	IdleWarning           time.Duration
+	NamedIdleTimeout      time.Duration // idle timeout of named sessions, which users can detach from and attach to
+	MaxSessionDuration    time.Duration // 0 means no limit
+	MaxSessionWarning     time.Duration
+	MaxOutputBytes        int // Per command, 0 means no limit, see session.maybeLimitOutput
+	MaxOutputMessages     int // Per command, 0 means no limit
+	ReadyTimeout          time.Duration
+	CompleteTimeout       time.Duration
+	KillGracePeriod       time.Duration
+	KillSignals           []string // names of the signals, see KillSignals; empty means processes are not signaled
+	MaxTotalSessions      int
+	MaxUserSessions       int
+	AdminUsers            []string
+	PrefsFile             string
+	DefaultControlMode    ControlMode
+	DefaultWindowMode     WindowMode
+	DefaultColorMode      ColorMode
+	DefaultAuthMode       AuthMode
+	BinaryMode            BinaryMode
+	ColorMap              map[int]int
+	DefaultSize           *Size
+	MaxMessageLength      int
+	DiscordEmbeds         bool // if true, session lifecycle messages are shown as embeds on Discord
+	DefaultWeb            bool
+	DefaultQuiet          bool
+	WebHost               string
+	ShareHost             string
+	ShareKeyFile          string
+	SharePortMin          int // if set, relay ports for terminal sharing are picked between SharePortMin and SharePortMax
+	SharePortMax          int
+	ShareMaxConns         int
+	ShareMaxSessionConns  int
+	ShareHandshakeTimeout time.Duration
+	HealthAddr            string
+	AdminAddr             string // listen address of the admin API, see AdminToken
+	AdminToken            string // if set, the admin API is enabled, and requests must carry it as a bearer token
+	SendRetries           int
+	SendRetryBackoff      time.Duration
+	ReconnectRetries      int
+	ReconnectBackoff      time.Duration
+	ShutdownTimeout       time.Duration // 0 means wait forever
+	CommandPrefix         string
+	CommentPrefix         string // empty means comments are sent to the REPL like any other input
+	StripInlineComments   bool
+	Reactions             map[string]string
+	AckReactions          bool // if true, messages sent to a session are acknowledged with a reaction, see Bot.maybeForwardMessage
+	Buttons               []*Button
+	WelcomeTemplate       string
+	HelpTemplate          string
+	DefaultRecord         bool
+	UploadRecording       bool
+	Cursor                time.Duration
+	RefreshInterval       time.Duration
+	ImageRefreshInterval  time.Duration // interval at which the terminal is uploaded with "render:image"
+	TerminalBackend       TerminalBackend
+	Shell                 string // shell that runs the scripts (e.g. bash); if empty, scripts are run via their shebang line
+	LocalAttach           bool   // if true, "!info" shows how to attach to the session's terminal on the REPLbot host
+	LogFormat             LogFormat
+	SessionLogDir         string
+	SessionLogRedact      *regexp.Regexp
+	OutputFilters         []*OutputFilter  // applied in order to the terminal output, after stripping control sequences
+	DangerousCommands     []*regexp.Regexp // user input matching any of these is only sent via "!force"
+	FilterRecordings      bool             // if true, OutputFilters are applied to session recordings as well
+	ReadOnlyMode          bool             // if true, nobody can send input to any session, e.g. for demos
+	Debug                 bool
 }
 
 // New instantiates a default new config
 func New(token string) *Config {
 	return &Config{
-		Token:              token,
-		IdleTimeout:        DefaultIdleTimeout,
-		MaxTotalSessions:   DefaultMaxTotalSessions,
-		MaxUserSessions:    DefaultMaxUserSessions,
-		DefaultControlMode: DefaultControlMode,
-		DefaultWindowMode:  DefaultWindowMode,
-		DefaultAuthMode:    DefaultAuthMode,
-		DefaultSize:        DefaultSize,
-		DefaultRecord:      DefaultRecord,
-		DefaultWeb:         DefaultWeb,
-		UploadRecording:    DefaultUploadRecording,
-		RefreshInterval:    defaultRefreshInterval,
-	}
-}
-
-// Platform returns the target connection type, based on the token
+		Token:                 token,
+		store:                 &scriptStore{},
+		ScriptAliases:         make(map[string]string),
+		TeamsAddr:             DefaultTeamsAddr,
+		WhatsAppAddr:          DefaultWhatsAppAddr,
+		TempDir:               os.TempDir(),
+		ShmDir:                defaultShmDir(),
+		IdleTimeout:           DefaultIdleTimeout,
+		IdleWarning:           DefaultIdleWarning,
+		NamedIdleTimeout:      DefaultNamedIdleTimeout,
+		MaxSessionWarning:     DefaultMaxSessionWarning,
+		ReadyTimeout:          DefaultReadyTimeout,
+		CompleteTimeout:       DefaultCompleteTimeout,
+		KillGracePeriod:       DefaultKillGracePeriod,
+		KillSignals:           DefaultKillSignals,
+		MaxTotalSessions:      DefaultMaxTotalSessions,
+		MaxUserSessions:       DefaultMaxUserSessions,
+		ShareMaxConns:         DefaultShareMaxConns,
+		ShareMaxSessionConns:  DefaultShareMaxSessionConns,
+		ShareHandshakeTimeout: DefaultShareHandshakeTimeout,
+		DefaultControlMode:    DefaultControlMode,
+		DefaultWindowMode:     DefaultWindowMode,
+		DefaultColorMode:      DefaultColorMode,
+		DefaultAuthMode:       DefaultAuthMode,
+		BinaryMode:            DefaultBinaryMode,
+		DefaultSize:           DefaultSize,
+		DefaultRecord:         DefaultRecord,
+		DefaultWeb:            DefaultWeb,
+		DefaultQuiet:          DefaultQuiet,
+		UploadRecording:       DefaultUploadRecording,
+		CommandPrefix:         DefaultCommandPrefix,
+		CommentPrefix:         DefaultCommentPrefix,
+		Reactions:             DefaultReactions,
+		Buttons:               DefaultButtons,
+		RefreshInterval:       defaultRefreshInterval,
+		ImageRefreshInterval:  DefaultImageRefreshInterval,
+		TerminalBackend:       DefaultTerminalBackend,
+		SendRetries:           DefaultSendRetries,
+		SendRetryBackoff:      DefaultSendRetryBackoff,
+		ReconnectRetries:      DefaultReconnectRetries,
+		ReconnectBackoff:      DefaultReconnectBackoff,
+		ShutdownTimeout:       DefaultShutdownTimeout,
+		AdminAddr:             DefaultAdminAddr,
+		LogFormat:             DefaultLogFormat,
+	}
+}
+
+// defaultShmDir returns DefaultShmDir if it exists, and the OS temp dir otherwise (e.g. in some containers)
+func defaultShmDir() string {
+	if util.FileExists(DefaultShmDir) {
+		return DefaultShmDir
+	}
+	return os.TempDir()
+}
+
+// scriptStore holds the scripts, so that they can be reloaded at runtime, see Config.ReloadScripts
+type scriptStore struct {
+	scripts   map[string]string // name -> path, nil until read for the first time
+	checksums map[string]string // name -> SHA-256 checksum of the script, to detect changes
+	mu        sync.RWMutex
+}
+
+// ScriptChanges lists the names of the scripts that were added, removed or changed, see Config.ReloadScripts
+type ScriptChanges struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// Platform returns the target connection type, based on the token and the platform-specific options
 func (c *Config) Platform() Platform {
 	if strings.HasPrefix(c.Token, "mem") {
 		return Mem
 	} else if strings.HasPrefix(c.Token, "xoxb-") {
 		return Slack
+	} else if c.ZulipSite != "" {
+		return Zulip
+	} else if c.TeamsAppID != "" {
+		return Teams
+	} else if c.RocketChatSite != "" {
+		return RocketChat
+	} else if c.MatrixHomeserver != "" {
+		return Matrix
+	} else if c.WhatsAppPhoneID != "" {
+		return WhatsApp
+	} else if c.WebhookAddr != "" {
+		return Webhook
 	}
 	return Discord
 }
 
+// Workspaces returns one config per workspace the bot connects to: the config itself, followed by a copy for each
+// of the ExtraBotTokens. The copies share all options (scripts, limits, ...), except for the token. Since the
+// platform-specific options only apply to the first workspace, additional workspaces must be on Slack or Discord.
+func (c *Config) Workspaces() []*Config {
+	workspaces := []*Config{c}
+	for _, token := range c.ExtraBotTokens {
+		workspace := *c
+		workspace.Token = token
+		workspace.ExtraBotTokens = nil
+		workspace.ZulipSite, workspace.ZulipEmail = "", ""
+		workspace.TeamsAppID, workspace.TeamsTenantID = "", ""
+		workspace.RocketChatSite, workspace.RocketChatUserID = "", ""
+		workspace.MatrixHomeserver = ""
+		workspace.WhatsAppPhoneID, workspace.WhatsAppAppSecret, workspace.WhatsAppVerifyToken = "", "", ""
+		workspace.WebhookAddr, workspace.WebhookCallbackURL = "", ""
+		workspaces = append(workspaces, &workspace)
+	}
+	return workspaces
+}
+
 // ShareEnabled returns true if the share features is enabled
 func (c *Config) ShareEnabled() bool {
 	return c.ShareHost != ""
@@ -95,6 +383,32 @@ func (c *Config) Scripts() []string {
 	return scripts
 }
 
+// ScriptCategories returns the names of all available scripts, grouped by category (see ScriptConfig.Category)
+// and sorted by name. Scripts without a category are grouped under the empty category.
+func (c *Config) ScriptCategories() map[string][]string {
+	categories := make(map[string][]string)
+	for name, path := range c.scripts() {
+		category := readScriptConfig(name, path).Category
+		categories[category] = append(categories[category], name)
+	}
+	for _, scripts := range categories {
+		sort.Strings(scripts)
+	}
+	return categories
+}
+
+// ScriptConfigs returns all available scripts, including their session defaults and descriptions, sorted by name
+func (c *Config) ScriptConfigs() []*ScriptConfig {
+	scripts := make([]*ScriptConfig, 0)
+	for name, path := range c.scripts() {
+		scripts = append(scripts, readScriptConfig(name, path))
+	}
+	sort.Slice(scripts, func(i, j int) bool {
+		return scripts[i].Name < scripts[j].Name
+	})
+	return scripts
+}
+
 // Script returns the path to the script with the given name.
 // If a script with the given name does not exist, the result may be empty.
 func (c *Config) Script(name string) string {
@@ -102,16 +416,108 @@ func (c *Config) Script(name string) string {
 	return scripts[name]
 }
 
+// ResolveScript returns the name of the script that the given name refers to, i.e. the script the alias points to
+// if name is one of the ScriptAliases. Scripts take precedence over aliases of the same name.
+func (c *Config) ResolveScript(name string) string {
+	if c.Script(name) != "" {
+		return name
+	} else if script, ok := c.ScriptAliases[name]; ok {
+		return script
+	}
+	return name
+}
+
+// ScriptConfig returns the script with the given name, including its session defaults.
+// If a script with the given name does not exist, the result is nil.
+func (c *Config) ScriptConfig(name string) *ScriptConfig {
+	path := c.Script(name)
+	if path == "" {
+		return nil
+	}
+	return readScriptConfig(name, path)
+}
+
+// CheckScripts checks that all scripts can be run, i.e. that they are executable and that the interpreter in their
+// shebang line exists. It returns one error per broken script, sorted by script name.
+func (c *Config) CheckScripts() []error {
+	errs := make([]error, 0)
+	for _, script := range c.ScriptConfigs() {
+		if err := checkScript(script); err != nil {
+			errs = append(errs, fmt.Errorf("script %s is broken: %s", script.Name, err.Error()))
+		}
+	}
+	return errs
+}
+
+// AllowedWorkDir checks if the given directory is an existing directory within one of the allowed
+// working directories (see AllowedWorkDirs), and returns its resolved absolute path.
+func (c *Config) AllowedWorkDir(dir string) (string, error) {
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	for _, allowed := range c.AllowedWorkDirs {
+		if resolved, err := util.ResolvePathWithin(allowed, dir); err == nil {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not an allowed working directory", dir)
+}
+
+// ReloadScripts re-reads the scripts from the ScriptDir and the fetched ScriptSources (see FetchScripts), and returns
+// which scripts were added, removed or changed. Sessions that are already running are not affected.
+func (c *Config) ReloadScripts() *ScriptChanges {
+	scripts := c.readScripts()
+	checksums := scriptChecksums(scripts)
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	changes := &ScriptChanges{Added: make([]string, 0), Removed: make([]string, 0), Changed: make([]string, 0)}
+	for name, checksum := range checksums {
+		if previous, ok := c.store.checksums[name]; !ok {
+			changes.Added = append(changes.Added, name)
+		} else if previous != checksum {
+			changes.Changed = append(changes.Changed, name)
+		}
+	}
+	for name := range c.store.checksums {
+		if _, ok := checksums[name]; !ok {
+			changes.Removed = append(changes.Removed, name)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Changed)
+	c.store.scripts, c.store.checksums = scripts, checksums
+	return changes
+}
+
+// scripts returns the scripts (name -> path), which are read on first use and then kept until ReloadScripts is
+// called. The returned map must not be modified.
 func (c *Config) scripts() map[string]string {
-	scripts := make(map[string]string)
-	entries, err := os.ReadDir(c.ScriptDir)
-	if err != nil {
+	c.store.mu.RLock()
+	scripts := c.store.scripts
+	c.store.mu.RUnlock()
+	if scripts != nil {
 		return scripts
 	}
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			scripts[entry.Name()] = filepath.Join(c.ScriptDir, entry.Name())
+	c.ReloadScripts()
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	return c.store.scripts
+}
+
+// readScripts reads the scripts of the ScriptSources (if fetched, see FetchScripts) and the ScriptDir. Scripts in
+// the ScriptDir take precedence over remote scripts of the same name.
+func (c *Config) readScripts() map[string]string {
+	scripts := make(map[string]string)
+	if c.ScriptCacheDir != "" {
+		for _, source := range c.ScriptSources {
+			for name, path := range readScriptDir(c.scriptSourceDir(source), true) {
+				scripts[name] = path
+			}
 		}
 	}
+	for name, path := range readScriptDir(c.ScriptDir, false) {
+		scripts[name] = path
+	}
 	return scripts
 }
@@ -0,0 +1,298 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	scriptFetchTimeout   = 2 * time.Minute
+	scriptMaxSize        = 1024 * 1024
+	scriptGitPrefix      = "git+"
+	scriptChecksumPrefix = "sha256:"
+)
+
+var (
+	scriptChecksumRegex   = regexp.MustCompile(`^[a-f0-9]{64}$`)
+	scriptGitCommitRegex  = regexp.MustCompile(`^[a-f0-9]{40}$`)
+	scriptNameRegex       = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+	scriptCacheEntryRegex = regexp.MustCompile(`^(\.fetch-\d+|[a-f0-9]{16}\.\d{20})$`) // See fetchScriptSource
+	errNoScripts          = errors.New("no executable scripts found")
+)
+
+// ScriptSource is a remote source of REPL scripts, either a single script fetched via HTTP(S), or a Git repository
+// with scripts at its top level. Remote scripts are fetched into the ScriptCacheDir, see Config.FetchScripts.
+type ScriptSource struct {
+	URL      string // URL of the script, or of the Git repository if Git is true
+	Git      bool
+	Ref      string // Git branch, tag or commit to check out; the default branch if empty
+	Checksum string // Hex-encoded SHA-256 checksum of the script (not for Git repositories), verified if set
+}
+
+// ParseScriptSource parses a script source of the form "<url> [sha256:<checksum>]" for a single script, or
+// "git+<url>[#<ref>]" for a Git repository. Git sources may be pinned to a commit instead of a checksum.
+func ParseScriptSource(s string) (*ScriptSource, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid script source %s, must be <url> [sha256:<checksum>] or git+<url>[#<ref>]", s)
+	}
+	source := &ScriptSource{URL: fields[0]}
+	if strings.HasPrefix(source.URL, scriptGitPrefix) {
+		source.Git = true
+		source.URL = strings.TrimPrefix(source.URL, scriptGitPrefix)
+		if i := strings.LastIndex(source.URL, "#"); i != -1 {
+			source.URL, source.Ref = source.URL[:i], source.URL[i+1:]
+		}
+	}
+	if !source.Git {
+		u, err := url.Parse(source.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid script source %s, must be an http:// or https:// URL", s)
+		} else if !scriptNameRegex.MatchString(path.Base(u.Path)) {
+			return nil, fmt.Errorf("invalid script source %s, URL must end with the script name", s)
+		}
+	} else if source.URL == "" {
+		return nil, fmt.Errorf("invalid script source %s, Git repository URL missing", s)
+	}
+	if len(fields) == 2 {
+		if source.Git {
+			return nil, fmt.Errorf("invalid script source %s, checksums are not supported for Git repositories, pin a commit instead", s)
+		}
+		source.Checksum = strings.ToLower(strings.TrimPrefix(fields[1], scriptChecksumPrefix))
+		if !strings.HasPrefix(fields[1], scriptChecksumPrefix) || !scriptChecksumRegex.MatchString(source.Checksum) {
+			return nil, fmt.Errorf("invalid script source %s, checksum must be sha256:<64 hex characters>", s)
+		}
+	}
+	return source, nil
+}
+
+// String returns the script source in the format understood by ParseScriptSource
+func (s *ScriptSource) String() string {
+	if s.Git && s.Ref != "" {
+		return fmt.Sprintf("%s%s#%s", scriptGitPrefix, s.URL, s.Ref)
+	} else if s.Git {
+		return scriptGitPrefix + s.URL
+	} else if s.Checksum != "" {
+		return fmt.Sprintf("%s %s%s", s.URL, scriptChecksumPrefix, s.Checksum)
+	}
+	return s.URL
+}
+
+// FetchScripts fetches the scripts of all ScriptSources into the ScriptCacheDir, so that they are returned by Scripts
+// and Script. Each source is fetched into a temporary directory first, and only replaces the previously fetched
+// scripts if fetching and verification succeeded. If a source fails, its last-good scripts are kept. The errors of
+// all failed sources are returned.
+func (c *Config) FetchScripts() []error {
+	errs := make([]error, 0)
+	for _, source := range c.ScriptSources {
+		if err := c.fetchScriptSource(source); err != nil {
+			errs = append(errs, fmt.Errorf("cannot fetch scripts from %s: %s", source.URL, err.Error()))
+		}
+	}
+	return errs
+}
+
+func (c *Config) fetchScriptSource(source *ScriptSource) error {
+	if err := os.MkdirAll(c.ScriptCacheDir, 0700); err != nil {
+		return err
+	}
+	tempDir, err := os.MkdirTemp(c.ScriptCacheDir, ".fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	ctx, cancel := context.WithTimeout(context.Background(), scriptFetchTimeout)
+	defer cancel()
+	if source.Git {
+		err = fetchGitScripts(ctx, source, tempDir)
+	} else {
+		err = fetchURLScript(ctx, source, tempDir)
+	}
+	if err != nil {
+		return err
+	} else if len(readScriptDir(tempDir, true)) == 0 {
+		return errNoScripts
+	}
+	current := c.scriptSourceDir(source)
+	if current != "" && scriptDirsEqual(current, tempDir) {
+		return nil // Unchanged, keep using the current directory
+	}
+	return os.Rename(tempDir, filepath.Join(c.ScriptCacheDir, fmt.Sprintf("%s.%020d", scriptSourceID(source), time.Now().UnixNano())))
+}
+
+// PruneScriptCache removes all but the most recently fetched scripts of each source from the ScriptCacheDir, as
+// well as the scripts of sources that are no longer configured. It must only be called if no sessions are running,
+// since sessions may still use older scripts, see scriptSourceDir.
+func (c *Config) PruneScriptCache() {
+	current := make(map[string]bool)
+	for _, source := range c.ScriptSources {
+		current[c.scriptSourceDir(source)] = true
+	}
+	entries, err := os.ReadDir(c.ScriptCacheDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(c.ScriptCacheDir, entry.Name())
+		if entry.IsDir() && !current[dir] && scriptCacheEntryRegex.MatchString(entry.Name()) {
+			_ = os.RemoveAll(dir)
+		}
+	}
+}
+
+// fetchURLScript downloads a single script, verifies its checksum (if set), and makes it executable
+func fetchURLScript(ctx context.Context, source *ScriptSource, dir string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	script, err := io.ReadAll(io.LimitReader(resp.Body, scriptMaxSize+1))
+	if err != nil {
+		return err
+	} else if len(script) > scriptMaxSize {
+		return fmt.Errorf("script is larger than %d bytes", scriptMaxSize)
+	} else if !bytes.HasPrefix(script, []byte("#!")) {
+		return errors.New("script is not executable, it must start with #!")
+	}
+	if source.Checksum != "" {
+		checksum := sha256.Sum256(script)
+		if actual := hex.EncodeToString(checksum[:]); actual != source.Checksum {
+			return fmt.Errorf("checksum mismatch, expected %s, got %s", source.Checksum, actual)
+		}
+	}
+	u, err := url.Parse(source.URL)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, path.Base(u.Path)), script, 0700)
+}
+
+// fetchGitScripts clones the Git repository and checks out the ref. If the ref is a commit, the checked out
+// commit is verified, which pins the scripts just like a checksum.
+func fetchGitScripts(ctx context.Context, source *ScriptSource, dir string) error {
+	pinned := scriptGitCommitRegex.MatchString(source.Ref)
+	args := []string{"clone", "--quiet"}
+	if !pinned {
+		args = append(args, "--depth", "1")
+		if source.Ref != "" {
+			args = append(args, "--branch", source.Ref)
+		}
+	}
+	if _, err := runGit(ctx, "", append(args, "--", source.URL, dir)...); err != nil {
+		return err
+	} else if !pinned {
+		return nil
+	}
+	if _, err := runGit(ctx, dir, "checkout", "--quiet", source.Ref); err != nil {
+		return err
+	}
+	head, err := runGit(ctx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	} else if head != source.Ref {
+		return fmt.Errorf("checked out commit %s, expected %s", head, source.Ref)
+	}
+	return nil
+}
+
+// runGit runs git in the given directory (if not empty), and returns its trimmed output
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0") // Fail instead of asking for credentials
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %s", args[0], strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// scriptSourceDir returns the directory in the ScriptCacheDir with the most recently fetched scripts of the given
+// source, or an empty string if it was never fetched. Every fetch that changes the scripts creates a new directory,
+// so that running sessions keep their scripts (e.g. to kill the REPL) until PruneScriptCache is called.
+func (c *Config) scriptSourceDir(source *ScriptSource) string {
+	dirs, err := filepath.Glob(filepath.Join(c.ScriptCacheDir, scriptSourceID(source)+".*"))
+	if err != nil || len(dirs) == 0 {
+		return ""
+	}
+	sort.Strings(dirs) // Names end with a zero-padded timestamp, see fetchScriptSource
+	return dirs[len(dirs)-1]
+}
+
+func scriptSourceID(source *ScriptSource) string {
+	checksum := sha256.Sum256([]byte(source.String()))
+	return hex.EncodeToString(checksum[:8])
+}
+
+// scriptDirsEqual returns true if both directories contain the same executable scripts
+func scriptDirsEqual(dir1, dir2 string) bool {
+	checksums1, checksums2 := scriptChecksums(readScriptDir(dir1, true)), scriptChecksums(readScriptDir(dir2, true))
+	if len(checksums1) != len(checksums2) {
+		return false
+	}
+	for name, checksum := range checksums1 {
+		if checksums2[name] != checksum {
+			return false
+		}
+	}
+	return true
+}
+
+// scriptChecksums returns the SHA-256 checksums of the given scripts (name -> path). Scripts that cannot be read
+// have an empty checksum.
+func scriptChecksums(scripts map[string]string) map[string]string {
+	checksums := make(map[string]string)
+	for name, path := range scripts {
+		if b, err := os.ReadFile(path); err == nil {
+			checksum := sha256.Sum256(b)
+			checksums[name] = hex.EncodeToString(checksum[:])
+		} else {
+			checksums[name] = ""
+		}
+	}
+	return checksums
+}
+
+// readScriptDir returns the scripts (name -> path) in the given directory, ignoring directories. If executableOnly
+// is true, hidden and non-executable files are ignored as well, e.g. a README in a Git repository.
+func readScriptDir(dir string, executableOnly bool) map[string]string {
+	scripts := make(map[string]string)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return scripts
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || (executableOnly && strings.HasPrefix(entry.Name(), ".")) {
+			continue
+		} else if executableOnly {
+			if info, err := entry.Info(); err != nil || info.Mode()&0111 == 0 {
+				continue
+			}
+		}
+		scripts[entry.Name()] = filepath.Join(dir, entry.Name())
+	}
+	return scripts
+}
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"heckel.io/replbot/util"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseScriptSource(t *testing.T) {
+	source, err := ParseScriptSource("https://example.com/scripts/python3 sha256:" + sha256Hex("x"))
+	require.Nil(t, err)
+	assert.False(t, source.Git)
+	assert.Equal(t, "https://example.com/scripts/python3", source.URL)
+	assert.Equal(t, sha256Hex("x"), source.Checksum)
+
+	source, err = ParseScriptSource("git+git@github.com:org/scripts.git#v1.2")
+	require.Nil(t, err)
+	assert.True(t, source.Git)
+	assert.Equal(t, "git@github.com:org/scripts.git", source.URL)
+	assert.Equal(t, "v1.2", source.Ref)
+	assert.Equal(t, "git+git@github.com:org/scripts.git#v1.2", source.String())
+
+	for _, invalid := range []string{"", "ftp://example.com/bash", "https://example.com/", "https://example.com/bash md5:abc",
+		"https://example.com/bash sha256:abc", "git+https://example.com/repo.git sha256:" + sha256Hex("x"), "git+"} {
+		_, err := ParseScriptSource(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestFetchScriptsURL(t *testing.T) {
+	script := "#!/bin/sh\n# description: Remote shell\nexec sh\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(script))
+	}))
+	defer server.Close()
+
+	conf := New("")
+	conf.ScriptDir = t.TempDir()
+	conf.ScriptCacheDir = filepath.Join(t.TempDir(), "cache")
+	source, err := ParseScriptSource(server.URL + "/remote-sh sha256:" + sha256Hex(script))
+	require.Nil(t, err)
+	conf.ScriptSources = []*ScriptSource{source}
+	assert.Empty(t, conf.FetchScripts())
+	assert.Equal(t, []string{"remote-sh"}, conf.Scripts())
+	assert.Equal(t, "Remote shell", conf.ScriptConfig("remote-sh").Description)
+
+	// Failing fetch keeps the last-good script
+	script = "#!/bin/sh\nrm -rf /\n"
+	errs := conf.FetchScripts()
+	require.Equal(t, 1, len(errs))
+	assert.Contains(t, errs[0].Error(), "checksum mismatch")
+	assert.Empty(t, conf.ReloadScripts().Changed)
+	assert.Equal(t, "Remote shell", conf.ScriptConfig("remote-sh").Description)
+
+	// Local scripts take precedence
+	require.Nil(t, os.WriteFile(filepath.Join(conf.ScriptDir, "remote-sh"), []byte("#!/bin/sh\n# description: Local shell\n"), 0700))
+	assert.Equal(t, []string{"remote-sh"}, conf.ReloadScripts().Changed)
+	assert.Equal(t, "Local shell", conf.ScriptConfig("remote-sh").Description)
+}
+
+func TestFetchScriptsGit(t *testing.T) {
+	repo := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(repo, "git-sh"), []byte("#!/bin/sh\nexec sh\n"), 0700))
+	require.Nil(t, os.WriteFile(filepath.Join(repo, "README.md"), []byte("Not a script"), 0600))
+	for _, args := range [][]string{{"init", "--quiet"}, {"add", "."}, {"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "Scripts"}} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		require.Nil(t, cmd.Run())
+	}
+	head, err := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output()
+	require.Nil(t, err)
+
+	conf := New("")
+	conf.ScriptDir = t.TempDir()
+	conf.ScriptCacheDir = t.TempDir()
+	source, err := ParseScriptSource("git+file://" + repo + "#" + string(head[:40]))
+	require.Nil(t, err)
+	conf.ScriptSources = []*ScriptSource{source}
+	assert.Empty(t, conf.FetchScripts())
+	assert.Equal(t, []string{"git-sh"}, conf.Scripts())
+}
+
+func sha256Hex(s string) string {
+	checksum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(checksum[:])
+}
+
+func TestFetchScriptsKeepsPreviousVersion(t *testing.T) {
+	script := "#!/bin/sh\necho v1\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(script))
+	}))
+	defer server.Close()
+
+	conf := New("")
+	conf.ScriptCacheDir = t.TempDir()
+	source, err := ParseScriptSource(server.URL + "/remote-sh")
+	require.Nil(t, err)
+	conf.ScriptSources = []*ScriptSource{source}
+	assert.Empty(t, conf.FetchScripts())
+	v1 := conf.Script("remote-sh")
+
+	// Unchanged scripts are not fetched into a new directory
+	assert.Empty(t, conf.FetchScripts())
+	assert.Empty(t, conf.ReloadScripts().Changed)
+	assert.Equal(t, v1, conf.Script("remote-sh"))
+
+	// Changed scripts are, and the previous version is kept until pruned
+	script = "#!/bin/sh\necho v2\n"
+	assert.Empty(t, conf.FetchScripts())
+	assert.Equal(t, []string{"remote-sh"}, conf.ReloadScripts().Changed)
+	assert.NotEqual(t, v1, conf.Script("remote-sh"))
+	assert.True(t, util.FileExists(v1))
+	conf.PruneScriptCache()
+	assert.False(t, util.FileExists(v1))
+	assert.True(t, util.FileExists(conf.Script("remote-sh")))
+}
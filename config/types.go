@@ -1,6 +1,7 @@
 package config
 
 import (
+	"regexp"
 	"time"
 )
 
@@ -9,9 +10,15 @@ type Platform string
 
 // All possible Platform constants
 const (
-	Slack   = Platform("slack")
-	Discord = Platform("discord")
-	Mem     = Platform("mem")
+	Slack      = Platform("slack")
+	Discord    = Platform("discord")
+	Zulip      = Platform("zulip")
+	Teams      = Platform("teams")
+	RocketChat = Platform("rocketchat")
+	Matrix     = Platform("matrix")
+	WhatsApp   = Platform("whatsapp")
+	Webhook    = Platform("webhook")
+	Mem        = Platform("mem")
 )
 
 // ControlMode defines where the control channel and where the terminal will be
@@ -36,6 +43,47 @@ const (
 	Trim              = WindowMode("trim")
 )
 
+// ColorMode defines whether ANSI colors are stripped from or preserved in the terminal output
+type ColorMode string
+
+// All possible ColorMode constants
+const (
+	DefaultColorMode = NoColor
+	Color            = ColorMode("color")
+	NoColor          = ColorMode("no-color")
+)
+
+// BinaryMode defines how binary (non-printable or invalid UTF-8) terminal output is handled
+type BinaryMode string
+
+// All possible BinaryMode constants
+const (
+	DefaultBinaryMode = Suppress
+	Suppress          = BinaryMode("suppress")
+	Hexdump           = BinaryMode("hexdump")
+	Upload            = BinaryMode("upload")
+)
+
+// LogFormat defines the format of the log output
+type LogFormat string
+
+// All possible LogFormat constants
+const (
+	DefaultLogFormat = TextLog
+	TextLog          = LogFormat("text")
+	JSONLog          = LogFormat("json")
+)
+
+// TerminalBackend defines the terminal multiplexer that runs the REPLs
+type TerminalBackend string
+
+// All possible TerminalBackend constants
+const (
+	DefaultTerminalBackend = Tmux
+	Tmux                   = TerminalBackend("tmux")
+	Screen                 = TerminalBackend("screen")
+)
+
 // AuthMode defines who is allowed to interact with the session by default
 type AuthMode string
 
@@ -46,6 +94,30 @@ const (
 	Everyone        = AuthMode("everyone")
 )
 
+// ScriptConfig defines a script and its session defaults. The defaults are defined in the script itself, using
+// a "# replbot-defaults:" header line, and an optional "# description:" line (see config.yml). Empty fields mean that
+// the global defaults are used.
+type ScriptConfig struct {
+	Name        string
+	Path        string
+	ControlMode ControlMode
+	WindowMode  WindowMode
+	ColorMode   ColorMode
+	AuthMode    AuthMode
+	Size        *Size
+	Image       string         // Docker image to run the script in, see config.yml
+	Prompt      *regexp.Regexp // if set, repeated bare prompts are collapsed in the terminal window, see config.yml
+	Ready       *regexp.Regexp // if set, user input is held back until the terminal matches, see config.yml
+	Category    string         // used to group scripts in the help message, see config.yml
+	Description string         // short summary of what the script does, shown by "list", see config.yml
+}
+
+// OutputFilter rewrites terminal output before it is sent to the chat, e.g. to redact secrets, see Config.OutputFilters
+type OutputFilter struct {
+	Regex       *regexp.Regexp
+	Replacement string // may refer to capture groups, e.g. "${1}"
+}
+
 // Size defines the dimensions of the terminal
 type Size struct {
 	Name   string
@@ -61,12 +133,18 @@ var (
 	Large  = &Size{"large", 120, 38}
 
 	DefaultSize = Small
-	Sizes       = map[string]*Size{
+
+	Sizes = map[string]*Size{
 		Tiny.Name:   Tiny,
 		Small.Name:  Small,
 		Medium.Name: Medium,
 		Large.Name:  Large,
 	}
+
+	// MinSize and MaxSize are the bounds for custom sizes, see ParseSize. Larger terminals would not fit in a chat
+	// message on most platforms anyway, see MaxMessageLength.
+	MinSize = &Size{"min", 20, 5}
+	MaxSize = &Size{"max", 250, 100}
 )
 
 // Max returns the larger size of the two given sizes
@@ -1,15 +1,182 @@
 package config
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
-// ParseSize converts a size string to a Size
+const (
+	scriptDefaultsPrefix    = "# replbot-defaults:"
+	scriptDescriptionPrefix = "# description:"
+	scriptDefaultsMaxLines  = 20 // Only look for the defaults and description lines in the first few lines of the script
+	scriptShebangPrefix     = "#!"
+	scriptShebangMaxLength  = 256
+)
+
+var (
+	imageRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/:@-]*$`)
+	sizeRegex  = regexp.MustCompile(`^(\d{1,4})x(\d{1,4})$`)
+)
+
+// ParseSize converts a size string to a Size. The size is either one of the named sizes (see Sizes), or a custom
+// size of the form <width>x<height>, e.g. 120x40, within the bounds MinSize and MaxSize.
 func ParseSize(size string) (*Size, error) {
-	switch size {
-	case Tiny.Name, Small.Name, Medium.Name, Large.Name:
-		return Sizes[size], nil
-	default:
+	if s, ok := Sizes[size]; ok {
+		return s, nil
+	}
+	matches := sizeRegex.FindStringSubmatch(size)
+	if matches == nil {
 		return nil, errors.New("invalid size")
 	}
+	width, _ := strconv.Atoi(matches[1]) // Cannot fail, see regex
+	height, _ := strconv.Atoi(matches[2])
+	if width < MinSize.Width || width > MaxSize.Width || height < MinSize.Height || height > MaxSize.Height {
+		return nil, fmt.Errorf("size must be between %dx%d and %dx%d", MinSize.Width, MinSize.Height, MaxSize.Width, MaxSize.Height)
+	}
+	return &Size{Name: fmt.Sprintf("%dx%d", width, height), Width: width, Height: height}, nil
+}
+
+// readScriptConfig reads the session defaults from the "# replbot-defaults:" line of the given script, e.g.
+// "# replbot-defaults: mode=thread window=trim size=large auth=only-me color=color image=python:3 prompt=>>>\s category=languages",
+// and the description from the "# description:" line, e.g. "# description: Python 3 REPL with numpy".
+// Invalid values are ignored. Only the first of each line is used.
+func readScriptConfig(name, path string) *ScriptConfig {
+	conf := &ScriptConfig{Name: name, Path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		return conf
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	var defaultsFound bool
+	for i := 0; i < scriptDefaultsMaxLines && scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, scriptDescriptionPrefix) && conf.Description == "" {
+			conf.Description = strings.TrimSpace(strings.TrimPrefix(line, scriptDescriptionPrefix))
+		} else if strings.HasPrefix(line, scriptDefaultsPrefix) && !defaultsFound {
+			defaultsFound = true
+			for _, field := range strings.Fields(strings.TrimPrefix(line, scriptDefaultsPrefix)) {
+				if err := conf.parseDefault(field); err != nil {
+					log.Printf("Warning: ignoring invalid default '%s' in script %s: %s", field, path, err.Error())
+				}
+			}
+		}
+	}
+	return conf
+}
+
+// checkScript checks that the script can be run: It must be an executable file, and if it has a shebang line, the
+// interpreter must exist. Scripts without a shebang line are run by the shell, which does not work for scripts
+// that run in a Docker image, since they are the entrypoint of the container. The interpreter of those scripts
+// is not checked, since it only has to exist in the image.
+func checkScript(conf *ScriptConfig) error {
+	stat, err := os.Stat(conf.Path)
+	if err != nil {
+		return err
+	} else if !stat.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	} else if stat.Mode()&0111 == 0 {
+		return fmt.Errorf("not executable, run 'chmod +x %s'", conf.Path)
+	}
+	interpreter, err := readShebang(conf.Path)
+	if err != nil {
+		return err
+	} else if interpreter == "" && conf.Image != "" {
+		return fmt.Errorf("shebang line (e.g. #!/bin/sh) missing, it is required to run the script in image %s", conf.Image)
+	} else if interpreter == "" || conf.Image != "" {
+		return nil
+	}
+	if stat, err := os.Stat(interpreter); err != nil || !stat.Mode().IsRegular() || stat.Mode()&0111 == 0 {
+		return fmt.Errorf("interpreter %s in shebang line is not an executable file", interpreter)
+	}
+	return nil
+}
+
+// readShebang returns the interpreter in the shebang line of the script, or an empty string if the script does not
+// have a shebang line. Arguments of the interpreter (e.g. "-e" in "#!/bin/bash -e") are ignored.
+func readShebang(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(io.LimitReader(file, scriptShebangMaxLength)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	} else if !strings.HasPrefix(line, scriptShebangPrefix) {
+		return "", nil
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, scriptShebangPrefix))
+	if len(fields) == 0 {
+		return "", errors.New("shebang line is empty")
+	}
+	return fields[0], nil
+}
+
+func (c *ScriptConfig) parseDefault(field string) error {
+	kv := strings.SplitN(field, "=", 2)
+	if len(kv) != 2 {
+		return errors.New("expected key=value")
+	}
+	key, value := kv[0], kv[1]
+	switch key {
+	case "mode":
+		if value != string(Channel) && value != string(Thread) && value != string(Split) {
+			return errors.New("invalid control mode")
+		}
+		c.ControlMode = ControlMode(value)
+	case "window":
+		if value != string(Full) && value != string(Trim) {
+			return errors.New("invalid window mode")
+		}
+		c.WindowMode = WindowMode(value)
+	case "color":
+		if value != string(Color) && value != string(NoColor) {
+			return errors.New("invalid color mode")
+		}
+		c.ColorMode = ColorMode(value)
+	case "auth":
+		if value != string(OnlyMe) && value != string(Everyone) {
+			return errors.New("invalid auth mode")
+		}
+		c.AuthMode = AuthMode(value)
+	case "size":
+		size, err := ParseSize(value)
+		if err != nil {
+			return err
+		}
+		c.Size = size
+	case "image":
+		if !imageRegex.MatchString(value) {
+			return errors.New("invalid image name")
+		}
+		c.Image = value
+	case "prompt":
+		prompt, err := regexp.Compile("^(?:" + value + ")")
+		if err != nil {
+			return err
+		}
+		c.Prompt = prompt
+	case "ready":
+		ready, err := regexp.Compile("(?m)" + value) // ^ and $ match at line boundaries
+		if err != nil {
+			return err
+		}
+		c.Ready = ready
+	case "category":
+		if value == "" {
+			return errors.New("empty category")
+		}
+		c.Category = value
+	default:
+		return errors.New("unknown key")
+	}
+	return nil
 }
@@ -2,6 +2,8 @@ package config
 
 import (
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -19,3 +21,65 @@ func TestConvertSize(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, nothing)
 }
+
+func TestReadScriptConfig(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "python")
+	contents := "#!/bin/sh\n# replbot-defaults: size=large image=python:3-alpine mode=invalid\nexec python3\n"
+	if err := os.WriteFile(script, []byte(contents), 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := readScriptConfig("python", script)
+	assert.Equal(t, "python", conf.Name)
+	assert.Equal(t, Large, conf.Size)
+	assert.Equal(t, "python:3-alpine", conf.Image)
+	assert.Empty(t, conf.ControlMode)
+}
+
+func TestReadScriptConfigPrompt(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "python")
+	contents := "#!/bin/sh\n# replbot-defaults: prompt=>>>\\s|\\.\\.\\.\\s\nexec python3\n"
+	if err := os.WriteFile(script, []byte(contents), 0700); err != nil {
+		t.Fatal(err)
+	}
+	prompt := readScriptConfig("python", script).Prompt
+	assert.NotNil(t, prompt)
+	assert.True(t, prompt.MatchString(">>> print(1)"))
+	assert.True(t, prompt.MatchString("... "))
+	assert.False(t, prompt.MatchString("print(1) >>> 2"))
+
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n# replbot-defaults: prompt=(unclosed\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, readScriptConfig("python", script).Prompt)
+}
+
+func TestReadScriptConfigDescription(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "python")
+	contents := "#!/bin/sh\n# replbot-defaults: size=large\n# description:  Python 3 REPL with numpy \n# description: ignored\nexec python3\n"
+	if err := os.WriteFile(script, []byte(contents), 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := readScriptConfig("python", script)
+	assert.Equal(t, "Python 3 REPL with numpy", conf.Description)
+	assert.Equal(t, Large, conf.Size)
+}
+
+func TestReadScriptConfigInvalidImage(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "evil")
+	contents := "#!/bin/sh\n# replbot-defaults: image=--privileged\n"
+	if err := os.WriteFile(script, []byte(contents), 0700); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, readScriptConfig("evil", script).Image)
+}
+
+func TestParseCustomSize(t *testing.T) {
+	size, err := ParseSize("100x30")
+	assert.Nil(t, err)
+	assert.Equal(t, &Size{Name: "100x30", Width: 100, Height: 30}, size)
+
+	for _, invalid := range []string{"huge", "100", "100x", "x30", "10000x40", "19x30", "100x101", "-1x30", "100X30"} {
+		_, err = ParseSize(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
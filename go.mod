@@ -7,9 +7,12 @@ require (
 	github.com/bwmarrin/discordgo v0.23.3-0.20210811014036-f7454d039f3a
 	github.com/cpuguy83/go-md2man/v2 v2.0.1 // indirect
 	github.com/gliderlabs/ssh v0.3.3
+	github.com/gorilla/websocket v1.4.2
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/slack-go/slack v0.9.4
 	github.com/stretchr/testify v1.2.2
+	github.com/tidwall/gjson v1.9.1
+	github.com/tidwall/sjson v1.2.2
 	github.com/urfave/cli/v2 v2.3.0
 	golang.org/x/crypto v0.0.0-20210812204632-0ba0e8f03122
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
@@ -20,13 +23,10 @@ require (
 require (
 	github.com/anmitsu/go-shlex v0.0.0-20200514113438-38f4b401e2be // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/gorilla/websocket v1.4.2 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
-	github.com/tidwall/gjson v1.9.1 // indirect
 	github.com/tidwall/match v1.0.3 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
-	github.com/tidwall/sjson v1.2.2 // indirect
 )
 
 replace github.com/bwmarrin/discordgo => github.com/binwiederhier/discordgo v0.23.3-0.20210824013058-32da67e86a5d
@@ -4,6 +4,8 @@ id replbot >/dev/null 2>&1 || useradd --system --create-home --home-dir /var/lib
 if getent group docker >/dev/null; then
   usermod -a -G docker replbot
 fi
+mkdir -p /var/cache/replbot
+chown replbot.replbot /var/cache/replbot
 systemctl daemon-reload
 if systemctl is-active -q replbot; then
   systemctl restart replbot
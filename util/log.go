@@ -0,0 +1,148 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFields are structured fields attached to a log line, e.g. the session ID, platform, user or event type.
+// Empty fields are omitted.
+type LogFields map[string]string
+
+var (
+	logJSON    bool
+	logOutput  io.Writer = os.Stderr
+	logCapture io.Writer // copy of all log output, see CaptureLogs
+	logMu      sync.Mutex
+)
+
+// EnableJSONLogs switches all log output to JSON, one object per line. Lines logged via Log include their
+// fields; lines logged directly via the log package are wrapped, so that the output stays parsable.
+func EnableJSONLogs(w io.Writer) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logJSON = true
+	logOutput = w
+	log.SetFlags(0)
+	log.SetOutput(&jsonLogWriter{})
+}
+
+// CaptureLogs copies all log output to w (if not nil), in addition to the regular output, e.g. to a LogBuffer.
+// Only one writer can capture the logs at a time; passing nil stops capturing.
+func CaptureLogs(w io.Writer) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logCapture = w
+	if logJSON {
+		return // Captured in writeJSONLog
+	} else if w != nil {
+		log.SetOutput(io.MultiWriter(logOutput, w))
+	} else {
+		log.SetOutput(logOutput)
+	}
+}
+
+// Log writes a log line with the given fields. In text mode (the default), the "session" field is used as
+// a "[session]" prefix and all other fields are dropped; in JSON mode, all fields are included.
+func Log(fields LogFields, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	logMu.Lock()
+	jsonEnabled := logJSON
+	logMu.Unlock()
+	if jsonEnabled {
+		writeJSONLog(fields, message)
+	} else if fields["session"] != "" {
+		log.Printf("[%s] %s", fields["session"], message)
+	} else {
+		log.Print(message)
+	}
+}
+
+func writeJSONLog(fields LogFields, message string) {
+	entry := map[string]string{
+		"time":    time.Now().UTC().Format(time.RFC3339Nano),
+		"message": message,
+	}
+	for key, value := range fields {
+		if value != "" {
+			entry[key] = value
+		}
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	_, _ = logOutput.Write(append(b, '\n'))
+	if logCapture != nil {
+		_, _ = logCapture.Write(append(b, '\n'))
+	}
+}
+
+// jsonLogWriter is used as the output of the log package in JSON mode, see EnableJSONLogs
+type jsonLogWriter struct{}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	writeJSONLog(nil, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// LogBuffer is an io.Writer that keeps the most recent log lines in memory, so that they can be shown without
+// access to the host, see CaptureLogs. Once it is full, the oldest lines are dropped.
+type LogBuffer struct {
+	lines   []string
+	next    int    // index of the next line in lines
+	count   int    // number of lines in use, at most len(lines)
+	partial []byte // incomplete last line, completed by the next Write
+	mu      sync.Mutex
+}
+
+// NewLogBuffer creates a new LogBuffer that holds up to size lines
+func NewLogBuffer(size int) *LogBuffer {
+	return &LogBuffer{
+		lines: make([]string, size),
+	}
+}
+
+// Write adds all complete lines in p to the buffer
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data := append(b.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			break
+		}
+		b.lines[b.next] = string(data[:i])
+		b.next = (b.next + 1) % len(b.lines)
+		if b.count < len(b.lines) {
+			b.count++
+		}
+		data = data[i+1:]
+	}
+	b.partial = append([]byte{}, data...)
+	return len(p), nil
+}
+
+// Last returns up to n of the most recent lines, oldest first
+func (b *LogBuffer) Last(n int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.count {
+		n = b.count
+	}
+	lines := make([]string, 0, n)
+	for i := n; i > 0; i-- {
+		lines = append(lines, b.lines[(b.next-i+len(b.lines))%len(b.lines)])
+	}
+	return lines
+}
@@ -0,0 +1,288 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	screenHistoryLimit = 50000
+	screenCaptureWait  = 2 * time.Second
+)
+
+// screenKeys translates tmux(1) key names (see Terminal.SendKeys) to the escape sequences of an xterm
+var screenKeys = map[string]string{
+	"escape": "\x1b",
+	"space":  " ",
+	"up":     "\x1b[A",
+	"down":   "\x1b[B",
+	"right":  "\x1b[C",
+	"left":   "\x1b[D",
+	"ppage":  "\x1b[5~",
+	"npage":  "\x1b[6~",
+	"home":   "\x1b[H",
+	"end":    "\x1b[F",
+	"ic":     "\x1b[2~",
+	"dc":     "\x1b[3~",
+	"bspace": "\x7f",
+	"f1":     "\x1bOP",
+	"f2":     "\x1bOQ",
+	"f3":     "\x1bOR",
+	"f4":     "\x1bOS",
+	"f5":     "\x1b[15~",
+	"f6":     "\x1b[17~",
+	"f7":     "\x1b[18~",
+	"f8":     "\x1b[19~",
+	"f9":     "\x1b[20~",
+	"f10":    "\x1b[21~",
+	"f11":    "\x1b[23~",
+	"f12":    "\x1b[24~",
+}
+
+// Screen is a Terminal backed by GNU screen(1). Compared to Tmux, it has a few limitations: screen cannot
+// capture colors or the cursor position, does not know if an application requested bracketed paste mode,
+// and does not support read-only attaching.
+type Screen struct {
+	id            string
+	width, height int
+	tempDir       string
+	shmDir        string
+}
+
+// NewScreen creates a new Screen instance, but does not start the screen. Temporary files are stored in tempDir,
+// except for the paste buffer and the hardcopy files, which are stored in shmDir.
+func NewScreen(id string, width, height int, tempDir, shmDir string) *Screen {
+	return &Screen{
+		id:      fmt.Sprintf("replbot_%s", id),
+		width:   width,
+		height:  height,
+		tempDir: tempDir,
+		shmDir:  shmDir,
+	}
+}
+
+// Start starts the screen using the given command and arguments. If dir is not empty, the command
+// is run in that working directory. When the command exits, the terminal and its history are saved
+// to the capture file, see Exited and RecordingFile.
+func (s *Screen) Start(env map[string]string, dir string, command ...string) error {
+	_ = os.Remove(s.captureFile()) // Left over if the terminal is restarted, see Exited
+	config := fmt.Sprintf("term xterm-256color\ndefscrollback %d\nstartup_message off\naltscreen on\n", screenHistoryLimit)
+	if err := os.WriteFile(s.configFile(), []byte(config), 0600); err != nil {
+		return err
+	}
+	var script strings.Builder
+	script.WriteString("#!/bin/sh\n")
+	script.WriteString(fmt.Sprintf("echo $$ > %s\n", Quote(s.pidFile()))) // See Signal
+	for key, value := range env {
+		script.WriteString(fmt.Sprintf("export %s=%s\n", key, Quote(value)))
+	}
+	if dir != "" {
+		script.WriteString(fmt.Sprintf("cd %s || exit 1\n", Quote(dir)))
+	}
+	script.WriteString(QuoteCommand(command) + "\n")
+	script.WriteString(QuoteCommand([]string{"screen", "-S", s.id, "-p", "0", "-X", "hardcopy", "-h", s.captureFile()}) + "\n")
+	if err := os.WriteFile(s.launchScriptFile(), []byte(script.String()), 0700); err != nil {
+		return err
+	}
+	if err := Run("screen", "-c", s.configFile(), "-dmS", s.id, s.launchScriptFile()); err != nil {
+		return err
+	}
+	return s.Resize(s.width, s.height)
+}
+
+// Active checks if the screen is still active
+func (s *Screen) Active() bool {
+	return Run("screen", "-S", s.id, "-X", "select", ".") == nil
+}
+
+// Exited returns true if the command exited on its own, i.e. if the launch script wrote the capture file
+func (s *Screen) Exited() bool {
+	return FileExists(s.captureFile())
+}
+
+// Paste pastes the input into the screen, as if the user entered it
+func (s *Screen) Paste(input string) error {
+	defer os.Remove(s.bufferFile())
+	if err := os.WriteFile(s.bufferFile(), []byte(input), 0600); err != nil {
+		return err
+	}
+	return RunAll(
+		[]string{"screen", "-S", s.id, "-p", "0", "-X", "readbuf", s.bufferFile()},
+		[]string{"screen", "-S", s.id, "-p", "0", "-X", "paste", "."},
+	)
+}
+
+// PasteBracketed is the same as Paste, since screen does not know whether the application requested
+// bracketed paste mode
+func (s *Screen) PasteBracketed(input string) error {
+	return s.Paste(input)
+}
+
+// SendKeys translates the given tmux(1) key names to escape sequences, and pastes them into the screen
+func (s *Screen) SendKeys(keys ...string) error {
+	return s.Paste(screenKeySequence(keys))
+}
+
+// screenKeySequence translates tmux(1) key names (e.g. "^C", "F1" or "up") to the bytes a terminal would send.
+// Unknown keys are sent as they are.
+func screenKeySequence(keys []string) string {
+	var input strings.Builder
+	for _, key := range keys {
+		if sequence, ok := screenKeys[strings.ToLower(key)]; ok {
+			input.WriteString(sequence)
+		} else if len(key) == 2 && key[0] == '^' && key[1] >= '@' && key[1] <= '_' {
+			input.WriteByte(key[1] - '@') // Ctrl-..
+		} else if len(key) == 3 && strings.HasPrefix(key, "C-") {
+			input.WriteByte(strings.ToUpper(key)[2] - '@') // Ctrl-.., tmux style
+		} else {
+			input.WriteString(key)
+		}
+	}
+	return input.String()
+}
+
+// Resize resizes the screen window to the given size
+func (s *Screen) Resize(width, height int) error {
+	return RunAll(
+		[]string{"screen", "-S", s.id, "-p", "0", "-X", "width", "-w", fmt.Sprint(width)},
+		[]string{"screen", "-S", s.id, "-p", "0", "-X", "height", "-w", fmt.Sprint(height)},
+	)
+}
+
+// Clear clears the screen window and the scrollback history, and asks the application to redraw itself (Ctrl-L)
+func (s *Screen) Clear() error {
+	if err := RunAll(
+		[]string{"screen", "-S", s.id, "-p", "0", "-X", "clear"},
+		[]string{"screen", "-S", s.id, "-p", "0", "-X", "scrollback", "0"},
+		[]string{"screen", "-S", s.id, "-p", "0", "-X", "scrollback", fmt.Sprint(screenHistoryLimit)},
+	); err != nil {
+		return err
+	}
+	return s.SendKeys("^L")
+}
+
+// Capture returns a string representation of the current terminal, using screen's hardcopy command
+func (s *Screen) Capture() (string, error) {
+	return s.hardcopy()
+}
+
+// CaptureWithEscapes returns the same as Capture, since screen cannot capture text attributes and colors
+func (s *Screen) CaptureWithEscapes() (string, error) {
+	return s.hardcopy()
+}
+
+// CaptureHistory returns a string representation of the entire scrollback history, including the
+// current terminal
+func (s *Screen) CaptureHistory() (string, error) {
+	return s.hardcopy("-h")
+}
+
+func (s *Screen) hardcopy(args ...string) (string, error) {
+	defer os.Remove(s.hardcopyFile())
+	_ = os.Remove(s.hardcopyFile())
+	command := append([]string{"screen", "-S", s.id, "-p", "0", "-X", "hardcopy"}, args...)
+	if err := Run(append(command, s.hardcopyFile())...); err != nil {
+		return "", err
+	}
+	if !WaitUntil(func() bool { return FileExists(s.hardcopyFile()) }, screenCaptureWait) {
+		return "", errors.New("screen did not write hardcopy file")
+	}
+	b, err := os.ReadFile(s.hardcopyFile())
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Cursor always returns a hidden cursor, since screen cannot report the cursor position
+func (s *Screen) Cursor() (show bool, x int, y int, err error) {
+	return false, 0, 0, nil
+}
+
+// AttachCommand returns the command to attach to the screen, or nil if readOnly is requested
+func (s *Screen) AttachCommand(readOnly bool) []string {
+	if readOnly {
+		return nil
+	}
+	return []string{"screen", "-x", s.id}
+}
+
+// SetTitle sets the title of the screen window, as shown in the window list when attached
+func (s *Screen) SetTitle(title string) error {
+	return Run("screen", "-S", s.id, "-p", "0", "-X", "title", title)
+}
+
+// SetStatus shows the status in the hardstatus line at the bottom of attached displays. Percent signs are
+// escaped, since screen would interpret them as string escapes.
+func (s *Screen) SetStatus(status string) error {
+	return Run("screen", "-S", s.id, "-X", "hardstatus", "alwayslastline", strings.ReplaceAll(status, "%", "%%"))
+}
+
+// RecordingFile returns the file name of the recording file. This method can only be called
+// after the session has exited. Before that, the file will not exist.
+func (s *Screen) RecordingFile() string {
+	return s.captureFile()
+}
+
+// Signal sends the signal to the foreground process group of the screen window, see Terminal.Signal. The PID of
+// the launch script is written to the PID file when the window is started, see Start.
+func (s *Screen) Signal(sig syscall.Signal) error {
+	pid, err := s.PID()
+	if err != nil {
+		return err
+	}
+	return signalForeground(pid, sig)
+}
+
+// PID returns the process ID of the launch script, which the launch script writes to the PID file, see Start
+func (s *Screen) PID() (int, error) {
+	b, err := os.ReadFile(s.pidFile())
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// Stop kills the screen and its command using the 'quit' command
+func (s *Screen) Stop() error {
+	if s.Active() {
+		if !FileExists(s.captureFile()) {
+			_ = Run("screen", "-S", s.id, "-p", "0", "-X", "hardcopy", "-h", s.captureFile())
+		}
+		_ = Run("screen", "-S", s.id, "-X", "quit")
+	}
+	_ = os.Remove(s.configFile())
+	_ = os.Remove(s.launchScriptFile())
+	_ = os.Remove(s.pidFile())
+	return nil
+}
+
+func (s *Screen) bufferFile() string {
+	return filepath.Join(s.shmDir, s.id+".screen.buffer")
+}
+
+func (s *Screen) hardcopyFile() string {
+	return filepath.Join(s.shmDir, s.id+".screen.hardcopy")
+}
+
+func (s *Screen) launchScriptFile() string {
+	return filepath.Join(s.tempDir, s.id+".screen.launch-script")
+}
+
+func (s *Screen) configFile() string {
+	return filepath.Join(s.tempDir, s.id+".screen.conf")
+}
+
+func (s *Screen) pidFile() string {
+	return filepath.Join(s.tempDir, s.id+".screen.pid")
+}
+
+func (s *Screen) captureFile() string {
+	return filepath.Join(s.tempDir, s.id+".screen.capture")
+}
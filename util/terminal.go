@@ -0,0 +1,152 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrNoForegroundProcess is returned by Terminal.Signal if no command is running in the foreground of the REPL
+var ErrNoForegroundProcess = errors.New("no foreground process")
+
+// Terminal is a terminal multiplexer running a REPL, controlled entirely via its command line interface.
+// Implementations are Tmux and Screen.
+type Terminal interface {
+	// Start starts the terminal using the given command and arguments. If dir is not empty, the command
+	// is run in that working directory.
+	Start(env map[string]string, dir string, command ...string) error
+
+	// Active checks if the terminal is still running
+	Active() bool
+
+	// Exited returns true if the command exited on its own. If the terminal is gone but this returns false,
+	// the terminal was killed externally.
+	Exited() bool
+
+	// Paste pastes the input into the terminal, as if the user entered it
+	Paste(input string) error
+
+	// PasteBracketed pastes the input into the terminal as one block, if supported
+	PasteBracketed(input string) error
+
+	// SendKeys sends tmux(1)-style key names (e.g. "^C", "F1", "up") to the terminal
+	SendKeys(keys ...string) error
+
+	// Resize resizes the terminal to the given size
+	Resize(width, height int) error
+
+	// Clear clears the terminal and the scrollback history
+	Clear() error
+
+	// Capture returns a string representation of the current terminal
+	Capture() (string, error)
+
+	// CaptureWithEscapes returns a string representation of the current terminal, including the escape
+	// sequences for text attributes and colors, if supported
+	CaptureWithEscapes() (string, error)
+
+	// CaptureHistory returns a string representation of the entire scrollback history, including the
+	// current terminal
+	CaptureHistory() (string, error)
+
+	// Cursor returns the X and Y position of the cursor
+	Cursor() (show bool, x int, y int, err error)
+
+	// AttachCommand returns the command to attach to the terminal (e.g. for the web terminal), or nil
+	// if attaching in the requested mode is not supported
+	AttachCommand(readOnly bool) []string
+
+	// SetTitle sets the title of the terminal window, as shown to users attached via AttachCommand
+	SetTitle(title string) error
+
+	// SetStatus sets the status line shown to users attached via AttachCommand, if supported
+	SetStatus(status string) error
+
+	// Signal sends the signal to the foreground process group of the terminal, i.e. the command that is currently
+	// running in the REPL. If the REPL itself is in the foreground, ErrNoForegroundProcess is returned.
+	Signal(sig syscall.Signal) error
+
+	// PID returns the process ID of the command started by the terminal, e.g. to find its process session
+	PID() (int, error)
+
+	// RecordingFile returns the file name of the recording file, see Tmux.RecordingFile
+	RecordingFile() string
+
+	// Stop kills the terminal and its command
+	Stop() error
+}
+
+// signalForeground sends the signal to the foreground process group of the terminal that the process with the
+// given PID (the command started by the terminal) is attached to. If that process's group is in the foreground,
+// ErrNoForegroundProcess is returned, so that the REPL itself is never signaled. Interactive shells like bash put
+// themselves in their own process group, which is fine, since they ignore SIGTERM and SIGINT.
+func signalForeground(pid int, sig syscall.Signal) error {
+	fields, err := processStat(pid)
+	if err != nil {
+		return err
+	}
+	pgrp, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return err
+	}
+	tpgid, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return err
+	} else if tpgid <= 0 || tpgid == pgrp {
+		return ErrNoForegroundProcess
+	}
+	return syscall.Kill(-tpgid, sig)
+}
+
+// ProcessSession returns the ID of the process session of the process with the given PID. Terminals start their
+// command in a new session, so all processes started by the command share it, even if they left its process group.
+func ProcessSession(pid int) (int, error) {
+	fields, err := processStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(fields[3])
+}
+
+// SessionProcesses returns the PIDs of all running processes in the process session with the given ID.
+// Zombie processes are ignored, since they have already exited.
+func SessionProcesses(sid int) []int {
+	pids := make([]int, 0)
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return pids
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		fields, err := processStat(pid)
+		if err != nil || fields[0] == "Z" || fields[3] != strconv.Itoa(sid) {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+// processStat returns the fields of /proc/<pid>/stat after the command name (which may contain spaces),
+// i.e. state ppid pgrp session tty_nr tpgid ...
+func processStat(pid int) ([]string, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	end := strings.LastIndex(string(stat), ")")
+	if end == -1 {
+		return nil, errors.New("unexpected stat format")
+	}
+	fields := strings.Fields(string(stat)[end+1:])
+	if len(fields) < 6 {
+		return nil, errors.New("unexpected stat format")
+	}
+	return fields, nil
+}
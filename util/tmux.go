@@ -7,9 +7,11 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/template"
 )
 
@@ -55,31 +57,39 @@ func CheckTmuxVersion() error {
 type Tmux struct {
 	id            string
 	width, height int
+	tempDir       string
+	shmDir        string
 }
 
 type tmuxScriptParams struct {
 	MainID, FrameID  string
 	Width, Height    int
 	Env              map[string]string
+	Dir              string
 	Command          string
 	ConfigFile       string
 	CaptureFile      string
 	LaunchScriptFile string
 }
 
-// NewTmux creates a new Tmux instance, but does not start the tmux
-func NewTmux(id string, width, height int) *Tmux {
+// NewTmux creates a new Tmux instance, but does not start the tmux. Temporary files are stored in tempDir,
+// except for the paste buffer, which is stored in shmDir.
+func NewTmux(id string, width, height int, tempDir, shmDir string) *Tmux {
 	return &Tmux{
-		id:     fmt.Sprintf("replbot_%s", id),
-		width:  width,
-		height: height,
+		id:      fmt.Sprintf("replbot_%s", id),
+		width:   width,
+		height:  height,
+		tempDir: tempDir,
+		shmDir:  shmDir,
 	}
 }
 
-// Start starts the tmux using the given command and arguments
-func (s *Tmux) Start(env map[string]string, command ...string) error {
+// Start starts the tmux using the given command and arguments. If dir is not empty, the command
+// is run in that working directory.
+func (s *Tmux) Start(env map[string]string, dir string, command ...string) error {
 	defer os.Remove(s.scriptFile())
 	defer os.Remove(s.launchScriptFile())
+	_ = os.Remove(s.captureFile()) // Left over if the terminal is restarted, see Exited
 	script, err := os.OpenFile(s.scriptFile(), os.O_CREATE|os.O_WRONLY, 0700)
 	if err != nil {
 		return err
@@ -91,11 +101,15 @@ func (s *Tmux) Start(env map[string]string, command ...string) error {
 		Width:            s.width,
 		Height:           s.height,
 		Env:              env,
+		Dir:              dir,
 		Command:          QuoteCommand(command),
 		ConfigFile:       s.configFile(),
 		CaptureFile:      s.captureFile(),
 		LaunchScriptFile: s.launchScriptFile(),
 	}
+	if dir != "" {
+		params.Dir = Quote(dir)
+	}
 	if err := scriptTemplate.Execute(script, params); err != nil {
 		return err
 	}
@@ -110,15 +124,31 @@ func (s *Tmux) Active() bool {
 	return Run("tmux", "has-session", "-t", s.mainID()) == nil
 }
 
+// Exited returns true if the main command exited on its own, i.e. the pane-died hook ran and saved the
+// capture file. If tmux is gone but this returns false, the tmux session was killed externally.
+func (s *Tmux) Exited() bool {
+	return FileExists(s.captureFile())
+}
+
 // Paste pastes the input into the tmux, as if the user entered it
 func (s *Tmux) Paste(input string) error {
+	return s.paste(input)
+}
+
+// PasteBracketed pastes the input into the tmux, surrounded by bracketed paste control codes if the
+// application has requested bracketed paste mode. This lets REPLs treat the input as one block.
+func (s *Tmux) PasteBracketed(input string) error {
+	return s.paste(input, "-p")
+}
+
+func (s *Tmux) paste(input string, args ...string) error {
 	defer os.Remove(s.bufferFile())
 	if err := os.WriteFile(s.bufferFile(), []byte(input), 0600); err != nil {
 		return err
 	}
 	return RunAll(
 		[]string{"tmux", "load-buffer", "-b", s.id, s.bufferFile()},
-		[]string{"tmux", "paste-buffer", "-b", s.id, "-t", s.mainID(), "-d"},
+		append([]string{"tmux", "paste-buffer", "-b", s.id, "-t", s.mainID(), "-d"}, args...),
 	)
 }
 
@@ -127,6 +157,14 @@ func (s *Tmux) SendKeys(keys ...string) error {
 	return Run(append([]string{"tmux", "send-keys", "-t", s.mainID()}, keys...)...)
 }
 
+// Clear resets the terminal, asks the application to redraw itself (Ctrl-L), and clears the scrollback history
+func (s *Tmux) Clear() error {
+	return RunAll(
+		[]string{"tmux", "send-keys", "-R", "-t", s.mainID(), "C-l"},
+		[]string{"tmux", "clear-history", "-t", s.mainID()},
+	)
+}
+
 // Resize resizes the active pane (.2) to the given size up to the max size
 func (s *Tmux) Resize(width, height int) error {
 	return Run("tmux", "resize-pane", "-t", s.frameMainPaneID(), "-x", strconv.Itoa(width), "-y", strconv.Itoa(height))
@@ -134,8 +172,24 @@ func (s *Tmux) Resize(width, height int) error {
 
 // Capture returns a string representation of the current terminal
 func (s *Tmux) Capture() (string, error) {
+	return s.capture("-p")
+}
+
+// CaptureWithEscapes returns a string representation of the current terminal, including the
+// escape sequences for text attributes and colors
+func (s *Tmux) CaptureWithEscapes() (string, error) {
+	return s.capture("-p", "-e")
+}
+
+// CaptureHistory returns a string representation of the entire scrollback history, including the
+// current terminal
+func (s *Tmux) CaptureHistory() (string, error) {
+	return s.capture("-p", "-S", "-")
+}
+
+func (s *Tmux) capture(args ...string) (string, error) {
 	var buf bytes.Buffer
-	cmd := exec.Command("tmux", "capture-pane", "-t", s.mainID(), "-p")
+	cmd := exec.Command("tmux", append([]string{"capture-pane", "-t", s.mainID()}, args...)...)
 	cmd.Stdout = &buf
 	if err := cmd.Run(); err != nil {
 		return "", err
@@ -171,6 +225,26 @@ func (s *Tmux) Cursor() (show bool, x int, y int, err error) {
 	return
 }
 
+// Signal sends the signal to the foreground process group of the main pane, see Terminal.Signal
+func (s *Tmux) Signal(sig syscall.Signal) error {
+	pid, err := s.PID()
+	if err != nil {
+		return err
+	}
+	return signalForeground(pid, sig)
+}
+
+// PID returns the process ID of the command running in the main pane
+func (s *Tmux) PID() (int, error) {
+	var buf bytes.Buffer
+	cmd := exec.Command("tmux", "display-message", "-t", s.mainID(), "-p", "-F", "#{pane_pid}")
+	cmd.Stdout = &buf
+	if err := cmd.Run(); err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(buf.String()))
+}
+
 // Stop kills the tmux and its command using the 'quit' command
 func (s *Tmux) Stop() error {
 	if s.Active() {
@@ -178,34 +252,60 @@ func (s *Tmux) Stop() error {
 			_ = Run("tmux", "capture-pane", "-t", s.mainID(), "-S-", "-E-", ";", "save-buffer", s.captureFile())
 		}
 		_ = Run("tmux", "kill-session", "-t", s.mainID())
-		_ = Run("tmux", "kill-session", "-t", s.frameID())
 	}
+	_ = Run("tmux", "kill-session", "-t", s.frameID()) // Always kill frame; it may outlive an externally killed main session
 	return nil
 }
 
+// AttachCommand returns the command to attach to the main tmux session
+func (s *Tmux) AttachCommand(readOnly bool) []string {
+	if readOnly {
+		return []string{"tmux", "attach", "-r", "-t", s.mainID()}
+	}
+	return []string{"tmux", "attach", "-t", s.mainID()}
+}
+
+// SetTitle sets the name of the main window, and stops tmux from renaming it automatically
+func (s *Tmux) SetTitle(title string) error {
+	return RunAll(
+		[]string{"tmux", "set-option", "-w", "-t", s.mainID(), "automatic-rename", "off"},
+		[]string{"tmux", "rename-window", "-t", s.mainID(), title},
+	)
+}
+
+// SetStatus sets the title of the terminals that are attached to the main session. The status line of the main
+// session stays off, since it would take away a line from the window, which would then differ from the captured one.
+// Hash signs are escaped, since tmux would interpret them as formats.
+func (s *Tmux) SetStatus(status string) error {
+	return RunAll(
+		[]string{"tmux", "set-option", "-t", s.mainID(), "set-titles", "on"},
+		[]string{"tmux", "set-option", "-t", s.mainID(), "set-titles-string", strings.ReplaceAll(status, "#", "##")},
+	)
+}
+
 // MainID returns the session identifier for the main tmux session
 func (s *Tmux) MainID() string {
 	return s.mainID()
 }
 
 func (s *Tmux) bufferFile() string {
-	return fmt.Sprintf("/dev/shm/%s.tmux.buffer", s.id)
+	return filepath.Join(s.shmDir, s.id+".tmux.buffer")
 }
 
 func (s *Tmux) scriptFile() string {
-	return fmt.Sprintf("/tmp/%s.tmux.script", s.id)
+	return filepath.Join(s.tempDir, s.id+".tmux.script")
 }
 
 func (s *Tmux) launchScriptFile() string {
-	return fmt.Sprintf("/tmp/%s.tmux.lauch-script", s.id)
+	return filepath.Join(s.tempDir, s.id+".tmux.lauch-script")
 }
 
 func (s *Tmux) configFile() string {
-	return fmt.Sprintf("/tmp/%s.tmux.conf", s.id)
+	return filepath.Join(s.tempDir, s.id+".tmux.conf")
 }
 
 func (s *Tmux) captureFile() string {
-	return fmt.Sprintf("/tmp/%s.tmux.capture", s.id)
+	return filepath.Join(s.tempDir, s.id+".tmux.capture")
 }
 
 func (s *Tmux) frameID() string {
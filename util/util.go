@@ -15,6 +15,10 @@ import (
 	"time"
 )
 
+const (
+	randomPortInRangeAttempts = 100
+)
+
 var (
 	nonAlphanumericCharsRegex = regexp.MustCompile(`[^A-Za-z0-9]`)
 	random                    = rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -32,6 +36,28 @@ func SanitizeNonAlphanumeric(s string) string {
 	return nonAlphanumericCharsRegex.ReplaceAllString(s, "_")
 }
 
+// ResolvePathWithin resolves the given path (following symlinks) to an absolute path, and returns an error
+// if the resolved path is not located within the base directory (or the base directory itself)
+func ResolvePathWithin(base, path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	} else if resolved, err = filepath.Abs(resolved); err != nil {
+		return "", err
+	}
+	base, err = filepath.EvalSymlinks(base)
+	if err != nil {
+		return "", err
+	} else if base, err = filepath.Abs(base); err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(base, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is not within %s", path, base)
+	}
+	return resolved, nil
+}
+
 // FileExists returns true if a file with the given filename exists
 func FileExists(filenames ...string) bool {
 	for _, filename := range filenames {
@@ -80,6 +106,26 @@ func RandomPort() (int, error) {
 	return port, nil
 }
 
+// RandomPortInRange finds a free port between min and max (inclusive). Starting at a random port in the range, up
+// to randomPortInRangeAttempts ports are tried, and an error is returned if none of them is free.
+func RandomPortInRange(min, max int) (int, error) {
+	if min < 1 || max > 65535 || min > max {
+		return 0, fmt.Errorf("invalid port range %d-%d", min, max)
+	}
+	size := max - min + 1
+	start := random.Intn(size)
+	for i := 0; i < size && i < randomPortInRangeAttempts; i++ {
+		port := min + (start+i)%size
+		listener, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
+		if err != nil {
+			continue
+		}
+		listener.Close()
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free port found in range %d-%d", min, max)
+}
+
 // RandomString returns a random alphanumeric string of the given length
 func RandomString(length int) string {
 	b := make([]byte, length)
@@ -89,11 +135,6 @@ func RandomString(length int) string {
 	return string(b)
 }
 
-// FormatMarkdownCode formats the given string as a markdown code block
-func FormatMarkdownCode(s string) string {
-	return fmt.Sprintf("```%s```", strings.ReplaceAll(s, "```", "` ` `")) // Hack ...
-}
-
 // InStringList returns true if needle is contained in the list of strings
 func InStringList(haystack []string, needle string) bool {
 	for _, s := range haystack {
@@ -129,6 +170,16 @@ func WaitUntilNot(fn func() bool, maxWait time.Duration) bool {
 	return WaitUntil(func() bool { return !fn() }, maxWait)
 }
 
+// CheckDirWritable checks if files can be created in the given directory by creating and removing a test file
+func CheckDirWritable(dir string) error {
+	file, err := os.CreateTemp(dir, "replbot_check_")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
 // TempFileName generates a random file name for a file in the temp folder
 func TempFileName() string {
 	return filepath.Join(os.TempDir(), "replbot_"+RandomString(10))
@@ -1,10 +1,19 @@
 package util
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"log"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestSanitizeNonAlphanumeric(t *testing.T) {
@@ -22,9 +31,32 @@ func TestFileExists(t *testing.T) {
 	assert.False(t, FileExists("/tmp/not-a-file"))
 }
 
-func TestFormatMarkdownCode(t *testing.T) {
-	assert.Equal(t, "```this is code```", FormatMarkdownCode("this is code"))
-	assert.Equal(t, "```` ` `this is a hack` ` ````", FormatMarkdownCode("```this is a hack```"))
+func TestCheckDirWritable(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, CheckDirWritable(dir))
+	entries, _ := os.ReadDir(dir)
+	assert.Empty(t, entries)
+	assert.NotNil(t, CheckDirWritable(filepath.Join(dir, "does-not-exist")))
+}
+
+func TestResolvePathWithin(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(file, []byte("hi"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd", filepath.Join(dir, "passwd")); err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := ResolvePathWithin(dir, filepath.Join(dir, "sub", "..", "file.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, file, resolved)
+
+	_, err = ResolvePathWithin(dir, filepath.Join(dir, "..", "..", "etc", "passwd"))
+	assert.NotNil(t, err)
+
+	_, err = ResolvePathWithin(dir, filepath.Join(dir, "passwd"))
+	assert.NotNil(t, err)
 }
 
 func TestRandomPort(t *testing.T) {
@@ -40,3 +72,107 @@ func TestRandomPort(t *testing.T) {
 	assert.True(t, port2 > 0 && port2 < 65000)
 	assert.NotEqual(t, port1, port2)
 }
+
+func TestRandomPortInRange(t *testing.T) {
+	port, err := RandomPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	port1, err := RandomPortInRange(port, port+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, port1 == port || port1 == port+1)
+
+	listener, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, err = RandomPortInRange(port, port)
+	assert.Error(t, err)
+	_, err = RandomPortInRange(port+1, port)
+	assert.Error(t, err)
+}
+
+func TestLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	EnableJSONLogs(&buf)
+	defer func() {
+		logJSON = false
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+	Log(LogFields{"session": "sess_1", "user": "phil", "event": "user_input", "platform": ""}, "User %s> %s", "phil", "ls")
+	log.Printf("plain line")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	var entry map[string]string
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "User phil> ls", entry["message"])
+	assert.Equal(t, "sess_1", entry["session"])
+	assert.Equal(t, "user_input", entry["event"])
+	_, hasPlatform := entry["platform"]
+	assert.False(t, hasPlatform)
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "plain line", entry["message"])
+}
+
+func TestLogBuffer(t *testing.T) {
+	buf := NewLogBuffer(3)
+	assert.Empty(t, buf.Last(10))
+	_, _ = buf.Write([]byte("line 1\nline"))
+	assert.Equal(t, []string{"line 1"}, buf.Last(10))
+	_, _ = buf.Write([]byte(" 2\nline 3\nline 4\n"))
+	assert.Equal(t, []string{"line 2", "line 3", "line 4"}, buf.Last(10))
+	assert.Equal(t, []string{"line 3", "line 4"}, buf.Last(2))
+
+	CaptureLogs(buf)
+	defer CaptureLogs(nil)
+	log.Print("captured")
+	assert.Equal(t, "line 4", buf.Last(2)[0])
+	assert.True(t, strings.HasSuffix(buf.Last(1)[0], "captured"))
+}
+
+func TestScreenKeySequence(t *testing.T) {
+	assert.Equal(t, "\x03", screenKeySequence([]string{"^C"}))
+	assert.Equal(t, "\x0c", screenKeySequence([]string{"C-l"}))
+	assert.Equal(t, "\x1b[A\x1b[B\r", screenKeySequence([]string{"up", "down", "^M"}))
+	assert.Equal(t, "\x1bOP\x1b[24~", screenKeySequence([]string{"F1", "F12"}))
+	assert.Equal(t, "\t\tx", screenKeySequence([]string{"\t\t", "x"}))
+}
+
+func TestSessionProcesses(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 30 & sleep 30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sid, err := ProcessSession(cmd.Process.Pid)
+	assert.Nil(t, err)
+	assert.Equal(t, cmd.Process.Pid, sid)
+	assert.True(t, WaitUntil(func() bool { return len(SessionProcesses(sid)) == 3 }, 5*time.Second))
+
+	for _, pid := range SessionProcesses(sid) {
+		assert.Nil(t, syscall.Kill(pid, syscall.SIGKILL))
+	}
+	_ = cmd.Wait()
+	assert.True(t, WaitUntil(func() bool { return len(SessionProcesses(sid)) == 0 }, 5*time.Second))
+}
+
+func TestTmuxSetTitle(t *testing.T) {
+	term := NewTmux(RandomString(10), 80, 24, t.TempDir(), t.TempDir())
+	if err := term.Start(nil, "", "sh"); err != nil {
+		t.Fatal(err)
+	}
+	defer term.Stop()
+	assert.Nil(t, term.SetTitle("my-session"))
+	assert.Nil(t, term.SetStatus("replbot: my-session | owner: #1"))
+	name, err := exec.Command("tmux", "display-message", "-t", term.MainID(), "-p", "#{window_name}").Output()
+	assert.Nil(t, err)
+	assert.Equal(t, "my-session", strings.TrimSpace(string(name)))
+	titles, err := exec.Command("tmux", "show-options", "-v", "-t", term.MainID(), "set-titles-string").Output()
+	assert.Nil(t, err)
+	assert.Equal(t, "replbot: my-session | owner: ##1", strings.TrimSpace(string(titles)))
+}